@@ -0,0 +1,499 @@
+// Package client provides a client for the vSphere Event Streaming server HTTP
+// API.
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+)
+
+const (
+	apiPath                  = "/api/v1"
+	defaultPageSize          = 50
+	defaultReconnectInterval = time.Second
+	maxReconnectInterval     = 30 * time.Second
+	defaultIdleTimeout       = time.Minute
+	maxErrorBodySize         = 1024
+	contentTypeProblem       = "application/problem+json"
+)
+
+// stable error codes of problem responses, see StatusError
+const (
+	CodeOffsetOutOfRange = "offset_out_of_range"
+	CodeOffsetInFuture   = "offset_in_future"
+	CodeLogNotReady      = "log_not_ready"
+	CodeInvalidParameter = "invalid_parameter"
+	CodeInternalError    = "internal_error"
+)
+
+var (
+	// ErrEmptyLog is returned when the server log does not contain any events
+	ErrEmptyLog = errors.New("empty log")
+	// ErrOutOfRange is returned when the requested offset has been purged
+	ErrOutOfRange = errors.New("offset out of range")
+	// ErrFutureOffset is returned when the requested offset has not been
+	// written yet
+	ErrFutureOffset = errors.New("future offset")
+)
+
+// StatusError is returned when the server responds with an unexpected status
+// code
+type StatusError struct {
+	Code    int
+	Message string
+	// ErrorCode and RequestID are set from problem responses
+	ErrorCode string
+	RequestID string
+}
+
+// OutOfRangeError is returned with ErrOutOfRange when the requested offset has
+// been purged. Clients reload their state, e.g. with List, and resume from
+// Earliest.
+type OutOfRangeError struct {
+	Offset   int64
+	Earliest int64
+}
+
+func (e *OutOfRangeError) Error() string {
+	return fmt.Sprintf("offset %d: %s, earliest available offset is %d", e.Offset, ErrOutOfRange, e.Earliest)
+}
+
+// Unwrap returns ErrOutOfRange
+func (e *OutOfRangeError) Unwrap() error {
+	return ErrOutOfRange
+}
+
+func (e *StatusError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("unexpected status code %d", e.Code)
+	}
+	return fmt.Sprintf("unexpected status code %d: %s", e.Code, e.Message)
+}
+
+// Range is the available offset range of the server log
+type Range struct {
+	Earliest int64 `json:"earliest"`
+	Latest   int64 `json:"latest"`
+}
+
+// Page is a page of events returned by List
+type Page struct {
+	Events []ce.Event
+	// Next is the offset to request the next page from
+	Next int64
+}
+
+// Batch is the result of GetBatch
+type Batch struct {
+	// Events are the events found in requested order
+	Events []ce.Event
+	// Missing maps the requested offsets not in the log to ErrOutOfRange for
+	// purged or ErrFutureOffset for unwritten events
+	Missing map[int64]error
+}
+
+// Client is a client for the vSphere Event Streaming server. Safe for
+// concurrent use.
+type Client struct {
+	base              *url.URL
+	http              *http.Client
+	reconnectInterval time.Duration
+	idleTimeout       time.Duration
+}
+
+// Option configures a client
+type Option func(*Client) error
+
+// WithHTTPClient sets the HTTP client used for requests. The client must not
+// set a timeout as it would terminate watches.
+func WithHTTPClient(c *http.Client) Option {
+	return func(client *Client) error {
+		if c == nil {
+			return errors.New("http client must not be nil")
+		}
+		client.http = c
+		return nil
+	}
+}
+
+// WithReconnectInterval sets the initial interval to wait before reconnecting
+// a watch. The interval is doubled on each failed attempt.
+func WithReconnectInterval(d time.Duration) Option {
+	return func(client *Client) error {
+		if d <= 0 {
+			return errors.New("reconnect interval must be greater than 0")
+		}
+		client.reconnectInterval = d
+		return nil
+	}
+}
+
+// WithIdleTimeout sets the time after which a watch reconnects if nothing has
+// been received, including the bookmarks the server sends on idle watches
+// (default 1m).
+func WithIdleTimeout(d time.Duration) Option {
+	return func(client *Client) error {
+		if d <= 0 {
+			return errors.New("idle timeout must be greater than 0")
+		}
+		client.idleTimeout = d
+		return nil
+	}
+}
+
+// New returns a client for the server at address, e.g. http://localhost:8080
+func New(address string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("parse server address: %w", err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid server address %q", address)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + apiPath
+
+	c := Client{
+		base:              u,
+		http:              &http.Client{},
+		reconnectInterval: defaultReconnectInterval,
+		idleTimeout:       defaultIdleTimeout,
+	}
+
+	for _, opt := range opts {
+		if err = opt(&c); err != nil {
+			return nil, fmt.Errorf("configure client: %w", err)
+		}
+	}
+
+	return &c, nil
+}
+
+// Range returns the available offset range. ErrEmptyLog is returned if the log
+// is empty or not initialized yet.
+func (c *Client) Range(ctx context.Context) (Range, error) {
+	res, err := c.get(ctx, "/range", nil)
+	if err != nil {
+		if notReady(err) {
+			return Range{}, ErrEmptyLog
+		}
+		return Range{}, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNoContent {
+		return Range{}, ErrEmptyLog
+	}
+
+	var r Range
+	if err = json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return Range{}, fmt.Errorf("decode range: %w", err)
+	}
+
+	return r, nil
+}
+
+// Get returns the event at the given offset
+func (c *Client) Get(ctx context.Context, offset int64) (ce.Event, error) {
+	res, err := c.get(ctx, "/events/"+strconv.FormatInt(offset, 10), nil)
+	if err != nil {
+		return ce.Event{}, err
+	}
+	defer res.Body.Close()
+
+	var e ce.Event
+	if err = json.NewDecoder(res.Body).Decode(&e); err != nil {
+		return ce.Event{}, fmt.Errorf("decode event: %w", err)
+	}
+
+	return e, nil
+}
+
+// GetBatch returns the events at the given offsets with a single request. At
+// most 50 offsets are supported by the server.
+func (c *Client) GetBatch(ctx context.Context, offsets ...int64) (*Batch, error) {
+	ids := make([]string, len(offsets))
+	for i, o := range offsets {
+		ids[i] = strconv.FormatInt(o, 10)
+	}
+
+	q := url.Values{}
+	q.Set("ids", strings.Join(ids, ","))
+
+	batch := Batch{Missing: make(map[int64]error)}
+	// empty log or log not initialized yet
+	unwritten := func() (*Batch, error) {
+		for _, o := range offsets {
+			batch.Missing[o] = ErrFutureOffset
+		}
+		return &batch, nil
+	}
+
+	res, err := c.get(ctx, "/events", q)
+	if err != nil {
+		if notReady(err) {
+			return unwritten()
+		}
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNoContent {
+		return unwritten()
+	}
+
+	var body struct {
+		Events  []ce.Event `json:"events"`
+		Missing []struct {
+			ID   int64  `json:"id"`
+			Code string `json:"code"`
+		} `json:"missing"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decode batch: %w", err)
+	}
+
+	batch.Events = body.Events
+	for _, m := range body.Missing {
+		switch m.Code {
+		case CodeOffsetOutOfRange:
+			batch.Missing[m.ID] = ErrOutOfRange
+		default:
+			batch.Missing[m.ID] = ErrFutureOffset
+		}
+	}
+
+	return &batch, nil
+}
+
+// Latest returns the last page of events
+func (c *Client) Latest(ctx context.Context) ([]ce.Event, error) {
+	res, err := c.get(ctx, "/events", nil)
+	if err != nil {
+		if notReady(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+
+	var events []ce.Event
+	if err = json.NewDecoder(res.Body).Decode(&events); err != nil {
+		return nil, fmt.Errorf("decode events: %w", err)
+	}
+
+	return events, nil
+}
+
+// List returns a page of at most limit events starting at offset from. A limit
+// of 0 uses the default page size. An empty page is returned when there are no
+// events at or after from. If from has been purged, the page starts at the
+// earliest event.
+//
+//	for page, err := c.List(ctx, r.Earliest, 0); err == nil && len(page.Events) > 0; page, err = c.List(ctx, page.Next, 0) {
+//		...
+//	}
+func (c *Client) List(ctx context.Context, from int64, limit int) (*Page, error) {
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+
+	q := url.Values{}
+	q.Set("from", strconv.FormatInt(from, 10))
+	q.Set("to", strconv.FormatInt(from+int64(limit)-1, 10))
+	q.Set("format", "ndjson")
+
+	page := Page{Next: from}
+	res, err := c.get(ctx, "/export", q)
+	if err != nil {
+		if errors.Is(err, ErrFutureOffset) || notReady(err) {
+			return &page, nil
+		}
+		if errors.Is(err, ErrOutOfRange) {
+			r, rerr := c.Range(ctx)
+			if rerr != nil {
+				return nil, rerr
+			}
+			// from has been purged
+			if r.Earliest > from {
+				return c.List(ctx, r.Earliest, limit)
+			}
+		}
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNoContent {
+		return &page, nil
+	}
+
+	dec := json.NewDecoder(res.Body)
+	for {
+		var e ce.Event
+		if err = dec.Decode(&e); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("decode event: %w", err)
+		}
+
+		offset, err := eventOffset(e)
+		if err != nil {
+			return nil, err
+		}
+
+		page.Events = append(page.Events, e)
+		page.Next = offset + 1
+	}
+
+	return &page, nil
+}
+
+// ExportOptions selects the events and format of an export
+type ExportOptions struct {
+	// From is the first offset or RFC3339 timestamp (inclusive). Defaults to
+	// the earliest event.
+	From string
+	// To is the last offset or RFC3339 timestamp (inclusive). Defaults to the
+	// latest event.
+	To string
+	// Format is one of "ndjson" (default), "ndjson.gz" or "batch"
+	Format string
+}
+
+// Export returns the exported events as streamed by the server in the requested
+// format. ErrEmptyLog is returned if the log is empty or not initialized yet.
+// The caller must close the returned reader.
+func (c *Client) Export(ctx context.Context, opts ExportOptions) (io.ReadCloser, error) {
+	q := url.Values{}
+	if opts.From != "" {
+		q.Set("from", opts.From)
+	}
+	if opts.To != "" {
+		q.Set("to", opts.To)
+	}
+	if opts.Format != "" {
+		q.Set("format", opts.Format)
+	}
+
+	res, err := c.get(ctx, "/export", q)
+	if err != nil {
+		if notReady(err) {
+			return nil, ErrEmptyLog
+		}
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusNoContent {
+		_ = res.Body.Close()
+		return nil, ErrEmptyLog
+	}
+
+	return res.Body, nil
+}
+
+// get sends a GET request to the API path and returns the response if the
+// status code indicates success. The caller must close the response body.
+func (c *Client) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	u := *c.base
+	u.Path += path
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("send request: %w", err)
+	}
+
+	if res.StatusCode > 299 {
+		defer res.Body.Close()
+		return nil, responseError(res)
+	}
+
+	return res, nil
+}
+
+// problem is an RFC 7807 problem details response of the server
+type problem struct {
+	Status    int    `json:"status"`
+	Detail    string `json:"detail"`
+	Code      string `json:"code"`
+	RequestID string `json:"requestId"`
+	Offset    int64  `json:"offset"`
+	Range     *Range `json:"range"`
+}
+
+// responseError converts an error response into an error
+func responseError(res *http.Response) error {
+	b, _ := io.ReadAll(io.LimitReader(res.Body, maxErrorBodySize))
+	msg := strings.TrimSpace(string(b))
+
+	var p problem
+	if strings.HasPrefix(res.Header.Get("Content-Type"), contentTypeProblem) && json.Unmarshal(b, &p) == nil {
+		switch p.Code {
+		case CodeOffsetOutOfRange:
+			oerr := OutOfRangeError{Offset: p.Offset}
+			if p.Range != nil {
+				oerr.Earliest = p.Range.Earliest
+			}
+			return &oerr
+		case CodeOffsetInFuture:
+			return fmt.Errorf("%s: %w", p.Detail, ErrFutureOffset)
+		}
+		return &StatusError{Code: res.StatusCode, Message: p.Detail, ErrorCode: p.Code, RequestID: p.RequestID}
+	}
+
+	// servers without problem responses
+	if res.StatusCode == http.StatusBadRequest {
+		switch {
+		case strings.Contains(msg, ErrOutOfRange.Error()):
+			return fmt.Errorf("%s: %w", msg, ErrOutOfRange)
+		case strings.Contains(msg, ErrFutureOffset.Error()):
+			return fmt.Errorf("%s: %w", msg, ErrFutureOffset)
+		}
+	}
+
+	return &StatusError{Code: res.StatusCode, Message: msg}
+}
+
+// notReady returns whether the error is a log_not_ready problem response, i.e.
+// the server log is not initialized yet
+func notReady(err error) bool {
+	var serr *StatusError
+	return errors.As(err, &serr) && serr.ErrorCode == CodeLogNotReady
+}
+
+// eventOffset returns the log offset of the event
+func eventOffset(e ce.Event) (int64, error) {
+	offset, err := strconv.ParseInt(e.ID(), 10, 64)
+	if err != nil {
+		return -1, fmt.Errorf("event id %q is not an offset", e.ID())
+	}
+	return offset, nil
+}
+
+// scanLines returns a scanner for newline-delimited records of up to maxSize
+// bytes
+func scanLines(r io.Reader, maxSize int) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxSize)
+	return scanner
+}
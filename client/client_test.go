@@ -0,0 +1,474 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"gotest.tools/v3/assert"
+)
+
+// fakeServer emulates the stream server API for a contiguous range of events
+type fakeServer struct {
+	mu       sync.Mutex
+	earliest int64
+	latest   int64 // -1 for empty log
+
+	// watch connections are closed after this many events (0 keeps open until
+	// the request context is done)
+	streamLimit int
+	watches     []string // watch request queries
+
+	// bookmarks are sent on idle watches at this interval (0 disables)
+	bookmarkInterval time.Duration
+}
+
+func (f *fakeServer) add(count int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.latest += int64(count)
+}
+
+func (f *fakeServer) offsets() (int64, int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.earliest, f.latest
+}
+
+func (f *fakeServer) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/api/v1/range", func(w http.ResponseWriter, r *http.Request) {
+		earliest, latest := f.offsets()
+		if latest == -1 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		_, _ = fmt.Fprintf(w, `{"earliest":%d,"latest":%d}`, earliest, latest)
+	})
+
+	mux.HandleFunc("/api/v1/events/", func(w http.ResponseWriter, r *http.Request) {
+		offset, err := strconv.ParseInt(r.URL.Path[len("/api/v1/events/"):], 10, 64)
+		if err != nil {
+			http.Error(w, "invalid offset", http.StatusBadRequest)
+			return
+		}
+		if status, msg := f.check(offset); status != 0 {
+			http.Error(w, msg, status)
+			return
+		}
+		_, _ = w.Write(testEvent(offset))
+	})
+
+	mux.HandleFunc("/api/v1/export", func(w http.ResponseWriter, r *http.Request) {
+		earliest, latest := f.offsets()
+		if latest == -1 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		from, to := earliest, latest
+		if v := r.FormValue("from"); v != "" {
+			from, _ = strconv.ParseInt(v, 10, 64)
+		}
+		if v := r.FormValue("to"); v != "" {
+			to, _ = strconv.ParseInt(v, 10, 64)
+		}
+		if status, msg := f.check(from); status != 0 {
+			http.Error(w, msg, status)
+			return
+		}
+
+		if to > latest {
+			to = latest
+		}
+		for i := from; i <= to; i++ {
+			_, _ = w.Write(append(testEvent(i), '\n'))
+		}
+	})
+
+	mux.HandleFunc("/api/v1/events", func(w http.ResponseWriter, r *http.Request) {
+		earliest, latest := f.offsets()
+		if ids := r.FormValue("ids"); ids != "" {
+			if latest == -1 {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			events, missing := []json.RawMessage{}, []string{}
+			for _, id := range strings.Split(ids, ",") {
+				offset, _ := strconv.ParseInt(id, 10, 64)
+				switch {
+				case offset < earliest:
+					missing = append(missing, fmt.Sprintf(`{"id":%d,"code":"offset_out_of_range"}`, offset))
+				case offset > latest:
+					missing = append(missing, fmt.Sprintf(`{"id":%d,"code":"offset_in_future"}`, offset))
+				default:
+					events = append(events, testEvent(offset))
+				}
+			}
+			b, _ := json.Marshal(events)
+			_, _ = fmt.Fprintf(w, `{"events":%s,"missing":[%s]}`, b, strings.Join(missing, ","))
+			return
+		}
+
+		if r.FormValue("watch") != "true" {
+			if latest == -1 {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			var events []json.RawMessage
+			for i := earliest; i <= latest; i++ {
+				events = append(events, testEvent(i))
+			}
+			_ = json.NewEncoder(w).Encode(events)
+			return
+		}
+
+		f.mu.Lock()
+		f.watches = append(f.watches, r.URL.RawQuery)
+		f.mu.Unlock()
+
+		next := latest + 1
+		if o := r.FormValue("offset"); o != "" {
+			next, _ = strconv.ParseInt(o, 10, 64)
+		}
+		if next < earliest {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusGone)
+			_, _ = fmt.Fprintf(w, `{"title":"Gone","status":410,"code":"offset_out_of_range","requestId":"test","offset":%d,"range":{"earliest":%d,"latest":%d}}`, next, earliest, latest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		sent := 0
+		idle := time.Now()
+		for {
+			if f.streamLimit > 0 && sent == f.streamLimit {
+				return
+			}
+
+			if _, latest = f.offsets(); next <= latest {
+				_, _ = w.Write(append(testEvent(next), '\n'))
+				w.(http.Flusher).Flush()
+				next++
+				sent++
+				idle = time.Now()
+				continue
+			}
+
+			if f.bookmarkInterval > 0 && time.Since(idle) >= f.bookmarkInterval {
+				_, _ = fmt.Fprintf(w, `{"bookmark":{"earliest":%d,"latest":%d}}`+"\n", earliest, latest)
+				w.(http.Flusher).Flush()
+				idle = time.Now()
+			}
+
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	})
+
+	return mux
+}
+
+// check returns an error status and message if the offset is not available
+func (f *fakeServer) check(offset int64) (int, string) {
+	earliest, latest := f.offsets()
+	switch {
+	case offset > latest:
+		return http.StatusBadRequest, "invalid offset: future offset"
+	case offset < earliest:
+		return http.StatusBadRequest, "invalid offset: offset out of range"
+	}
+	return 0, ""
+}
+
+func testEvent(offset int64) []byte {
+	e := ce.NewEvent()
+	e.SetID(strconv.FormatInt(offset, 10))
+	e.SetType("test.event.v0")
+	e.SetSource("/test/source")
+	e.SetTime(time.Date(2022, 1, 14, 14, 0, 0, 0, time.UTC))
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func newTestClient(t *testing.T, f *fakeServer) *Client {
+	t.Helper()
+
+	ts := httptest.NewServer(f.handler())
+	t.Cleanup(ts.Close)
+
+	c, err := New(ts.URL, WithReconnectInterval(time.Millisecond))
+	assert.NilError(t, err)
+	return c
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		address string
+		opts    []Option
+		wantErr string
+	}{
+		{name: "valid address", address: "http://localhost:8080"},
+		{name: "valid address with path", address: "http://localhost:8080/stream/"},
+		{name: "missing scheme", address: "localhost:8080", wantErr: "invalid server address"},
+		{name: "nil http client", address: "http://localhost:8080", opts: []Option{WithHTTPClient(nil)}, wantErr: "http client must not be nil"},
+		{name: "invalid reconnect interval", address: "http://localhost:8080", opts: []Option{WithReconnectInterval(0)}, wantErr: "reconnect interval"},
+		{name: "invalid idle timeout", address: "http://localhost:8080", opts: []Option{WithIdleTimeout(-time.Second)}, wantErr: "idle timeout"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := New(tc.address, tc.opts...)
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			assert.NilError(t, err)
+		})
+	}
+}
+
+func TestClient_Range(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("empty log", func(t *testing.T) {
+		c := newTestClient(t, &fakeServer{earliest: 0, latest: -1})
+		_, err := c.Range(ctx)
+		assert.Assert(t, errors.Is(err, ErrEmptyLog))
+	})
+
+	t.Run("returns range", func(t *testing.T) {
+		c := newTestClient(t, &fakeServer{earliest: 44, latest: 46})
+		r, err := c.Range(ctx)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, r, Range{Earliest: 44, Latest: 46})
+	})
+}
+
+func TestClient_Get(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t, &fakeServer{earliest: 10, latest: 20})
+
+	tests := []struct {
+		name    string
+		offset  int64
+		wantErr error
+	}{
+		{name: "returns event", offset: 15},
+		{name: "purged offset", offset: 3, wantErr: ErrOutOfRange},
+		{name: "future offset", offset: 21, wantErr: ErrFutureOffset},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			e, err := c.Get(ctx, tc.offset)
+			if tc.wantErr != nil {
+				assert.Assert(t, errors.Is(err, tc.wantErr), "got %v", err)
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, e.ID(), strconv.FormatInt(tc.offset, 10))
+		})
+	}
+}
+
+func TestClient_GetBatch(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("returns events and missing offsets", func(t *testing.T) {
+		c := newTestClient(t, &fakeServer{earliest: 10, latest: 20})
+
+		batch, err := c.GetBatch(ctx, 15, 3, 11, 21)
+		assert.NilError(t, err)
+
+		var ids []string
+		for _, e := range batch.Events {
+			ids = append(ids, e.ID())
+		}
+		assert.DeepEqual(t, ids, []string{"15", "11"})
+		assert.Equal(t, len(batch.Missing), 2)
+		assert.Equal(t, batch.Missing[3], ErrOutOfRange)
+		assert.Equal(t, batch.Missing[21], ErrFutureOffset)
+	})
+
+	t.Run("empty log", func(t *testing.T) {
+		c := newTestClient(t, &fakeServer{latest: -1})
+
+		batch, err := c.GetBatch(ctx, 1)
+		assert.NilError(t, err)
+		assert.Equal(t, len(batch.Events), 0)
+		assert.Equal(t, batch.Missing[1], ErrFutureOffset)
+	})
+}
+
+func TestClient_List(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t, &fakeServer{earliest: 10, latest: 134})
+
+	var ids []string
+	pages := 0
+	page, err := c.List(ctx, 10, 50)
+	for ; err == nil && len(page.Events) > 0; page, err = c.List(ctx, page.Next, 50) {
+		pages++
+		for _, e := range page.Events {
+			ids = append(ids, e.ID())
+		}
+	}
+	assert.NilError(t, err)
+	assert.Equal(t, pages, 3)
+	assert.Equal(t, len(ids), 125)
+	assert.Equal(t, ids[0], "10")
+	assert.Equal(t, ids[124], "134")
+	assert.Equal(t, page.Next, int64(135))
+
+	t.Run("purged offset starts at earliest", func(t *testing.T) {
+		page, err := c.List(ctx, 3, 5)
+		assert.NilError(t, err)
+		assert.Equal(t, len(page.Events), 5)
+		assert.Equal(t, page.Events[0].ID(), "10")
+		assert.Equal(t, page.Next, int64(15))
+	})
+}
+
+func TestClient_Latest(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("empty log", func(t *testing.T) {
+		c := newTestClient(t, &fakeServer{earliest: 0, latest: -1})
+		events, err := c.Latest(ctx)
+		assert.NilError(t, err)
+		assert.Equal(t, len(events), 0)
+	})
+
+	t.Run("returns events", func(t *testing.T) {
+		c := newTestClient(t, &fakeServer{earliest: 0, latest: 2})
+		events, err := c.Latest(ctx)
+		assert.NilError(t, err)
+		assert.Equal(t, len(events), 3)
+	})
+}
+
+func TestClient_Export(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("empty log", func(t *testing.T) {
+		c := newTestClient(t, &fakeServer{earliest: 0, latest: -1})
+		_, err := c.Export(ctx, ExportOptions{})
+		assert.Assert(t, errors.Is(err, ErrEmptyLog), "got %v", err)
+	})
+
+	t.Run("exports range", func(t *testing.T) {
+		c := newTestClient(t, &fakeServer{earliest: 0, latest: 9})
+		rc, err := c.Export(ctx, ExportOptions{From: "3", To: "5"})
+		assert.NilError(t, err)
+		defer rc.Close()
+
+		b, err := io.ReadAll(rc)
+		assert.NilError(t, err)
+		assert.Equal(t, strings.Count(string(b), "\n"), 3)
+	})
+}
+
+func TestClient_logNotReady(t *testing.T) {
+	ctx := context.Background()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentTypeProblem)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = io.WriteString(w, `{"title":"Service Unavailable","status":503,"detail":"log not initialized","code":"log_not_ready","requestId":"req-1"}`)
+	}))
+	t.Cleanup(ts.Close)
+
+	c, err := New(ts.URL)
+	assert.NilError(t, err)
+
+	_, err = c.Range(ctx)
+	assert.Assert(t, errors.Is(err, ErrEmptyLog), "got %v", err)
+
+	events, err := c.Latest(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, len(events), 0)
+
+	page, err := c.List(ctx, 5, 0)
+	assert.NilError(t, err)
+	assert.Equal(t, len(page.Events), 0)
+	assert.Equal(t, page.Next, int64(5))
+
+	batch, err := c.GetBatch(ctx, 1, 2)
+	assert.NilError(t, err)
+	assert.Assert(t, errors.Is(batch.Missing[1], ErrFutureOffset))
+	assert.Assert(t, errors.Is(batch.Missing[2], ErrFutureOffset))
+
+	_, err = c.Export(ctx, ExportOptions{})
+	assert.Assert(t, errors.Is(err, ErrEmptyLog), "got %v", err)
+
+	_, err = c.Get(ctx, 1)
+	var serr *StatusError
+	assert.Assert(t, errors.As(err, &serr))
+	assert.Equal(t, serr.ErrorCode, CodeLogNotReady)
+}
+
+func Test_responseError(t *testing.T) {
+	response := func(code int, contentType, body string) *http.Response {
+		rec := httptest.NewRecorder()
+		rec.Header().Set("Content-Type", contentType)
+		rec.WriteHeader(code)
+		_, _ = rec.WriteString(body)
+		return rec.Result()
+	}
+
+	t.Run("offset out of range problem", func(t *testing.T) {
+		err := responseError(response(http.StatusGone, contentTypeProblem,
+			`{"title":"Gone","status":410,"detail":"invalid offset: offset out of range","code":"offset_out_of_range","requestId":"req-1","offset":3,"range":{"earliest":41,"latest":46}}`))
+		assert.Assert(t, errors.Is(err, ErrOutOfRange))
+
+		var oerr *OutOfRangeError
+		assert.Assert(t, errors.As(err, &oerr))
+		assert.Equal(t, *oerr, OutOfRangeError{Offset: 3, Earliest: 41})
+	})
+
+	t.Run("offset in future problem", func(t *testing.T) {
+		err := responseError(response(http.StatusBadRequest, contentTypeProblem,
+			`{"title":"Bad Request","status":400,"detail":"invalid offset: future offset","code":"offset_in_future","requestId":"req-2"}`))
+		assert.Assert(t, errors.Is(err, ErrFutureOffset))
+	})
+
+	t.Run("other problem", func(t *testing.T) {
+		err := responseError(response(http.StatusServiceUnavailable, contentTypeProblem+"; charset=utf-8",
+			`{"title":"Service Unavailable","status":503,"detail":"log not initialized","code":"log_not_ready","requestId":"req-3"}`))
+
+		var serr *StatusError
+		assert.Assert(t, errors.As(err, &serr))
+		assert.DeepEqual(t, *serr, StatusError{Code: 503, Message: "log not initialized", ErrorCode: CodeLogNotReady, RequestID: "req-3"})
+	})
+
+	t.Run("plain text", func(t *testing.T) {
+		err := responseError(response(http.StatusBadRequest, "text/plain; charset=utf-8", "invalid q parameter\n"))
+
+		var serr *StatusError
+		assert.Assert(t, errors.As(err, &serr))
+		assert.DeepEqual(t, *serr, StatusError{Code: 400, Message: "invalid q parameter"})
+	})
+}
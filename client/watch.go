@@ -0,0 +1,280 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+)
+
+const maxEventSize = 1 << 20 // 1MiB
+
+// bookmarkPrefix identifies bookmarks on the stream, e.g.
+// {"bookmark":{"earliest":41,"latest":46}}
+var bookmarkPrefix = []byte(`{"bookmark":`)
+
+type bookmark struct {
+	Bookmark Range `json:"bookmark"`
+}
+
+// WatchOption configures the start position of a watch
+type WatchOption func(*Watcher)
+
+// FromOffset starts the watch at the given offset
+func FromOffset(offset int64) WatchOption {
+	return func(w *Watcher) {
+		w.next = offset
+	}
+}
+
+// Since starts the watch with the first event at or after t
+func Since(t time.Time) WatchOption {
+	return func(w *Watcher) {
+		w.since = t
+	}
+}
+
+// Watcher is an iterator over events streamed from the server. If the
+// connection is lost or idle, i.e. neither events nor bookmarks are received
+// within the idle timeout, the watcher reconnects and resumes after the last
+// received event. It must only be used within the same goroutine.
+type Watcher struct {
+	ctx    context.Context
+	client *Client
+
+	next   int64     // offset to resume from, -1 for latest
+	since  time.Time // used until the first event is received
+	latest int64     // server log latest offset of the last bookmark
+
+	body     io.ReadCloser
+	idle     *time.Timer // closes body when expired
+	scanner  *bufio.Scanner
+	received bool // events received on current connection
+	backoff  time.Duration
+	done     bool
+	err      error
+}
+
+// Watch returns an iterator streaming events from the server until the context
+// is cancelled or an unrecoverable error occurs. Without options the watch
+// starts with the next event written to the log.
+//
+//	w := c.Watch(ctx, client.FromOffset(44))
+//	defer w.Close()
+//	for {
+//		e, ok := w.Next()
+//		if !ok {
+//			break
+//		}
+//		...
+//	}
+//	if err := w.Err(); err != nil { ... }
+func (c *Client) Watch(ctx context.Context, opts ...WatchOption) *Watcher {
+	w := Watcher{
+		ctx:     ctx,
+		client:  c,
+		next:    -1,
+		latest:  -1,
+		backoff: c.reconnectInterval,
+	}
+
+	for _, opt := range opts {
+		opt(&w)
+	}
+
+	return &w
+}
+
+// Next blocks until the next event is available. ok is true if the iterator
+// has not stopped, otherwise ok is false and any subsequent calls return an
+// empty event and false.
+//
+// The caller must consult Err() which error caused stopping the iterator.
+func (w *Watcher) Next() (ce.Event, bool) {
+	for {
+		if w.done {
+			return ce.Event{}, false
+		}
+
+		if err := w.ctx.Err(); err != nil {
+			w.stop(err)
+			continue
+		}
+
+		if w.scanner == nil {
+			if err := w.connect(); err != nil {
+				if !retryable(err) {
+					w.stop(err)
+					continue
+				}
+
+				w.wait()
+			}
+			continue
+		}
+
+		if !w.scanner.Scan() {
+			if err := w.scanner.Err(); errors.Is(err, bufio.ErrTooLong) {
+				w.stop(fmt.Errorf("read event: %w", err))
+				continue
+			}
+
+			// server closed stream (e.g. timeout) or connection lost, back off
+			// if nothing was received to not hammer the server
+			idle := !w.received
+			w.disconnect()
+			if idle {
+				w.wait()
+			}
+			continue
+		}
+		w.received = true
+		w.idle.Reset(w.client.idleTimeout)
+
+		line := w.scanner.Bytes()
+		if bytes.HasPrefix(line, bookmarkPrefix) {
+			var bm bookmark
+			if err := json.Unmarshal(line, &bm); err != nil {
+				w.stop(fmt.Errorf("decode bookmark: %w", err))
+				continue
+			}
+			w.latest = bm.Bookmark.Latest
+			continue
+		}
+
+		var e ce.Event
+		if err := json.Unmarshal(line, &e); err != nil {
+			w.stop(fmt.Errorf("decode event: %w", err))
+			continue
+		}
+
+		offset, err := eventOffset(e)
+		if err != nil {
+			w.stop(err)
+			continue
+		}
+
+		w.next = offset + 1
+		w.since = time.Time{}
+		w.backoff = w.client.reconnectInterval
+		return e, true
+	}
+}
+
+// Err returns the error that stopped the iterator
+func (w *Watcher) Err() error {
+	return w.err
+}
+
+// Close stops the iterator and releases the connection
+func (w *Watcher) Close() {
+	if !w.done {
+		w.stop(nil)
+	}
+}
+
+// Offset returns the offset of the next expected event or -1 if no event has
+// been received and the watch started at the latest offset
+func (w *Watcher) Offset() int64 {
+	return w.next
+}
+
+// Latest returns the latest offset in the server log reported by the last
+// bookmark or -1 if no bookmark has been received
+func (w *Watcher) Latest() int64 {
+	return w.latest
+}
+
+func (w *Watcher) connect() error {
+	q := url.Values{}
+	q.Set("watch", "true")
+	q.Set("bookmarks", "true")
+
+	switch {
+	case !w.since.IsZero():
+		q.Set("since", w.since.Format(time.RFC3339))
+	case w.next == -1:
+		// pin the start offset so reconnects do not miss events
+		r, err := w.client.Range(w.ctx)
+		if err != nil && !errors.Is(err, ErrEmptyLog) {
+			return err
+		}
+		if err == nil {
+			w.next = r.Latest + 1
+			q.Set("offset", strconv.FormatInt(w.next, 10))
+		}
+	default:
+		q.Set("offset", strconv.FormatInt(w.next, 10))
+	}
+
+	res, err := w.client.get(w.ctx, "/events", q)
+	if err != nil {
+		return err
+	}
+
+	w.body = res.Body
+	w.scanner = scanLines(res.Body, maxEventSize)
+	w.received = false
+	w.idle = time.AfterFunc(w.client.idleTimeout, func() {
+		// unblocks the scanner to reconnect
+		_ = res.Body.Close()
+	})
+	return nil
+}
+
+func (w *Watcher) disconnect() {
+	if w.idle != nil {
+		w.idle.Stop()
+	}
+	if w.body != nil {
+		_ = w.body.Close()
+	}
+	w.idle = nil
+	w.body = nil
+	w.scanner = nil
+}
+
+func (w *Watcher) stop(err error) {
+	w.disconnect()
+	w.done = true
+	w.err = err
+}
+
+// wait blocks for the current backoff interval and increases it
+func (w *Watcher) wait() {
+	t := time.NewTimer(w.backoff)
+	defer t.Stop()
+
+	select {
+	case <-w.ctx.Done():
+	case <-t.C:
+	}
+
+	w.backoff *= 2
+	if w.backoff > maxReconnectInterval {
+		w.backoff = maxReconnectInterval
+	}
+}
+
+// retryable returns whether a watch should reconnect after err
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var serr *StatusError
+	if errors.As(err, &serr) {
+		return serr.Code >= 500
+	}
+
+	// out of range, future offset
+	return !errors.Is(err, ErrOutOfRange) && !errors.Is(err, ErrFutureOffset)
+}
@@ -0,0 +1,152 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestClient_Watch(t *testing.T) {
+	t.Run("reconnects and resumes after last event", func(t *testing.T) {
+		f := &fakeServer{earliest: 0, latest: 9, streamLimit: 3}
+		c := newTestClient(t, f)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		w := c.Watch(ctx, FromOffset(2))
+		defer w.Close()
+
+		for want := 2; want <= 9; want++ {
+			e, ok := w.Next()
+			assert.Assert(t, ok, "watch stopped: %v", w.Err())
+			assert.Equal(t, e.ID(), strconv.Itoa(want))
+		}
+		assert.Equal(t, w.Offset(), int64(10))
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		assert.DeepEqual(t, f.watches, []string{
+			"bookmarks=true&offset=2&watch=true",
+			"bookmarks=true&offset=5&watch=true",
+			"bookmarks=true&offset=8&watch=true",
+		})
+	})
+
+	t.Run("starts after latest event", func(t *testing.T) {
+		f := &fakeServer{earliest: 0, latest: 9}
+		c := newTestClient(t, f)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		w := c.Watch(ctx)
+		defer w.Close()
+
+		// keep writing as the start offset depends on when the watch connects
+		go func() {
+			for ctx.Err() == nil {
+				f.add(1)
+				time.Sleep(10 * time.Millisecond)
+			}
+		}()
+
+		e, ok := w.Next()
+		assert.Assert(t, ok, "watch stopped: %v", w.Err())
+		first, err := strconv.Atoi(e.ID())
+		assert.NilError(t, err)
+		assert.Assert(t, first >= 10)
+
+		e, ok = w.Next()
+		assert.Assert(t, ok, "watch stopped: %v", w.Err())
+		assert.Equal(t, e.ID(), strconv.Itoa(first+1))
+	})
+
+	t.Run("stops on purged offset", func(t *testing.T) {
+		c := newTestClient(t, &fakeServer{earliest: 10, latest: 20})
+
+		w := c.Watch(context.Background(), FromOffset(3))
+		_, ok := w.Next()
+		assert.Assert(t, !ok)
+		assert.Assert(t, errors.Is(w.Err(), ErrOutOfRange))
+
+		var oerr *OutOfRangeError
+		assert.Assert(t, errors.As(w.Err(), &oerr))
+		assert.Equal(t, *oerr, OutOfRangeError{Offset: 3, Earliest: 10})
+	})
+
+	t.Run("receives bookmarks on idle watch", func(t *testing.T) {
+		f := &fakeServer{earliest: 0, latest: 9, bookmarkInterval: 5 * time.Millisecond}
+		c := newTestClient(t, f)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		w := c.Watch(ctx, FromOffset(9))
+		defer w.Close()
+
+		e, ok := w.Next()
+		assert.Assert(t, ok, "watch stopped: %v", w.Err())
+		assert.Equal(t, e.ID(), "9")
+		assert.Equal(t, w.Latest(), int64(-1))
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			f.add(1)
+		}()
+
+		e, ok = w.Next()
+		assert.Assert(t, ok, "watch stopped: %v", w.Err())
+		assert.Equal(t, e.ID(), "10")
+		assert.Equal(t, w.Latest(), int64(9))
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		assert.Equal(t, len(f.watches), 1)
+	})
+
+	t.Run("reconnects idle watch", func(t *testing.T) {
+		f := &fakeServer{earliest: 0, latest: 9}
+		ts := httptest.NewServer(f.handler())
+		defer ts.Close()
+
+		c, err := New(ts.URL, WithReconnectInterval(time.Millisecond), WithIdleTimeout(20*time.Millisecond))
+		assert.NilError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		w := c.Watch(ctx, FromOffset(10))
+		defer w.Close()
+
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			f.add(1)
+		}()
+
+		e, ok := w.Next()
+		assert.Assert(t, ok, "watch stopped: %v", w.Err())
+		assert.Equal(t, e.ID(), "10")
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		assert.Assert(t, len(f.watches) > 1, "watches: %v", f.watches)
+	})
+
+	t.Run("stops on cancelled context", func(t *testing.T) {
+		c := newTestClient(t, &fakeServer{earliest: 0, latest: 9})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		w := c.Watch(ctx)
+		_, ok := w.Next()
+		assert.Assert(t, !ok)
+		assert.Assert(t, errors.Is(w.Err(), context.DeadlineExceeded), "got %v", w.Err())
+	})
+}
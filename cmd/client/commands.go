@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/embano1/vsphere-event-streaming/client"
+)
+
+// outputFlags registers the output flags shared by commands
+type outputFlags struct {
+	format   string
+	columns  string
+	template string
+}
+
+func (o *outputFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.format, "o", outputJSON, "output format: json|yaml|table|template")
+	fs.StringVar(&o.columns, "columns", defaultColumns, "comma-separated table columns: offset, time, type, class, entity, message, source or data.<field path>")
+	fs.StringVar(&o.template, "template", "", "Go template for template output, e.g. '{{.Offset}} {{.Type}} {{.Data.UserName}}'")
+}
+
+func (o *outputFlags) printer(w io.Writer) (*printer, error) {
+	return newPrinter(w, o.format, o.columns, o.template)
+}
+
+// parseFlags parses command flags and returns a usage error on invalid input.
+// Flag errors and usage are written to stderr.
+func parseFlags(fs *flag.FlagSet, args []string, stderr io.Writer) error {
+	fs.SetOutput(stderr)
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return &usageError{msg: err.Error()}
+	}
+	return nil
+}
+
+func rangeCmd(ctx context.Context, c *client.Client, args []string, stdout, stderr io.Writer) error {
+	var out outputFlags
+	fs := flag.NewFlagSet("range", flag.ContinueOnError)
+	out.register(fs)
+	if err := parseFlags(fs, args, stderr); err != nil {
+		return err
+	}
+
+	p, err := out.printer(stdout)
+	if err != nil {
+		return err
+	}
+
+	r, err := c.Range(ctx)
+	if err != nil {
+		return fmt.Errorf("get range: %w", err)
+	}
+
+	if err = p.printRange(r); err != nil {
+		return err
+	}
+	return p.flush()
+}
+
+func getCmd(ctx context.Context, c *client.Client, args []string, stdout, stderr io.Writer) error {
+	var out outputFlags
+	fs := flag.NewFlagSet("get", flag.ContinueOnError)
+	out.register(fs)
+	if err := parseFlags(fs, args, stderr); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return &usageError{msg: "get requires exactly one event id"}
+	}
+
+	id, err := strconv.ParseInt(fs.Arg(0), 10, 64)
+	if err != nil {
+		return &usageError{msg: fmt.Sprintf("invalid event id %q", fs.Arg(0))}
+	}
+
+	p, err := out.printer(stdout)
+	if err != nil {
+		return err
+	}
+
+	e, err := c.Get(ctx, id)
+	if err != nil {
+		return fmt.Errorf("get event %d: %w", id, err)
+	}
+
+	if err = p.printEvent(e); err != nil {
+		return err
+	}
+	return p.flush()
+}
+
+func listCmd(ctx context.Context, c *client.Client, args []string, stdout, stderr io.Writer) error {
+	var (
+		out   outputFlags
+		from  int64
+		limit int
+		all   bool
+	)
+
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	out.register(fs)
+	fs.Int64Var(&from, "from", -1, "first event id (offset), defaults to the earliest event")
+	fs.IntVar(&limit, "limit", 50, "maximum number of events per page")
+	fs.BoolVar(&all, "all", false, "list all events by following pages")
+	if err := parseFlags(fs, args, stderr); err != nil {
+		return err
+	}
+
+	p, err := out.printer(stdout)
+	if err != nil {
+		return err
+	}
+
+	if from == -1 {
+		r, err := c.Range(ctx)
+		if err != nil {
+			return fmt.Errorf("get range: %w", err)
+		}
+		from = r.Earliest
+	}
+
+	for {
+		page, err := c.List(ctx, from, limit)
+		if err != nil {
+			return fmt.Errorf("list events: %w", err)
+		}
+
+		for _, e := range page.Events {
+			if err = p.printEvent(e); err != nil {
+				return err
+			}
+		}
+
+		if !all || len(page.Events) == 0 {
+			break
+		}
+		from = page.Next
+	}
+
+	return p.flush()
+}
+
+func watchCmd(ctx context.Context, c *client.Client, args []string, stdout, stderr io.Writer) error {
+	var (
+		out     outputFlags
+		from    int64
+		since   string
+		command string
+		file    string
+		rotate  string
+		state   string
+	)
+
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	out.register(fs)
+	fs.Int64Var(&from, "from", -1, "start at event id (offset), defaults to the checkpoint in -state or the next event")
+	fs.StringVar(&since, "since", "", "start at the first event at or after this RFC3339 time")
+	fs.StringVar(&command, "exec", "", "run command for each event with the event as JSON on stdin and EVENT_ID, EVENT_TYPE, EVENT_SOURCE and EVENT_TIME set")
+	fs.StringVar(&file, "out", "", "append events to file instead of stdout")
+	fs.StringVar(&rotate, "rotate", "", "rotate -out file when it exceeds this size, e.g. 100MB")
+	fs.StringVar(&state, "state", "", "checkpoint the last processed event id to this file and resume from it")
+	if err := parseFlags(fs, args, stderr); err != nil {
+		return err
+	}
+
+	if from != -1 && since != "" {
+		return &usageError{msg: "-from and -since are mutually exclusive"}
+	}
+	if rotate != "" && file == "" {
+		return &usageError{msg: "-rotate requires -out"}
+	}
+
+	handlers, err := watchHandlers(out, command, file, rotate, stdout, stderr)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, h := range handlers {
+			_ = h.close()
+		}
+	}()
+
+	var opts []client.WatchOption
+	if since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return &usageError{msg: "invalid -since: must be an RFC3339 timestamp"}
+		}
+		opts = append(opts, client.Since(t))
+	}
+
+	var cp *checkpoint
+	if state != "" {
+		cp = &checkpoint{path: state}
+		offset, ok, err := cp.load()
+		if err != nil {
+			return err
+		}
+		if ok && from == -1 && since == "" {
+			from = offset + 1
+		}
+	}
+	if from != -1 {
+		opts = append(opts, client.FromOffset(from))
+	}
+
+	w := c.Watch(ctx, opts...)
+	defer w.Close()
+
+	for {
+		e, ok := w.Next()
+		if !ok {
+			break
+		}
+
+		for _, h := range handlers {
+			if err = h.handle(ctx, e); err != nil {
+				if ctx.Err() != nil {
+					// command killed on shutdown, event is retried on restart
+					return ctx.Err()
+				}
+				return err
+			}
+		}
+
+		if cp != nil {
+			if err = cp.save(w.Offset() - 1); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err = w.Err(); err != nil {
+		return fmt.Errorf("watch events: %w", err)
+	}
+	return nil
+}
+
+// watchHandlers returns the event handlers for the watch flags. Events are
+// printed to stdout if neither a command nor a file is specified.
+func watchHandlers(out outputFlags, command, file, rotate string, stdout, stderr io.Writer) ([]handler, error) {
+	var handlers []handler
+
+	if file != "" {
+		var size int64
+		if rotate != "" {
+			s, err := parseSize(rotate)
+			if err != nil {
+				return nil, &usageError{msg: "invalid -rotate: " + err.Error()}
+			}
+			size = s
+		}
+
+		h, err := newFileHandler(file, size, out)
+		if err != nil {
+			return nil, err
+		}
+		handlers = append(handlers, h)
+	}
+
+	if command != "" {
+		handlers = append(handlers, &execHandler{command: command, stdout: stdout, stderr: stderr})
+	}
+
+	if len(handlers) == 0 {
+		p, err := out.printer(stdout)
+		if err != nil {
+			return nil, err
+		}
+		handlers = append(handlers, &printHandler{p: p})
+	}
+
+	return handlers, nil
+}
+
+func exportCmd(ctx context.Context, c *client.Client, args []string, stdout, stderr io.Writer) error {
+	var (
+		opts client.ExportOptions
+		out  string
+	)
+
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fs.StringVar(&opts.From, "from", "", "first event id (offset) or RFC3339 time, defaults to the earliest event")
+	fs.StringVar(&opts.To, "to", "", "last event id (offset) or RFC3339 time, defaults to the latest event")
+	fs.StringVar(&opts.Format, "format", "ndjson", "export format: ndjson|ndjson.gz|batch")
+	fs.StringVar(&out, "out", "", "write export to file instead of stdout")
+	if err := parseFlags(fs, args, stderr); err != nil {
+		return err
+	}
+
+	rc, err := c.Export(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("export events: %w", err)
+	}
+	defer rc.Close()
+
+	if out == "" {
+		if _, err = io.Copy(stdout, rc); err != nil {
+			return fmt.Errorf("write export: %w", err)
+		}
+		return nil
+	}
+
+	f, err := os.Create(out)
+	if err != nil {
+		return fmt.Errorf("create output file: %w", err)
+	}
+	if _, err = io.Copy(f, rc); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("write export: %w", err)
+	}
+	if err = f.Close(); err != nil {
+		return fmt.Errorf("close output file: %w", err)
+	}
+	return nil
+}
+
+// isConnectionError returns whether err is caused by a failed request, e.g.
+// server not reachable
+func isConnectionError(err error) bool {
+	var uerr *url.Error
+	return errors.As(err, &uerr)
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+)
+
+// handler processes events received by watch
+type handler interface {
+	handle(ctx context.Context, e ce.Event) error
+	close() error
+}
+
+// printHandler prints events to a writer
+type printHandler struct {
+	p *printer
+}
+
+func (h *printHandler) handle(_ context.Context, e ce.Event) error {
+	if err := h.p.printEvent(e); err != nil {
+		return err
+	}
+	return h.p.flush()
+}
+
+func (h *printHandler) close() error {
+	return h.p.flush()
+}
+
+// execHandler runs a command for each event. The event is passed as JSON on
+// stdin and its attributes as EVENT_* environment variables.
+type execHandler struct {
+	command string
+	stdout  io.Writer
+	stderr  io.Writer
+}
+
+func (h *execHandler) handle(ctx context.Context, e ce.Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("marshal event: %w", err)
+	}
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", h.command)
+	cmd.Stdin = bytes.NewReader(b)
+	cmd.Stdout = h.stdout
+	cmd.Stderr = h.stderr
+	cmd.Env = append(os.Environ(),
+		"EVENT_ID="+e.ID(),
+		"EVENT_TYPE="+e.Type(),
+		"EVENT_SOURCE="+e.Source(),
+		"EVENT_TIME="+newRow(e).Time,
+	)
+
+	if err = cmd.Run(); err != nil {
+		return fmt.Errorf("exec handler for event %s: %w", e.ID(), err)
+	}
+	return nil
+}
+
+func (h *execHandler) close() error {
+	return nil
+}
+
+// fileHandler writes events to a file which is rotated when it exceeds
+// maxSize bytes. Rotated files are renamed to <path>.<last offset>.
+type fileHandler struct {
+	path    string
+	maxSize int64 // 0 disables rotation
+	out     outputFlags
+
+	f    *os.File
+	p    *printer
+	size int64
+	last string // id of last written event
+}
+
+func newFileHandler(path string, maxSize int64, out outputFlags) (*fileHandler, error) {
+	h := fileHandler{
+		path:    path,
+		maxSize: maxSize,
+		out:     out,
+	}
+
+	if err := h.open(); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+func (h *fileHandler) open() error {
+	f, err := os.OpenFile(h.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open output file: %w", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("stat output file: %w", err)
+	}
+
+	p, err := h.out.printer(&countingWriter{w: f, n: &h.size})
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	h.f = f
+	h.p = p
+	h.size = info.Size()
+	return nil
+}
+
+func (h *fileHandler) handle(_ context.Context, e ce.Event) error {
+	if h.maxSize > 0 && h.size >= h.maxSize {
+		if err := h.rotate(e); err != nil {
+			return err
+		}
+	}
+
+	if err := h.p.printEvent(e); err != nil {
+		return fmt.Errorf("write event: %w", err)
+	}
+	if err := h.p.flush(); err != nil {
+		return fmt.Errorf("write event: %w", err)
+	}
+
+	// checkpoint must not be ahead of the file contents
+	if err := h.f.Sync(); err != nil {
+		return fmt.Errorf("sync output file: %w", err)
+	}
+
+	h.last = e.ID()
+	return nil
+}
+
+// rotate renames the current file before writing next
+func (h *fileHandler) rotate(next ce.Event) error {
+	if err := h.f.Close(); err != nil {
+		return fmt.Errorf("close output file: %w", err)
+	}
+
+	// file was written by a previous run and ends before the next event
+	suffix := h.last
+	if suffix == "" {
+		offset, err := strconv.ParseInt(next.ID(), 10, 64)
+		if err != nil {
+			return fmt.Errorf("event id %q is not an offset", next.ID())
+		}
+		suffix = strconv.FormatInt(offset-1, 10)
+	}
+
+	rotated := h.path + "." + suffix
+	if _, err := os.Stat(rotated); err == nil {
+		return fmt.Errorf("rotate output file: %q already exists", rotated)
+	}
+	if err := os.Rename(h.path, rotated); err != nil {
+		return fmt.Errorf("rotate output file: %w", err)
+	}
+
+	return h.open()
+}
+
+func (h *fileHandler) close() error {
+	return h.f.Close()
+}
+
+// countingWriter counts the bytes written to w
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	*c.n += int64(n)
+	return n, err
+}
+
+// parseSize parses a size with an optional binary unit suffix, e.g. 100MB
+func parseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		size   int64
+	}{
+		{"KIB", 1 << 10}, {"MIB", 1 << 20}, {"GIB", 1 << 30},
+		{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30},
+		{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30},
+		{"B", 1},
+	}
+
+	v := strings.ToUpper(strings.TrimSpace(s))
+	mult := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(v, u.suffix) {
+			v = strings.TrimSpace(strings.TrimSuffix(v, u.suffix))
+			mult = u.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+// checkpoint persists the offset of the last processed event
+type checkpoint struct {
+	path string
+}
+
+type checkpointState struct {
+	Offset int64 `json:"offset"`
+}
+
+// load returns the checkpointed offset. ok is false if no checkpoint exists.
+func (c *checkpoint) load() (int64, bool, error) {
+	b, err := os.ReadFile(c.path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return 0, false, nil
+		}
+		return 0, false, fmt.Errorf("read state file: %w", err)
+	}
+
+	var state checkpointState
+	if err = json.Unmarshal(b, &state); err != nil {
+		return 0, false, fmt.Errorf("parse state file %q: %w", c.path, err)
+	}
+
+	return state.Offset, true, nil
+}
+
+// save atomically replaces the state file
+func (c *checkpoint) save(offset int64) error {
+	b, err := json.Marshal(checkpointState{Offset: offset})
+	if err != nil {
+		return fmt.Errorf("marshal state: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), filepath.Base(c.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("create state file: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // no-op after rename
+
+	if _, err = tmp.Write(append(b, '\n')); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("write state file: %w", err)
+	}
+	if err = tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("sync state file: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("close state file: %w", err)
+	}
+
+	if err = os.Rename(tmp.Name(), c.path); err != nil {
+		return fmt.Errorf("replace state file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"gotest.tools/v3/assert"
+)
+
+func Test_parseSize(t *testing.T) {
+	tests := []struct {
+		size    string
+		want    int64
+		wantErr bool
+	}{
+		{size: "100", want: 100},
+		{size: "100B", want: 100},
+		{size: "10KB", want: 10 << 10},
+		{size: "100MB", want: 100 << 20},
+		{size: "100mb", want: 100 << 20},
+		{size: "1 GiB", want: 1 << 30},
+		{size: "2G", want: 2 << 30},
+		{size: "0MB", wantErr: true},
+		{size: "-1", wantErr: true},
+		{size: "MB", wantErr: true},
+		{size: "1.5MB", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.size, func(t *testing.T) {
+			got, err := parseSize(tc.size)
+			if tc.wantErr {
+				assert.ErrorContains(t, err, "invalid size")
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, got, tc.want)
+		})
+	}
+}
+
+func Test_checkpoint(t *testing.T) {
+	cp := checkpoint{path: filepath.Join(t.TempDir(), "watch.state")}
+
+	_, ok, err := cp.load()
+	assert.NilError(t, err)
+	assert.Assert(t, !ok)
+
+	assert.NilError(t, cp.save(44))
+	assert.NilError(t, cp.save(45))
+
+	offset, ok, err := cp.load()
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+	assert.Equal(t, offset, int64(45))
+
+	t.Run("invalid state file", func(t *testing.T) {
+		assert.NilError(t, os.WriteFile(cp.path, []byte("45"), 0o644))
+		_, _, err = cp.load()
+		assert.ErrorContains(t, err, "parse state file")
+	})
+}
+
+func Test_fileHandler(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "events.ndjson")
+
+	// previous run
+	assert.NilError(t, os.WriteFile(path, []byte(strings.Repeat("x", 99)+"\n"), 0o644))
+
+	h, err := newFileHandler(path, 100, outputFlags{format: outputJSON})
+	assert.NilError(t, err)
+
+	e := testEvent(t)
+	for i := 44; i < 47; i++ {
+		e.SetID(strconv.Itoa(i))
+		assert.NilError(t, h.handle(ctx, e))
+	}
+	assert.NilError(t, h.close())
+
+	// each event exceeds the max size
+	wantFiles := map[string]int{
+		"events.ndjson.43": 0,
+		"events.ndjson.44": 1,
+		"events.ndjson.45": 1,
+		"events.ndjson":    1,
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(path))
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), len(wantFiles))
+
+	for name, events := range wantFiles {
+		b, err := os.ReadFile(filepath.Join(filepath.Dir(path), name))
+		assert.NilError(t, err)
+		if events == 0 {
+			continue
+		}
+		assert.Equal(t, strings.Count(string(b), "\n"), events, name)
+		assert.Assert(t, strings.HasPrefix(string(b), `{"specversion":"1.0"`), name)
+	}
+}
+
+func Test_execHandler(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("passes event to command", func(t *testing.T) {
+		var stdout bytes.Buffer
+		h := execHandler{
+			command: `echo "$EVENT_ID $EVENT_TYPE $EVENT_TIME"; cat`,
+			stdout:  &stdout,
+			stderr:  &stdout,
+		}
+
+		e := testEvent(t)
+		assert.NilError(t, h.handle(ctx, e))
+
+		header, body, ok := strings.Cut(stdout.String(), "\n")
+		assert.Assert(t, ok)
+		assert.Equal(t, header, "44 vmware.vsphere.VmPoweredOnEvent.v0 2022-01-14T13:26:22Z")
+
+		var got ce.Event
+		assert.NilError(t, json.Unmarshal([]byte(body), &got))
+		assert.Equal(t, got.ID(), e.ID())
+	})
+
+	t.Run("command fails", func(t *testing.T) {
+		var stdout bytes.Buffer
+		h := execHandler{command: "exit 3", stdout: &stdout, stderr: &stdout}
+		assert.ErrorContains(t, h.handle(ctx, testEvent(t)), "exec handler for event 44: exit status 3")
+	})
+}
+
+func Test_watchCheckpoint(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		mu      sync.Mutex
+		queries []string
+	)
+
+	// streams three events per connection and cancels the watch on the second
+	// connection
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/range" {
+			_, _ = fmt.Fprint(w, `{"earliest":0,"latest":9}`)
+			return
+		}
+
+		mu.Lock()
+		queries = append(queries, r.URL.RawQuery)
+		conns := len(queries)
+		mu.Unlock()
+
+		if conns%2 == 0 {
+			cancel()
+			<-r.Context().Done()
+			return
+		}
+
+		next, err := strconv.Atoi(r.FormValue("offset"))
+		if err != nil {
+			next = 10
+		}
+
+		e := testEvent(t)
+		for i := next; i < next+3; i++ {
+			e.SetID(strconv.Itoa(i))
+			b, err := json.Marshal(e)
+			assert.NilError(t, err)
+			_, _ = fmt.Fprintln(w, string(b))
+		}
+	}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	state := filepath.Join(dir, "watch.state")
+	out := filepath.Join(dir, "events.ndjson")
+	args := []string{"-server", ts.URL, "watch", "-state", state, "-out", out, "-exec", "true"}
+
+	var stdout, stderr bytes.Buffer
+	assert.Equal(t, run(ctx, args, &stdout, &stderr), exitOK, stderr.String())
+
+	b, err := os.ReadFile(state)
+	assert.NilError(t, err)
+	assert.Equal(t, string(b), "{\"offset\":12}\n")
+
+	// resume from checkpoint
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	assert.Equal(t, run(ctx, args, &stdout, &stderr), exitOK, stderr.String())
+
+	b, err = os.ReadFile(state)
+	assert.NilError(t, err)
+	assert.Equal(t, string(b), "{\"offset\":15}\n")
+
+	b, err = os.ReadFile(out)
+	assert.NilError(t, err)
+	assert.Equal(t, strings.Count(string(b), "\n"), 6)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, queries[0], "bookmarks=true&offset=10&watch=true")
+	assert.Equal(t, queries[2], "bookmarks=true&offset=13&watch=true")
+}
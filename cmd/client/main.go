@@ -1,87 +1,154 @@
 package main
 
 import (
-	"bufio"
 	"context"
+	"errors"
 	"flag"
-	"net/http"
+	"fmt"
+	"io"
 	"os"
 	"os/signal"
-	"strconv"
 	"syscall"
-	"time"
 
-	"github.com/embano1/vsphere/logger"
-	"go.uber.org/zap"
+	"github.com/embano1/vsphere-event-streaming/client"
 )
 
-var (
-	address string
-	watch   bool
-	start   int
+// exit codes
+const (
+	exitOK          = 0
+	exitError       = 1 // unspecified error
+	exitUsage       = 2 // invalid command or flags
+	exitNotFound    = 3 // empty log or offset not written yet
+	exitOutOfRange  = 4 // offset purged from log
+	exitServerError = 5 // server unavailable or failed
 )
 
-func main() {
-	flag.StringVar(&address, "server", "http://localhost:8080/api/v1/events", "full stream server URL")
-	flag.IntVar(&start, "start", 0, "start offset (0 for latest)")
-	flag.BoolVar(&watch, "watch", false, "watch the event stream")
-	flag.Parse()
-
-	l, err := zap.NewDevelopment()
-	if err != nil {
-		panic("create logger: " + err.Error())
-	}
+const usage = `Usage: client [-server URL] <command> [flags]
+
+Flags:
+  -server     stream server URL (env EVENT_STREAM_SERVER, default http://localhost:8080)
+
+Commands:
+  range       show the available event range
+  get <id>    show the event with the given id (offset)
+  list        list events, starting at the earliest event
+  watch       watch the event stream
+  export      export events as (gzip-compressed) NDJSON or CloudEvents batch
+
+Exit codes:
+  0  success
+  1  error
+  2  invalid usage
+  3  not found (empty log or future offset)
+  4  offset out of range (purged)
+  5  server error
+
+Run "client <command> -h" for command flags.
+`
+
+// command runs a subcommand with the given arguments, writing its output to
+// stdout and flag errors and command output of -exec to stderr
+type command func(ctx context.Context, c *client.Client, args []string, stdout, stderr io.Writer) error
+
+var commands = map[string]command{
+	"range":  rangeCmd,
+	"get":    getCmd,
+	"list":   listCmd,
+	"watch":  watchCmd,
+	"export": exportCmd,
+}
 
-	ctx := logger.Set(context.Background(), l)
-	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
-	defer cancel()
+// usageError is returned for invalid command line usage
+type usageError struct {
+	msg string
+}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, address, nil)
-	if err != nil {
-		l.Fatal("could not create request", zap.Error(err))
-	}
+func (e *usageError) Error() string { return e.msg }
 
-	req.Header.Add("Transfer-Encoding", "chunked")
+func main() {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	code := run(ctx, os.Args[1:], os.Stdout, os.Stderr)
+	cancel()
+	os.Exit(code)
+}
 
-	q := req.URL.Query()
+func run(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("client", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { _, _ = fmt.Fprint(stderr, usage) }
 
-	var startOffset string
-	if start != 0 {
-		startOffset = strconv.Itoa(start)
-	}
-	if startOffset != "" {
-		q.Add("offset", startOffset)
+	address := fs.String("server", envOrDefault("EVENT_STREAM_SERVER", "http://localhost:8080"), "stream server URL (env EVENT_STREAM_SERVER)")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
 	}
 
-	if watch {
-		q.Add("watch", strconv.FormatBool(watch))
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
 	}
 
-	req.URL.RawQuery = q.Encode()
-
-	c := http.Client{
-		Timeout: time.Second * 10, // will also terminate watch after this time
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		_, _ = fmt.Fprintf(stderr, "unknown command %q\n\n", fs.Arg(0))
+		fs.Usage()
+		return exitUsage
 	}
-	res, err := c.Do(req)
+
+	c, err := client.New(*address)
 	if err != nil {
-		l.Fatal("could not send request", zap.Error(err))
+		_, _ = fmt.Fprintf(stderr, "error: %v\n", err)
+		return exitUsage
 	}
-	defer func() {
-		if err = res.Body.Close(); err != nil {
-			l.Error("could not close response body", zap.Error(err))
+
+	if err = cmd(ctx, c, fs.Args()[1:], stdout, stderr); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
 		}
-	}()
 
-	if res.StatusCode > 299 {
-		l.Fatal("could not read event stream", zap.Int("statusCode", res.StatusCode))
+		code := exitCode(err)
+		if code != exitOK {
+			_, _ = fmt.Fprintf(stderr, "error: %v\n", err)
+		}
+		return code
 	}
 
-	scanner := bufio.NewScanner(res.Body)
-	for scanner.Scan() {
-		l.Debug("received new event", zap.String("event", scanner.Text()))
+	return exitOK
+}
+
+// exitCode maps an error to the process exit code
+func exitCode(err error) int {
+	var (
+		uerr *usageError
+		serr *client.StatusError
+	)
+
+	switch {
+	case err == nil, errors.Is(err, context.Canceled):
+		return exitOK
+	case errors.As(err, &uerr):
+		return exitUsage
+	case errors.Is(err, client.ErrEmptyLog), errors.Is(err, client.ErrFutureOffset):
+		return exitNotFound
+	case errors.Is(err, client.ErrOutOfRange):
+		return exitOutOfRange
+	case errors.As(err, &serr):
+		if serr.Code >= 500 {
+			return exitServerError
+		}
+		return exitError
+	case isConnectionError(err):
+		return exitServerError
+	default:
+		return exitError
 	}
+}
 
-	if scanner.Err() != nil {
-		l.Fatal("could not read response body", zap.Error(scanner.Err()))
+func envOrDefault(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
 	}
+	return def
 }
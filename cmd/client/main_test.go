@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+
+	"github.com/embano1/vsphere-event-streaming/client"
+)
+
+func Test_exitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "no error", err: nil, want: exitOK},
+		{name: "canceled", err: fmt.Errorf("watch events: %w", context.Canceled), want: exitOK},
+		{name: "usage", err: &usageError{msg: "invalid"}, want: exitUsage},
+		{name: "empty log", err: fmt.Errorf("get range: %w", client.ErrEmptyLog), want: exitNotFound},
+		{name: "future offset", err: fmt.Errorf("get event: %w", client.ErrFutureOffset), want: exitNotFound},
+		{name: "out of range", err: fmt.Errorf("get event: %w", client.ErrOutOfRange), want: exitOutOfRange},
+		{name: "server error", err: &client.StatusError{Code: http.StatusInternalServerError}, want: exitServerError},
+		{name: "client error", err: &client.StatusError{Code: http.StatusBadRequest}, want: exitError},
+		{name: "other error", err: errors.New("failed"), want: exitError},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, exitCode(tc.err), tc.want)
+		})
+	}
+}
+
+func Test_run(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/range":
+			_, _ = fmt.Fprint(w, `{"earliest":44,"latest":46}`)
+		case "/api/v1/events/3":
+			http.Error(w, "invalid offset: offset out of range", http.StatusBadRequest)
+		case "/api/v1/events/47":
+			http.Error(w, "invalid offset: future offset", http.StatusBadRequest)
+		case "/api/v1/export":
+			_, _ = fmt.Fprint(w, "{\"id\":\"44\"}\n")
+		default:
+			http.Error(w, "internal error", http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	exported := filepath.Join(t.TempDir(), "events.ndjson")
+
+	tests := []struct {
+		name       string
+		args       []string
+		wantCode   int
+		wantStdout string
+		wantStderr string // contained in stderr
+	}{
+		{name: "no command", args: nil, wantCode: exitUsage},
+		{name: "unknown command", args: []string{"foo"}, wantCode: exitUsage},
+		{name: "help", args: []string{"-h"}, wantCode: exitOK},
+		{name: "range", args: []string{"range", "-o", "table"}, wantCode: exitOK, wantStdout: "EARLIEST  LATEST\n44        46\n"},
+		{name: "get without id", args: []string{"get"}, wantCode: exitUsage},
+		{name: "get invalid flag", args: []string{"get", "-x"}, wantCode: exitUsage, wantStderr: "flag provided but not defined: -x"},
+		{name: "get invalid id", args: []string{"get", "abc"}, wantCode: exitUsage},
+		{name: "get purged event", args: []string{"get", "3"}, wantCode: exitOutOfRange},
+		{name: "get future event", args: []string{"get", "47"}, wantCode: exitNotFound},
+		{name: "get server error", args: []string{"get", "45"}, wantCode: exitServerError},
+		{name: "export to file", args: []string{"export", "-out", exported}, wantCode: exitOK},
+		{name: "watch with from and since", args: []string{"watch", "-from", "1", "-since", "2022-01-14T13:00:00Z"}, wantCode: exitUsage},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			args := append([]string{"-server", ts.URL}, tc.args...)
+
+			code := run(context.Background(), args, &stdout, &stderr)
+			assert.Equal(t, code, tc.wantCode, "stderr: %s", stderr.String())
+			if tc.wantStdout != "" {
+				assert.Equal(t, stdout.String(), tc.wantStdout)
+			}
+			if tc.wantStderr != "" {
+				assert.Assert(t, strings.Contains(stderr.String(), tc.wantStderr), stderr.String())
+			}
+		})
+	}
+
+	b, err := os.ReadFile(exported)
+	assert.NilError(t, err)
+	assert.Equal(t, string(b), "{\"id\":\"44\"}\n")
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"sigs.k8s.io/yaml"
+
+	"github.com/embano1/vsphere-event-streaming/client"
+)
+
+// output formats
+const (
+	outputJSON     = "json"
+	outputYAML     = "yaml"
+	outputTable    = "table"
+	outputTemplate = "template"
+)
+
+const defaultColumns = "offset,time,type,entity,message"
+
+// entity fields in vSphere event data in order of precedence
+var entityFields = []string{"Vm", "Host", "ComputeResource", "Datacenter", "Ds", "Net", "Dvs"}
+
+// row is an event flattened for table and template output
+type row struct {
+	Offset  string
+	Time    string
+	Type    string
+	Class   string
+	Entity  string
+	Message string
+	Event   ce.Event
+	Data    map[string]interface{}
+}
+
+func newRow(e ce.Event) row {
+	r := row{
+		Offset: e.ID(),
+		Type:   e.Type(),
+		Event:  e,
+	}
+
+	if !e.Time().IsZero() {
+		r.Time = e.Time().UTC().Format(time.RFC3339)
+	}
+	if class, ok := e.Extensions()["eventclass"]; ok {
+		r.Class = fmt.Sprint(class)
+	}
+
+	// non-json data is ignored
+	_ = json.Unmarshal(e.Data(), &r.Data)
+
+	for _, field := range entityFields {
+		if name := lookup(r.Data, field+".Name"); name != "" {
+			r.Entity = name
+			break
+		}
+	}
+	r.Message = strings.TrimSpace(lookup(r.Data, "FullFormattedMessage"))
+
+	return r
+}
+
+// column returns the value for a column name or a field path, e.g.
+// "data.Vm.Name"
+func (r row) column(name string) string {
+	switch strings.ToLower(name) {
+	case "offset", "id":
+		return r.Offset
+	case "time":
+		return r.Time
+	case "type":
+		return r.Type
+	case "class", "eventclass":
+		return r.Class
+	case "entity":
+		return r.Entity
+	case "message":
+		return r.Message
+	case "source":
+		return r.Event.Source()
+	}
+
+	if path := strings.TrimPrefix(name, "data."); path != name {
+		return lookup(r.Data, path)
+	}
+
+	return ""
+}
+
+// lookup returns the string representation of the value at the dot-separated
+// path in data or an empty string if it does not exist
+func lookup(data map[string]interface{}, path string) string {
+	var cur interface{} = data
+	for _, key := range strings.Split(path, ".") {
+		switch v := cur.(type) {
+		case map[string]interface{}:
+			cur = v[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return ""
+			}
+			cur = v[i]
+		default:
+			return ""
+		}
+	}
+
+	switch v := cur.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case map[string]interface{}, []interface{}:
+		b, _ := json.Marshal(v)
+		return string(b)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// printer writes events and ranges in the configured output format
+type printer struct {
+	format  string
+	columns []string
+	tmpl    *template.Template
+
+	w      io.Writer
+	tw     *tabwriter.Writer
+	header bool // table header written
+	docs   int  // yaml documents written
+}
+
+func newPrinter(w io.Writer, format, columns, tmpl string) (*printer, error) {
+	p := printer{
+		format: format,
+		w:      w,
+	}
+
+	switch format {
+	case outputJSON, outputYAML:
+	case outputTable:
+		for _, c := range strings.Split(columns, ",") {
+			if c = strings.TrimSpace(c); c != "" {
+				p.columns = append(p.columns, c)
+			}
+		}
+		if len(p.columns) == 0 {
+			return nil, &usageError{msg: "no table columns specified"}
+		}
+		p.tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	case outputTemplate:
+		if tmpl == "" {
+			return nil, &usageError{msg: "template output requires -template"}
+		}
+		t, err := template.New("output").Parse(tmpl)
+		if err != nil {
+			return nil, &usageError{msg: "invalid template: " + err.Error()}
+		}
+		p.tmpl = t
+	default:
+		return nil, &usageError{msg: fmt.Sprintf("invalid output format %q", format)}
+	}
+
+	return &p, nil
+}
+
+// printEvent prints a single event. Table output is buffered; the caller must
+// call flush before exiting.
+func (p *printer) printEvent(e ce.Event) error {
+	switch p.format {
+	case outputJSON:
+		return p.printJSON(e)
+	case outputYAML:
+		return p.printYAML(e)
+	case outputTable:
+		r := newRow(e)
+		values := make([]string, len(p.columns))
+		for i, c := range p.columns {
+			values[i] = sanitize(r.column(c))
+		}
+		return p.printRow(values)
+	default:
+		return p.printTemplate(newRow(e))
+	}
+}
+
+func (p *printer) printRange(r client.Range) error {
+	switch p.format {
+	case outputJSON:
+		return p.printJSON(r)
+	case outputYAML:
+		return p.printYAML(r)
+	case outputTable:
+		p.columns = []string{"earliest", "latest"}
+		return p.printRow([]string{strconv.FormatInt(r.Earliest, 10), strconv.FormatInt(r.Latest, 10)})
+	default:
+		return p.printTemplate(r)
+	}
+}
+
+func (p *printer) printJSON(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal json: %w", err)
+	}
+	_, err = fmt.Fprintln(p.w, string(b))
+	return err
+}
+
+func (p *printer) printYAML(v interface{}) error {
+	b, err := yaml.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal yaml: %w", err)
+	}
+
+	if p.docs > 0 {
+		if _, err = io.WriteString(p.w, "---\n"); err != nil {
+			return err
+		}
+	}
+	p.docs++
+
+	_, err = p.w.Write(b)
+	return err
+}
+
+func (p *printer) printRow(values []string) error {
+	if !p.header {
+		header := make([]string, len(p.columns))
+		for i, c := range p.columns {
+			header[i] = strings.ToUpper(c)
+		}
+		if _, err := fmt.Fprintln(p.tw, strings.Join(header, "\t")); err != nil {
+			return err
+		}
+		p.header = true
+	}
+
+	if _, err := fmt.Fprintln(p.tw, strings.Join(values, "\t")); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (p *printer) printTemplate(v interface{}) error {
+	if err := p.tmpl.Execute(p.w, v); err != nil {
+		return fmt.Errorf("execute template: %w", err)
+	}
+	_, err := fmt.Fprintln(p.w)
+	return err
+}
+
+// flush writes buffered table rows
+func (p *printer) flush() error {
+	if p.tw != nil {
+		return p.tw.Flush()
+	}
+	return nil
+}
+
+// sanitize removes characters breaking the table layout
+func sanitize(s string) string {
+	return strings.NewReplacer("\t", " ", "\n", " ", "\r", "").Replace(s)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"gotest.tools/v3/assert"
+
+	"github.com/embano1/vsphere-event-streaming/client"
+)
+
+func testEvent(t *testing.T) ce.Event {
+	t.Helper()
+
+	e := ce.NewEvent()
+	e.SetID("44")
+	e.SetType("vmware.vsphere.VmPoweredOnEvent.v0")
+	e.SetSource("https://vcenter/sdk")
+	e.SetTime(time.Date(2022, 1, 14, 13, 26, 22, 0, time.UTC))
+	e.SetExtension("eventclass", "event")
+	err := e.SetData(ce.ApplicationJSON, map[string]interface{}{
+		"Key":                  44,
+		"UserName":             "alice",
+		"Host":                 map[string]interface{}{"Name": "esx-01"},
+		"Vm":                   map[string]interface{}{"Name": "vm-web-17"},
+		"FullFormattedMessage": "vm-web-17 on esx-01 is powered on\n",
+		"Tags":                 []interface{}{"a", "b"},
+	})
+	assert.NilError(t, err)
+
+	return e
+}
+
+func Test_lookup(t *testing.T) {
+	r := newRow(testEvent(t))
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "UserName", want: "alice"},
+		{path: "Key", want: "44"},
+		{path: "Vm.Name", want: "vm-web-17"},
+		{path: "Tags.1", want: "b"},
+		{path: "Tags.5", want: ""},
+		{path: "Host", want: `{"Name":"esx-01"}`},
+		{path: "Ds.Name", want: ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.path, func(t *testing.T) {
+			assert.Equal(t, lookup(r.Data, tc.path), tc.want)
+		})
+	}
+}
+
+func Test_printer(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		columns  string
+		template string
+		want     string
+		wantErr  string
+	}{
+		{
+			name:   "json",
+			format: outputJSON,
+			want:   `{"specversion":"1.0","id":"44",`,
+		},
+		{
+			name:   "yaml",
+			format: outputYAML,
+			want:   "data:\n  FullFormattedMessage: |\n    vm-web-17 on esx-01 is powered on\n",
+		},
+		{
+			name:    "table with default columns",
+			format:  outputTable,
+			columns: defaultColumns,
+			want: "OFFSET  TIME                  TYPE                                ENTITY     MESSAGE\n" +
+				"44      2022-01-14T13:26:22Z  vmware.vsphere.VmPoweredOnEvent.v0  vm-web-17  vm-web-17 on esx-01 is powered on\n",
+		},
+		{
+			name:    "table with field path columns",
+			format:  outputTable,
+			columns: "offset, data.UserName,data.Host.Name,class",
+			want: "OFFSET  DATA.USERNAME  DATA.HOST.NAME  CLASS\n" +
+				"44      alice          esx-01          event\n",
+		},
+		{
+			name:     "template",
+			format:   outputTemplate,
+			template: "{{.Offset}} {{.Event.Type}} {{.Data.UserName}}",
+			want:     "44 vmware.vsphere.VmPoweredOnEvent.v0 alice\n",
+		},
+		{
+			name:    "table without columns",
+			format:  outputTable,
+			columns: " , ",
+			wantErr: "no table columns specified",
+		},
+		{
+			name:    "template without template",
+			format:  outputTemplate,
+			wantErr: "template output requires -template",
+		},
+		{
+			name:     "invalid template",
+			format:   outputTemplate,
+			template: "{{.Offset",
+			wantErr:  "invalid template",
+		},
+		{
+			name:    "invalid format",
+			format:  "xml",
+			wantErr: `invalid output format "xml"`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var b bytes.Buffer
+			p, err := newPrinter(&b, tc.format, tc.columns, tc.template)
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				assert.Equal(t, exitCode(err), exitUsage)
+				return
+			}
+			assert.NilError(t, err)
+
+			assert.NilError(t, p.printEvent(testEvent(t)))
+			assert.NilError(t, p.flush())
+
+			switch tc.format {
+			case outputJSON, outputYAML:
+				assert.Assert(t, bytes.Contains(b.Bytes(), []byte(tc.want)), "got %q", b.String())
+			default:
+				assert.Equal(t, b.String(), tc.want)
+			}
+		})
+	}
+}
+
+func Test_printerRange(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{format: outputJSON, want: "{\"earliest\":44,\"latest\":46}\n"},
+		{format: outputYAML, want: "earliest: 44\nlatest: 46\n"},
+		{format: outputTable, want: "EARLIEST  LATEST\n44        46\n"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.format, func(t *testing.T) {
+			var b bytes.Buffer
+			p, err := newPrinter(&b, tc.format, defaultColumns, "")
+			assert.NilError(t, err)
+
+			assert.NilError(t, p.printRange(client.Range{Earliest: 44, Latest: 46}))
+			assert.NilError(t, p.flush())
+			assert.Equal(t, b.String(), tc.want)
+		})
+	}
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/embano1/memlog"
+	"github.com/embano1/vsphere/logger"
+	"github.com/julienschmidt/httprouter"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+	"go.uber.org/zap"
+
+	"github.com/embano1/vsphere-event-streaming/events"
+)
+
+const activityBatchSize = 50 // tasks read per poll
+
+// alarm state changes
+const (
+	alarmTriggered = "triggered"
+	alarmChanged   = "changed"
+	alarmCleared   = "cleared"
+)
+
+// newActivityServer returns the server of the activity log with the log
+// settings of srv. The activity log contains vCenter task and alarm state
+// changes. It is separate from the event log because its records do not have a
+// vCenter event key to use as offset.
+func newActivityServer(srv *server) *server {
+	a := server{
+		ready:     make(chan struct{}),
+		retention: srv.retention,
+		codec:     srv.codec,
+	}
+	a.times = newTimeIndex(timeIndexInterval)
+	a.indexers = []indexer{a.times}
+	return &a
+}
+
+// activityRoute serves the handler for the activity log or 404 if tasks and
+// alarms are not collected
+func (s *server) activityRoute(ctx context.Context, h func(*server, context.Context) httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if !s.collectsActivity() {
+			notFound(w, "task and alarm collection is disabled")
+			return
+		}
+		s.activity.whenReady(h(s.activity, ctx))(w, r, ps)
+	}
+}
+
+// collectsActivity returns whether tasks or alarms are collected with the
+// current configuration
+func (s *server) collectsActivity() bool {
+	if s.activity == nil {
+		return false
+	}
+	if s.reloader == nil {
+		return true
+	}
+	vc := s.reloader.config().VCenter
+	return vc.Tasks || vc.Alarms
+}
+
+// appendNext writes the event with the next offset as its id to the log
+func (s *server) appendNext(ctx context.Context, e *ce.Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e.SetID(strconv.FormatInt(int64(s.nextOffset(ctx)), 10))
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("marshal cloudevent to JSON: %w", err)
+	}
+	return s.write(ctx, e, b)
+}
+
+// taskReader reads new tasks from a vCenter task history collector
+type taskReader interface {
+	ReadNextTasks(ctx context.Context, maxCount int32) ([]types.TaskInfo, error)
+}
+
+// taskInfoFunc returns the current info of the tasks. Tasks no longer
+// available in vCenter are omitted.
+type taskInfoFunc func(ctx context.Context, refs []types.ManagedObjectReference) ([]types.TaskInfo, error)
+
+// taskTracker returns the task state changes. New tasks are read from the task
+// history collector and the info of unfinished tasks is refreshed on each poll.
+type taskTracker struct {
+	collector taskReader
+	refresh   taskInfoFunc
+	pending   map[types.ManagedObjectReference]types.TaskInfoState // unfinished tasks
+	finished  map[types.ManagedObjectReference]bool                // recorded before, skipped when read again
+}
+
+// newTaskTracker returns a task tracker continuing with the last recorded task
+// infos, e.g. after a restart of the collector. The collector must start with
+// the tasks queued at the latest recorded queue time.
+func newTaskTracker(collector taskReader, refresh taskInfoFunc, recorded map[types.ManagedObjectReference]types.TaskInfo) *taskTracker {
+	t := taskTracker{
+		collector: collector,
+		refresh:   refresh,
+		pending:   make(map[types.ManagedObjectReference]types.TaskInfoState),
+		finished:  make(map[types.ManagedObjectReference]bool),
+	}
+
+	var last time.Time
+	for _, info := range recorded {
+		if info.QueueTime.After(last) {
+			last = info.QueueTime
+		}
+	}
+	for ref, info := range recorded {
+		switch info.State {
+		case types.TaskInfoStateSuccess, types.TaskInfoStateError:
+			// earlier tasks are not read again
+			if info.QueueTime.Equal(last) {
+				t.finished[ref] = true
+			}
+		default:
+			t.pending[ref] = info.State
+		}
+	}
+	return &t
+}
+
+// poll returns the new tasks and tasks with a changed state since the last
+// poll
+func (t *taskTracker) poll(ctx context.Context) ([]types.TaskInfo, error) {
+	var changed []types.TaskInfo
+
+	if len(t.pending) > 0 {
+		refs := make([]types.ManagedObjectReference, 0, len(t.pending))
+		for ref := range t.pending {
+			refs = append(refs, ref)
+		}
+		sort.Slice(refs, func(i, j int) bool {
+			return refs[i].Value < refs[j].Value
+		})
+
+		infos, err := t.refresh(ctx, refs)
+		if err != nil {
+			return nil, fmt.Errorf("refresh tasks: %w", err)
+		}
+
+		current := make(map[types.ManagedObjectReference]bool, len(infos))
+		for _, info := range infos {
+			current[info.Task] = true
+			if info.State != t.pending[info.Task] {
+				changed = append(changed, info)
+			}
+			t.track(info)
+		}
+
+		// removed from vCenter, e.g. expired after completion
+		for ref := range t.pending {
+			if !current[ref] {
+				delete(t.pending, ref)
+			}
+		}
+	}
+
+	tasks, err := t.collector.ReadNextTasks(ctx, activityBatchSize)
+	if err != nil {
+		return nil, fmt.Errorf("read tasks: %w", err)
+	}
+	for _, info := range tasks {
+		if _, ok := t.pending[info.Task]; ok {
+			continue
+		}
+		if t.finished[info.Task] {
+			// read once by the collector
+			delete(t.finished, info.Task)
+			continue
+		}
+		changed = append(changed, info)
+		t.track(info)
+	}
+
+	return changed, nil
+}
+
+// track adds unfinished tasks to the pending tasks
+func (t *taskTracker) track(info types.TaskInfo) {
+	switch info.State {
+	case types.TaskInfoStateSuccess, types.TaskInfoStateError:
+		delete(t.pending, info.Task)
+	default:
+		t.pending[info.Task] = info.State
+	}
+}
+
+// alarmStateFunc returns the triggered alarm states
+type alarmStateFunc func(ctx context.Context) ([]types.AlarmState, error)
+
+type alarmChange struct {
+	change string
+	state  types.AlarmState
+}
+
+// alarmTracker returns the changes of triggered alarm states between polls
+type alarmTracker struct {
+	states alarmStateFunc
+	last   map[string]types.AlarmState // by alarm state key
+}
+
+// newAlarmTracker returns an alarm tracker continuing with the recorded
+// triggered alarm states, e.g. after a restart of the collector
+func newAlarmTracker(states alarmStateFunc, recorded map[string]types.AlarmState) *alarmTracker {
+	last := make(map[string]types.AlarmState, len(recorded))
+	for key, state := range recorded {
+		last[key] = state
+	}
+	return &alarmTracker{
+		states: states,
+		last:   last,
+	}
+}
+
+// poll returns the triggered, changed (status or acknowledgement) and cleared
+// alarm states since the last poll. All triggered alarm states not recorded
+// before are returned on the first poll.
+func (a *alarmTracker) poll(ctx context.Context) ([]alarmChange, error) {
+	states, err := a.states(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("read triggered alarm states: %w", err)
+	}
+
+	var changes []alarmChange
+	current := make(map[string]types.AlarmState, len(states))
+	for _, state := range states {
+		current[state.Key] = state
+
+		prev, ok := a.last[state.Key]
+		switch {
+		case !ok:
+			changes = append(changes, alarmChange{change: alarmTriggered, state: state})
+		case prev.OverallStatus != state.OverallStatus || boolValue(prev.Acknowledged) != boolValue(state.Acknowledged):
+			changes = append(changes, alarmChange{change: alarmChanged, state: state})
+		}
+	}
+
+	var cleared []string
+	for key := range a.last {
+		if _, ok := current[key]; !ok {
+			cleared = append(cleared, key)
+		}
+	}
+	sort.Strings(cleared)
+	for _, key := range cleared {
+		changes = append(changes, alarmChange{change: alarmCleared, state: a.last[key]})
+	}
+
+	a.last = current
+	return changes, nil
+}
+
+func boolValue(b *bool) bool {
+	return b != nil && *b
+}
+
+// recordedActivity is the task and alarm state recorded in the activity log
+type recordedActivity struct {
+	tasks      map[types.ManagedObjectReference]types.TaskInfo // last recorded info
+	lastQueued time.Time                                       // latest queue time of recorded tasks
+	alarms     map[string]types.AlarmState                     // triggered alarm states by key
+}
+
+// recordedActivity returns the task and alarm state recorded in the activity
+// log to continue collecting without duplicate records. Records purged by the
+// retention policy are not considered.
+func (s *server) recordedActivity(ctx context.Context) (recordedActivity, error) {
+	ra := recordedActivity{
+		tasks:  make(map[types.ManagedObjectReference]types.TaskInfo),
+		alarms: make(map[string]types.AlarmState),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	earliest, latest := s.log.Range(ctx)
+	if latest == -1 {
+		return ra, nil
+	}
+
+	cleared := events.Type(events.ClassAlarm + "." + alarmCleared)
+	for offset := earliest; offset <= latest; offset++ {
+		rec, err := s.log.Read(ctx, offset)
+		if err != nil {
+			if errors.Is(err, memlog.ErrOutOfRange) {
+				// purged in between
+				continue
+			}
+			return recordedActivity{}, fmt.Errorf("read record %d: %w", offset, err)
+		}
+
+		var e ce.Event
+		if err = json.Unmarshal(rec.Data, &e); err != nil {
+			return recordedActivity{}, fmt.Errorf("decode record %d: %w", offset, err)
+		}
+
+		switch class, _ := e.Extensions()[events.ClassExtension].(string); class {
+		case events.ClassTask:
+			info, err := events.DecodeTask(e)
+			if err != nil {
+				return recordedActivity{}, fmt.Errorf("decode record %d: %w", offset, err)
+			}
+			ra.tasks[info.Task] = *info
+			if info.QueueTime.After(ra.lastQueued) {
+				ra.lastQueued = info.QueueTime
+			}
+		case events.ClassAlarm:
+			state, err := events.DecodeAlarm(e)
+			if err != nil {
+				return recordedActivity{}, fmt.Errorf("decode record %d: %w", offset, err)
+			}
+			if e.Type() == cleared {
+				delete(ra.alarms, state.Key)
+				continue
+			}
+			ra.alarms[state.Key] = *state
+		}
+	}
+
+	return ra, nil
+}
+
+// taskEvent converts the task info to a cloudevent of the task class with the
+// task state in the type, e.g. com.vmware.vsphere.task.success.v0
+func taskEvent(source string, info types.TaskInfo) (ce.Event, error) {
+	t := info.QueueTime
+	switch {
+	case info.CompleteTime != nil:
+		t = *info.CompleteTime
+	case info.StartTime != nil:
+		t = *info.StartTime
+	}
+
+	var subject string
+	if info.Entity != nil {
+		subject = info.Entity.Value
+	}
+	return activityEvent(source, events.ClassTask, string(info.State), subject, t, info)
+}
+
+// alarmEvent converts the alarm state change to a cloudevent of the alarm
+// class with the change in the type, e.g. com.vmware.vsphere.alarm.triggered.v0
+func alarmEvent(source string, c alarmChange, now time.Time) (ce.Event, error) {
+	t := c.state.Time
+	if c.change == alarmCleared {
+		t = now
+	}
+	return activityEvent(source, events.ClassAlarm, c.change, c.state.Entity.Value, t, c.state)
+}
+
+func activityEvent(source, class, change, subject string, t time.Time, data interface{}) (ce.Event, error) {
+	e := ce.NewEvent()
+	e.SetSource(source)
+	e.SetType(events.Type(class + "." + change))
+	e.SetTime(t)
+	e.SetExtension(events.ClassExtension, class)
+	if subject != "" {
+		e.SetSubject(subject)
+	}
+
+	if err := e.SetData(ce.ApplicationJSON, data); err != nil {
+		return ce.Event{}, fmt.Errorf("marshal %s to cloudevent data: %w", class, err)
+	}
+	return e, nil
+}
+
+// collectActivity writes vCenter task state changes starting with tasks queued
+// at begin and triggered alarm state changes to the activity log until the
+// context is cancelled or swap is closed. On swap errCollectorSwap is returned
+// after writing the current batch. A restarted collector continues with the
+// task and alarm state recorded in the activity log, starting with the last
+// recorded task.
+func collectActivity(ctx context.Context, srv *server, cfg config, begin time.Time, swap <-chan struct{}) error {
+	l := logger.Get(ctx)
+	a := srv.activity
+
+	if !cfg.VCenter.Tasks && !cfg.VCenter.Alarms {
+		// until enabled on reload
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-swap:
+			return errCollectorSwap
+		}
+	}
+
+	if err := a.initializeLog(ctx, 0, cfg.Log.MaxSegmentSize, cfg.Log.MaxRecordSize); err != nil {
+		return fmt.Errorf("initialize activity log: %w", err)
+	}
+
+	recorded, err := a.recordedActivity(ctx)
+	if err != nil {
+		return fmt.Errorf("read activity log: %w", err)
+	}
+	if !recorded.lastQueued.IsZero() {
+		begin = recorded.lastQueued
+	}
+
+	root := srv.vc.SOAP.ServiceContent.RootFolder
+	source := srv.vc.SOAP.URL().String()
+	pc := property.DefaultCollector(srv.vc.SOAP.Client)
+
+	var tasks *taskTracker
+	if cfg.VCenter.Tasks {
+		collector, err := srv.vc.Tasks.CreateCollectorForTasks(ctx, types.TaskFilterSpec{
+			Entity: &types.TaskFilterSpecByEntity{
+				Entity:    root,
+				Recursion: types.TaskFilterSpecRecursionOptionAll,
+			},
+			Time: &types.TaskFilterSpecByTime{
+				TimeType:  types.TaskFilterSpecTimeOptionQueuedTime,
+				BeginTime: types.NewTime(begin),
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("create task collector: %w", err)
+		}
+		defer func() {
+			// not bound to ctx to release the collector on cancellation
+			if err := collector.Destroy(context.Background()); err != nil {
+				l.Warn("could not destroy task collector", zap.Error(err))
+			}
+		}()
+		tasks = newTaskTracker(collector, taskInfos(pc), recorded.tasks)
+	}
+
+	var alarms *alarmTracker
+	if cfg.VCenter.Alarms {
+		alarms = newAlarmTracker(triggeredAlarms(pc, root), recorded.alarms)
+	}
+
+	l.Info("starting vsphere task and alarm collector",
+		zap.Bool("tasks", tasks != nil),
+		zap.Bool("alarms", alarms != nil),
+		zap.Time("begin", begin),
+	)
+	ticker := time.NewTicker(cfg.Collector.PollInterval.Duration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-swap:
+			l.Info("swapping vsphere task and alarm collector")
+			return errCollectorSwap
+		case <-ticker.C:
+			var records []ce.Event
+
+			if tasks != nil {
+				infos, err := tasks.poll(ctx)
+				if err != nil {
+					return err
+				}
+				for _, info := range infos {
+					e, err := taskEvent(source, info)
+					if err != nil {
+						return err
+					}
+					records = append(records, e)
+				}
+			}
+
+			if alarms != nil {
+				changes, err := alarms.poll(ctx)
+				if err != nil {
+					return err
+				}
+				now := time.Now().UTC()
+				for _, c := range changes {
+					e, err := alarmEvent(source, c, now)
+					if err != nil {
+						return err
+					}
+					records = append(records, e)
+				}
+			}
+
+			for i := range records {
+				if err := a.appendNext(ctx, &records[i]); err != nil {
+					return fmt.Errorf("write to activity log: %w", err)
+				}
+				l.Debug("wrote cloudevent to activity log", zap.String("event", records[i].String()))
+			}
+		}
+	}
+}
+
+// taskInfos returns the current info of tasks with the property collector.
+// The tasks are retrieved with a single call unless a task has been removed
+// from vCenter, which fails the call for all tasks.
+func taskInfos(pc *property.Collector) taskInfoFunc {
+	return func(ctx context.Context, refs []types.ManagedObjectReference) ([]types.TaskInfo, error) {
+		var tasks []mo.Task
+		err := pc.Retrieve(ctx, refs, []string{"info"}, &tasks)
+		if err != nil && !isNotFound(err) {
+			return nil, err
+		}
+
+		if err != nil {
+			tasks = tasks[:0]
+			for _, ref := range refs {
+				var task mo.Task
+				if err = pc.RetrieveOne(ctx, ref, []string{"info"}, &task); err != nil {
+					if isNotFound(err) {
+						continue
+					}
+					return nil, err
+				}
+				tasks = append(tasks, task)
+			}
+		}
+
+		infos := make([]types.TaskInfo, 0, len(tasks))
+		for _, task := range tasks {
+			infos = append(infos, task.Info)
+		}
+		return infos, nil
+	}
+}
+
+// triggeredAlarms returns the triggered alarm states of the root folder which
+// include the alarms triggered on all inventory objects
+func triggeredAlarms(pc *property.Collector, root types.ManagedObjectReference) alarmStateFunc {
+	return func(ctx context.Context) ([]types.AlarmState, error) {
+		var folder mo.Folder
+		if err := pc.RetrieveOne(ctx, root, []string{"triggeredAlarmState"}, &folder); err != nil {
+			return nil, err
+		}
+		return folder.TriggeredAlarmState, nil
+	}
+}
+
+func isNotFound(err error) bool {
+	if !soap.IsSoapFault(err) {
+		return false
+	}
+	_, ok := soap.ToSoapFault(err).VimFault().(types.ManagedObjectNotFound)
+	return ok
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/embano1/vsphere/logger"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/types"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/v3/assert"
+
+	"github.com/embano1/vsphere-event-streaming/events"
+)
+
+type fakeTaskReader struct {
+	batches [][]types.TaskInfo
+}
+
+func (f *fakeTaskReader) ReadNextTasks(_ context.Context, _ int32) ([]types.TaskInfo, error) {
+	if len(f.batches) == 0 {
+		return nil, nil
+	}
+	batch := f.batches[0]
+	f.batches = f.batches[1:]
+	return batch, nil
+}
+
+func Test_taskTracker(t *testing.T) {
+	ctx := context.Background()
+
+	task := func(id string, state types.TaskInfoState) types.TaskInfo {
+		return types.TaskInfo{
+			Key:   id,
+			Task:  types.ManagedObjectReference{Type: "Task", Value: id},
+			State: state,
+		}
+	}
+
+	// current state of tasks in vCenter
+	current := map[string]types.TaskInfo{}
+	refresh := func(_ context.Context, refs []types.ManagedObjectReference) ([]types.TaskInfo, error) {
+		var infos []types.TaskInfo
+		for _, ref := range refs {
+			if info, ok := current[ref.Value]; ok {
+				infos = append(infos, info)
+			}
+		}
+		return infos, nil
+	}
+
+	collector := fakeTaskReader{batches: [][]types.TaskInfo{
+		{task("task-1", types.TaskInfoStateQueued), task("task-2", types.TaskInfoStateSuccess)},
+		{task("task-3", types.TaskInfoStateRunning)},
+	}}
+	tracker := newTaskTracker(&collector, refresh, nil)
+
+	states := func(infos []types.TaskInfo) []string {
+		var got []string
+		for _, info := range infos {
+			got = append(got, info.Key+"="+string(info.State))
+		}
+		return got
+	}
+
+	got, err := tracker.poll(ctx)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, states(got), []string{"task-1=queued", "task-2=success"})
+
+	current["task-1"] = task("task-1", types.TaskInfoStateRunning)
+	got, err = tracker.poll(ctx)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, states(got), []string{"task-1=running", "task-3=running"})
+
+	// task-3 removed from vCenter
+	current["task-1"] = task("task-1", types.TaskInfoStateError)
+	got, err = tracker.poll(ctx)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, states(got), []string{"task-1=error"})
+	assert.Equal(t, len(tracker.pending), 0)
+
+	got, err = tracker.poll(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, len(got), 0)
+
+	t.Run("continues with recorded tasks", func(t *testing.T) {
+		queued := func(info types.TaskInfo, at time.Time) types.TaskInfo {
+			info.QueueTime = at
+			return info
+		}
+
+		begin := time.Now().UTC()
+		recorded := map[types.ManagedObjectReference]types.TaskInfo{}
+		for _, info := range []types.TaskInfo{
+			queued(task("task-4", types.TaskInfoStateSuccess), begin.Add(-time.Minute)),
+			queued(task("task-5", types.TaskInfoStateRunning), begin.Add(-time.Minute)),
+			queued(task("task-6", types.TaskInfoStateSuccess), begin),
+		} {
+			recorded[info.Task] = info
+		}
+
+		// collector starts with the tasks queued at begin
+		collector := fakeTaskReader{batches: [][]types.TaskInfo{
+			{queued(task("task-6", types.TaskInfoStateSuccess), begin), queued(task("task-7", types.TaskInfoStateQueued), begin)},
+		}}
+		tracker := newTaskTracker(&collector, refresh, recorded)
+		assert.Equal(t, len(tracker.finished), 1)
+
+		current["task-5"] = task("task-5", types.TaskInfoStateSuccess)
+		got, err := tracker.poll(ctx)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, states(got), []string{"task-5=success", "task-7=queued"})
+		assert.Equal(t, len(tracker.finished), 0)
+	})
+}
+
+func Test_taskInfos(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		vms, err := find.NewFinder(c).VirtualMachineList(ctx, "*")
+		assert.NilError(t, err)
+
+		var refs []types.ManagedObjectReference
+		for _, vm := range vms[:2] {
+			task, err := vm.PowerOff(ctx)
+			assert.NilError(t, err)
+			assert.NilError(t, task.Wait(ctx))
+			refs = append(refs, task.Reference())
+		}
+
+		infos := taskInfos(property.DefaultCollector(c))
+
+		got, err := infos(ctx, refs)
+		assert.NilError(t, err)
+		assert.Equal(t, len(got), 2)
+		assert.Equal(t, got[0].State, types.TaskInfoStateSuccess)
+
+		// removed from vCenter
+		missing := types.ManagedObjectReference{Type: "Task", Value: "task-404"}
+		got, err = infos(ctx, []types.ManagedObjectReference{refs[0], missing, refs[1]})
+		assert.NilError(t, err)
+		assert.Equal(t, len(got), 2)
+		assert.Equal(t, got[0].Task, refs[0])
+		assert.Equal(t, got[1].Task, refs[1])
+	})
+}
+
+func Test_alarmTracker(t *testing.T) {
+	ctx := context.Background()
+	acknowledged := true
+
+	alarm := func(key string, status types.ManagedEntityStatus) types.AlarmState {
+		return types.AlarmState{
+			Key:           key,
+			Entity:        types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-1"},
+			OverallStatus: status,
+		}
+	}
+
+	var current []types.AlarmState
+	tracker := newAlarmTracker(func(context.Context) ([]types.AlarmState, error) {
+		return current, nil
+	}, nil)
+
+	changes := func(got []alarmChange) []string {
+		var s []string
+		for _, c := range got {
+			s = append(s, c.state.Key+"="+c.change)
+		}
+		return s
+	}
+
+	current = []types.AlarmState{alarm("alarm-1", types.ManagedEntityStatusYellow), alarm("alarm-2", types.ManagedEntityStatusRed)}
+	got, err := tracker.poll(ctx)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, changes(got), []string{"alarm-1=triggered", "alarm-2=triggered"})
+
+	got, err = tracker.poll(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, len(got), 0)
+
+	acked := alarm("alarm-2", types.ManagedEntityStatusRed)
+	acked.Acknowledged = &acknowledged
+	current = []types.AlarmState{alarm("alarm-1", types.ManagedEntityStatusRed), acked, alarm("alarm-3", types.ManagedEntityStatusYellow)}
+	got, err = tracker.poll(ctx)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, changes(got), []string{"alarm-1=changed", "alarm-2=changed", "alarm-3=triggered"})
+
+	current = []types.AlarmState{alarm("alarm-3", types.ManagedEntityStatusYellow)}
+	got, err = tracker.poll(ctx)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, changes(got), []string{"alarm-1=cleared", "alarm-2=cleared"})
+
+	t.Run("continues with recorded alarms", func(t *testing.T) {
+		recorded := map[string]types.AlarmState{
+			"alarm-3": alarm("alarm-3", types.ManagedEntityStatusYellow),
+			"alarm-4": alarm("alarm-4", types.ManagedEntityStatusRed),
+		}
+		tracker := newAlarmTracker(func(context.Context) ([]types.AlarmState, error) {
+			return current, nil
+		}, recorded)
+
+		current = []types.AlarmState{alarm("alarm-3", types.ManagedEntityStatusYellow), alarm("alarm-5", types.ManagedEntityStatusRed)}
+		got, err := tracker.poll(ctx)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, changes(got), []string{"alarm-5=triggered", "alarm-4=cleared"})
+	})
+}
+
+func Test_recordedActivity(t *testing.T) {
+	ctx := logger.Set(context.Background(), zaptest.NewLogger(t))
+	begin := time.Now().UTC().Add(-time.Hour)
+
+	srv := server{}
+	a := newActivityServer(&srv)
+	assert.NilError(t, a.initializeLog(ctx, 0, 100, 4096))
+
+	got, err := a.recordedActivity(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, len(got.tasks), 0)
+	assert.Assert(t, got.lastQueued.IsZero())
+
+	task := func(id string, state types.TaskInfoState, queued time.Time) ce.Event {
+		e, err := taskEvent("/test/source", types.TaskInfo{
+			Key:       id,
+			Task:      types.ManagedObjectReference{Type: "Task", Value: id},
+			State:     state,
+			QueueTime: queued,
+		})
+		assert.NilError(t, err)
+		return e
+	}
+	alarm := func(key, change string) ce.Event {
+		e, err := alarmEvent("/test/source", alarmChange{
+			change: change,
+			state: types.AlarmState{
+				Key:           key,
+				Entity:        types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-1"},
+				OverallStatus: types.ManagedEntityStatusRed,
+				Time:          begin,
+			},
+		}, begin)
+		assert.NilError(t, err)
+		return e
+	}
+
+	for _, e := range []ce.Event{
+		task("task-1", types.TaskInfoStateRunning, begin),
+		alarm("alarm-1", alarmTriggered),
+		alarm("alarm-2", alarmTriggered),
+		task("task-2", types.TaskInfoStateQueued, begin.Add(time.Minute)),
+		task("task-1", types.TaskInfoStateSuccess, begin),
+		alarm("alarm-1", alarmCleared),
+		alarm("alarm-2", alarmChanged),
+	} {
+		assert.NilError(t, a.appendNext(ctx, &e))
+	}
+
+	got, err = a.recordedActivity(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, len(got.tasks), 2)
+	assert.Equal(t, got.tasks[types.ManagedObjectReference{Type: "Task", Value: "task-1"}].State, types.TaskInfoStateSuccess)
+	assert.Equal(t, got.tasks[types.ManagedObjectReference{Type: "Task", Value: "task-2"}].State, types.TaskInfoStateQueued)
+	assert.Assert(t, got.lastQueued.Equal(begin.Add(time.Minute)))
+	assert.Equal(t, len(got.alarms), 1)
+	assert.Equal(t, got.alarms["alarm-2"].OverallStatus, types.ManagedEntityStatusRed)
+}
+
+func Test_activityLog(t *testing.T) {
+	ctx := logger.Set(context.Background(), zaptest.NewLogger(t))
+	now := time.Now().UTC()
+
+	srv := server{}
+	srv.activity = newActivityServer(&srv)
+
+	t.Run("disabled", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/activity/range", nil)
+		(&server{}).routes(ctx).ServeHTTP(rec, req)
+		assert.Equal(t, rec.Code, http.StatusNotFound)
+	})
+
+	t.Run("not ready", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/activity/range", nil)
+		srv.routes(ctx).ServeHTTP(rec, req)
+		assert.Equal(t, rec.Code, http.StatusServiceUnavailable)
+		assert.Equal(t, rec.Header().Get("Content-Type"), contentTypeProblem)
+	})
+
+	assert.NilError(t, srv.activity.initializeLog(ctx, 0, 100, 4096))
+
+	start := now.Add(-time.Minute)
+	e, err := taskEvent("/test/source", types.TaskInfo{
+		Key:           "task-1",
+		Task:          types.ManagedObjectReference{Type: "Task", Value: "task-1"},
+		Entity:        &types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-1"},
+		State:         types.TaskInfoStateRunning,
+		QueueTime:     start.Add(-time.Second),
+		StartTime:     &start,
+		DescriptionId: "VirtualMachine.powerOn",
+	})
+	assert.NilError(t, err)
+	assert.NilError(t, srv.activity.appendNext(ctx, &e))
+
+	a, err := alarmEvent("/test/source", alarmChange{
+		change: alarmCleared,
+		state: types.AlarmState{
+			Key:    "alarm-1",
+			Entity: types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-1"},
+			Time:   start,
+		},
+	}, now)
+	assert.NilError(t, err)
+	assert.NilError(t, srv.activity.appendNext(ctx, &a))
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/activity/events", nil)
+	srv.routes(ctx).ServeHTTP(rec, req)
+	assert.Equal(t, rec.Code, http.StatusOK)
+
+	var got []ce.Event
+	assert.NilError(t, json.NewDecoder(rec.Body).Decode(&got))
+	assert.Equal(t, len(got), 2)
+
+	assert.Equal(t, got[0].ID(), "0")
+	assert.Equal(t, got[0].Type(), "com.vmware.vsphere.task.running.v0")
+	assert.Equal(t, got[0].Subject(), "vm-1")
+	assert.Assert(t, got[0].Time().Equal(start))
+	info, err := events.DecodeTask(got[0])
+	assert.NilError(t, err)
+	assert.Equal(t, info.DescriptionId, "VirtualMachine.powerOn")
+
+	assert.Equal(t, got[1].ID(), "1")
+	assert.Equal(t, got[1].Type(), "com.vmware.vsphere.alarm.cleared.v0")
+	assert.Assert(t, got[1].Time().Equal(now))
+	state, err := events.DecodeAlarm(got[1])
+	assert.NilError(t, err)
+	assert.Equal(t, state.Key, "alarm-1")
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/embano1/memlog"
+	"github.com/embano1/vsphere/logger"
+	"go.uber.org/zap"
+)
+
+const idsKey = "ids"
+
+// batchResponse contains the events requested by id in request order and the
+// requested ids which are not in the log. It is served as application/json
+// since it wraps the CloudEvents batch with the missing ids.
+type batchResponse struct {
+	Events  []json.RawMessage `json:"events"` // CloudEvents JSON batch
+	Missing []batchMissing    `json:"missing"`
+}
+
+// batchMissing is a requested id with the error code of reading it, i.e.
+// offset_out_of_range for purged or offset_in_future for unwritten records
+type batchMissing struct {
+	ID   memlog.Offset `json:"id"`
+	Code string        `json:"code"`
+}
+
+// parseIDs parses a comma-separated list of at most pageSize event ids
+func parseIDs(val string) ([]memlog.Offset, error) {
+	fields := strings.Split(val, ",")
+	if len(fields) > pageSize {
+		return nil, fmt.Errorf("invalid ids parameter: at most %d ids", pageSize)
+	}
+
+	ids := make([]memlog.Offset, 0, len(fields))
+	for _, f := range fields {
+		id, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || id < 0 {
+			return nil, fmt.Errorf("invalid ids parameter: %q is not an event id", f)
+		}
+		ids = append(ids, memlog.Offset(id))
+	}
+	return ids, nil
+}
+
+// batchGet returns the events with the ids in the "ids" parameter, e.g.
+// ids=1,5,9, reading the decompressed records from the log
+func (s *server) batchGet(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := logger.Get(ctx)
+
+	if r.FormValue(sinceKey) != "" || r.FormValue(offsetKey) != "" {
+		invalidParameter(w, "ids parameter is mutually exclusive with offset and since")
+		return
+	}
+
+	ids, err := parseIDs(r.FormValue(idsKey))
+	if err != nil {
+		invalidParameter(w, err.Error())
+		return
+	}
+
+	rctx := r.Context()
+	res := batchResponse{
+		Events:  make([]json.RawMessage, 0, len(ids)),
+		Missing: []batchMissing{},
+	}
+	for _, id := range ids {
+		rec, err := s.log.Read(rctx, id)
+		if err != nil {
+			switch {
+			case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+				return
+			case errors.Is(err, memlog.ErrOutOfRange):
+				res.Missing = append(res.Missing, batchMissing{ID: id, Code: codeOffsetOutOfRange})
+			case errors.Is(err, memlog.ErrFutureOffset):
+				res.Missing = append(res.Missing, batchMissing{ID: id, Code: codeOffsetInFuture})
+			default:
+				log.Error("read record", zap.Error(err))
+				internalError(w)
+				return
+			}
+			continue
+		}
+		res.Events = append(res.Events, rec.Data)
+	}
+
+	b, err := json.Marshal(res)
+	if err != nil {
+		log.Error("marshal batch response", zap.Error(err))
+		internalError(w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if _, err = w.Write(append(b, '\n')); err != nil {
+		log.Error("write response", zap.Error(err))
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/embano1/memlog"
+	"github.com/embano1/vsphere/logger"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/v3/assert"
+)
+
+func Test_batchGet(t *testing.T) {
+	ctx := logger.Set(context.Background(), zaptest.NewLogger(t))
+
+	ml, err := memlog.New(ctx, memlog.WithStartOffset(10))
+	assert.NilError(t, err)
+	for _, d := range createData(3) {
+		_, err = ml.Write(ctx, d)
+		assert.NilError(t, err)
+	}
+	srv := server{log: wrapLog(t, ml)}
+
+	t.Run("returns events in request order and missing ids", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/events?ids=12,3,10,13", nil)
+		srv.getEvents(ctx)(rec, req, nil)
+		assert.Equal(t, rec.Code, http.StatusOK)
+		assert.Equal(t, rec.Header().Get("Content-Type"), "application/json")
+
+		var got batchResponse
+		assert.NilError(t, json.NewDecoder(rec.Body).Decode(&got))
+		assert.DeepEqual(t, got, batchResponse{
+			Events: []json.RawMessage{json.RawMessage("2"), json.RawMessage("0")},
+			Missing: []batchMissing{
+				{ID: 3, Code: codeOffsetOutOfRange},
+				{ID: 13, Code: codeOffsetInFuture},
+			},
+		})
+	})
+
+	t.Run("all ids missing", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/events?ids=99", nil)
+		srv.getEvents(ctx)(rec, req, nil)
+		assert.Equal(t, rec.Code, http.StatusOK)
+		assert.Equal(t, strings.TrimSpace(rec.Body.String()), `{"events":[],"missing":[{"id":99,"code":"offset_in_future"}]}`)
+	})
+
+	tooMany := make([]string, pageSize+1)
+	for i := range tooMany {
+		tooMany[i] = strconv.Itoa(i + 10)
+	}
+
+	invalid := map[string]string{
+		"invalid id":  "ids=10,abc",
+		"negative id": "ids=-1",
+		"empty id":    "ids=10,,11",
+		"too many":    "ids=" + strings.Join(tooMany, ","),
+		"with watch":  "ids=10&watch=true",
+		"with offset": "ids=10&offset=10",
+		"with since":  "ids=10&since=2022-01-14T13:00:00Z",
+	}
+	for name, query := range invalid {
+		t.Run(name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/events?"+query, nil)
+			srv.getEvents(ctx)(rec, req, nil)
+			assert.Equal(t, rec.Code, http.StatusBadRequest)
+			assert.Equal(t, rec.Header().Get("Content-Type"), contentTypeProblem)
+
+			var p problem
+			assert.NilError(t, json.NewDecoder(rec.Body).Decode(&p))
+			assert.Equal(t, p.Code, codeInvalidParameter)
+		})
+	}
+}
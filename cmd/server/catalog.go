@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/embano1/memlog"
+	"github.com/embano1/vsphere/logger"
+	"github.com/julienschmidt/httprouter"
+	"go.uber.org/zap"
+
+	"github.com/embano1/vsphere-event-streaming/events"
+)
+
+const statsWindow = 60 // minutes
+
+// catalogEntry tracks the retained records of an event type
+type catalogEntry struct {
+	class    string
+	offsets  []memlog.Offset // retained records in offset order
+	lastSeen time.Time       // event time of the last record
+}
+
+// typeCatalog is an index of the cloudevent types in the retained log and the
+// number of events per minute by event time within the stats window.
+//
+// Safe for concurrent use.
+type typeCatalog struct {
+	mu      sync.RWMutex
+	types   map[string]*catalogEntry
+	records int
+	minutes map[time.Time]map[string]int // event counts by minute and type
+}
+
+func newTypeCatalog() *typeCatalog {
+	return &typeCatalog{
+		types:   make(map[string]*catalogEntry),
+		minutes: make(map[time.Time]map[string]int),
+	}
+}
+
+func (c *typeCatalog) index(offset memlog.Offset, e *ce.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.types[e.Type()]
+	if !ok {
+		entry = &catalogEntry{}
+		c.types[e.Type()] = entry
+	}
+	if class, ok := e.Extensions()[events.ClassExtension]; ok {
+		entry.class = fmt.Sprint(class)
+	}
+	entry.offsets = append(entry.offsets, offset)
+	entry.lastSeen = e.Time()
+	c.records++
+
+	minute := e.Time().UTC().Truncate(time.Minute)
+	counts, ok := c.minutes[minute]
+	if !ok {
+		counts = make(map[string]int)
+		c.minutes[minute] = counts
+	}
+	counts[e.Type()]++
+
+	// keep the window before the latest event
+	if len(c.minutes) > statsWindow {
+		cutoff := minute.Add(-statsWindow * time.Minute)
+		for m := range c.minutes {
+			if !m.After(cutoff) {
+				delete(c.minutes, m)
+			}
+		}
+	}
+}
+
+func (c *typeCatalog) prune(earliest memlog.Offset) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for typ, entry := range c.types {
+		i := sort.Search(len(entry.offsets), func(i int) bool {
+			return entry.offsets[i] >= earliest
+		})
+		if i == 0 {
+			continue
+		}
+
+		c.records -= i
+		if i == len(entry.offsets) {
+			delete(c.types, typ)
+			continue
+		}
+		entry.offsets = append(entry.offsets[:0], entry.offsets[i:]...)
+	}
+}
+
+type typeStats struct {
+	Type     string        `json:"type"`
+	Class    string        `json:"class,omitempty"`
+	Count    int           `json:"count"`
+	First    memlog.Offset `json:"first"`
+	Last     memlog.Offset `json:"last"`
+	LastSeen time.Time     `json:"lastSeen"`
+}
+
+// list returns the event types in the retained log ordered by type
+func (c *typeCatalog) list() []typeStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	list := make([]typeStats, 0, len(c.types))
+	for typ, entry := range c.types {
+		list = append(list, typeStats{
+			Type:     typ,
+			Class:    entry.class,
+			Count:    len(entry.offsets),
+			First:    entry.offsets[0],
+			Last:     entry.offsets[len(entry.offsets)-1],
+			LastSeen: entry.lastSeen,
+		})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Type < list[j].Type
+	})
+	return list
+}
+
+type minuteStats struct {
+	Time  time.Time `json:"time"`
+	Count int       `json:"count"`
+}
+
+type statsResponse struct {
+	Records   int                `json:"records"` // retained
+	Types     int                `json:"types"`   // retained
+	Window    string             `json:"window"`
+	Total     int                `json:"total"`     // events within window
+	PerMinute float64            `json:"perMinute"` // average rate within window
+	Rates     map[string]float64 `json:"rates"`     // average rate within window by type
+	Minutes   []minuteStats      `json:"minutes"`   // oldest first
+}
+
+// stats returns the event rates within the window ending with the minute of now
+func (c *typeCatalog) stats(now time.Time) statsResponse {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	resp := statsResponse{
+		Records: c.records,
+		Types:   len(c.types),
+		Window:  (statsWindow * time.Minute).String(),
+		Rates:   make(map[string]float64),
+		Minutes: make([]minuteStats, 0, statsWindow),
+	}
+
+	totals := make(map[string]int)
+	end := now.UTC().Truncate(time.Minute)
+	for i := statsWindow - 1; i >= 0; i-- {
+		minute := end.Add(-time.Duration(i) * time.Minute)
+
+		var count int
+		for typ, n := range c.minutes[minute] {
+			count += n
+			totals[typ] += n
+		}
+		resp.Total += count
+		resp.Minutes = append(resp.Minutes, minuteStats{Time: minute, Count: count})
+	}
+	resp.PerMinute = float64(resp.Total) / statsWindow
+	for typ, n := range totals {
+		resp.Rates[typ] = float64(n) / statsWindow
+	}
+
+	return resp
+}
+
+// getTypes returns the event types in the retained log
+func (s *server) getTypes(ctx context.Context) httprouter.Handle {
+	return func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(s.types.list()); err != nil {
+			logger.Get(ctx).Error("marshal types response", zap.Error(err))
+		}
+	}
+}
+
+// getStats returns the per-minute event rates
+func (s *server) getStats(ctx context.Context) httprouter.Handle {
+	return func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(s.types.stats(time.Now())); err != nil {
+			logger.Get(ctx).Error("marshal stats response", zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/embano1/memlog"
+	"github.com/embano1/vsphere/logger"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/v3/assert"
+)
+
+func Test_typeCatalog(t *testing.T) {
+	ctx := logger.Set(context.Background(), zaptest.NewLogger(t))
+	begin := time.Date(2022, 1, 14, 13, 0, 0, 0, time.UTC)
+
+	// segment size 5: offsets 0-4 are purged after writing offset 10
+	srv := server{types: newTypeCatalog()}
+	srv.indexers = []indexer{srv.types}
+	assert.NilError(t, srv.initializeLog(ctx, 0, 5, 1024))
+
+	types := []string{
+		"com.vmware.vsphere.VmPoweredOnEvent.v0",
+		"com.vmware.vsphere.VmPoweredOffEvent.v0",
+		"com.vmware.vsphere.VmPoweredOnEvent.v0",
+	}
+	for i := 0; i < 12; i++ {
+		e := ce.NewEvent()
+		e.SetID(strconv.Itoa(i))
+		e.SetType(types[i%len(types)])
+		e.SetTime(begin.Add(time.Duration(i) * 30 * time.Second))
+		e.SetSource("/test/source")
+		e.SetExtension("eventclass", "event")
+
+		b, err := json.Marshal(e)
+		assert.NilError(t, err)
+		written, err := srv.appendRecord(ctx, memlog.Offset(i), &e, b)
+		assert.NilError(t, err)
+		assert.Assert(t, written)
+	}
+
+	t.Run("lists retained types", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		srv.getTypes(ctx)(rec, httptest.NewRequest(http.MethodGet, "/api/v1/types", nil), nil)
+		assert.Equal(t, rec.Code, http.StatusOK)
+
+		var got []typeStats
+		assert.NilError(t, json.NewDecoder(rec.Body).Decode(&got))
+		assert.DeepEqual(t, got, []typeStats{
+			{
+				Type:     "com.vmware.vsphere.VmPoweredOffEvent.v0",
+				Class:    "event",
+				Count:    2,
+				First:    7,
+				Last:     10,
+				LastSeen: begin.Add(5 * time.Minute),
+			},
+			{
+				Type:     "com.vmware.vsphere.VmPoweredOnEvent.v0",
+				Class:    "event",
+				Count:    5,
+				First:    5,
+				Last:     11,
+				LastSeen: begin.Add(330 * time.Second),
+			},
+		})
+	})
+
+	t.Run("removes purged types", func(t *testing.T) {
+		c := newTypeCatalog()
+		for i, typ := range []string{"a.v0", "b.v0", "a.v0"} {
+			e := ce.NewEvent()
+			e.SetType(typ)
+			c.index(memlog.Offset(i), &e)
+		}
+
+		c.prune(2)
+		list := c.list()
+		assert.Equal(t, len(list), 1)
+		assert.Equal(t, list[0].Type, "a.v0")
+		assert.Equal(t, list[0].First, memlog.Offset(2))
+		assert.Equal(t, c.records, 1)
+	})
+
+	t.Run("returns per-minute rates", func(t *testing.T) {
+		stats := srv.types.stats(begin.Add(5*time.Minute + 10*time.Second))
+		assert.Equal(t, stats.Records, 7)
+		assert.Equal(t, stats.Types, 2)
+		assert.Equal(t, stats.Window, "1h0m0s")
+		assert.Equal(t, stats.Total, 12)
+		assert.Equal(t, stats.PerMinute, 12.0/statsWindow)
+		assert.Equal(t, stats.Rates["com.vmware.vsphere.VmPoweredOffEvent.v0"], 4.0/statsWindow)
+
+		assert.Equal(t, len(stats.Minutes), statsWindow)
+		latest := stats.Minutes[len(stats.Minutes)-1]
+		assert.DeepEqual(t, latest, minuteStats{Time: begin.Add(5 * time.Minute), Count: 2})
+		assert.Equal(t, stats.Minutes[len(stats.Minutes)-7].Count, 0)
+
+		// outside of window
+		stats = srv.types.stats(begin.Add(2 * time.Hour))
+		assert.Equal(t, stats.Total, 0)
+		assert.Equal(t, stats.Records, 7)
+	})
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/embano1/memlog"
+	"github.com/embano1/vsphere/logger"
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
+	"go.uber.org/zap"
+)
+
+// operation status
+const (
+	operationCompleted = "completed"
+	operationFailed    = "failed"
+)
+
+// progressEvents are the vSphere events reporting an operation in progress.
+// The next event in the chain completes the operation.
+var progressEvents = map[string]bool{
+	"TaskEvent":                  true,
+	"HostDasDisablingEvent":      true,
+	"HostDasEnablingEvent":       true,
+	"VmBeingClonedEvent":         true,
+	"VmBeingClonedNoFolderEvent": true,
+	"VmBeingCreatedEvent":        true,
+	"VmBeingDeployedEvent":       true,
+	"VmBeingHotMigratedEvent":    true,
+	"VmBeingMigratedEvent":       true,
+	"VmBeingRelocatedEvent":      true,
+	"VmEmigratingEvent":          true,
+	"VmResettingEvent":           true,
+	"VmResumingEvent":            true,
+	"VmStartingEvent":            true,
+	"VmStoppingEvent":            true,
+	"VmSuspendingEvent":          true,
+	"VmUnsupportedStartingEvent": true,
+	"VmUpgradingEvent":           true,
+}
+
+// chainData are the vSphere event fields identifying the chain
+type chainData struct {
+	Key     int32 `json:"Key"`
+	ChainID int32 `json:"ChainId"`
+}
+
+// chainEntry is the forward index of a record with a chain id
+type chainEntry struct {
+	offset  memlog.Offset
+	chainID int32
+}
+
+// chain are the retained records of an operation
+type chain struct {
+	offsets  []memlog.Offset
+	terminal memlog.Offset // -1 if in progress
+}
+
+// chainIndex maps vSphere event chain ids to the offsets of the retained
+// records in the chain. A chain is completed by its terminal event, i.e. the
+// first event following the initial event which does not report an operation
+// in progress.
+//
+// Safe for concurrent use.
+type chainIndex struct {
+	mu        sync.RWMutex
+	entries   []chainEntry // ordered by offset
+	chains    map[int32]*chain
+	completed []memlog.Offset // terminal offsets in order
+	last      memlog.Offset   // last indexed offset
+	indexed   chan struct{}   // closed and replaced on each indexed record
+}
+
+func newChainIndex() *chainIndex {
+	return &chainIndex{
+		chains:  make(map[int32]*chain),
+		last:    -1,
+		indexed: make(chan struct{}),
+	}
+}
+
+func (ci *chainIndex) index(offset memlog.Offset, e *ce.Event) {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	ci.last = offset
+	close(ci.indexed)
+	ci.indexed = make(chan struct{})
+
+	var data chainData
+	if err := json.Unmarshal(e.Data(), &data); err != nil || data.ChainID == 0 {
+		return
+	}
+
+	c, ok := ci.chains[data.ChainID]
+	if !ok {
+		c = &chain{terminal: -1}
+		ci.chains[data.ChainID] = c
+	}
+	ci.entries = append(ci.entries, chainEntry{offset: offset, chainID: data.ChainID})
+	c.offsets = append(c.offsets, offset)
+
+	if c.terminal == -1 && data.Key != data.ChainID && !progressEvents[eventName(e.Type())] {
+		c.terminal = offset
+		ci.completed = append(ci.completed, offset)
+	}
+}
+
+func (ci *chainIndex) prune(earliest memlog.Offset) {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
+	var i int
+	for ; i < len(ci.entries) && ci.entries[i].offset < earliest; i++ {
+		id := ci.entries[i].chainID
+		// purged in offset order
+		c := ci.chains[id]
+		c.offsets = c.offsets[1:]
+		if len(c.offsets) == 0 {
+			delete(ci.chains, id)
+		}
+	}
+
+	if i > 0 {
+		ci.entries = append(ci.entries[:0], ci.entries[i:]...)
+	}
+
+	j := sort.Search(len(ci.completed), func(j int) bool {
+		return ci.completed[j] >= earliest
+	})
+	if j > 0 {
+		ci.completed = append(ci.completed[:0], ci.completed[j:]...)
+	}
+}
+
+// wait blocks until the record at offset has been indexed, i.e. records read
+// from a stream right after they have been written
+func (ci *chainIndex) wait(ctx context.Context, offset memlog.Offset) error {
+	for {
+		ci.mu.RLock()
+		last, indexed := ci.last, ci.indexed
+		ci.mu.RUnlock()
+
+		if last >= offset {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-indexed:
+		}
+	}
+}
+
+// get returns the retained offsets of the chain in order
+func (ci *chainIndex) get(id int32) []memlog.Offset {
+	ci.mu.RLock()
+	defer ci.mu.RUnlock()
+
+	c, ok := ci.chains[id]
+	if !ok {
+		return nil
+	}
+	return append([]memlog.Offset(nil), c.offsets...)
+}
+
+// latest returns up to n offsets of the latest terminal events in order
+func (ci *chainIndex) latest(n int) []memlog.Offset {
+	ci.mu.RLock()
+	defer ci.mu.RUnlock()
+
+	completed := ci.completed
+	if len(completed) > n {
+		completed = completed[len(completed)-n:]
+	}
+	return append([]memlog.Offset(nil), completed...)
+}
+
+// operation returns the retained offsets of the chain completed by the
+// terminal event at offset and false if offset is not a terminal event
+func (ci *chainIndex) operation(offset memlog.Offset) ([]memlog.Offset, bool) {
+	ci.mu.RLock()
+	defer ci.mu.RUnlock()
+
+	i := sort.Search(len(ci.entries), func(i int) bool {
+		return ci.entries[i].offset >= offset
+	})
+	if i == len(ci.entries) || ci.entries[i].offset != offset {
+		return nil, false
+	}
+
+	c := ci.chains[ci.entries[i].chainID]
+	if c.terminal != offset {
+		return nil, false
+	}
+
+	var offsets []memlog.Offset
+	for _, o := range c.offsets {
+		if o <= offset {
+			offsets = append(offsets, o)
+		}
+	}
+	return offsets, true
+}
+
+// operationResponse is the aggregated record of a completed operation
+type operationResponse struct {
+	ChainID  int32           `json:"chainId"`
+	Status   string          `json:"status"`
+	Type     string          `json:"type"` // terminal event
+	Message  string          `json:"message"`
+	Offsets  []memlog.Offset `json:"offsets"`
+	Start    time.Time       `json:"start"`
+	End      time.Time       `json:"end"`
+	Duration string          `json:"duration"`
+}
+
+// readChain returns the events at the offsets in order. Purged events are
+// skipped.
+func (s *server) readChain(ctx context.Context, offsets []memlog.Offset) ([]ce.Event, error) {
+	var events []ce.Event
+	for _, offset := range offsets {
+		rec, err := s.log.Read(ctx, offset)
+		if err != nil {
+			if errors.Is(err, memlog.ErrOutOfRange) {
+				continue
+			}
+			return nil, err
+		}
+
+		var e ce.Event
+		if err = json.Unmarshal(rec.Data, &e); err != nil {
+			return nil, fmt.Errorf("unmarshal event %d: %w", offset, err)
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// newOperation aggregates the events of a chain ending with the terminal event
+func newOperation(chainID int32, events []ce.Event) operationResponse {
+	first, last := events[0], events[len(events)-1]
+
+	var data struct {
+		FullFormattedMessage string
+	}
+	_ = json.Unmarshal(last.Data(), &data)
+
+	op := operationResponse{
+		ChainID:  chainID,
+		Status:   operationCompleted,
+		Type:     last.Type(),
+		Message:  data.FullFormattedMessage,
+		Start:    first.Time(),
+		End:      last.Time(),
+		Duration: last.Time().Sub(first.Time()).String(),
+	}
+	if strings.Contains(eventName(last.Type()), "Fail") {
+		op.Status = operationFailed
+	}
+	for _, e := range events {
+		offset, _ := strconv.ParseInt(e.ID(), 10, 64)
+		op.Offsets = append(op.Offsets, memlog.Offset(offset))
+	}
+	return op
+}
+
+// operationAt returns the completed operation of the terminal event at offset
+// and false if offset is not a terminal event
+func (s *server) operationAt(ctx context.Context, offset memlog.Offset) (operationResponse, bool, error) {
+	offsets, ok := s.chains.operation(offset)
+	if !ok {
+		return operationResponse{}, false, nil
+	}
+
+	events, err := s.readChain(ctx, offsets)
+	if err != nil {
+		return operationResponse{}, false, err
+	}
+	// terminal event purged
+	if len(events) == 0 {
+		return operationResponse{}, false, nil
+	}
+
+	var data chainData
+	if err = json.Unmarshal(events[0].Data(), &data); err != nil {
+		return operationResponse{}, false, fmt.Errorf("unmarshal event data: %w", err)
+	}
+	return newOperation(data.ChainID, events), true, nil
+}
+
+// getChain returns the retained events of the chain in order
+func (s *server) getChain(ctx context.Context) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		log := logger.Get(ctx)
+
+		id, err := strconv.ParseInt(ps.ByName("chainId"), 10, 32)
+		if err != nil {
+			invalidParameter(w, "invalid chain id")
+			return
+		}
+
+		rctx := r.Context()
+		events, err := s.readChain(rctx, s.chains.get(int32(id)))
+		if err != nil {
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				return
+			}
+			log.Error("read chain", zap.Error(err))
+			internalError(w)
+			return
+		}
+
+		if len(events) == 0 {
+			notFound(w, "chain not found")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(w).Encode(events); err != nil {
+			log.Error("marshal chain response", zap.Error(err))
+		}
+	}
+}
+
+// getOperations returns the latest completed operations or, if "watch=true",
+// streams operations as their terminal events are written starting with the
+// "offset" or "since" parameter like getEvents
+func (s *server) getOperations(ctx context.Context) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		switch val := r.FormValue(watchKey); val {
+		case "":
+		case "true":
+			s.streamOperations(ctx, w, r)
+			return
+		default:
+			invalidParameter(w, "invalid watch parameter")
+			return
+		}
+
+		log := logger.Get(ctx)
+		rctx := r.Context()
+		ops := []operationResponse{}
+		for _, offset := range s.chains.latest(pageSize) {
+			op, ok, err := s.operationAt(rctx, offset)
+			if err != nil {
+				if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+					return
+				}
+				log.Error("read operation", zap.Error(err))
+				internalError(w)
+				return
+			}
+			if ok {
+				ops = append(ops, op)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(ops); err != nil {
+			log.Error("marshal operations response", zap.Error(err))
+		}
+	}
+}
+
+func (s *server) streamOperations(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := logger.Get(ctx).With(zap.String("streamID", uuid.New().String()))
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Error("writer does not implement flusher")
+		internalError(w)
+		return
+	}
+
+	rctx := r.Context()
+	start, ok := s.watchStart(ctx, w, r)
+	if !ok {
+		return
+	}
+	if s.startPurged(rctx, w, start) {
+		return
+	}
+
+	w.Header().Set("Connection", "Keep-Alive")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	stream := s.log.Stream(rctx, start)
+	enc := json.NewEncoder(w)
+	for {
+		// give a chance for server shutdown (not guaranteed)
+		if ctx.Err() != nil {
+			return
+		}
+
+		rec, ok := stream.Next()
+		if !ok {
+			if err := stream.Err(); err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+				log.Error("stream records", zap.Error(err))
+			}
+			return
+		}
+
+		if err := s.chains.wait(rctx, rec.Metadata.Offset); err != nil {
+			return
+		}
+
+		op, ok, err := s.operationAt(rctx, rec.Metadata.Offset)
+		if err != nil {
+			log.Error("read operation", zap.Error(err))
+			return
+		}
+		if !ok {
+			continue
+		}
+
+		if err = enc.Encode(op); err != nil {
+			if !errors.Is(err, io.ErrClosedPipe) {
+				log.Debug("write operation", zap.Error(err))
+			}
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/embano1/memlog"
+	"github.com/embano1/vsphere/logger"
+	"github.com/julienschmidt/httprouter"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/v3/assert"
+)
+
+func Test_chains(t *testing.T) {
+	ctx := logger.Set(context.Background(), zaptest.NewLogger(t))
+	begin := time.Date(2022, 1, 14, 13, 0, 0, 0, time.UTC)
+
+	type vsphereEvent struct {
+		name    string
+		chainID int32
+		message string
+	}
+
+	// key (offset) 1-7
+	records := []vsphereEvent{
+		{name: "TaskEvent", chainID: 1, message: "Task: Power On virtual machine"},
+		{name: "VmStartingEvent", chainID: 1, message: "vm-01 on esx-01 is starting"},
+		{name: "UserLoginSessionEvent", chainID: 3, message: "User alice logged in"},
+		{name: "VmStartingEvent", chainID: 4, message: "vm-02 on esx-01 is starting"},
+		{name: "VmPoweredOnEvent", chainID: 1, message: "vm-01 on esx-01 is powered on"},
+		{name: "VmFailedToPowerOnEvent", chainID: 4, message: "Failed to power on vm-02"},
+		{name: "VmStartingEvent", chainID: 7, message: "vm-03 on esx-01 is starting"},
+	}
+
+	srv := server{chains: newChainIndex()}
+	srv.indexers = []indexer{srv.chains}
+	assert.NilError(t, srv.initializeLog(ctx, 1, 100, 1024))
+
+	write := func(t *testing.T, key int, r vsphereEvent) {
+		t.Helper()
+
+		e := ce.NewEvent()
+		e.SetID(strconv.Itoa(key))
+		e.SetType("com.vmware.vsphere." + r.name + ".v0")
+		e.SetTime(begin.Add(time.Duration(key) * time.Second))
+		e.SetSource("/test/source")
+		assert.NilError(t, e.SetData(ce.ApplicationJSON, map[string]interface{}{
+			"Key":                  key,
+			"ChainId":              r.chainID,
+			"FullFormattedMessage": r.message,
+		}))
+
+		b, err := json.Marshal(e)
+		assert.NilError(t, err)
+		written, err := srv.appendRecord(ctx, memlog.Offset(key), &e, b)
+		assert.NilError(t, err)
+		assert.Assert(t, written)
+	}
+
+	for i, r := range records {
+		write(t, i+1, r)
+	}
+
+	t.Run("returns events in chain", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/chains/1", nil)
+		srv.getChain(ctx)(rec, req, httprouter.Params{{Key: "chainId", Value: "1"}})
+		assert.Equal(t, rec.Code, http.StatusOK)
+
+		var got []ce.Event
+		assert.NilError(t, json.NewDecoder(rec.Body).Decode(&got))
+		var ids []string
+		for _, e := range got {
+			ids = append(ids, e.ID())
+		}
+		assert.DeepEqual(t, ids, []string{"1", "2", "5"})
+	})
+
+	t.Run("chain errors", func(t *testing.T) {
+		for id, want := range map[string]int{"99": http.StatusNotFound, "abc": http.StatusBadRequest} {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/chains/"+id, nil)
+			srv.getChain(ctx)(rec, req, httprouter.Params{{Key: "chainId", Value: id}})
+			assert.Equal(t, rec.Code, want, "chain %s", id)
+		}
+	})
+
+	t.Run("returns completed operations", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/chains", nil)
+		srv.getOperations(ctx)(rec, req, nil)
+		assert.Equal(t, rec.Code, http.StatusOK)
+
+		var got []operationResponse
+		assert.NilError(t, json.NewDecoder(rec.Body).Decode(&got))
+		assert.DeepEqual(t, got, []operationResponse{
+			{
+				ChainID:  1,
+				Status:   operationCompleted,
+				Type:     "com.vmware.vsphere.VmPoweredOnEvent.v0",
+				Message:  "vm-01 on esx-01 is powered on",
+				Offsets:  []memlog.Offset{1, 2, 5},
+				Start:    begin.Add(time.Second),
+				End:      begin.Add(5 * time.Second),
+				Duration: "4s",
+			},
+			{
+				ChainID:  4,
+				Status:   operationFailed,
+				Type:     "com.vmware.vsphere.VmFailedToPowerOnEvent.v0",
+				Message:  "Failed to power on vm-02",
+				Offsets:  []memlog.Offset{4, 6},
+				Start:    begin.Add(4 * time.Second),
+				End:      begin.Add(6 * time.Second),
+				Duration: "2s",
+			},
+		})
+	})
+
+	t.Run("streams operations once terminal event arrives", func(t *testing.T) {
+		ts := httptest.NewServer(srv.routes(ctx))
+		defer ts.Close()
+
+		rctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(rctx, http.MethodGet, ts.URL+"/api/v1/chains?watch=true&offset=6", nil)
+		assert.NilError(t, err)
+		res, err := http.DefaultClient.Do(req)
+		assert.NilError(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, res.StatusCode, http.StatusOK)
+
+		lines := bufio.NewScanner(res.Body)
+		assert.Assert(t, lines.Scan())
+		var op operationResponse
+		assert.NilError(t, json.Unmarshal(lines.Bytes(), &op))
+		assert.Equal(t, op.ChainID, int32(4))
+
+		// completes chain 7
+		write(t, 8, vsphereEvent{name: "VmPoweredOnEvent", chainID: 7, message: "vm-03 on esx-01 is powered on"})
+		assert.Assert(t, lines.Scan())
+		assert.NilError(t, json.Unmarshal(lines.Bytes(), &op))
+		assert.Equal(t, op.ChainID, int32(7))
+		assert.DeepEqual(t, op.Offsets, []memlog.Offset{7, 8})
+	})
+	t.Run("sends headers before first operation", func(t *testing.T) {
+		ts := httptest.NewServer(srv.routes(ctx))
+		defer ts.Close()
+
+		rctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+
+		// no operation completes after the latest record
+		req, err := http.NewRequestWithContext(rctx, http.MethodGet, ts.URL+"/api/v1/chains?watch=true", nil)
+		assert.NilError(t, err)
+		res, err := http.DefaultClient.Do(req)
+		assert.NilError(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, res.StatusCode, http.StatusOK)
+		assert.Equal(t, res.Header.Get("Content-Type"), "application/json")
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// record compression
+const (
+	compressionNone   = "none"
+	compressionZstd   = "zstd"
+	compressionSnappy = "snappy"
+)
+
+// codec compresses records stored in the log. Safe for concurrent use.
+type codec interface {
+	// encode returns the compressed src
+	encode(src []byte) []byte
+	// decode returns the decompressed src
+	decode(src []byte) ([]byte, error)
+	// maxEncodedLen returns the maximum compressed size of a record with size n
+	maxEncodedLen(n int) int
+	// contentEncoding returns the HTTP content coding of compressed records or
+	// an empty string if records can not be served compressed
+	contentEncoding() string
+}
+
+// newCodec returns the codec for the compression or nil for no compression.
+// maxSize is the maximum size of a decompressed record.
+func newCodec(compression string, maxSize int) (codec, error) {
+	switch compression {
+	case "", compressionNone:
+		return nil, nil
+	case compressionZstd:
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("create zstd encoder: %w", err)
+		}
+		dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(uint64(maxSize)))
+		if err != nil {
+			return nil, fmt.Errorf("create zstd decoder: %w", err)
+		}
+		return &zstdCodec{enc: enc, dec: dec}, nil
+	case compressionSnappy:
+		return &snappyCodec{maxSize: maxSize}, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", compression)
+	}
+}
+
+type zstdCodec struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+func (c *zstdCodec) encode(src []byte) []byte {
+	return c.enc.EncodeAll(src, nil)
+}
+
+func (c *zstdCodec) decode(src []byte) ([]byte, error) {
+	return c.dec.DecodeAll(src, nil)
+}
+
+func (c *zstdCodec) maxEncodedLen(n int) int {
+	return c.enc.MaxEncodedSize(n)
+}
+
+func (c *zstdCodec) contentEncoding() string {
+	return compressionZstd
+}
+
+type snappyCodec struct {
+	maxSize int
+}
+
+func (c *snappyCodec) encode(src []byte) []byte {
+	return snappy.Encode(nil, src)
+}
+
+func (c *snappyCodec) decode(src []byte) ([]byte, error) {
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	if n > c.maxSize {
+		return nil, fmt.Errorf("decoded size %d exceeds maximum record size", n)
+	}
+	return snappy.Decode(nil, src)
+}
+
+func (c *snappyCodec) maxEncodedLen(n int) int {
+	return snappy.MaxEncodedLen(n)
+}
+
+// snappy block format has no registered HTTP content coding
+func (c *snappyCodec) contentEncoding() string {
+	return ""
+}
+
+// acceptsEncoding returns whether the request accepts the content coding
+func acceptsEncoding(r *http.Request, coding string) bool {
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(header, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			if !strings.EqualFold(strings.TrimSpace(name), coding) {
+				continue
+			}
+			// rejected with q=0
+			q := strings.ReplaceAll(params, " ", "")
+			return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+		}
+	}
+	return false
+}
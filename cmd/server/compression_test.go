@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/embano1/memlog"
+	"github.com/embano1/vsphere/logger"
+	"github.com/julienschmidt/httprouter"
+	"github.com/klauspost/compress/zstd"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/v3/assert"
+)
+
+func Test_newCodec(t *testing.T) {
+	data := bytes.Repeat([]byte(`{"Vm":{"Name":"vm-01"},"FullFormattedMessage":"powered on"}`), 20)
+
+	for _, compression := range []string{compressionZstd, compressionSnappy} {
+		t.Run(compression, func(t *testing.T) {
+			c, err := newCodec(compression, len(data))
+			assert.NilError(t, err)
+
+			encoded := c.encode(data)
+			assert.Assert(t, len(encoded) < len(data)/4, "compressed %d bytes to %d", len(data), len(encoded))
+			assert.Assert(t, len(encoded) <= c.maxEncodedLen(len(data)))
+
+			decoded, err := c.decode(encoded)
+			assert.NilError(t, err)
+			assert.DeepEqual(t, decoded, data)
+
+			// exceeds maximum record size
+			small, err := newCodec(compression, len(data)-1)
+			assert.NilError(t, err)
+			_, err = small.decode(encoded)
+			assert.Assert(t, err != nil)
+		})
+	}
+
+	t.Run("none", func(t *testing.T) {
+		c, err := newCodec(compressionNone, len(data))
+		assert.NilError(t, err)
+		assert.Assert(t, c == nil)
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		_, err := newCodec("lz4", len(data))
+		assert.ErrorContains(t, err, `unsupported compression "lz4"`)
+	})
+}
+
+func Test_acceptsEncoding(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []string
+		want   bool
+	}{
+		{name: "no header", want: false},
+		{name: "single coding", header: []string{"zstd"}, want: true},
+		{name: "list", header: []string{"gzip, deflate, br, zstd"}, want: true},
+		{name: "multiple headers", header: []string{"gzip", "ZSTD;q=0.5"}, want: true},
+		{name: "other codings", header: []string{"gzip, br"}, want: false},
+		{name: "rejected", header: []string{"gzip, zstd; q=0"}, want: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			for _, h := range tc.header {
+				r.Header.Add("Accept-Encoding", h)
+			}
+			assert.Equal(t, acceptsEncoding(r, compressionZstd), tc.want)
+		})
+	}
+}
+
+func Test_compressedLog(t *testing.T) {
+	ctx := logger.Set(context.Background(), zaptest.NewLogger(t))
+
+	for _, compression := range []string{compressionZstd, compressionSnappy} {
+		t.Run(compression, func(t *testing.T) {
+			c, err := newCodec(compression, 1024)
+			assert.NilError(t, err)
+
+			srv := server{codec: c}
+			assert.NilError(t, srv.initializeLog(ctx, 10, 10, 1024))
+
+			var raw [][]byte
+			for i := 0; i < 5; i++ {
+				b := bytes.Repeat([]byte("vsphere event "), 20)
+				raw = append(raw, b)
+				_, err = srv.log.Write(ctx, b)
+				assert.NilError(t, err)
+			}
+
+			// record size applies to uncompressed data
+			_, err = srv.log.Write(ctx, make([]byte, 1025))
+			assert.ErrorIs(t, err, memlog.ErrRecordTooLarge)
+
+			rec, err := srv.log.Read(ctx, 11)
+			assert.NilError(t, err)
+			assert.DeepEqual(t, rec.Data, raw[1])
+
+			stored, err := srv.log.ReadStored(ctx, 11)
+			assert.NilError(t, err)
+			assert.Assert(t, len(stored.Data) < len(raw[1]))
+
+			batch := make([]memlog.Record, 5)
+			count, err := srv.log.ReadBatch(ctx, 10, batch)
+			assert.NilError(t, err)
+			assert.Equal(t, count, 5)
+			for i := 0; i < count; i++ {
+				assert.DeepEqual(t, batch[i].Data, raw[i])
+			}
+
+			stream := srv.log.Stream(ctx, 13)
+			rec, ok := stream.Next()
+			assert.Assert(t, ok)
+			assert.DeepEqual(t, rec.Data, raw[3])
+		})
+	}
+
+	t.Run("serves compressed record if accepted", func(t *testing.T) {
+		c, err := newCodec(compressionZstd, 1024)
+		assert.NilError(t, err)
+
+		srv := server{codec: c}
+		assert.NilError(t, srv.initializeLog(ctx, 10, 10, 1024))
+		want := []byte(`{"id":"10","specversion":"1.0","source":"/test/source","type":"test.event.v0"}`)
+		_, err = srv.log.Write(ctx, want)
+		assert.NilError(t, err)
+
+		get := func(acceptEncoding string) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/events/10", nil)
+			if acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", acceptEncoding)
+			}
+			srv.getEvent(ctx)(rec, req, httprouter.Params{{Key: "id", Value: "10"}})
+			return rec
+		}
+
+		rec := get("")
+		assert.Equal(t, rec.Code, http.StatusOK)
+		assert.Equal(t, rec.Header().Get("Content-Encoding"), "")
+		assert.Equal(t, rec.Header().Get("Vary"), "Accept-Encoding")
+		assert.DeepEqual(t, rec.Body.Bytes(), want)
+
+		rec = get("gzip, zstd")
+		assert.Equal(t, rec.Code, http.StatusOK)
+		assert.Equal(t, rec.Header().Get("Content-Encoding"), compressionZstd)
+
+		dec, err := zstd.NewReader(nil)
+		assert.NilError(t, err)
+		defer dec.Close()
+		got, err := dec.DecodeAll(rec.Body.Bytes(), nil)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, got, want)
+	})
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	configVersion = 1
+	maskedValue   = "******"
+
+	// maxBatchSize is the maximum number of events vCenter returns per read
+	maxBatchSize = 1000
+)
+
+// extensionName is a valid cloudevents extension attribute name
+var extensionName = regexp.MustCompile(`^[a-z0-9]{1,20}$`)
+
+// reservedAttributes are the cloudevents attributes set by the collector
+var reservedAttributes = map[string]bool{
+	"specversion": true, "id": true, "source": true, "type": true, "subject": true, "time": true,
+	"datacontenttype": true, "dataschema": true, "data": true, "eventclass": true,
+	"traceparent": true, "tracestate": true,
+}
+
+// config is the server configuration. It is read from an optional YAML or JSON
+// file and each field can be overridden with the environment variable in its
+// envconfig tag.
+type config struct {
+	Version     int               `json:"version"`
+	Server      serverConfig      `json:"server"`
+	VCenter     vcenterConfig     `json:"vcenter"`
+	Collector   collectorConfig   `json:"collector"`
+	Log         logConfig         `json:"log"`
+	NATS        natsConfig        `json:"nats"`
+	Import      importConfig      `json:"import"`
+	Election    electionConfig    `json:"election"`
+	Replication replicationConfig `json:"replication"`
+	Tracing     tracingConfig     `json:"tracing"`
+}
+
+// serverConfig configures the http listener and logging. The configuration
+// file is reloaded on changes if watchConfig is set. The admin api requires
+// adminToken as bearer token and is disabled if empty.
+type serverConfig struct {
+	Port        int    `json:"port" envconfig:"PORT"`
+	Debug       bool   `json:"debug" envconfig:"DEBUG"`
+	WatchConfig bool   `json:"watchConfig" envconfig:"WATCH_CONFIG"`
+	AdminToken  string `json:"adminToken,omitempty" envconfig:"ADMIN_TOKEN"`
+}
+
+// vcenterConfig is passed to the vsphere client via its environment variables.
+// Tasks and triggered alarm state changes are collected into the activity log
+// if enabled.
+type vcenterConfig struct {
+	URL         string   `json:"url" envconfig:"VCENTER_URL"`
+	Insecure    bool     `json:"insecure" envconfig:"VCENTER_INSECURE"`
+	SecretPath  string   `json:"secretPath" envconfig:"VCENTER_SECRET_PATH"`
+	StreamBegin duration `json:"streamBegin" envconfig:"VCENTER_STREAM_BEGIN"`
+	Tasks       bool     `json:"tasks" envconfig:"VCENTER_TASKS"`
+	Alarms      bool     `json:"alarms" envconfig:"VCENTER_ALARMS"`
+}
+
+// collectorConfig configures the vCenter event collector. It reads up to
+// batchSize events every pollInterval, limiting the rate of events read from
+// vCenter, and adds the extensions as cloudevents extension attributes to each
+// collected event.
+type collectorConfig struct {
+	PollInterval duration          `json:"pollInterval" envconfig:"COLLECTOR_POLL_INTERVAL"`
+	BatchSize    int               `json:"batchSize" envconfig:"COLLECTOR_BATCH_SIZE"`
+	Extensions   map[string]string `json:"extensions,omitempty" envconfig:"COLLECTOR_EXTENSIONS"`
+}
+
+// logConfig configures the log size. Records are purged when the segment size
+// is exceeded and, if set, when older than maxAge (event time) or exceeding
+// maxBytes (as stored) in total. Records are stored compressed with zstd or
+// snappy if compression is set.
+type logConfig struct {
+	MaxRecordSize  int      `json:"maxRecordSize" envconfig:"LOG_MAX_RECORD_SIZE_BYTES"`
+	MaxSegmentSize int      `json:"maxSegmentSize" envconfig:"LOG_MAX_SEGMENT_SIZE"`
+	MaxAge         duration `json:"maxAge" envconfig:"LOG_MAX_AGE"`
+	MaxBytes       int64    `json:"maxBytes" envconfig:"LOG_MAX_BYTES"`
+	Compression    string   `json:"compression" envconfig:"LOG_COMPRESSION"`
+}
+
+// natsConfig configures the nats publisher (disabled if url is empty)
+type natsConfig struct {
+	URL           string `json:"url" envconfig:"NATS_URL"`
+	Token         string `json:"token" envconfig:"NATS_TOKEN"`
+	Stream        string `json:"stream" envconfig:"NATS_STREAM"`
+	SubjectPrefix string `json:"subjectPrefix" envconfig:"NATS_SUBJECT_PREFIX"`
+}
+
+// importConfig seeds the log from an export archive before starting the
+// collector. Archives uploaded to the admin api are limited to maxBytes and
+// must be read within timeout.
+type importConfig struct {
+	File     string   `json:"file" envconfig:"IMPORT_FILE"`
+	MaxBytes int64    `json:"maxBytes" envconfig:"IMPORT_MAX_BYTES"`
+	Timeout  duration `json:"timeout" envconfig:"IMPORT_TIMEOUT"`
+}
+
+// electionConfig configures leader election (disabled if backend is empty).
+// Only the leader collects vCenter events, standbys follow the leader log.
+type electionConfig struct {
+	// Backend is "kubernetes" (Lease) or "file" (lock file for local testing)
+	Backend string `json:"backend" envconfig:"ELECTION_BACKEND"`
+	// AdvertiseURL is the URL standbys use to follow this instance when it
+	// leads. Used as the lease holder identity.
+	AdvertiseURL  string   `json:"advertiseURL" envconfig:"ELECTION_ADVERTISE_URL"`
+	LeaseName     string   `json:"leaseName" envconfig:"ELECTION_LEASE_NAME"`
+	Namespace     string   `json:"namespace" envconfig:"ELECTION_NAMESPACE"`
+	LockFile      string   `json:"lockFile" envconfig:"ELECTION_LOCK_FILE"`
+	LeaseDuration duration `json:"leaseDuration" envconfig:"ELECTION_LEASE_DURATION"`
+	RenewDeadline duration `json:"renewDeadline" envconfig:"ELECTION_RENEW_DEADLINE"`
+	RetryPeriod   duration `json:"retryPeriod" envconfig:"ELECTION_RETRY_PERIOD"`
+}
+
+// replicationConfig runs the server as a read replica of a primary (disabled if
+// primaryURL is empty). Replicas do not connect to vCenter and serve reads and
+// watches from their local copy of the primary log.
+type replicationConfig struct {
+	PrimaryURL string `json:"primaryURL" envconfig:"REPLICATION_PRIMARY_URL"`
+}
+
+// tracingConfig configures the OpenTelemetry span exporter ("none" disables
+// tracing). The otlp exporter sends to endpoint, if set, or the endpoint in the
+// standard OTEL_EXPORTER_OTLP_* environment variables.
+type tracingConfig struct {
+	Exporter    string  `json:"exporter" envconfig:"TRACING_EXPORTER"`
+	Endpoint    string  `json:"endpoint" envconfig:"TRACING_OTLP_ENDPOINT"`
+	SampleRatio float64 `json:"sampleRatio" envconfig:"TRACING_SAMPLE_RATIO"`
+}
+
+// duration is a time.Duration in Go duration string format, e.g. "10m"
+type duration struct {
+	time.Duration
+}
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", string(b))
+	}
+	d.Duration = v
+	return nil
+}
+
+func defaultConfig() config {
+	return config{
+		Version: configVersion,
+		Server: serverConfig{
+			Port: 8080,
+		},
+		VCenter: vcenterConfig{
+			SecretPath:  "/var/bindings/vsphere",
+			StreamBegin: duration{10 * time.Minute},
+		},
+		Collector: collectorConfig{
+			PollInterval: duration{time.Second},
+			BatchSize:    50,
+		},
+		Log: logConfig{
+			MaxRecordSize:  524288,
+			MaxSegmentSize: 1000,
+			Compression:    compressionNone,
+		},
+		NATS: natsConfig{
+			Stream:        "VSPHERE_EVENTS",
+			SubjectPrefix: "vsphere.events",
+		},
+		Import: importConfig{
+			MaxBytes: 100 << 20, // 100MiB
+			Timeout:  duration{5 * time.Minute},
+		},
+		Election: electionConfig{
+			LeaseName:     "vsphere-event-stream",
+			LeaseDuration: duration{15 * time.Second},
+			RenewDeadline: duration{10 * time.Second},
+			RetryPeriod:   duration{2 * time.Second},
+		},
+		Tracing: tracingConfig{
+			Exporter:    tracingExporterNone,
+			SampleRatio: 1,
+		},
+	}
+}
+
+// loadConfig returns the effective configuration from defaults, the optional
+// file at path and environment variables (in increasing precedence)
+func loadConfig(path string) (config, error) {
+	cfg := defaultConfig()
+
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return config{}, fmt.Errorf("read config file: %w", err)
+		}
+
+		// version is required in files
+		cfg.Version = 0
+		if err = yaml.UnmarshalStrict(b, &cfg); err != nil {
+			return config{}, fmt.Errorf("parse config file %q: %w", path, err)
+		}
+	}
+
+	sections := []interface{}{&cfg.Server, &cfg.VCenter, &cfg.Collector, &cfg.Log, &cfg.NATS, &cfg.Import, &cfg.Election, &cfg.Replication, &cfg.Tracing}
+	for _, s := range sections {
+		if err := envconfig.Process("", s); err != nil {
+			return config{}, fmt.Errorf("process environment variables: %w", err)
+		}
+	}
+
+	err := cfg.validate()
+	if cfg.Server.WatchConfig && path == "" {
+		err = errors.Join(err, errors.New("server.watchConfig: requires a configuration file"))
+	}
+	if err != nil {
+		return config{}, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	return cfg, nil
+}
+
+// validate returns all configuration errors
+func (c config) validate() error {
+	var errs []error
+	invalid := func(field, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+
+	switch c.Version {
+	case configVersion:
+	case 0:
+		invalid("version", "required, must be %d", configVersion)
+	default:
+		invalid("version", "unsupported version %d, must be %d", c.Version, configVersion)
+	}
+
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		invalid("server.port", "must be between 1 and 65535, got %d", c.Server.Port)
+	}
+
+	replica := c.Replication.PrimaryURL != ""
+	if c.VCenter.URL == "" {
+		if !replica {
+			invalid("vcenter.url", "required")
+		}
+	} else if u, err := url.Parse(c.VCenter.URL); err != nil || u.Scheme == "" || u.Host == "" {
+		invalid("vcenter.url", "must be an absolute URL, got %q", c.VCenter.URL)
+	}
+	if c.VCenter.SecretPath == "" {
+		invalid("vcenter.secretPath", "required")
+	}
+	if c.VCenter.StreamBegin.Duration < 0 {
+		invalid("vcenter.streamBegin", "must not be negative, got %s", c.VCenter.StreamBegin)
+	}
+
+	if c.Collector.PollInterval.Duration <= 0 {
+		invalid("collector.pollInterval", "must be greater than 0, got %s", c.Collector.PollInterval)
+	}
+	if c.Collector.BatchSize < 1 || c.Collector.BatchSize > maxBatchSize {
+		invalid("collector.batchSize", "must be between 1 and %d, got %d", maxBatchSize, c.Collector.BatchSize)
+	}
+	for name := range c.Collector.Extensions {
+		switch {
+		case !extensionName.MatchString(name):
+			invalid("collector.extensions", "name must be 1-20 lowercase letters or digits, got %q", name)
+		case reservedAttributes[name]:
+			invalid("collector.extensions", "name %q is reserved", name)
+		}
+	}
+
+	if c.Log.MaxRecordSize <= 0 {
+		invalid("log.maxRecordSize", "must be greater than 0, got %d", c.Log.MaxRecordSize)
+	}
+	if c.Log.MaxSegmentSize <= 0 {
+		invalid("log.maxSegmentSize", "must be greater than 0, got %d", c.Log.MaxSegmentSize)
+	}
+	if c.Log.MaxAge.Duration < 0 {
+		invalid("log.maxAge", "must not be negative, got %s", c.Log.MaxAge)
+	}
+	if c.Log.MaxBytes < 0 {
+		invalid("log.maxBytes", "must not be negative, got %d", c.Log.MaxBytes)
+	}
+	switch c.Log.Compression {
+	case compressionNone, compressionZstd, compressionSnappy:
+	default:
+		invalid("log.compression", "must be %q, %q or %q, got %q", compressionNone, compressionZstd, compressionSnappy, c.Log.Compression)
+	}
+
+	if c.NATS.URL != "" {
+		if c.NATS.Stream == "" {
+			invalid("nats.stream", "required when nats.url is set")
+		}
+		if c.NATS.SubjectPrefix == "" {
+			invalid("nats.subjectPrefix", "required when nats.url is set")
+		}
+	}
+
+	if c.Import.MaxBytes <= 0 {
+		invalid("import.maxBytes", "must be greater than 0, got %d", c.Import.MaxBytes)
+	}
+	if c.Import.Timeout.Duration <= 0 {
+		invalid("import.timeout", "must be greater than 0, got %s", c.Import.Timeout)
+	}
+
+	e := c.Election
+	switch e.Backend {
+	case "":
+	case electionBackendKubernetes, electionBackendFile:
+		if e.AdvertiseURL == "" {
+			invalid("election.advertiseURL", "required when election is enabled")
+		} else if u, err := url.Parse(e.AdvertiseURL); err != nil || u.Scheme == "" || u.Host == "" {
+			invalid("election.advertiseURL", "must be an absolute URL, got %q", e.AdvertiseURL)
+		}
+		if e.Backend == electionBackendKubernetes && e.LeaseName == "" {
+			invalid("election.leaseName", "required for backend %q", e.Backend)
+		}
+		if e.Backend == electionBackendFile && e.LockFile == "" {
+			invalid("election.lockFile", "required for backend %q", e.Backend)
+		}
+		if e.RetryPeriod.Duration <= 0 || e.RenewDeadline.Duration <= e.RetryPeriod.Duration || e.LeaseDuration.Duration <= e.RenewDeadline.Duration {
+			invalid("election", "must satisfy leaseDuration > renewDeadline > retryPeriod > 0, got %s, %s, %s",
+				e.LeaseDuration, e.RenewDeadline, e.RetryPeriod)
+		}
+	default:
+		invalid("election.backend", "must be %q or %q, got %q", electionBackendKubernetes, electionBackendFile, e.Backend)
+	}
+
+	if replica {
+		if u, err := url.Parse(c.Replication.PrimaryURL); err != nil || u.Scheme == "" || u.Host == "" {
+			invalid("replication.primaryURL", "must be an absolute URL, got %q", c.Replication.PrimaryURL)
+		}
+		if e.Backend != "" {
+			invalid("replication.primaryURL", "read replicas do not support election")
+		}
+		if c.Import.File != "" {
+			invalid("replication.primaryURL", "read replicas do not support import")
+		}
+		if c.VCenter.Tasks || c.VCenter.Alarms {
+			invalid("replication.primaryURL", "read replicas do not support task and alarm collection")
+		}
+	}
+
+	t := c.Tracing
+	switch t.Exporter {
+	case tracingExporterNone, tracingExporterStdout:
+	case tracingExporterOTLP:
+		if t.Endpoint != "" {
+			if u, err := url.Parse(t.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+				invalid("tracing.endpoint", "must be an absolute URL, got %q", t.Endpoint)
+			}
+		}
+	default:
+		invalid("tracing.exporter", "must be %q, %q or %q, got %q", tracingExporterNone, tracingExporterStdout, tracingExporterOTLP, t.Exporter)
+	}
+	if t.SampleRatio < 0 || t.SampleRatio > 1 {
+		invalid("tracing.sampleRatio", "must be between 0 and 1, got %g", t.SampleRatio)
+	}
+
+	return errors.Join(errs...)
+}
+
+// setVCenterEnv exports the vcenter settings to the environment variables read
+// by the vsphere client
+func (c config) setVCenterEnv() error {
+	vars := map[string]string{
+		"VCENTER_URL":         c.VCenter.URL,
+		"VCENTER_INSECURE":    strconv.FormatBool(c.VCenter.Insecure),
+		"VCENTER_SECRET_PATH": c.VCenter.SecretPath,
+	}
+
+	for k, v := range vars {
+		if err := os.Setenv(k, v); err != nil {
+			return fmt.Errorf("set environment variable %s: %w", k, err)
+		}
+	}
+	return nil
+}
+
+// masked returns a copy of the configuration with secrets masked
+func (c config) masked() config {
+	if c.NATS.Token != "" {
+		c.NATS.Token = maskedValue
+	}
+	if c.Server.AdminToken != "" {
+		c.Server.AdminToken = maskedValue
+	}
+	c.NATS.URL = maskURL(c.NATS.URL)
+	c.VCenter.URL = maskURL(c.VCenter.URL)
+	c.Replication.PrimaryURL = maskURL(c.Replication.PrimaryURL)
+	c.Tracing.Endpoint = maskURL(c.Tracing.Endpoint)
+	return c
+}
+
+// maskURL masks the password in the user info of a URL
+func maskURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	return u.Redacted()
+}
+
+// yaml returns the configuration with secrets masked as YAML
+func (c config) yaml() ([]byte, error) {
+	b, err := yaml.Marshal(c.masked())
+	if err != nil {
+		return nil, fmt.Errorf("marshal config: %w", err)
+	}
+	return b, nil
+}
+
+// retention returns the log retention policy
+func (c logConfig) retention() retentionPolicy {
+	return retentionPolicy{
+		maxAge:   c.MaxAge.Duration,
+		maxBytes: c.MaxBytes,
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/embano1/vsphere/logger"
+	"go.uber.org/zap"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/leaderelection"
+	rl "k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	electionBackendKubernetes = "kubernetes"
+	electionBackendFile       = "file"
+
+	namespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// newLeaderLock returns the resource lock for the configured election backend
+func newLeaderLock(cfg electionConfig) (rl.Interface, error) {
+	switch cfg.Backend {
+	case electionBackendKubernetes:
+		kc, err := rest.InClusterConfig()
+		if err != nil {
+			return nil, fmt.Errorf("create kubernetes config: %w", err)
+		}
+
+		cs, err := kubernetes.NewForConfig(kc)
+		if err != nil {
+			return nil, fmt.Errorf("create kubernetes client: %w", err)
+		}
+
+		ns := cfg.Namespace
+		if ns == "" {
+			b, err := os.ReadFile(namespaceFile)
+			if err != nil {
+				return nil, fmt.Errorf("read namespace: %w", err)
+			}
+			ns = strings.TrimSpace(string(b))
+		}
+
+		return &rl.LeaseLock{
+			LeaseMeta: metav1.ObjectMeta{
+				Name:      cfg.LeaseName,
+				Namespace: ns,
+			},
+			Client:     cs.CoordinationV1(),
+			LockConfig: rl.ResourceLockConfig{Identity: cfg.AdvertiseURL},
+		}, nil
+
+	case electionBackendFile:
+		return &fileLock{path: cfg.LockFile, identity: cfg.AdvertiseURL}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported election backend %q", cfg.Backend)
+	}
+}
+
+// election runs leader election. The leader runs the collector, standbys follow
+// the log of the leader and take over collection from the last replicated
+// offset on failover.
+type election struct {
+	srv     *server
+	lock    rl.Interface
+	cfg     config
+	collect func(ctx context.Context) error
+
+	errCh chan error // fatal collector or follower errors
+
+	mu         sync.Mutex
+	leading    bool
+	collecting chan struct{} // closed when collector stopped
+	follower   context.CancelFunc
+	following  chan struct{} // closed when follower stopped
+}
+
+func newElection(srv *server, lock rl.Interface, cfg config, collect func(ctx context.Context) error) *election {
+	return &election{
+		srv:     srv,
+		lock:    lock,
+		cfg:     cfg,
+		collect: collect,
+		errCh:   make(chan error, 1),
+	}
+}
+
+// run campaigns for leadership until the context is cancelled or a fatal error
+// occurs. After losing leadership the instance rejoins the election as
+// standby.
+func (e *election) run(ctx context.Context) error {
+	l := logger.Get(ctx).With(zap.String("identity", e.lock.Identity()))
+	ctx = logger.Set(ctx, l)
+
+	defer e.stopFollower()
+	defer e.waitCollector()
+
+	for {
+		le, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+			Lock:            e.lock,
+			LeaseDuration:   e.cfg.Election.LeaseDuration.Duration,
+			RenewDeadline:   e.cfg.Election.RenewDeadline.Duration,
+			RetryPeriod:     e.cfg.Election.RetryPeriod.Duration,
+			ReleaseOnCancel: true,
+			Name:            e.cfg.Election.LeaseName,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) { e.lead(ctx) },
+				OnStoppedLeading: func() { e.setLeading(false) },
+				OnNewLeader:      func(identity string) { e.follow(ctx, identity) },
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("create leader elector: %w", err)
+		}
+
+		runCtx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			le.Run(runCtx)
+		}()
+
+		select {
+		case <-done:
+			cancel()
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			l.Warn("lost leadership, rejoining election")
+		case err = <-e.errCh:
+			cancel()
+			<-done
+			return err
+		}
+	}
+}
+
+// lead stops following and runs the collector until leadership is lost
+func (e *election) lead(ctx context.Context) {
+	logger.Get(ctx).Info("started leading")
+
+	done := make(chan struct{})
+	e.mu.Lock()
+	e.leading = true
+	e.collecting = done
+	e.mu.Unlock()
+	defer close(done)
+
+	e.stopFollower()
+
+	if err := e.collect(ctx); err != nil && ctx.Err() == nil {
+		e.fail(err)
+	}
+}
+
+// follow follows the log of a new leader unless this instance leads
+func (e *election) follow(ctx context.Context, leader string) {
+	if leader == e.lock.Identity() || leader == "" {
+		return
+	}
+
+	e.stopFollower()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.leading || ctx.Err() != nil {
+		return
+	}
+
+	logger.Get(ctx).Info("new leader elected", zap.String("leader", leader))
+
+	f, err := newFollower(e.srv, leader, e.cfg.Log.MaxSegmentSize, e.cfg.Log.MaxRecordSize)
+	if err != nil {
+		e.fail(err)
+		return
+	}
+
+	fctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	collecting := e.collecting
+	e.follower = cancel
+	e.following = done
+
+	go func() {
+		defer close(done)
+
+		// collector of previous leadership term must not write concurrently
+		if collecting != nil {
+			select {
+			case <-fctx.Done():
+				return
+			case <-collecting:
+			}
+		}
+
+		if err := f.run(fctx); err != nil && fctx.Err() == nil {
+			e.fail(fmt.Errorf("follow leader: %w", err))
+		}
+	}()
+}
+
+func (e *election) stopFollower() {
+	e.mu.Lock()
+	cancel, done := e.follower, e.following
+	e.follower, e.following = nil, nil
+	e.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+func (e *election) waitCollector() {
+	e.mu.Lock()
+	done := e.collecting
+	e.mu.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
+
+func (e *election) setLeading(leading bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.leading = leading
+}
+
+// fail reports a fatal error without blocking
+func (e *election) fail(err error) {
+	select {
+	case e.errCh <- err:
+	default:
+	}
+}
+
+// fileLock is a leader election lock stored in a local file for testing
+// without Kubernetes. Concurrent updates are detected by comparing the file
+// contents with the last observed record.
+type fileLock struct {
+	path     string
+	identity string
+	observed []byte // last read or written record
+}
+
+var _ rl.Interface = (*fileLock)(nil)
+
+const (
+	fileLockRetries  = 50
+	fileLockInterval = 10 * time.Millisecond
+	fileLockStale    = 10 * time.Second
+)
+
+func (l *fileLock) Get(_ context.Context) (*rl.LeaderElectionRecord, []byte, error) {
+	b, err := os.ReadFile(l.path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil, apierrors.NewNotFound(schema.GroupResource{Resource: "lockfile"}, l.path)
+		}
+		return nil, nil, fmt.Errorf("read lock file: %w", err)
+	}
+
+	var rec rl.LeaderElectionRecord
+	if err = json.Unmarshal(b, &rec); err != nil {
+		return nil, nil, fmt.Errorf("parse lock file: %w", err)
+	}
+	l.observed = b
+
+	return &rec, b, nil
+}
+
+func (l *fileLock) Create(_ context.Context, ler rl.LeaderElectionRecord) error {
+	return l.locked(func() error {
+		if _, err := os.Stat(l.path); err == nil {
+			return apierrors.NewAlreadyExists(schema.GroupResource{Resource: "lockfile"}, l.path)
+		}
+		return l.write(ler)
+	})
+}
+
+func (l *fileLock) Update(_ context.Context, ler rl.LeaderElectionRecord) error {
+	return l.locked(func() error {
+		cur, err := os.ReadFile(l.path)
+		if err != nil {
+			return fmt.Errorf("read lock file: %w", err)
+		}
+		if !bytes.Equal(cur, l.observed) {
+			return apierrors.NewConflict(schema.GroupResource{Resource: "lockfile"}, l.path, errors.New("lock file modified"))
+		}
+		return l.write(ler)
+	})
+}
+
+func (l *fileLock) RecordEvent(string) {}
+
+func (l *fileLock) Identity() string {
+	return l.identity
+}
+
+func (l *fileLock) Describe() string {
+	return "file/" + l.path
+}
+
+// write atomically replaces the lock file. Must be called with the mutex file
+// held.
+func (l *fileLock) write(ler rl.LeaderElectionRecord) error {
+	b, err := json.Marshal(ler)
+	if err != nil {
+		return fmt.Errorf("marshal lock record: %w", err)
+	}
+
+	tmp := l.path + ".tmp"
+	if err = os.WriteFile(tmp, b, 0o644); err != nil {
+		return fmt.Errorf("write lock file: %w", err)
+	}
+	if err = os.Rename(tmp, l.path); err != nil {
+		return fmt.Errorf("replace lock file: %w", err)
+	}
+
+	l.observed = b
+	return nil
+}
+
+// locked runs fn while holding a mutex file to serialize updates across
+// processes. Mutex files left behind by crashed processes are removed after
+// fileLockStale.
+func (l *fileLock) locked(fn func() error) error {
+	mutex := l.path + ".lock"
+	if err := os.MkdirAll(filepath.Dir(mutex), 0o755); err != nil {
+		return fmt.Errorf("create lock directory: %w", err)
+	}
+
+	for i := 0; ; i++ {
+		f, err := os.OpenFile(mutex, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err == nil {
+			_ = f.Close()
+			break
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return fmt.Errorf("create mutex file: %w", err)
+		}
+
+		if info, err := os.Stat(mutex); err == nil && time.Since(info.ModTime()) > fileLockStale {
+			_ = os.Remove(mutex)
+			continue
+		}
+
+		if i == fileLockRetries {
+			return fmt.Errorf("mutex file %q is held by another process", mutex)
+		}
+		time.Sleep(fileLockInterval)
+	}
+	defer os.Remove(mutex)
+
+	return fn()
+}
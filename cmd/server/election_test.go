@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/embano1/memlog"
+	"github.com/embano1/vsphere/logger"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/poll"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	rl "k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+func Test_fileLock(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "leader.json")
+
+	a := fileLock{path: path, identity: "http://a:8080"}
+	b := fileLock{path: path, identity: "http://b:8080"}
+
+	_, _, err := a.Get(ctx)
+	assert.Assert(t, apierrors.IsNotFound(err), "got %v", err)
+
+	rec := rl.LeaderElectionRecord{
+		HolderIdentity:       a.Identity(),
+		LeaseDurationSeconds: 15,
+		AcquireTime:          metav1.Now(),
+		RenewTime:            metav1.Now(),
+	}
+	assert.NilError(t, a.Create(ctx, rec))
+	assert.Assert(t, apierrors.IsAlreadyExists(b.Create(ctx, rec)))
+
+	got, _, err := b.Get(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, got.HolderIdentity, "http://a:8080")
+
+	// renew
+	rec.RenewTime = metav1.NewTime(rec.RenewTime.Add(time.Second))
+	assert.NilError(t, a.Update(ctx, rec))
+
+	// b observed a stale record
+	rec.HolderIdentity = b.Identity()
+	assert.Assert(t, apierrors.IsConflict(b.Update(ctx, rec)))
+
+	_, _, err = b.Get(ctx)
+	assert.NilError(t, err)
+	assert.NilError(t, b.Update(ctx, rec))
+
+	got, _, err = a.Get(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, got.HolderIdentity, "http://b:8080")
+}
+
+func Test_election(t *testing.T) {
+	ctx := logger.Set(context.Background(), zaptest.NewLogger(t))
+	lockFile := filepath.Join(t.TempDir(), "leader.json")
+
+	type instance struct {
+		name       string
+		srv        *server
+		collecting atomic.Bool
+		cancel     context.CancelFunc
+		errCh      chan error
+	}
+
+	start := func(t *testing.T, name string) *instance {
+		t.Helper()
+
+		i := instance{name: name, srv: &server{ready: make(chan struct{})}, errCh: make(chan error, 1)}
+		i.srv.times = newTimeIndex(timeIndexInterval)
+		i.srv.indexers = []indexer{i.srv.times}
+
+		ts := httptest.NewServer(i.srv.routes(ctx))
+		t.Cleanup(ts.Close)
+
+		cfg := defaultConfig()
+		cfg.Log.MaxSegmentSize = 1000
+		cfg.Log.MaxRecordSize = 1024
+		cfg.Election = electionConfig{
+			Backend:       electionBackendFile,
+			AdvertiseURL:  ts.URL,
+			LeaseName:     "test",
+			LockFile:      lockFile,
+			LeaseDuration: duration{time.Second},
+			RenewDeadline: duration{500 * time.Millisecond},
+			RetryPeriod:   duration{100 * time.Millisecond},
+		}
+
+		lock, err := newLeaderLock(cfg.Election)
+		assert.NilError(t, err)
+
+		// writes an event every few milliseconds continuing the log
+		collect := func(ctx context.Context) error {
+			i.collecting.Store(true)
+			defer i.collecting.Store(false)
+
+			if err := i.srv.initializeLog(ctx, 100, cfg.Log.MaxSegmentSize, cfg.Log.MaxRecordSize); err != nil {
+				return err
+			}
+
+			for {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(5 * time.Millisecond):
+				}
+
+				i.srv.mu.Lock()
+				next := i.srv.nextOffset(ctx)
+				i.srv.mu.Unlock()
+
+				e := ce.NewEvent()
+				e.SetID(strconv.Itoa(int(next)))
+				e.SetType("test.event.v0")
+				e.SetSource(i.name)
+				e.SetTime(time.Now().UTC())
+
+				b, err := json.Marshal(e)
+				if err != nil {
+					return err
+				}
+				if _, err = i.srv.appendRecord(ctx, next, &e, b); err != nil {
+					return err
+				}
+			}
+		}
+
+		ictx, cancel := context.WithCancel(ctx)
+		i.cancel = cancel
+		go func() {
+			i.errCh <- newElection(i.srv, lock, cfg, collect).run(ictx)
+		}()
+
+		return &i
+	}
+
+	latest := func(i *instance) memlog.Offset {
+		log, err := i.srv.waitLog(ctx)
+		assert.NilError(t, err)
+		_, latest := log.Range(ctx)
+		return latest
+	}
+
+	a := start(t, "a")
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		if !a.collecting.Load() {
+			return poll.Continue("a is not leading")
+		}
+		return poll.Success()
+	}, poll.WithTimeout(5*time.Second))
+
+	b := start(t, "b")
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		if got := latest(b); got < 120 {
+			return poll.Continue("b replicated up to %d", got)
+		}
+		return poll.Success()
+	}, poll.WithTimeout(5*time.Second))
+	assert.Assert(t, !b.collecting.Load())
+
+	// failover
+	a.cancel()
+	assert.ErrorIs(t, <-a.errCh, context.Canceled)
+	takeover := latest(b)
+
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		if !b.collecting.Load() {
+			return poll.Continue("b is not leading")
+		}
+		if got := latest(b); got < takeover+20 {
+			return poll.Continue("b collected up to %d", got)
+		}
+		return poll.Success()
+	}, poll.WithTimeout(5*time.Second))
+
+	b.cancel()
+	assert.ErrorIs(t, <-b.errCh, context.Canceled)
+
+	// b log continues the replicated log of a with identical offsets
+	earliest, end := b.srv.log.Range(ctx)
+	assert.Equal(t, earliest, memlog.Offset(100))
+
+	sources := map[string]int{}
+	for offset := earliest; offset <= end; offset++ {
+		rec, err := b.srv.log.Read(ctx, offset)
+		assert.NilError(t, err)
+
+		var e ce.Event
+		assert.NilError(t, json.Unmarshal(rec.Data, &e))
+		assert.Equal(t, e.ID(), strconv.Itoa(int(offset)))
+		sources[e.Source()]++
+	}
+	assert.Assert(t, sources["a"] > 0)
+	assert.Assert(t, sources["b"] > 0)
+}
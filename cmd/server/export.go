@@ -0,0 +1,323 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/embano1/memlog"
+	"github.com/embano1/vsphere/logger"
+	"github.com/julienschmidt/httprouter"
+	"go.uber.org/zap"
+)
+
+const (
+	fromKey         = "from"
+	toKey           = "to"
+	formatKey       = "format"
+	exportBatchSize = 100 // records read and flushed at once
+
+	formatNDJSON = "ndjson"
+	formatGzip   = "ndjson.gz"
+	formatBatch  = "batch"
+
+	contentTypeNDJSON = "application/x-ndjson"
+	contentTypeGzip   = "application/gzip"
+	contentTypeBatch  = "application/cloudevents-batch+json"
+)
+
+// bound is an export range boundary specified as offset or time
+type bound struct {
+	offset memlog.Offset
+	time   time.Time // used if not zero
+}
+
+// parseBound parses an offset or RFC3339 timestamp
+func parseBound(val string) (bound, error) {
+	if offset, err := strconv.Atoi(val); err == nil {
+		if offset < 0 {
+			return bound{}, errors.New("offset must not be negative")
+		}
+		return bound{offset: memlog.Offset(offset)}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		return bound{}, errors.New("must be an offset or RFC3339 timestamp")
+	}
+
+	return bound{time: t}, nil
+}
+
+// boundValue parses the bound query parameter specified by key, using def as the
+// default offset
+func boundValue(r *http.Request, key string, def memlog.Offset) (bound, error) {
+	val := r.FormValue(key)
+	if val == "" {
+		return bound{offset: def}, nil
+	}
+
+	b, err := parseBound(html.EscapeString(val))
+	if err != nil {
+		return bound{}, fmt.Errorf("invalid %s parameter: %w", key, err)
+	}
+
+	return b, nil
+}
+
+// recordWriter encodes records in an export format
+type recordWriter interface {
+	begin() error
+	write(data []byte) error
+	end() error
+	flush() error
+}
+
+type ndjsonWriter struct {
+	w io.Writer
+}
+
+func (n *ndjsonWriter) begin() error { return nil }
+
+func (n *ndjsonWriter) write(data []byte) error {
+	if _, err := n.w.Write(data); err != nil {
+		return err
+	}
+	_, err := n.w.Write([]byte{'\n'})
+	return err
+}
+
+func (n *ndjsonWriter) end() error   { return nil }
+func (n *ndjsonWriter) flush() error { return nil }
+
+type gzipWriter struct {
+	ndjsonWriter
+	gz *gzip.Writer
+}
+
+func newGzipWriter(w io.Writer) *gzipWriter {
+	gz := gzip.NewWriter(w)
+	return &gzipWriter{ndjsonWriter: ndjsonWriter{w: gz}, gz: gz}
+}
+
+func (g *gzipWriter) end() error   { return g.gz.Close() }
+func (g *gzipWriter) flush() error { return g.gz.Flush() }
+
+// batchWriter writes a JSON array of cloudevents
+type batchWriter struct {
+	w     io.Writer
+	first bool
+}
+
+func (b *batchWriter) begin() error {
+	b.first = true
+	_, err := b.w.Write([]byte{'['})
+	return err
+}
+
+func (b *batchWriter) write(data []byte) error {
+	if !b.first {
+		if _, err := b.w.Write([]byte{','}); err != nil {
+			return err
+		}
+	}
+	b.first = false
+	_, err := b.w.Write(data)
+	return err
+}
+
+func (b *batchWriter) end() error {
+	_, err := b.w.Write([]byte{']', '\n'})
+	return err
+}
+
+func (b *batchWriter) flush() error { return nil }
+
+// exportEvents streams the records in the requested offset or time range
+// (inclusive). Without range parameters all records are exported.
+//
+// Supported formats are "ndjson" (default), "ndjson.gz" and "batch"
+// (CloudEvents JSON batch).
+func (s *server) exportEvents(ctx context.Context) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		log := logger.Get(ctx)
+
+		format := formatNDJSON
+		if val := r.FormValue(formatKey); val != "" {
+			format = html.EscapeString(val)
+		}
+
+		var (
+			ext         string
+			contentType string
+			rw          recordWriter
+		)
+		switch format {
+		case formatNDJSON:
+			ext, contentType, rw = "ndjson", contentTypeNDJSON, &ndjsonWriter{w: w}
+		case formatGzip:
+			ext, contentType, rw = "ndjson.gz", contentTypeGzip, newGzipWriter(w)
+		case formatBatch:
+			ext, contentType, rw = "json", contentTypeBatch, &batchWriter{w: w}
+		default:
+			invalidParameter(w, "invalid format parameter")
+			return
+		}
+
+		rctx := r.Context()
+		earliest, latest := s.log.Range(rctx)
+		if latest == -1 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		from, err := boundValue(r, fromKey, earliest)
+		if err != nil {
+			invalidParameter(w, err.Error())
+			return
+		}
+
+		to, err := boundValue(r, toKey, latest)
+		if err != nil {
+			invalidParameter(w, err.Error())
+			return
+		}
+
+		// time bounds are applied while reading, starting with the first record
+		// at or after from
+		start, end := earliest, latest
+		if from.time.IsZero() {
+			start = from.offset
+		} else {
+			offset, err := s.offsetAt(rctx, from.time)
+			switch {
+			case err == nil:
+				start = offset
+			case errors.Is(err, errNoRecordAfter):
+				// latest is filtered by time and the export is empty
+				start = latest
+			case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+				return
+			default:
+				log.Error("seek offset", zap.Error(err))
+				internalError(w)
+				return
+			}
+		}
+		if to.time.IsZero() {
+			end = to.offset
+		}
+
+		if start < earliest {
+			s.offsetProblem(r.Context(), w, start, memlog.ErrOutOfRange)
+			return
+		}
+		if start > latest {
+			s.offsetProblem(r.Context(), w, start, memlog.ErrFutureOffset)
+			return
+		}
+		if end < start {
+			invalidParameter(w, "invalid range: from must not be after to")
+			return
+		}
+		if end > latest {
+			end = latest
+		}
+
+		flusher, _ := w.(http.Flusher)
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"events-%d-%d.%s\"", start, end, ext))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+
+		if err = s.export(rctx, rw, flusher, start, end, from.time, to.time); err != nil {
+			// status already sent
+			if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+				log.Error("export events", zap.Error(err))
+			}
+		}
+	}
+}
+
+// export writes the records between start and end offset (inclusive) with a
+// cloudevent time within the optional time range
+func (s *server) export(ctx context.Context, rw recordWriter, flusher http.Flusher, start, end memlog.Offset, from, to time.Time) error {
+	if err := rw.begin(); err != nil {
+		return fmt.Errorf("write export header: %w", err)
+	}
+
+	batch := make([]memlog.Record, exportBatchSize)
+	for offset := start; offset <= end; {
+		size := exportBatchSize
+		if remaining := int(end-offset) + 1; remaining < size {
+			size = remaining
+		}
+
+		count, err := s.log.ReadBatch(ctx, offset, batch[:size])
+		if err != nil && !errors.Is(err, memlog.ErrFutureOffset) {
+			if errors.Is(err, memlog.ErrOutOfRange) {
+				return fmt.Errorf("records purged during export at offset %d: %w", offset, err)
+			}
+			return fmt.Errorf("read records: %w", err)
+		}
+
+		for _, rec := range batch[:count] {
+			ok, err := inTimeRange(rec.Data, from, to)
+			if err != nil {
+				return fmt.Errorf("read cloudevent time at offset %d: %w", rec.Metadata.Offset, err)
+			}
+			if !ok {
+				continue
+			}
+
+			if err = rw.write(rec.Data); err != nil {
+				return fmt.Errorf("write record: %w", err)
+			}
+		}
+
+		if err = rw.flush(); err != nil {
+			return fmt.Errorf("flush records: %w", err)
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		if count == 0 {
+			break
+		}
+		offset += memlog.Offset(count)
+	}
+
+	if err := rw.end(); err != nil {
+		return fmt.Errorf("write export trailer: %w", err)
+	}
+
+	return nil
+}
+
+// inTimeRange returns whether the cloudevent time is within the (optional)
+// from and to boundaries (inclusive)
+func inTimeRange(data []byte, from, to time.Time) (bool, error) {
+	if from.IsZero() && to.IsZero() {
+		return true, nil
+	}
+
+	t, err := recordTime(data)
+	if err != nil {
+		return false, err
+	}
+
+	if !from.IsZero() && t.Before(from) {
+		return false, nil
+	}
+	if !to.IsZero() && t.After(to) {
+		return false, nil
+	}
+
+	return true, nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/embano1/memlog"
+	"github.com/embano1/vsphere/logger"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/v3/assert"
+)
+
+func Test_exportEvents(t *testing.T) {
+	tests := []struct {
+		name            string
+		size            int
+		data            [][]byte
+		params          map[string]string
+		wantCode        int
+		wantContentType string
+		want            string
+	}{
+		{
+			name:            "204 on empty log",
+			size:            10,
+			data:            nil,
+			wantCode:        http.StatusNoContent,
+			wantContentType: "",
+			want:            "",
+		},
+		{
+			name:            "200 exports all records as ndjson",
+			size:            10,
+			data:            createData(3),
+			wantCode:        http.StatusOK,
+			wantContentType: contentTypeNDJSON,
+			want:            "0\n1\n2\n",
+		},
+		{
+			name:            "200 exports offset range as ndjson",
+			size:            10,
+			data:            createData(10),
+			params:          map[string]string{fromKey: "3", toKey: "5"},
+			wantCode:        http.StatusOK,
+			wantContentType: contentTypeNDJSON,
+			want:            "3\n4\n5\n",
+		},
+		{
+			name:            "200 exports range larger than batch size",
+			size:            200,
+			data:            createData(250),
+			params:          map[string]string{fromKey: "98", toKey: "201"},
+			wantCode:        http.StatusOK,
+			wantContentType: contentTypeNDJSON,
+			want:            joinData(98, 201, "\n") + "\n",
+		},
+		{
+			name:            "200 to beyond latest is truncated",
+			size:            10,
+			data:            createData(5),
+			params:          map[string]string{fromKey: "3", toKey: "100"},
+			wantCode:        http.StatusOK,
+			wantContentType: contentTypeNDJSON,
+			want:            "3\n4\n",
+		},
+		{
+			name:            "200 exports offset range as cloudevents batch",
+			size:            10,
+			data:            createData(10),
+			params:          map[string]string{fromKey: "3", toKey: "5", formatKey: formatBatch},
+			wantCode:        http.StatusOK,
+			wantContentType: contentTypeBatch,
+			want:            "[3,4,5]\n",
+		},
+		{
+			name:            "400 invalid format",
+			size:            10,
+			data:            createData(10),
+			params:          map[string]string{formatKey: "xml"},
+			wantCode:        http.StatusBadRequest,
+			wantContentType: contentTypeProblem,
+			want:            `{"title":"Bad Request","status":400,"detail":"invalid format parameter","code":"invalid_parameter","requestId":"test-request"}` + "\n",
+		},
+		{
+			name:            "400 invalid from",
+			size:            10,
+			data:            createData(10),
+			params:          map[string]string{fromKey: "yesterday"},
+			wantCode:        http.StatusBadRequest,
+			wantContentType: contentTypeProblem,
+			want:            `{"title":"Bad Request","status":400,"detail":"invalid from parameter: must be an offset or RFC3339 timestamp","code":"invalid_parameter","requestId":"test-request"}` + "\n",
+		},
+		{
+			name:            "400 from after to",
+			size:            10,
+			data:            createData(10),
+			params:          map[string]string{fromKey: "5", toKey: "3"},
+			wantCode:        http.StatusBadRequest,
+			wantContentType: contentTypeProblem,
+			want:            `{"title":"Bad Request","status":400,"detail":"invalid range: from must not be after to","code":"invalid_parameter","requestId":"test-request"}` + "\n",
+		},
+		{
+			name:            "410 from purged",
+			size:            5,
+			data:            createData(20),
+			params:          map[string]string{fromKey: "3"},
+			wantCode:        http.StatusGone,
+			wantContentType: contentTypeProblem,
+			want:            `{"title":"Gone","status":410,"detail":"invalid offset: offset out of range","code":"offset_out_of_range","requestId":"test-request","offset":3,"range":{"earliest":10,"latest":19}}` + "\n",
+		},
+		{
+			name:            "400 from in future",
+			size:            10,
+			data:            createData(5),
+			params:          map[string]string{fromKey: "10"},
+			wantCode:        http.StatusBadRequest,
+			wantContentType: contentTypeProblem,
+			want:            `{"title":"Bad Request","status":400,"detail":"invalid offset: future offset","code":"offset_in_future","requestId":"test-request","offset":10,"range":{"earliest":0,"latest":4}}` + "\n",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := logger.Set(context.Background(), zaptest.NewLogger(t))
+			log, err := memlog.New(ctx, memlog.WithMaxSegmentSize(tc.size))
+			assert.NilError(t, err)
+
+			for _, v := range tc.data {
+				_, err = log.Write(ctx, v)
+				assert.NilError(t, err)
+			}
+
+			srv := server{
+				log: wrapLog(t, log),
+			}
+
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/export", nil)
+			q := req.URL.Query()
+			for k, v := range tc.params {
+				q.Add(k, v)
+			}
+			req.URL.RawQuery = q.Encode()
+			req.Header.Set(requestIDHeader, "test-request")
+
+			h := srv.exportEvents(ctx)
+			withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				h(w, r, nil)
+			})).ServeHTTP(rec, req)
+
+			assert.Equal(t, rec.Result().StatusCode, tc.wantCode)
+			assert.Equal(t, rec.Result().Header.Get("content-type"), tc.wantContentType)
+			assert.Equal(t, rec.Body.String(), tc.want)
+		})
+	}
+}
+
+func Test_exportEventsGzipTimeRange(t *testing.T) {
+	ctx := logger.Set(context.Background(), zaptest.NewLogger(t))
+	log, err := memlog.New(ctx)
+	assert.NilError(t, err)
+
+	begin := time.Date(2022, 1, 14, 14, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		e := ce.NewEvent()
+		e.SetID(strconv.Itoa(i))
+		e.SetType("test.event.v0")
+		e.SetTime(begin.Add(time.Duration(i) * time.Minute))
+		e.SetSource("/test/source")
+
+		b, err := json.Marshal(e)
+		assert.NilError(t, err)
+
+		_, err = log.Write(ctx, b)
+		assert.NilError(t, err)
+	}
+
+	srv := server{
+		log: wrapLog(t, log),
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/export", nil)
+	q := req.URL.Query()
+	q.Add(fromKey, begin.Add(2*time.Minute).Format(time.RFC3339))
+	q.Add(toKey, begin.Add(4*time.Minute).Format(time.RFC3339))
+	q.Add(formatKey, formatGzip)
+	req.URL.RawQuery = q.Encode()
+
+	h := srv.exportEvents(ctx)
+	h(rec, req, nil)
+
+	assert.Equal(t, rec.Result().StatusCode, http.StatusOK)
+	assert.Equal(t, rec.Result().Header.Get("content-type"), contentTypeGzip)
+	assert.Equal(t, rec.Result().Header.Get("content-disposition"), `attachment; filename="events-2-9.ndjson.gz"`)
+
+	gz, err := gzip.NewReader(rec.Body)
+	assert.NilError(t, err)
+
+	dec := json.NewDecoder(gz)
+	var ids []string
+	for {
+		var e ce.Event
+		if err = dec.Decode(&e); err == io.EOF {
+			break
+		}
+		assert.NilError(t, err)
+		ids = append(ids, e.ID())
+	}
+	assert.DeepEqual(t, ids, []string{"2", "3", "4"})
+}
+
+func Test_exportEventsSeeksTime(t *testing.T) {
+	ctx := logger.Set(context.Background(), zaptest.NewLogger(t))
+	srv := newTimedServer(t, ctx, 100, 50)
+
+	tests := []struct {
+		name            string
+		from            time.Time
+		wantDisposition string
+		want            []string
+	}{
+		{
+			name:            "starts at first record at or after from",
+			from:            indexBegin.Add(45 * time.Minute),
+			wantDisposition: `attachment; filename="events-45-49.json"`,
+			want:            idRange(45, 49),
+		},
+		{
+			name:            "empty export after latest record",
+			from:            indexBegin.Add(time.Hour),
+			wantDisposition: `attachment; filename="events-49-49.json"`,
+			want:            []string{},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/export", nil)
+			q := req.URL.Query()
+			q.Add(fromKey, tc.from.Format(time.RFC3339))
+			q.Add(formatKey, formatBatch)
+			req.URL.RawQuery = q.Encode()
+
+			srv.exportEvents(ctx)(rec, req, nil)
+			assert.Equal(t, rec.Code, http.StatusOK)
+			assert.Equal(t, rec.Result().Header.Get("content-disposition"), tc.wantDisposition)
+
+			var events []ce.Event
+			assert.NilError(t, json.NewDecoder(rec.Body).Decode(&events))
+			ids := []string{}
+			for _, e := range events {
+				ids = append(ids, e.ID())
+			}
+			assert.DeepEqual(t, ids, tc.want)
+		})
+	}
+}
+
+// joinData returns the string values from start to end (inclusive) separated by
+// sep
+func joinData(start, end int, sep string) string {
+	var s string
+	for i := start; i <= end; i++ {
+		if i > start {
+			s += sep
+		}
+		s += strconv.Itoa(i)
+	}
+	return s
+}
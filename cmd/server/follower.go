@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/embano1/memlog"
+	"github.com/embano1/vsphere/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	followRetryInterval = time.Second
+	maxErrorBodySize    = 1024
+	maxFrameOverhead    = 1024 // replication frame fields besides the record
+)
+
+var (
+	// errReplicaBehind is returned when the records to replicate have been
+	// purged from the leader log
+	errReplicaBehind = errors.New("replica fell behind leader log retention")
+	// errLeaderEmpty is returned when the leader log is empty or not
+	// initialized yet
+	errLeaderEmpty = errors.New("leader log is empty")
+)
+
+// follower replicates the log of a leader into the local log with identical
+// offsets
+type follower struct {
+	srv         *server
+	leader      *url.URL
+	http        *http.Client
+	segmentSize int
+	recordSize  int
+
+	mu           sync.Mutex // protects replication status
+	connected    bool
+	leaderLatest memlog.Offset
+	lastContact  time.Time
+}
+
+func newFollower(srv *server, leader string, segmentSize, recordSize int) (*follower, error) {
+	u, err := url.Parse(leader)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid leader address %q", leader)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + apiPath
+
+	return &follower{
+		srv:          srv,
+		leader:       u,
+		http:         &http.Client{},
+		segmentSize:  segmentSize,
+		recordSize:   recordSize,
+		leaderLatest: -1,
+	}, nil
+}
+
+// run replicates records until the context is cancelled. Connection errors are
+// retried, errReplicaBehind is returned if replication can not continue.
+func (f *follower) run(ctx context.Context) error {
+	l := logger.Get(ctx).With(zap.String("leader", f.leader.Host))
+	l.Info("following leader")
+
+	for {
+		err := f.replicate(ctx)
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case errors.Is(err, errReplicaBehind):
+			return err
+		case err != nil:
+			l.Warn("could not replicate from leader, retrying", zap.Error(err), zap.Duration("retry", followRetryInterval))
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(followRetryInterval):
+		}
+	}
+}
+
+// replicate streams records from the leader starting with the next local
+// offset until the connection is closed
+func (f *follower) replicate(ctx context.Context) error {
+	defer f.setConnected(false)
+
+	if err := f.initializeLog(ctx); err != nil {
+		return err
+	}
+
+	f.srv.mu.Lock()
+	next := f.srv.nextOffset(ctx)
+	f.srv.mu.Unlock()
+
+	q := url.Values{}
+	q.Set(watchKey, "true")
+	q.Set(offsetKey, strconv.Itoa(int(next)))
+
+	res, err := f.get(ctx, "/internal/replication", q)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	f.setConnected(true)
+
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), f.recordSize+maxFrameOverhead)
+	for scanner.Scan() {
+		var frame replicationFrame
+		if err = json.Unmarshal(scanner.Bytes(), &frame); err != nil {
+			return fmt.Errorf("unmarshal replication frame: %w", err)
+		}
+
+		if len(frame.Record) > 0 {
+			if err = f.append(ctx, frame.Record); err != nil {
+				return err
+			}
+		}
+		f.contact(frame.Latest)
+	}
+	return scanner.Err()
+}
+
+// initializeLog creates the local log starting at the earliest leader offset
+func (f *follower) initializeLog(ctx context.Context) error {
+	f.srv.mu.Lock()
+	initialized := f.srv.log != nil
+	f.srv.mu.Unlock()
+
+	if initialized {
+		return nil
+	}
+
+	res, err := f.get(ctx, "/range", nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNoContent {
+		return errLeaderEmpty
+	}
+
+	var r logRange
+	if err = json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return fmt.Errorf("decode leader range: %w", err)
+	}
+
+	return f.srv.initializeLog(ctx, r.Earliest, f.segmentSize, f.recordSize)
+}
+
+// status returns the replication status
+func (f *follower) status() replicationStatus {
+	f.srv.mu.Lock()
+	latest := memlog.Offset(-1)
+	if f.srv.log != nil {
+		_, latest = f.srv.log.Range(context.Background())
+	}
+	f.srv.mu.Unlock()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	leader := *f.leader
+	leader.Path = strings.TrimSuffix(leader.Path, apiPath)
+	s := replicationStatus{
+		Primary:       leader.Redacted(),
+		Connected:     f.connected,
+		Latest:        latest,
+		PrimaryLatest: f.leaderLatest,
+	}
+	if f.leaderLatest > latest {
+		s.Lag = int64(f.leaderLatest - latest)
+	}
+	if !f.lastContact.IsZero() {
+		t := f.lastContact
+		s.LastContact = &t
+	}
+	return s
+}
+
+func (f *follower) setConnected(connected bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.connected = connected
+}
+
+// contact records the latest leader offset received on the replication stream
+func (f *follower) contact(latest memlog.Offset) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.leaderLatest = latest
+	f.lastContact = time.Now().UTC()
+}
+
+// append writes the record to the local log. Records must be contiguous. data
+// must not be modified after the call.
+func (f *follower) append(ctx context.Context, data []byte) error {
+	var e ce.Event
+	if err := json.Unmarshal(data, &e); err != nil {
+		return fmt.Errorf("unmarshal cloudevent: %w", err)
+	}
+
+	offset, err := strconv.Atoi(e.ID())
+	if err != nil {
+		return fmt.Errorf("event id %q is not an offset", e.ID())
+	}
+
+	f.srv.mu.Lock()
+	defer f.srv.mu.Unlock()
+
+	next := f.srv.nextOffset(ctx)
+	switch {
+	case memlog.Offset(offset) < next:
+		return nil
+	case memlog.Offset(offset) > next:
+		return fmt.Errorf("%w: expected offset %d, got %d", errReplicaBehind, next, offset)
+	}
+
+	return f.srv.write(ctx, &e, data)
+}
+
+// get sends a GET request to the leader api and returns the response if the
+// status code indicates success. The caller must close the response body.
+func (f *follower) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	u := *f.leader
+	u.Path += path
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+
+	res, err := f.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("send request: %w", err)
+	}
+
+	if res.StatusCode > 299 {
+		defer res.Body.Close()
+		b, _ := io.ReadAll(io.LimitReader(res.Body, maxErrorBodySize))
+		msg := strings.TrimSpace(string(b))
+		// 400 from leaders without problem responses
+		if res.StatusCode == http.StatusGone || res.StatusCode == http.StatusBadRequest && strings.Contains(msg, memlog.ErrOutOfRange.Error()) {
+			return nil, fmt.Errorf("%w: %s", errReplicaBehind, msg)
+		}
+		if res.StatusCode == http.StatusServiceUnavailable {
+			return nil, fmt.Errorf("%w: %s", errLeaderEmpty, msg)
+		}
+		return nil, fmt.Errorf("unexpected status code %d: %s", res.StatusCode, msg)
+	}
+
+	return res, nil
+}
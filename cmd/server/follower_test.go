@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/embano1/memlog"
+	"github.com/embano1/vsphere/logger"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/poll"
+)
+
+func Test_follower(t *testing.T) {
+	ctx := logger.Set(context.Background(), zaptest.NewLogger(t))
+
+	// leader log contains offsets 10-29
+	leader := newTimedServer(t, ctx, 10, 30)
+	ts := httptest.NewServer(leader.routes(ctx))
+	defer ts.Close()
+
+	t.Run("replicates with identical offsets", func(t *testing.T) {
+		srv := server{ready: make(chan struct{})}
+		srv.times = newTimeIndex(timeIndexInterval)
+		srv.indexers = []indexer{srv.times}
+
+		f, err := newFollower(&srv, ts.URL, 10, 1024)
+		assert.NilError(t, err)
+
+		fctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- f.run(fctx)
+		}()
+
+		poll.WaitOn(t, func(poll.LogT) poll.Result {
+			log, err := srv.waitLog(fctx)
+			if err != nil {
+				return poll.Error(err)
+			}
+			if earliest, latest := log.Range(ctx); earliest != 10 || latest != 29 {
+				return poll.Continue("replicated range %d-%d", earliest, latest)
+			}
+			return poll.Success()
+		}, poll.WithTimeout(5*time.Second))
+
+		// leader continues, purging 10-19 in both logs
+		appendEvents(t, ctx, leader, 3)
+		poll.WaitOn(t, func(poll.LogT) poll.Result {
+			if _, latest := srv.log.Range(ctx); latest != 32 {
+				return poll.Continue("replicated up to %d", latest)
+			}
+			return poll.Success()
+		}, poll.WithTimeout(5*time.Second))
+
+		for _, o := range []memlog.Offset{20, 32} {
+			want, err := leader.log.Read(ctx, o)
+			assert.NilError(t, err)
+			got, err := srv.log.Read(ctx, o)
+			assert.NilError(t, err)
+			assert.DeepEqual(t, got.Data, want.Data)
+		}
+
+		// lag is reported once the replica caught up
+		poll.WaitOn(t, func(poll.LogT) poll.Result {
+			if got := f.status(); got.PrimaryLatest != 32 {
+				return poll.Continue("primary latest is %d", got.PrimaryLatest)
+			}
+			return poll.Success()
+		}, poll.WithTimeout(5*time.Second))
+
+		status := f.status()
+		assert.Equal(t, status.Primary, ts.URL)
+		assert.Assert(t, status.Connected)
+		assert.Equal(t, status.Latest, memlog.Offset(32))
+		assert.Equal(t, status.Lag, int64(0))
+		assert.Assert(t, status.LastContact != nil)
+
+		// time index is maintained
+		offset, err := srv.offsetAt(ctx, indexBegin.Add(25*time.Minute))
+		assert.NilError(t, err)
+		assert.Equal(t, offset, memlog.Offset(25))
+
+		cancel()
+		assert.ErrorIs(t, <-errCh, context.Canceled)
+	})
+
+	t.Run("replicates records byte for byte", func(t *testing.T) {
+		srv := server{ready: make(chan struct{})}
+		f, err := newFollower(&srv, ts.URL, 10, 1024)
+		assert.NilError(t, err)
+
+		fctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- f.run(fctx)
+		}()
+
+		leader.mu.Lock()
+		next := leader.nextOffset(ctx)
+		leader.mu.Unlock()
+
+		// written as is, json.Marshal would escape the html characters
+		e := ce.NewEvent()
+		e.SetID(strconv.Itoa(int(next)))
+		e.SetType("test.event.v0")
+		e.SetTime(indexBegin.Add(time.Duration(next) * time.Minute))
+		e.SetSource("/test/source")
+		data := fmt.Sprintf(`{"specversion":"1.0","id":"%d","source":"/test/source","type":"test.event.v0","time":%q,"data":{"FullFormattedMessage":"a<b & c>d"}}`,
+			next, e.Time().Format(time.RFC3339Nano))
+
+		written, err := leader.appendRecord(ctx, next, &e, []byte(data))
+		assert.NilError(t, err)
+		assert.Assert(t, written)
+
+		poll.WaitOn(t, func(poll.LogT) poll.Result {
+			log, err := srv.waitLog(fctx)
+			if err != nil {
+				return poll.Error(err)
+			}
+			if _, latest := log.Range(ctx); latest != next {
+				return poll.Continue("replicated up to %d", latest)
+			}
+			return poll.Success()
+		}, poll.WithTimeout(5*time.Second))
+
+		got, err := srv.log.Read(ctx, next)
+		assert.NilError(t, err)
+		assert.Equal(t, string(got.Data), data)
+
+		cancel()
+		assert.ErrorIs(t, <-errCh, context.Canceled)
+	})
+
+	t.Run("fails when behind leader retention", func(t *testing.T) {
+		srv := server{ready: make(chan struct{})}
+		assert.NilError(t, srv.initializeLog(ctx, 0, 10, 1024))
+
+		f, err := newFollower(&srv, ts.URL, 10, 1024)
+		assert.NilError(t, err)
+
+		err = f.run(ctx)
+		assert.ErrorIs(t, err, errReplicaBehind)
+	})
+
+	t.Run("invalid leader address", func(t *testing.T) {
+		_, err := newFollower(&server{}, "leader:8080", 10, 1024)
+		assert.ErrorContains(t, err, "invalid leader address")
+	})
+}
+
+// appendEvents appends count events continuing the log of a server created
+// with newTimedServer
+func appendEvents(t *testing.T, ctx context.Context, srv *server, count int) {
+	t.Helper()
+
+	for i := 0; i < count; i++ {
+		srv.mu.Lock()
+		next := srv.nextOffset(ctx)
+		srv.mu.Unlock()
+
+		e := ce.NewEvent()
+		e.SetID(strconv.Itoa(int(next)))
+		e.SetType("test.event.v0")
+		e.SetTime(indexBegin.Add(time.Duration(next) * time.Minute))
+		e.SetSource("/test/source")
+
+		b, err := json.Marshal(e)
+		assert.NilError(t, err)
+
+		written, err := srv.appendRecord(ctx, next, &e, b)
+		assert.NilError(t, err)
+		assert.Assert(t, written)
+	}
+}
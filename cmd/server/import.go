@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/embano1/memlog"
+	"github.com/embano1/vsphere/logger"
+	"github.com/julienschmidt/httprouter"
+	"go.uber.org/zap"
+)
+
+var (
+	// errImportGap is returned when archive records are not contiguous or do
+	// not continue the log
+	errImportGap = errors.New("offsets not contiguous")
+	// errLogNotReady is returned when the log is not initialized yet
+	errLogNotReady = errors.New("log not initialized")
+	// errInvalidArchive is returned when the archive can not be decoded
+	errInvalidArchive = errors.New("invalid archive")
+)
+
+// archiveRecord is a cloudevent read from an export archive with the offset
+// derived from its ID
+type archiveRecord struct {
+	offset memlog.Offset
+	event  ce.Event
+	data   []byte
+}
+
+type importResult struct {
+	Imported int           `json:"imported"`
+	Skipped  int           `json:"skipped"` // already in log
+	Earliest memlog.Offset `json:"earliest"`
+	Latest   memlog.Offset `json:"latest"`
+
+	lastTime time.Time // of the last imported record
+}
+
+// archiveReader decodes cloudevents one at a time in the formats written by the
+// export endpoint, i.e. (gzip-compressed) NDJSON or a CloudEvents JSON batch,
+// without reading the whole archive into memory. Records must have contiguous
+// offsets in ascending order.
+type archiveReader struct {
+	dec    *json.Decoder
+	gz     *gzip.Reader // nil if not compressed
+	batch  bool
+	count  int // records read
+	last   memlog.Offset
+	peeked *archiveRecord
+}
+
+func newArchiveReader(r io.Reader) (*archiveReader, error) {
+	var ar archiveReader
+	br := bufio.NewReader(r)
+
+	// gzip magic number
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("create gzip reader: %w", err)
+		}
+		ar.gz = gz
+		br = bufio.NewReader(gz)
+	}
+
+	first, err := firstByte(br)
+	if err != nil {
+		ar.close()
+		return nil, err
+	}
+
+	ar.dec = json.NewDecoder(br)
+	if first == '[' {
+		// consume opening bracket
+		if _, err = ar.dec.Token(); err != nil {
+			ar.close()
+			return nil, fmt.Errorf("decode cloudevents batch: %w", err)
+		}
+		ar.batch = true
+	}
+
+	return &ar, nil
+}
+
+// next returns the next record or io.EOF at the end of the archive
+func (ar *archiveReader) next() (archiveRecord, error) {
+	if rec := ar.peeked; rec != nil {
+		ar.peeked = nil
+		return *rec, nil
+	}
+	return ar.read()
+}
+
+// peek returns the next record without consuming it
+func (ar *archiveReader) peek() (archiveRecord, error) {
+	if ar.peeked == nil {
+		rec, err := ar.read()
+		if err != nil {
+			return archiveRecord{}, err
+		}
+		ar.peeked = &rec
+	}
+	return *ar.peeked, nil
+}
+
+func (ar *archiveReader) read() (archiveRecord, error) {
+	i := ar.count
+
+	var m json.RawMessage
+	if ar.batch && !ar.dec.More() {
+		if _, err := ar.dec.Token(); err != nil {
+			return archiveRecord{}, fmt.Errorf("decode cloudevents batch: %w", err)
+		}
+		return archiveRecord{}, io.EOF
+	}
+	if err := ar.dec.Decode(&m); err != nil {
+		if !ar.batch && errors.Is(err, io.EOF) {
+			return archiveRecord{}, io.EOF
+		}
+		return archiveRecord{}, fmt.Errorf("decode cloudevent %d: %w", i, err)
+	}
+
+	var e ce.Event
+	if err := json.Unmarshal(m, &e); err != nil {
+		return archiveRecord{}, fmt.Errorf("decode cloudevent %d: %w", i, err)
+	}
+	if err := e.Validate(); err != nil {
+		return archiveRecord{}, fmt.Errorf("invalid cloudevent %d: %w", i, err)
+	}
+
+	id, err := strconv.Atoi(e.ID())
+	if err != nil {
+		return archiveRecord{}, fmt.Errorf("cloudevent %d: id %q is not an offset", i, e.ID())
+	}
+	offset := memlog.Offset(id)
+
+	if i > 0 && offset != ar.last+1 {
+		return archiveRecord{}, fmt.Errorf("cloudevent %d: expected offset %d, got %d: %w", i, ar.last+1, offset, errImportGap)
+	}
+
+	var b bytes.Buffer
+	if err = json.Compact(&b, m); err != nil {
+		return archiveRecord{}, fmt.Errorf("compact cloudevent %d: %w", i, err)
+	}
+
+	ar.count++
+	ar.last = offset
+	return archiveRecord{offset: offset, event: e, data: b.Bytes()}, nil
+}
+
+func (ar *archiveReader) close() {
+	if ar.gz != nil {
+		_ = ar.gz.Close()
+	}
+}
+
+// firstByte returns the first non-whitespace byte without consuming it
+func firstByte(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return 0, errors.New("empty archive")
+			}
+			return 0, fmt.Errorf("read archive: %w", err)
+		}
+
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			if _, err = br.Discard(1); err != nil {
+				return 0, err
+			}
+		default:
+			return b[0], nil
+		}
+	}
+}
+
+// importRecords appends the records read from the archive to the initialized
+// log. Records already in the log are skipped, the remaining records must
+// continue the log without gaps. Records are written as they are read, so
+// records before an invalid record are imported. Decoding errors are returned
+// as errInvalidArchive, gaps in the archive as errImportGap.
+func (s *server) importRecords(ctx context.Context, ar *archiveReader) (importResult, error) {
+	var res importResult
+	for {
+		rec, err := ar.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if errors.Is(err, errImportGap) {
+				return res, err
+			}
+			return res, fmt.Errorf("%w: %w", errInvalidArchive, err)
+		}
+
+		if err = s.importRecord(ctx, &rec, &res); err != nil {
+			return res, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.log == nil {
+		return res, errLogNotReady
+	}
+	res.Earliest, res.Latest = s.log.Range(ctx)
+	return res, nil
+}
+
+// importRecord appends the record to the log unless already in the log. The
+// lock is only held per record to not block collecting while reading the
+// archive.
+func (s *server) importRecord(ctx context.Context, rec *archiveRecord, res *importResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.log == nil {
+		return errLogNotReady
+	}
+
+	next := s.nextOffset(ctx)
+	if rec.offset < next {
+		res.Skipped++
+		return nil
+	}
+	if rec.offset != next {
+		return fmt.Errorf("log continues at offset %d, got %d: %w", next, rec.offset, errImportGap)
+	}
+
+	if err := s.write(ctx, &rec.event, rec.data); err != nil {
+		return fmt.Errorf("write to log: %w", err)
+	}
+	res.Imported++
+	res.lastTime = rec.event.Time()
+	return nil
+}
+
+// importFile seeds the log with the records from the archive at path. The log
+// is initialized with the first archive offset if needed.
+func (s *server) importFile(ctx context.Context, path string, segmentSize, recordSize int) (importResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return importResult{}, fmt.Errorf("open archive: %w", err)
+	}
+	defer f.Close()
+
+	ar, err := newArchiveReader(f)
+	if err != nil {
+		return importResult{}, fmt.Errorf("read archive: %w", err)
+	}
+	defer ar.close()
+
+	first, err := ar.peek()
+	if errors.Is(err, io.EOF) {
+		return importResult{Earliest: -1, Latest: -1}, nil
+	}
+	if err != nil {
+		return importResult{}, fmt.Errorf("read archive: %w", err)
+	}
+
+	if err = s.initializeLog(ctx, first.offset, segmentSize, recordSize); err != nil {
+		return importResult{}, err
+	}
+
+	return s.importRecords(ctx, ar)
+}
+
+// archiveTooLarge writes the problem response for an archive exceeding the
+// upload limit
+func archiveTooLarge(w http.ResponseWriter, err *http.MaxBytesError) {
+	writeProblem(w, problem{
+		Status: http.StatusRequestEntityTooLarge,
+		Code:   codeInvalidParameter,
+		Detail: fmt.Sprintf("archive exceeds %d bytes", err.Limit),
+	})
+}
+
+// importEvents appends the cloudevents in the request body to the log
+func (s *server) importEvents(ctx context.Context) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		log := logger.Get(ctx)
+
+		if s.replica != nil {
+			conflict(w, "import not supported on read replica")
+			return
+		}
+
+		s.mu.Lock()
+		ready := s.log != nil
+		s.mu.Unlock()
+		if !ready {
+			logNotReady(w, errLogNotReady.Error())
+			return
+		}
+
+		// archives take longer to upload and import than regular requests
+		if timeout := s.imports.Timeout.Duration; timeout > 0 {
+			deadline := time.Now().Add(timeout)
+			rc := http.NewResponseController(w)
+			if err := rc.SetReadDeadline(deadline); err != nil {
+				log.Debug("could not extend read deadline", zap.Error(err))
+			}
+			if err := rc.SetWriteDeadline(deadline); err != nil {
+				log.Debug("could not extend write deadline", zap.Error(err))
+			}
+		}
+
+		body := r.Body
+		if s.imports.MaxBytes > 0 {
+			body = http.MaxBytesReader(w, r.Body, s.imports.MaxBytes)
+		}
+
+		var tooLarge *http.MaxBytesError
+		ar, err := newArchiveReader(body)
+		if err != nil {
+			if errors.As(err, &tooLarge) {
+				archiveTooLarge(w, tooLarge)
+				return
+			}
+			invalidParameter(w, "invalid archive: "+err.Error())
+			return
+		}
+		defer ar.close()
+
+		res, err := s.importRecords(r.Context(), ar)
+		if err != nil {
+			// records before the error are imported
+			log := log.With(zap.Int("imported", res.Imported), zap.Int("skipped", res.Skipped), zap.Error(err))
+
+			switch {
+			case errors.As(err, &tooLarge):
+				log.Warn("could not import records")
+				archiveTooLarge(w, tooLarge)
+			case errors.Is(err, errInvalidArchive):
+				log.Warn("could not import records")
+				invalidParameter(w, err.Error())
+			case errors.Is(err, errLogNotReady):
+				logNotReady(w, err.Error())
+			case errors.Is(err, errImportGap):
+				log.Warn("could not import records")
+				conflict(w, "import failed: "+err.Error())
+			default:
+				log.Error("import records")
+				internalError(w)
+			}
+			return
+		}
+
+		log.Info("imported records",
+			zap.Int("imported", res.Imported),
+			zap.Int("skipped", res.Skipped),
+		)
+
+		w.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(w).Encode(res); err != nil {
+			log.Error("marshal import response", zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/embano1/memlog"
+	"github.com/embano1/vsphere/logger"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/v3/assert"
+)
+
+func Test_archiveReader(t *testing.T) {
+	tests := []struct {
+		name        string
+		archive     []byte
+		wantOffsets []memlog.Offset
+		wantErr     string
+	}{
+		{
+			name:        "ndjson",
+			archive:     ndjson(createEvents(t, 10, 3)),
+			wantOffsets: []memlog.Offset{10, 11, 12},
+		},
+		{
+			name:        "gzip ndjson",
+			archive:     gzipped(t, ndjson(createEvents(t, 10, 3))),
+			wantOffsets: []memlog.Offset{10, 11, 12},
+		},
+		{
+			name:        "cloudevents batch",
+			archive:     []byte("\n [" + string(bytes.Join(createEvents(t, 5, 2), []byte(","))) + "]"),
+			wantOffsets: []memlog.Offset{5, 6},
+		},
+		{
+			name:        "empty batch",
+			archive:     []byte("[]"),
+			wantOffsets: []memlog.Offset{},
+		},
+		{
+			name:    "empty archive",
+			archive: nil,
+			wantErr: "empty archive",
+		},
+		{
+			name:    "offsets not contiguous",
+			archive: ndjson(append(createEvents(t, 10, 2), createEvents(t, 13, 1)...)),
+			wantErr: "cloudevent 2: expected offset 12, got 13: offsets not contiguous",
+		},
+		{
+			name:    "id is not an offset",
+			archive: []byte(`{"specversion":"1.0","id":"abc","source":"/test","type":"test.event.v0"}`),
+			wantErr: `cloudevent 0: id "abc" is not an offset`,
+		},
+		{
+			name:    "invalid cloudevent",
+			archive: []byte(`{"id":"1"}`),
+			wantErr: "decode cloudevent 0",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := readOffsets(bytes.NewReader(tc.archive))
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			assert.NilError(t, err)
+			assert.DeepEqual(t, got, tc.wantOffsets)
+		})
+	}
+}
+
+// readOffsets returns the offsets of all records in the archive
+func readOffsets(r io.Reader) ([]memlog.Offset, error) {
+	ar, err := newArchiveReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer ar.close()
+
+	offsets := []memlog.Offset{}
+	for {
+		rec, err := ar.next()
+		if errors.Is(err, io.EOF) {
+			return offsets, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		offsets = append(offsets, rec.offset)
+	}
+}
+
+func Test_importEvents(t *testing.T) {
+	tests := []struct {
+		name       string
+		logStart   memlog.Offset
+		logEvents  int
+		archive    []byte
+		wantCode   int
+		wantBody   string
+		wantLatest memlog.Offset // if set
+	}{
+		{
+			name:      "200 imports into empty log",
+			logStart:  10,
+			logEvents: 0,
+			archive:   ndjson(createEvents(t, 10, 3)),
+			wantCode:  http.StatusOK,
+			wantBody:  `{"imported":3,"skipped":0,"earliest":10,"latest":12}`,
+		},
+		{
+			name:      "200 skips records already in log",
+			logStart:  10,
+			logEvents: 2,
+			archive:   ndjson(createEvents(t, 10, 5)),
+			wantCode:  http.StatusOK,
+			wantBody:  `{"imported":3,"skipped":2,"earliest":10,"latest":14}`,
+		},
+		{
+			name:      "409 archive does not continue log",
+			logStart:  10,
+			logEvents: 2,
+			archive:   ndjson(createEvents(t, 13, 2)),
+			wantCode:  http.StatusConflict,
+			wantBody:  `{"title":"Conflict","status":409,"detail":"import failed: log continues at offset 12, got 13: offsets not contiguous","code":"conflict"`,
+		},
+		{
+			name:       "409 imports records before gap in archive",
+			logStart:   10,
+			logEvents:  0,
+			archive:    ndjson(append(createEvents(t, 10, 2), createEvents(t, 13, 1)...)),
+			wantCode:   http.StatusConflict,
+			wantBody:   `{"title":"Conflict","status":409,"detail":"import failed: cloudevent 2: expected offset 12, got 13: offsets not contiguous","code":"conflict"`,
+			wantLatest: 11,
+		},
+		{
+			name:       "400 imports records before invalid record",
+			logStart:   10,
+			logEvents:  0,
+			archive:    append(ndjson(createEvents(t, 10, 2)), []byte("not json")...),
+			wantCode:   http.StatusBadRequest,
+			wantBody:   `{"title":"Bad Request","status":400,"detail":"invalid archive: decode cloudevent 2`,
+			wantLatest: 11,
+		},
+		{
+			name:      "400 invalid archive",
+			logStart:  10,
+			logEvents: 0,
+			archive:   []byte("not json"),
+			wantCode:  http.StatusBadRequest,
+			wantBody:  `{"title":"Bad Request","status":400,"detail":"invalid archive: decode cloudevent 0`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := logger.Set(context.Background(), zaptest.NewLogger(t))
+
+			var srv server
+			err := srv.initializeLog(ctx, tc.logStart, 10, 1024)
+			assert.NilError(t, err)
+
+			for _, e := range createEvents(t, tc.logStart, tc.logEvents) {
+				_, err = srv.log.Write(ctx, e)
+				assert.NilError(t, err)
+			}
+
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/admin/import", bytes.NewReader(tc.archive))
+
+			h := srv.importEvents(ctx)
+			h(rec, req, nil)
+
+			assert.Equal(t, rec.Result().StatusCode, tc.wantCode)
+			assert.Assert(t, strings.HasPrefix(rec.Body.String(), tc.wantBody), "got %q", rec.Body.String())
+			if tc.wantLatest != 0 {
+				_, latest := srv.log.Range(ctx)
+				assert.Equal(t, latest, tc.wantLatest)
+			}
+		})
+	}
+
+	t.Run("503 log not initialized", func(t *testing.T) {
+		ctx := logger.Set(context.Background(), zaptest.NewLogger(t))
+		var srv server
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/admin/import", bytes.NewReader(ndjson(createEvents(t, 1, 1))))
+
+		h := srv.importEvents(ctx)
+		h(rec, req, nil)
+
+		assert.Equal(t, rec.Result().StatusCode, http.StatusServiceUnavailable)
+	})
+
+	t.Run("413 archive too large", func(t *testing.T) {
+		ctx := logger.Set(context.Background(), zaptest.NewLogger(t))
+		archive := ndjson(createEvents(t, 10, 3))
+
+		srv := server{imports: importConfig{MaxBytes: int64(len(archive) - 1)}}
+		assert.NilError(t, srv.initializeLog(ctx, 10, 10, 1024))
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/admin/import", bytes.NewReader(archive))
+		srv.importEvents(ctx)(rec, req, nil)
+
+		assert.Equal(t, rec.Result().StatusCode, http.StatusRequestEntityTooLarge)
+		assert.Equal(t, rec.Header().Get("Content-Type"), contentTypeProblem)
+		assert.Assert(t, strings.Contains(rec.Body.String(), fmt.Sprintf("archive exceeds %d bytes", len(archive)-1)), rec.Body.String())
+	})
+
+	t.Run("200 upload slower than read timeout", func(t *testing.T) {
+		ctx := logger.Set(context.Background(), zaptest.NewLogger(t))
+
+		srv := server{imports: importConfig{MaxBytes: 1 << 20, Timeout: duration{5 * time.Second}}}
+		assert.NilError(t, srv.initializeLog(ctx, 10, 10, 1024))
+
+		h := srv.importEvents(ctx)
+		ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h(w, r, nil)
+		}))
+		ts.Config.ReadTimeout = 100 * time.Millisecond
+		ts.Start()
+		defer ts.Close()
+
+		pr, pw := io.Pipe()
+		go func() {
+			for _, e := range createEvents(t, 10, 3) {
+				time.Sleep(100 * time.Millisecond)
+				_, _ = pw.Write(append(e, '\n'))
+			}
+			_ = pw.Close()
+		}()
+
+		res, err := http.Post(ts.URL, "application/x-ndjson", pr)
+		assert.NilError(t, err)
+		defer res.Body.Close()
+
+		b, err := io.ReadAll(res.Body)
+		assert.NilError(t, err)
+		assert.Equal(t, res.StatusCode, http.StatusOK, string(b))
+		assert.Equal(t, string(b), `{"imported":3,"skipped":0,"earliest":10,"latest":12}`+"\n")
+	})
+}
+
+func Test_importFile(t *testing.T) {
+	ctx := logger.Set(context.Background(), zaptest.NewLogger(t))
+
+	path := filepath.Join(t.TempDir(), "events.ndjson.gz")
+	err := os.WriteFile(path, gzipped(t, ndjson(createEvents(t, 20, 5))), 0o600)
+	assert.NilError(t, err)
+
+	srv := server{ready: make(chan struct{})}
+	res, err := srv.importFile(ctx, path, 10, 1024)
+	assert.NilError(t, err)
+	assert.Equal(t, res.Imported, 5)
+
+	// log is ready and collector writes are deduplicated
+	log, err := srv.waitLog(ctx)
+	assert.NilError(t, err)
+
+	earliest, latest := log.Range(ctx)
+	assert.Equal(t, earliest, memlog.Offset(20))
+	assert.Equal(t, latest, memlog.Offset(24))
+
+	written, err := srv.appendRecord(ctx, 24, &ce.Event{}, []byte("duplicate"))
+	assert.NilError(t, err)
+	assert.Assert(t, !written)
+
+	written, err = srv.appendRecord(ctx, 25, &ce.Event{}, []byte("new"))
+	assert.NilError(t, err)
+	assert.Assert(t, written)
+
+	// offset must match the event key
+	written, err = srv.appendRecord(ctx, 27, &ce.Event{}, []byte("gap"))
+	assert.ErrorIs(t, err, errOffsetGap)
+	assert.Assert(t, !written)
+}
+
+// createEvents returns count JSON-encoded cloudevents with IDs starting at
+// offset
+func createEvents(t *testing.T, offset memlog.Offset, count int) [][]byte {
+	t.Helper()
+
+	events := make([][]byte, count)
+	for i := 0; i < count; i++ {
+		e := ce.NewEvent()
+		e.SetID(strconv.Itoa(int(offset) + i))
+		e.SetType("test.event.v0")
+		e.SetTime(time.Now().UTC())
+		e.SetSource("/test/source")
+
+		b, err := json.Marshal(e)
+		assert.NilError(t, err)
+		events[i] = b
+	}
+
+	return events
+}
+
+func ndjson(events [][]byte) []byte {
+	return append(bytes.Join(events, []byte("\n")), '\n')
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	_, err := gz.Write(data)
+	assert.NilError(t, err)
+	assert.NilError(t, gz.Close())
+
+	return b.Bytes()
+}
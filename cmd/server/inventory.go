@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/embano1/memlog"
+	"github.com/embano1/vsphere/logger"
+	"github.com/julienschmidt/httprouter"
+	"github.com/vmware/govmomi/view"
+	"github.com/vmware/govmomi/vim25/mo"
+	"go.uber.org/zap"
+)
+
+// inventoryResponse is a snapshot of the vSphere inventory. The snapshot
+// reflects at least all events up to and including offset, and may already
+// reflect later events.
+type inventoryResponse struct {
+	Offset          memlog.Offset   `json:"offset"`
+	Time            time.Time       `json:"time"`
+	Clusters        []inventoryItem `json:"clusters"`
+	Hosts           []inventoryHost `json:"hosts"`
+	VirtualMachines []inventoryVM   `json:"virtualMachines"`
+}
+
+type inventoryItem struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type inventoryHost struct {
+	inventoryItem
+	Cluster         string `json:"cluster,omitempty"`
+	ConnectionState string `json:"connectionState"`
+	PowerState      string `json:"powerState"`
+}
+
+type inventoryVM struct {
+	inventoryItem
+	Host       string `json:"host,omitempty"`
+	PowerState string `json:"powerState"`
+}
+
+// snapshotInventory returns the clusters, hosts and virtual machines in vCenter
+// ordered by id
+func (s *server) snapshotInventory(ctx context.Context) (inventoryResponse, error) {
+	var inv inventoryResponse
+
+	c := s.vc.SOAP.Client
+	v, err := view.NewManager(c).CreateContainerView(ctx, c.ServiceContent.RootFolder,
+		[]string{"ClusterComputeResource", "HostSystem", "VirtualMachine"}, true)
+	if err != nil {
+		return inv, fmt.Errorf("create container view: %w", err)
+	}
+	defer func() {
+		_ = v.Destroy(context.Background())
+	}()
+
+	var clusters []mo.ClusterComputeResource
+	if err = v.Retrieve(ctx, []string{"ClusterComputeResource"}, []string{"name"}, &clusters); err != nil {
+		return inv, fmt.Errorf("retrieve clusters: %w", err)
+	}
+	inv.Clusters = make([]inventoryItem, 0, len(clusters))
+	for _, cl := range clusters {
+		inv.Clusters = append(inv.Clusters, inventoryItem{ID: cl.Self.Value, Name: cl.Name})
+	}
+
+	var hosts []mo.HostSystem
+	props := []string{"name", "parent", "runtime.connectionState", "runtime.powerState"}
+	if err = v.Retrieve(ctx, []string{"HostSystem"}, props, &hosts); err != nil {
+		return inv, fmt.Errorf("retrieve hosts: %w", err)
+	}
+	inv.Hosts = make([]inventoryHost, 0, len(hosts))
+	for _, h := range hosts {
+		host := inventoryHost{
+			inventoryItem:   inventoryItem{ID: h.Self.Value, Name: h.Name},
+			ConnectionState: string(h.Runtime.ConnectionState),
+			PowerState:      string(h.Runtime.PowerState),
+		}
+		// standalone hosts have a ComputeResource parent
+		if h.Parent != nil && h.Parent.Type == "ClusterComputeResource" {
+			host.Cluster = h.Parent.Value
+		}
+		inv.Hosts = append(inv.Hosts, host)
+	}
+
+	var vms []mo.VirtualMachine
+	props = []string{"name", "runtime.host", "runtime.powerState"}
+	if err = v.Retrieve(ctx, []string{"VirtualMachine"}, props, &vms); err != nil {
+		return inv, fmt.Errorf("retrieve virtual machines: %w", err)
+	}
+	inv.VirtualMachines = make([]inventoryVM, 0, len(vms))
+	for _, vm := range vms {
+		item := inventoryVM{
+			inventoryItem: inventoryItem{ID: vm.Self.Value, Name: vm.Name},
+			PowerState:    string(vm.Runtime.PowerState),
+		}
+		if vm.Runtime.Host != nil {
+			item.Host = vm.Runtime.Host.Value
+		}
+		inv.VirtualMachines = append(inv.VirtualMachines, item)
+	}
+
+	sort.Slice(inv.Clusters, func(i, j int) bool {
+		return inv.Clusters[i].ID < inv.Clusters[j].ID
+	})
+	sort.Slice(inv.Hosts, func(i, j int) bool {
+		return inv.Hosts[i].ID < inv.Hosts[j].ID
+	})
+	sort.Slice(inv.VirtualMachines, func(i, j int) bool {
+		return inv.VirtualMachines[i].ID < inv.VirtualMachines[j].ID
+	})
+
+	return inv, nil
+}
+
+// getInventory returns a snapshot of the vSphere inventory with the offset of
+// the last event written before the snapshot was taken. Clients load the
+// snapshot and then watch from offset+1 without missing changes.
+func (s *server) getInventory(ctx context.Context) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		log := logger.Get(ctx)
+
+		if s.vc == nil {
+			notFound(w, "inventory not supported on read replica")
+			return
+		}
+
+		rctx := r.Context()
+
+		// taken before the snapshot so that events written concurrently are
+		// replayed by the watch instead of being missed
+		s.mu.Lock()
+		offset := s.nextOffset(rctx) - 1
+		s.mu.Unlock()
+
+		now := time.Now().UTC()
+		inv, err := s.snapshotInventory(rctx)
+		if err != nil {
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				return
+			}
+			log.Error("snapshot inventory", zap.Error(err))
+			writeProblem(w, problem{Status: http.StatusBadGateway, Code: codeUpstreamError, Detail: "could not retrieve inventory from vcenter"})
+			return
+		}
+		inv.Offset = offset
+		inv.Time = now
+
+		w.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(w).Encode(inv); err != nil {
+			log.Error("marshal inventory response", zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/embano1/memlog"
+	"github.com/embano1/vsphere/client"
+	"github.com/embano1/vsphere/logger"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/v3/assert"
+)
+
+func Test_getInventory(t *testing.T) {
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		ctx = logger.Set(ctx, zaptest.NewLogger(t))
+
+		srv := server{vc: &client.Client{SOAP: &govmomi.Client{Client: c}}}
+		assert.NilError(t, srv.initializeLog(ctx, 1, 100, 1024))
+
+		t.Run("empty log", func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/inventory", nil)
+			srv.getInventory(ctx)(rec, req, nil)
+			assert.Equal(t, rec.Code, http.StatusOK)
+
+			// watch starts at the log start offset
+			var got inventoryResponse
+			assert.NilError(t, json.NewDecoder(rec.Body).Decode(&got))
+			assert.Equal(t, got.Offset, memlog.Offset(0))
+		})
+
+		for i := 1; i <= 3; i++ {
+			e := ce.NewEvent()
+			e.SetID(strconv.Itoa(i))
+			e.SetType("com.vmware.vsphere.VmPoweredOnEvent.v0")
+			e.SetSource("/test/source")
+			b, err := json.Marshal(e)
+			assert.NilError(t, err)
+			_, err = srv.appendRecord(ctx, memlog.Offset(i), &e, b)
+			assert.NilError(t, err)
+		}
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/inventory", nil)
+		srv.getInventory(ctx)(rec, req, nil)
+		assert.Equal(t, rec.Code, http.StatusOK)
+
+		var got inventoryResponse
+		assert.NilError(t, json.NewDecoder(rec.Body).Decode(&got))
+		assert.Equal(t, got.Offset, memlog.Offset(3))
+		assert.DeepEqual(t, got.Clusters, []inventoryItem{{ID: "domain-c27", Name: "DC0_C0"}})
+
+		assert.Equal(t, len(got.Hosts), 4)
+		assert.Equal(t, got.Hosts[0], inventoryHost{
+			inventoryItem:   inventoryItem{ID: "host-21", Name: "DC0_H0"},
+			ConnectionState: "connected",
+			PowerState:      "poweredOn",
+		})
+		for _, h := range got.Hosts[1:] {
+			assert.Equal(t, h.Cluster, "domain-c27", "host %s", h.ID)
+		}
+
+		assert.Equal(t, len(got.VirtualMachines), 4)
+		assert.Equal(t, got.VirtualMachines[0], inventoryVM{
+			inventoryItem: inventoryItem{ID: "vm-55", Name: "DC0_H0_VM0"},
+			Host:          "host-21",
+			PowerState:    "poweredOn",
+		})
+	})
+
+	t.Run("read replica", func(t *testing.T) {
+		ctx := logger.Set(context.Background(), zaptest.NewLogger(t))
+
+		var srv server
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/inventory", nil)
+		srv.getInventory(ctx)(rec, req, nil)
+		assert.Equal(t, rec.Code, http.StatusNotFound)
+	})
+}
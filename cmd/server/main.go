@@ -4,10 +4,12 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
@@ -15,34 +17,58 @@ import (
 	"github.com/embano1/memlog"
 	"github.com/embano1/vsphere/event"
 	"github.com/embano1/vsphere/logger"
-	"github.com/kelseyhightower/envconfig"
 	"github.com/vmware/govmomi/vim25/types"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.39.0"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
 )
 
-var pollInterval = time.Second // poll vcenter events
+// errCollectorSwap stops the collector to swap it for the reloaded collector
+// configuration
+var errCollectorSwap = errors.New("collector configuration changed")
 
 func main() {
-	var env envConfig
-	if err := envconfig.Process("", &env); err != nil {
-		panic("could not process environment variables: " + err.Error())
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "path to YAML or JSON configuration file (env CONFIG_FILE)")
+	printConfig := flag.Bool("print-config", false, "print the effective configuration with secrets masked and exit")
+	flag.Parse()
+
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not load configuration: %v\n", err)
+		os.Exit(1)
 	}
 
-	var l *zap.Logger
-	if env.Debug {
-		zapLogger, err := zap.NewDevelopment()
+	if *printConfig {
+		b, err := cfg.yaml()
 		if err != nil {
-			panic("could not create logger: " + err.Error())
+			fmt.Fprintf(os.Stderr, "could not print configuration: %v\n", err)
+			os.Exit(1)
 		}
-		l = zapLogger
+		_, _ = os.Stdout.Write(b)
+		return
+	}
 
-	} else {
-		zapLogger, err := zap.NewProduction()
-		if err != nil {
-			panic("could not create logger: " + err.Error())
+	replica := cfg.Replication.PrimaryURL != ""
+	if !replica {
+		if err = cfg.setVCenterEnv(); err != nil {
+			panic("could not configure vsphere client: " + err.Error())
 		}
-		l = zapLogger
+	}
+
+	zc := zap.NewProductionConfig()
+	if cfg.Server.Debug {
+		zc = zap.NewDevelopmentConfig()
+	}
+	// level can be changed on reload
+	level := zap.NewAtomicLevelAt(logLevel(cfg.Server.Debug))
+	zc.Level = level
+
+	l, err := zc.Build()
+	if err != nil {
+		panic("could not create logger: " + err.Error())
 	}
 
 	l = l.Named("eventstream")
@@ -50,23 +76,83 @@ func main() {
 	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
-	srv, err := newServer(ctx, fmt.Sprintf("0.0.0.0:%d", env.Port))
+	tp, err := newTracerProvider(ctx, cfg.Tracing, os.Stdout)
+	if err != nil {
+		l.Fatal("could not create tracer provider", zap.Error(err))
+	}
+	if tp != nil {
+		setTracerProvider(tp)
+		defer func() {
+			// flush pending spans
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			if err := tp.Shutdown(shutdownCtx); err != nil {
+				l.Error("could not shut down tracer provider", zap.Error(err))
+			}
+		}()
+	}
+
+	srv, err := newServer(ctx, fmt.Sprintf("0.0.0.0:%d", cfg.Server.Port), replica)
 	if err != nil {
 		l.Fatal("could not create server", zap.Error(err))
 	}
 
-	if err = run(ctx, srv); err != nil && !errors.Is(err, context.Canceled) {
+	if err = run(ctx, srv, newReloader(*configFile, cfg, level)); err != nil && !errors.Is(err, context.Canceled) {
 		l.Fatal("could not run server", zap.Error(err))
 	}
 }
 
-func run(ctx context.Context, srv *server) error {
-	var env envConfig
-	if err := envconfig.Process("", &env); err != nil {
-		return fmt.Errorf("process environment variables: %w", err)
+func run(ctx context.Context, srv *server, rl *reloader) error {
+	l := logger.Get(ctx)
+	cfg := rl.config()
+	srv.reloader = rl
+	srv.adminToken = cfg.Server.AdminToken
+	srv.imports = cfg.Import
+	srv.retention = cfg.Log.retention()
+
+	c, err := newCodec(cfg.Log.Compression, cfg.Log.MaxRecordSize)
+	if err != nil {
+		return err
+	}
+	srv.codec = c
+
+	if cfg.Replication.PrimaryURL != "" {
+		f, err := newFollower(srv, cfg.Replication.PrimaryURL, cfg.Log.MaxSegmentSize, cfg.Log.MaxRecordSize)
+		if err != nil {
+			return fmt.Errorf("create read replica: %w", err)
+		}
+		srv.replica = f
+	}
+
+	// collector replays the configured history, or starting with the last
+	// imported record if older
+	begin := time.Now().UTC().Add(-cfg.VCenter.StreamBegin.Duration)
+	if cfg.Import.File != "" {
+		res, err := srv.importFile(ctx, cfg.Import.File, cfg.Log.MaxSegmentSize, cfg.Log.MaxRecordSize)
+		if err != nil {
+			return fmt.Errorf("import %q: %w", cfg.Import.File, err)
+		}
+		l.Info("imported records from archive",
+			zap.String("file", cfg.Import.File),
+			zap.Int("imported", res.Imported),
+			zap.Any("earliest", res.Earliest),
+			zap.Any("latest", res.Latest),
+		)
+
+		if !res.lastTime.IsZero() && res.lastTime.Before(begin) {
+			begin = res.lastTime
+		}
+	}
+
+	var lock resourcelock.Interface
+	if cfg.Election.Backend != "" {
+		leaderLock, err := newLeaderLock(cfg.Election)
+		if err != nil {
+			return fmt.Errorf("create leader election lock: %w", err)
+		}
+		lock = leaderLock
 	}
 
-	l := logger.Get(ctx)
 	eg, egCtx := errgroup.WithContext(ctx)
 
 	eg.Go(func() error {
@@ -82,75 +168,100 @@ func run(ctx context.Context, srv *server) error {
 		return egCtx.Err()
 	})
 
-	var once sync.Once
-	eg.Go(func() error {
-		root := srv.vc.SOAP.ServiceContent.RootFolder
-		mgr := srv.vc.Events
-		source := srv.vc.SOAP.URL().String()
-		start := types.EventFilterSpecByTime{
-			BeginTime: types.NewTime(time.Now().UTC().Add(-5 * time.Minute)),
+	// task and alarm collection can be enabled on reload
+	if srv.replica == nil {
+		srv.activity = newActivityServer(srv)
+	}
+
+	// the collectors are swapped on reload after the last polled batch is
+	// written and resume with the last record
+	collectEvents := func(ctx context.Context) error {
+		for {
+			cfg, swap := rl.collector()
+			err := collect(ctx, srv, cfg, srv.collectorBegin(ctx, begin), swap)
+			if !errors.Is(err, errCollectorSwap) {
+				return err
+			}
 		}
+	}
+	collectTasksAndAlarms := func(ctx context.Context) error {
+		for {
+			cfg, swap := rl.collector()
+			err := collectActivity(ctx, srv, cfg, begin, swap)
+			if !errors.Is(err, errCollectorSwap) {
+				return err
+			}
+		}
+	}
 
-		collector, err := event.NewHistoryCollector(egCtx, mgr, root, event.WithTime(&start))
-		if err != nil {
-			return fmt.Errorf("create event collector: %w", err)
+	// the instance collecting events also publishes them to the sink, so
+	// standbys and read replicas do not publish
+	runCollector := func(ctx context.Context) error {
+		ceg, cegCtx := errgroup.WithContext(ctx)
+		ceg.Go(func() error {
+			return collectEvents(cegCtx)
+		})
+		if srv.activity != nil {
+			ceg.Go(func() error {
+				return collectTasksAndAlarms(cegCtx)
+			})
+		}
+		ceg.Go(func() error {
+			return rl.sinks.run(cegCtx, srv)
+		})
+		return ceg.Wait()
+	}
+
+	switch {
+	case srv.replica != nil:
+		// read replicas replicate the primary log instead of collecting events
+		eg.Go(func() error {
+			return srv.replica.run(egCtx)
+		})
+	case lock == nil:
+		eg.Go(func() error {
+			return runCollector(egCtx)
+		})
+	default:
+		// only the leader collects events
+		eg.Go(func() error {
+			return newElection(srv, lock, cfg, runCollector).run(egCtx)
+		})
+	}
+
+	if cfg.Log.MaxAge.Duration > 0 {
+		eg.Go(func() error {
+			return srv.enforceRetention(egCtx)
+		})
+
+		if srv.activity != nil {
+			eg.Go(func() error {
+				return srv.activity.enforceRetention(egCtx)
+			})
 		}
+	}
+
+	eg.Go(func() error {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
 
-		l.Info("starting vsphere event collector", zap.Duration("begin", env.StreamBegin), zap.Duration("pollInterval", pollInterval))
-		ticker := time.NewTicker(pollInterval)
-		defer ticker.Stop()
 		for {
 			select {
 			case <-egCtx.Done():
 				return egCtx.Err()
-			case <-ticker.C:
-				events, err := collector.ReadNextEvents(egCtx, 50)
-				if err != nil {
-					return fmt.Errorf("read events: %w", err)
-				}
-
-				for _, e := range events {
-					id := e.GetEvent().Key
-
-					// set event ID as start offset
-					once.Do(func() {
-						l.Debug("initializing new log",
-							zap.Int32("startOffset", id),
-							zap.Int("maxSegmentSize", env.SegmentSize),
-							zap.Int("maxRecordSize", env.RecordSize),
-						)
-						if err := srv.initializeLog(egCtx, memlog.Offset(id), env.SegmentSize, env.RecordSize); err != nil {
-							l.Fatal("initialize log", zap.Error(err))
-						}
-					})
-
-					details := event.GetDetails(e)
-					cevent, err := event.ToCloudEvent(source, e, map[string]string{"eventclass": details.Class})
-					if err != nil {
-						l.Error("convert vsphere event to cloudevent", zap.Error(err), zap.Any("event", e))
-						return fmt.Errorf("convert vsphere event to cloudevent: %w", err)
-					}
-
-					b, err := json.Marshal(cevent)
-					if err != nil {
-						l.Error("marshal cloudevent to JSON", zap.Error(err), zap.String("event", cevent.String()))
-						return fmt.Errorf("marshal cloudevent to JSON: %w", err)
-					}
-
-					offset, err := srv.log.Write(egCtx, b)
-					if err != nil {
-						return fmt.Errorf("write to log: %w", err)
-					}
-					l.Debug("wrote cloudevent to log",
-						zap.Any("offset", offset),
-						zap.String("event", cevent.String()),
-						zap.Int("bytes", len(b)),
-					)
-				}
+			case <-hup:
+				rl.reload(egCtx, "signal")
 			}
 		}
 	})
 
+	if cfg.Server.WatchConfig {
+		eg.Go(func() error {
+			return rl.watch(egCtx, configWatchInterval)
+		})
+	}
+
 	eg.Go(func() error {
 		l.Info("starting http listener", zap.String("address", srv.http.Addr))
 		if err := srv.http.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
@@ -161,3 +272,133 @@ func run(ctx context.Context, srv *server) error {
 
 	return eg.Wait()
 }
+
+// collect writes vCenter events starting at begin to the log until the context
+// is cancelled or swap is closed. On swap errCollectorSwap is returned after
+// writing the current batch.
+func collect(ctx context.Context, srv *server, cfg config, begin time.Time, swap <-chan struct{}) error {
+	l := logger.Get(ctx)
+	cc := cfg.Collector
+
+	var (
+		once sync.Once
+		last int32 = -1 // last written event key
+	)
+
+	root := srv.vc.SOAP.ServiceContent.RootFolder
+	mgr := srv.vc.Events
+	source := srv.vc.SOAP.URL().String()
+	start := types.EventFilterSpecByTime{
+		BeginTime: types.NewTime(begin),
+	}
+
+	collector, err := event.NewHistoryCollector(ctx, mgr, root, event.WithTime(&start))
+	if err != nil {
+		return fmt.Errorf("create event collector: %w", err)
+	}
+	defer func() {
+		// not bound to ctx to release the collector on cancellation
+		if err := collector.Destroy(context.Background()); err != nil {
+			l.Warn("could not destroy event collector", zap.Error(err))
+		}
+	}()
+
+	l.Info("starting vsphere event collector",
+		zap.Time("begin", begin),
+		zap.Duration("pollInterval", cc.PollInterval.Duration),
+		zap.Int("batchSize", cc.BatchSize),
+	)
+	ticker := time.NewTicker(cc.PollInterval.Duration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-swap:
+			l.Info("swapping vsphere event collector", zap.Int32("lastKey", last))
+			return errCollectorSwap
+		case <-ticker.C:
+			pctx, span := tracer().Start(ctx, "vsphere.poll")
+			events, err := collector.ReadNextEvents(pctx, int32(cc.BatchSize))
+			if err != nil {
+				endSpan(span, err)
+				return fmt.Errorf("read events: %w", err)
+			}
+			span.SetAttributes(attribute.Int("vsphere.events", len(events)))
+
+			for _, e := range events {
+				id := e.GetEvent().Key
+
+				// set event ID as start offset
+				once.Do(func() {
+					l.Debug("initializing new log",
+						zap.Int32("startOffset", id),
+						zap.Int("maxSegmentSize", cfg.Log.MaxSegmentSize),
+						zap.Int("maxRecordSize", cfg.Log.MaxRecordSize),
+					)
+					if err := srv.initializeLog(ctx, memlog.Offset(id), cfg.Log.MaxSegmentSize, cfg.Log.MaxRecordSize); err != nil {
+						l.Fatal("initialize log", zap.Error(err))
+					}
+				})
+
+				if err = ingest(pctx, srv, source, e, cc.Extensions); err != nil {
+					endSpan(span, err)
+					return err
+				}
+				last = id
+			}
+			span.End()
+		}
+	}
+}
+
+// ingest converts the vCenter event to a cloudevent with the extension
+// attributes and writes it to the log. The trace context of the ingestion is
+// added to the cloudevent with the distributed tracing extension.
+func ingest(ctx context.Context, srv *server, source string, e types.BaseEvent, extensions map[string]string) (err error) {
+	l := logger.Get(ctx)
+	id := e.GetEvent().Key
+
+	ctx, span := tracer().Start(ctx, "event.ingest",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(semconv.CloudEventsEventID(strconv.Itoa(int(id)))),
+	)
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	details := event.GetDetails(e)
+	attrs := map[string]string{"eventclass": details.Class}
+	for k, v := range extensions {
+		attrs[k] = v
+	}
+	cevent, err := event.ToCloudEvent(source, e, attrs)
+	if err != nil {
+		l.Error("convert vsphere event to cloudevent", zap.Error(err), zap.Any("event", e))
+		return fmt.Errorf("convert vsphere event to cloudevent: %w", err)
+	}
+	span.SetAttributes(semconv.CloudEventsEventType(cevent.Type()))
+	injectTraceContext(ctx, &cevent)
+
+	b, err := json.Marshal(cevent)
+	if err != nil {
+		l.Error("marshal cloudevent to JSON", zap.Error(err), zap.String("event", cevent.String()))
+		return fmt.Errorf("marshal cloudevent to JSON: %w", err)
+	}
+
+	written, err := srv.appendRecord(ctx, memlog.Offset(id), &cevent, b)
+	if err != nil {
+		return fmt.Errorf("write to log: %w", err)
+	}
+	if !written {
+		l.Debug("skipping cloudevent already in log", zap.Int32("offset", id))
+		span.SetAttributes(attribute.Bool("event.duplicate", true))
+		return nil
+	}
+	l.Debug("wrote cloudevent to log",
+		zap.Int32("offset", id),
+		zap.String("event", cevent.String()),
+		zap.Int("bytes", len(b)),
+	)
+	return nil
+}
@@ -18,6 +18,7 @@ import (
 	"github.com/vmware/govmomi/simulator"
 	_ "github.com/vmware/govmomi/vapi/simulator"
 	"github.com/vmware/govmomi/vim25"
+	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest"
 	"gotest.tools/v3/assert"
 )
@@ -39,26 +40,29 @@ func Test_run(t *testing.T) {
 		simulator.Run(func(ctx context.Context, vimclient *vim25.Client) error {
 			ctx = logger.Set(ctx, zaptest.NewLogger(t))
 
-			pollInterval = time.Millisecond * 10
 			ctx, cancel := context.WithCancel(ctx)
 			defer cancel()
 
 			t.Setenv("VCENTER_URL", vimclient.URL().String())
 			t.Setenv("VCENTER_INSECURE", "true")
 			t.Setenv("VCENTER_SECRET_PATH", dir)
+			t.Setenv("COLLECTOR_POLL_INTERVAL", "10ms")
 
 			vc, err := client.New(ctx)
 			assert.NilError(t, err)
 
 			const address = "127.0.0.1:8080"
-			srv, err := newServer(ctx, address)
+			srv, err := newServer(ctx, address, false)
 			assert.NilError(t, err)
 
 			srv.vc = vc
 
+			cfg, err := loadConfig("")
+			assert.NilError(t, err)
+
 			runErrCh := make(chan error)
 			go func() {
-				runErrCh <- run(ctx, srv)
+				runErrCh <- run(ctx, srv, newReloader("", cfg, zap.NewAtomicLevel()))
 			}()
 
 			// give server time to initialize event stream log
@@ -96,6 +100,57 @@ func Test_run(t *testing.T) {
 	})
 }
 
+func Test_collect(t *testing.T) {
+	t.Run("stops on collector swap", func(t *testing.T) {
+		dir := tempDir(t)
+		t.Cleanup(func() {
+			assert.NilError(t, os.RemoveAll(dir))
+		})
+
+		simulator.Run(func(ctx context.Context, vimclient *vim25.Client) error {
+			ctx = logger.Set(ctx, zaptest.NewLogger(t))
+
+			t.Setenv("VCENTER_URL", vimclient.URL().String())
+			t.Setenv("VCENTER_INSECURE", "true")
+			t.Setenv("VCENTER_SECRET_PATH", dir)
+			t.Setenv("COLLECTOR_POLL_INTERVAL", "10ms")
+
+			vc, err := client.New(ctx)
+			assert.NilError(t, err)
+
+			srv, err := newServer(ctx, "127.0.0.1:8080", false)
+			assert.NilError(t, err)
+			srv.vc = vc
+
+			cfg, err := loadConfig("")
+			assert.NilError(t, err)
+			rl := newReloader("", cfg, zap.NewAtomicLevel())
+			cfg, swap := rl.collector()
+
+			errCh := make(chan error)
+			go func() {
+				errCh <- collect(ctx, srv, cfg, time.Now().Add(-time.Hour), swap)
+			}()
+
+			// give collector time to write events
+			time.Sleep(500 * time.Millisecond)
+			_, latest := srv.log.Range(ctx)
+			assert.Assert(t, latest > 0)
+
+			rl.mu.Lock()
+			close(rl.swap)
+			rl.mu.Unlock()
+			assert.ErrorIs(t, <-errCh, errCollectorSwap)
+
+			// swapped collector resumes after the last record
+			begin := srv.collectorBegin(ctx, time.Time{})
+			assert.Assert(t, !begin.IsZero())
+
+			return nil
+		})
+	})
+}
+
 func tempDir(t *testing.T) string {
 	t.Helper()
 
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+const metricsNamespace = "vsphere_event_stream"
+
+// newRegistry returns a metrics registry with the Go runtime and process
+// collectors
+func newRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return reg
+}
+
+// logMetrics are the event log metrics. A nil *logMetrics discards all
+// updates.
+type logMetrics struct {
+	purgedRecords *prometheus.CounterVec
+	purgedBytes   *prometheus.CounterVec
+	records       prometheus.Gauge
+	bytes         prometheus.Gauge
+}
+
+func newLogMetrics(reg prometheus.Registerer) *logMetrics {
+	m := logMetrics{
+		purgedRecords: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "log",
+			Name:      "purged_records_total",
+			Help:      "Number of records purged from the log by reason (age, size or segment).",
+		}, []string{"reason"}),
+		purgedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "log",
+			Name:      "purged_bytes_total",
+			Help:      "Data size of records purged from the log by reason (age, size or segment).",
+		}, []string{"reason"}),
+		records: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "log",
+			Name:      "records",
+			Help:      "Number of records retained in the log.",
+		}),
+		bytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "log",
+			Name:      "bytes",
+			Help:      "Data size of records retained in the log.",
+		}),
+	}
+
+	reg.MustRegister(m.purgedRecords, m.purgedBytes, m.records, m.bytes)
+	return &m
+}
+
+func (m *logMetrics) purged(reason string, size int64) {
+	if m == nil {
+		return
+	}
+	m.purgedRecords.WithLabelValues(reason).Inc()
+	m.purgedBytes.WithLabelValues(reason).Add(float64(size))
+}
+
+func (m *logMetrics) retained(records int, bytes int64) {
+	if m == nil {
+		return
+	}
+	m.records.Set(float64(records))
+	m.bytes.Set(float64(bytes))
+}
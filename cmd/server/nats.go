@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/embano1/memlog"
+	"github.com/embano1/vsphere/logger"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.39.0"
+	"go.uber.org/zap"
+)
+
+const (
+	natsTypePrefix    = "com.vmware.vsphere."
+	natsRetryInterval = time.Second
+	natsAckedScan     = 1000 // messages scanned back for the last acknowledged offset
+)
+
+// natsSink publishes log records to NATS JetStream. The record offset is used
+// as the JetStream message ID so the last acknowledged offset can be recovered
+// from the stream after a restart.
+type natsSink struct {
+	nc     *nats.Conn
+	js     jetstream.JetStream
+	stream jetstream.Stream
+	prefix string
+	acked  atomic.Int64 // last acknowledged offset
+}
+
+func newNATSSink(ctx context.Context, cfg natsConfig) (*natsSink, error) {
+	opts := []nats.Option{nats.Name("vsphere-event-stream"), nats.MaxReconnects(-1)}
+	if cfg.Token != "" {
+		opts = append(opts, nats.Token(cfg.Token))
+	}
+
+	nc, err := nats.Connect(cfg.URL, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("connect to nats: %w", err)
+	}
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("create jetstream context: %w", err)
+	}
+
+	s, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:     cfg.Stream,
+		Subjects: []string{cfg.SubjectPrefix + ".>"},
+	})
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("create jetstream stream %q: %w", cfg.Stream, err)
+	}
+
+	sink := natsSink{
+		nc:     nc,
+		js:     js,
+		stream: s,
+		prefix: cfg.SubjectPrefix,
+	}
+	sink.acked.Store(-1)
+
+	return &sink, nil
+}
+
+// lastAcked returns the offset of the last record stored in the stream or -1
+// if the stream is empty. Messages without an offset as message ID, e.g. from
+// other publishers to the stream subjects, are skipped up to natsAckedScan
+// messages back. If no record is found all retained records are published
+// again.
+func (n *natsSink) lastAcked(ctx context.Context) (memlog.Offset, error) {
+	info, err := n.stream.Info(ctx)
+	if err != nil {
+		return -1, fmt.Errorf("get stream info: %w", err)
+	}
+
+	last := info.State.LastSeq
+	var stop uint64
+	if last > natsAckedScan {
+		stop = last - natsAckedScan
+	}
+
+	for seq := last; seq > stop && seq >= info.State.FirstSeq; seq-- {
+		msg, err := n.stream.GetMsg(ctx, seq)
+		if err != nil {
+			// deleted message
+			if errors.Is(err, jetstream.ErrMsgNotFound) {
+				continue
+			}
+			return -1, fmt.Errorf("get message %d: %w", seq, err)
+		}
+
+		if offset, err := strconv.Atoi(msg.Header.Get(jetstream.MsgIDHeader)); err == nil && offset >= 0 {
+			return memlog.Offset(offset), nil
+		}
+	}
+
+	return -1, nil
+}
+
+// run publishes records from the log, resuming after the last acknowledged
+// offset, until the context is cancelled
+func (n *natsSink) run(ctx context.Context, log *eventLog) error {
+	l := logger.Get(ctx).With(zap.String("sink", "nats"))
+
+	last, err := n.lastAcked(ctx)
+	if err != nil {
+		return err
+	}
+	n.acked.Store(int64(last))
+
+	start := last + 1
+	for {
+		earliest, _ := log.Range(ctx)
+		if last == -1 || start < earliest {
+			if last != -1 {
+				l.Warn("records purged before publishing", zap.Any("from", start), zap.Any("to", earliest-1))
+			}
+			start = earliest
+		}
+
+		l.Info("starting nats publisher", zap.Any("start", start), zap.Any("lastAcked", last))
+		stream := log.Stream(ctx, start)
+		for {
+			rec, ok := stream.Next()
+			if !ok {
+				break
+			}
+
+			if err = n.publish(ctx, rec); err != nil {
+				return err
+			}
+			start = rec.Metadata.Offset + 1
+			last = rec.Metadata.Offset
+		}
+
+		err = stream.Err()
+		if errors.Is(err, memlog.ErrOutOfRange) {
+			// fell behind retention, continue with earliest available record
+			continue
+		}
+		return err
+	}
+}
+
+// publish retries until the record is acknowledged by the server. Duplicates
+// are discarded by JetStream using the message ID.
+func (n *natsSink) publish(ctx context.Context, rec memlog.Record) error {
+	var e struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(rec.Data, &e); err != nil {
+		return fmt.Errorf("unmarshal cloudevent type: %w", err)
+	}
+
+	msg := nats.NewMsg(subjectFor(n.prefix, e.Type))
+	msg.Data = rec.Data
+	msg.Header.Set("Content-Type", "application/cloudevents+json")
+
+	ctx, span := startDelivery(ctx, "event.publish", rec,
+		semconv.MessagingSystemKey.String("nats"),
+		semconv.MessagingOperationTypeSend,
+		semconv.MessagingDestinationName(msg.Subject),
+	)
+	defer span.End()
+	traceContext.Inject(ctx, propagation.HeaderCarrier(msg.Header))
+
+	id := strconv.Itoa(int(rec.Metadata.Offset))
+	for {
+		ack, err := n.js.PublishMsg(ctx, msg, jetstream.WithMsgID(id))
+		if err == nil {
+			n.acked.Store(int64(rec.Metadata.Offset))
+			logger.Get(ctx).Debug("published event to nats",
+				zap.Any("offset", rec.Metadata.Offset),
+				zap.String("subject", msg.Subject),
+				zap.Uint64("sequence", ack.Sequence),
+				zap.Bool("duplicate", ack.Duplicate),
+			)
+			return nil
+		}
+
+		logger.Get(ctx).Warn("could not publish event to nats, retrying",
+			zap.Error(err),
+			zap.Any("offset", rec.Metadata.Offset),
+			zap.Duration("retry", natsRetryInterval),
+		)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(natsRetryInterval):
+		}
+	}
+}
+
+func (n *natsSink) close() {
+	n.nc.Close()
+}
+
+// subjectFor derives the subject from the cloudevent type, e.g.
+// "com.vmware.vsphere.VmPoweredOnEvent.v0" becomes
+// "<prefix>.VmPoweredOnEvent"
+func subjectFor(prefix, ceType string) string {
+	name := strings.TrimPrefix(ceType, natsTypePrefix)
+	if i := strings.LastIndex(name, ".v"); i > 0 {
+		if _, err := strconv.Atoi(name[i+2:]); err == nil {
+			name = name[:i]
+		}
+	}
+
+	// subject tokens must not be empty or contain wildcards/whitespace
+	name = strings.Map(func(r rune) rune {
+		switch r {
+		case '*', '>', ' ', '\t', '\n', '\r':
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "" {
+		name = "unknown"
+	}
+
+	return prefix + "." + name
+}
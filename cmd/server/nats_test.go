@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/embano1/memlog"
+	"github.com/embano1/vsphere/logger"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go/jetstream"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/poll"
+)
+
+func Test_subjectFor(t *testing.T) {
+	tests := []struct {
+		name   string
+		ceType string
+		want   string
+	}{
+		{
+			name:   "strips vsphere prefix and version",
+			ceType: "com.vmware.vsphere.VmPoweredOnEvent.v0",
+			want:   "vsphere.events.VmPoweredOnEvent",
+		},
+		{
+			name:   "keeps dotted extended event type",
+			ceType: "com.vmware.vsphere.com.vmware.vc.HA.ClusterFailoverActionCompletedEvent.v0",
+			want:   "vsphere.events.com.vmware.vc.HA.ClusterFailoverActionCompletedEvent",
+		},
+		{
+			name:   "keeps unknown type without version",
+			ceType: "test.event",
+			want:   "vsphere.events.test.event",
+		},
+		{
+			name:   "replaces wildcards",
+			ceType: "com.vmware.vsphere.Some*Event>.v1",
+			want:   "vsphere.events.Some_Event_",
+		},
+		{
+			name:   "empty type",
+			ceType: "",
+			want:   "vsphere.events.unknown",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, subjectFor("vsphere.events", tc.ceType), tc.want)
+		})
+	}
+}
+
+func Test_natsSink(t *testing.T) {
+	ctx := logger.Set(context.Background(), zaptest.NewLogger(t))
+	url := runNATSServer(t)
+
+	ml, err := memlog.New(ctx, memlog.WithStartOffset(10), memlog.WithMaxSegmentSize(10))
+	assert.NilError(t, err)
+	log := wrapLog(t, ml)
+
+	writeEvents(t, log, 5)
+
+	runSink := func(t *testing.T, want memlog.Offset) {
+		sink, err := newNATSSink(ctx, natsConfig{URL: url, Stream: "TEST", SubjectPrefix: "vsphere.events"})
+		assert.NilError(t, err)
+		defer sink.close()
+
+		sinkCtx, cancel := context.WithCancel(ctx)
+		errCh := make(chan error)
+		go func() {
+			errCh <- sink.run(sinkCtx, log)
+		}()
+
+		poll.WaitOn(t, func(poll.LogT) poll.Result {
+			if got := memlog.Offset(sink.acked.Load()); got != want {
+				return poll.Continue("last acked offset %d, want %d", got, want)
+			}
+			return poll.Success()
+		}, poll.WithTimeout(5*time.Second))
+
+		cancel()
+		err = <-errCh
+		assert.Assert(t, errors.Is(err, context.Canceled))
+	}
+
+	t.Run("publishes all records", func(t *testing.T) {
+		runSink(t, 14)
+	})
+
+	t.Run("resumes after last acked offset on restart", func(t *testing.T) {
+		writeEvents(t, log, 3)
+		runSink(t, 17)
+	})
+
+	t.Run("stream contains each record once", func(t *testing.T) {
+		sink, err := newNATSSink(ctx, natsConfig{URL: url, Stream: "TEST", SubjectPrefix: "vsphere.events"})
+		assert.NilError(t, err)
+		defer sink.close()
+
+		info, err := sink.stream.Info(ctx)
+		assert.NilError(t, err)
+		assert.Equal(t, info.State.Msgs, uint64(8))
+
+		last, err := sink.lastAcked(ctx)
+		assert.NilError(t, err)
+		assert.Equal(t, last, memlog.Offset(17))
+
+		msg, err := sink.stream.GetMsg(ctx, 1)
+		assert.NilError(t, err)
+		assert.Equal(t, msg.Subject, "vsphere.events.VmPoweredOnEvent")
+		assert.Equal(t, msg.Header.Get(jetstream.MsgIDHeader), "10")
+	})
+
+	t.Run("skips messages of other publishers for last acked offset", func(t *testing.T) {
+		sink, err := newNATSSink(ctx, natsConfig{URL: url, Stream: "TEST", SubjectPrefix: "vsphere.events"})
+		assert.NilError(t, err)
+		defer sink.close()
+
+		_, err = sink.js.Publish(ctx, "vsphere.events.other", []byte("no id"))
+		assert.NilError(t, err)
+		_, err = sink.js.Publish(ctx, "vsphere.events.other", []byte("other id"), jetstream.WithMsgID("other"))
+		assert.NilError(t, err)
+
+		last, err := sink.lastAcked(ctx)
+		assert.NilError(t, err)
+		assert.Equal(t, last, memlog.Offset(17))
+	})
+}
+
+// runNATSServer starts an embedded NATS server with JetStream enabled and
+// returns its client URL
+func runNATSServer(t *testing.T) string {
+	t.Helper()
+
+	opts := natsserver.Options{
+		Host:      "127.0.0.1",
+		Port:      -1, // random
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	}
+
+	ns, err := natsserver.NewServer(&opts)
+	assert.NilError(t, err)
+
+	go ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+	t.Cleanup(ns.Shutdown)
+
+	return ns.ClientURL()
+}
+
+// writeEvents writes the given number of VmPoweredOnEvent cloudevents to the
+// log
+func writeEvents(t *testing.T, log *eventLog, count int) {
+	t.Helper()
+
+	ctx := context.Background()
+	for i := 0; i < count; i++ {
+		e := ce.NewEvent()
+		e.SetID(strconv.Itoa(i))
+		e.SetType("com.vmware.vsphere.VmPoweredOnEvent.v0")
+		e.SetTime(time.Now().UTC())
+		e.SetSource("/test/source")
+
+		b, err := json.Marshal(e)
+		assert.NilError(t, err)
+
+		_, err = log.Write(ctx, b)
+		assert.NilError(t, err)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"net/http"
+
+	"github.com/embano1/vsphere/logger"
+	"github.com/julienschmidt/httprouter"
+	"go.uber.org/zap"
+)
+
+// openAPISpec is the OpenAPI document of the api routes. Routes and responses
+// are checked against the handlers in openapi_test.go.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// getOpenAPI returns the OpenAPI document of the api
+func (s *server) getOpenAPI(ctx context.Context) httprouter.Handle {
+	return func(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(openAPISpec); err != nil {
+			logger.Get(ctx).Error("write openapi document", zap.Error(err))
+		}
+	}
+}
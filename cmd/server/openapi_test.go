@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/embano1/memlog"
+	"github.com/embano1/vsphere/client"
+	"github.com/embano1/vsphere/logger"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/types"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/v3/assert"
+)
+
+// apiDoc is the subset of the OpenAPI document to check responses against
+type apiDoc struct {
+	Paths      map[string]map[string]apiOperation `json:"paths"`
+	Components struct {
+		Responses map[string]apiResponse `json:"responses"`
+		Schemas   map[string]interface{} `json:"schemas"`
+	} `json:"components"`
+}
+
+type apiOperation struct {
+	Responses map[string]apiResponse `json:"responses"`
+}
+
+type apiResponse struct {
+	Ref     string `json:"$ref"`
+	Content map[string]struct {
+		Schema interface{} `json:"schema"`
+	} `json:"content"`
+	StreamSchema interface{} `json:"x-stream-schema"` // of each line on watches
+}
+
+func loadAPIDoc(t *testing.T) apiDoc {
+	t.Helper()
+
+	var doc apiDoc
+	assert.NilError(t, json.Unmarshal(openAPISpec, &doc))
+	return doc
+}
+
+// operations returns the documented operations, e.g. "GET /events/{id}"
+func (d apiDoc) operations() []string {
+	var ops []string
+	for path, methods := range d.Paths {
+		for method := range methods {
+			ops = append(ops, strings.ToUpper(method)+" "+path)
+		}
+	}
+	sort.Strings(ops)
+	return ops
+}
+
+// response returns the documented response of the operation for the status
+// code with references resolved
+func (d apiDoc) response(op string, status int) (apiResponse, bool) {
+	method, path, _ := strings.Cut(op, " ")
+	res, ok := d.Paths[path][strings.ToLower(method)].Responses[strconv.Itoa(status)]
+	if !ok {
+		return apiResponse{}, false
+	}
+	if res.Ref != "" {
+		res, ok = d.Components.Responses[strings.TrimPrefix(res.Ref, "#/components/responses/")]
+	}
+	return res, ok
+}
+
+// validate checks the decoded JSON value against the subset of JSON Schema
+// used in the document
+func (d apiDoc) validate(schema interface{}, v interface{}, at string) error {
+	s, ok := schema.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s: invalid schema %v", at, schema)
+	}
+
+	if ref, ok := s["$ref"].(string); ok {
+		return d.validate(d.Components.Schemas[strings.TrimPrefix(ref, "#/components/schemas/")], v, at)
+	}
+
+	if anyOf, ok := s["anyOf"].([]interface{}); ok {
+		var errs []string
+		for _, sub := range anyOf {
+			err := d.validate(sub, v, at)
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, err.Error())
+		}
+		return fmt.Errorf("%s: no schema matches: %s", at, strings.Join(errs, "; "))
+	}
+
+	if typ, ok := s["type"]; ok {
+		var allowed []interface{}
+		switch typ := typ.(type) {
+		case string:
+			allowed = []interface{}{typ}
+		case []interface{}:
+			allowed = typ
+		}
+
+		matches := false
+		for _, a := range allowed {
+			if jsonTypeOf(v, a.(string)) {
+				matches = true
+			}
+		}
+		if !matches {
+			return fmt.Errorf("%s: expected type %v, got %T", at, typ, v)
+		}
+	}
+
+	if enum, ok := s["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: %v not in enum %v", at, v, enum)
+		}
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		props, _ := s["properties"].(map[string]interface{})
+		if required, ok := s["required"].([]interface{}); ok {
+			for _, r := range required {
+				if _, ok := v[r.(string)]; !ok {
+					return fmt.Errorf("%s: missing required property %q", at, r)
+				}
+			}
+		}
+		for k, val := range v {
+			if ps, ok := props[k]; ok {
+				if err := d.validate(ps, val, at+"."+k); err != nil {
+					return err
+				}
+				continue
+			}
+			switch additional := s["additionalProperties"].(type) {
+			case bool:
+				if !additional {
+					return fmt.Errorf("%s: unexpected property %q", at, k)
+				}
+			case map[string]interface{}:
+				if err := d.validate(additional, val, at+"."+k); err != nil {
+					return err
+				}
+			}
+		}
+	case []interface{}:
+		if items, ok := s["items"]; ok {
+			for i, item := range v {
+				if err := d.validate(items, item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func jsonTypeOf(v interface{}, typ string) bool {
+	switch v := v.(type) {
+	case nil:
+		return typ == "null"
+	case bool:
+		return typ == "boolean"
+	case string:
+		return typ == "string"
+	case float64:
+		return typ == "number" || typ == "integer" && v == math.Trunc(v)
+	case []interface{}:
+		return typ == "array"
+	case map[string]interface{}:
+		return typ == "object"
+	}
+	return false
+}
+
+// checkResponse checks that the response status, content type and body are
+// documented for the operation
+func (d apiDoc) checkResponse(t *testing.T, op string, watch bool, rec *httptest.ResponseRecorder) {
+	t.Helper()
+
+	res, ok := d.response(op, rec.Code)
+	assert.Assert(t, ok, "%s: status %d not documented", op, rec.Code)
+
+	body := rec.Body.Bytes()
+	if len(body) == 0 {
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	assert.NilError(t, err)
+	content, ok := res.Content[mediaType]
+	assert.Assert(t, ok, "%s: content type %q not documented for status %d", op, mediaType, rec.Code)
+
+	switch {
+	case watch && res.StreamSchema != nil:
+		d.checkLines(t, res.StreamSchema, body)
+	case strings.HasSuffix(mediaType, "ndjson"):
+		d.checkLines(t, content.Schema, body)
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		var v interface{}
+		assert.NilError(t, json.Unmarshal(body, &v))
+		assert.NilError(t, d.validate(content.Schema, v, "body"))
+	}
+}
+
+// checkLines validates each line of a newline-delimited body
+func (d apiDoc) checkLines(t *testing.T, schema interface{}, body []byte) {
+	t.Helper()
+
+	sc := bufio.NewScanner(bytes.NewReader(body))
+	for i := 0; sc.Scan(); i++ {
+		var v interface{}
+		assert.NilError(t, json.Unmarshal(sc.Bytes(), &v))
+		assert.NilError(t, d.validate(schema, v, fmt.Sprintf("line[%d]", i)))
+	}
+	assert.NilError(t, sc.Err())
+}
+
+func Test_openAPIRoutes(t *testing.T) {
+	ctx := logger.Set(context.Background(), zaptest.NewLogger(t))
+	srv := server{}
+
+	var registered []string
+	for _, r := range srv.apiRoutes(ctx) {
+		segments := strings.Split(r.path, "/")
+		for i, s := range segments {
+			if strings.HasPrefix(s, ":") {
+				segments[i] = "{" + s[1:] + "}"
+			}
+		}
+		registered = append(registered, r.method+" "+strings.Join(segments, "/"))
+	}
+	sort.Strings(registered)
+
+	assert.DeepEqual(t, loadAPIDoc(t).operations(), registered)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/openapi.json", nil)
+	srv.routes(ctx).ServeHTTP(rec, req)
+	assert.Equal(t, rec.Code, http.StatusOK)
+	assert.Equal(t, rec.Body.String(), string(openAPISpec))
+}
+
+func Test_openAPIConformance(t *testing.T) {
+	interval := bookmarkInterval
+	bookmarkInterval = 20 * time.Millisecond
+	t.Cleanup(func() {
+		bookmarkInterval = interval
+	})
+
+	simulator.Test(func(ctx context.Context, c *vim25.Client) {
+		ctx = logger.Set(ctx, zaptest.NewLogger(t))
+		begin := time.Date(2022, 1, 14, 13, 0, 0, 0, time.UTC)
+		doc := loadAPIDoc(t)
+
+		srv := server{vc: &client.Client{SOAP: &govmomi.Client{Client: c}}, adminToken: "t0k3n"}
+		srv.times = newTimeIndex(timeIndexInterval)
+		srv.types = newTypeCatalog()
+		srv.search = newSearchIndex()
+		srv.chains = newChainIndex()
+		srv.indexers = []indexer{srv.times, srv.types, srv.search, srv.chains}
+		srv.activity = newActivityServer(&srv)
+		assert.NilError(t, srv.initializeLog(ctx, 1, 100, 4096))
+		assert.NilError(t, srv.activity.initializeLog(ctx, 0, 100, 4096))
+
+		// key (offset) 1-3, chain 1 completes with offset 3
+		names := []string{"TaskEvent", "UserLoginSessionEvent", "VmPoweredOnEvent"}
+		var archive [][]byte
+		for i, name := range names {
+			key := i + 1
+			e := ce.NewEvent()
+			e.SetID(strconv.Itoa(key))
+			e.SetType("com.vmware.vsphere." + name + ".v0")
+			e.SetTime(begin.Add(time.Duration(key) * time.Second))
+			e.SetSource("/test/source")
+			assert.NilError(t, e.SetData(ce.ApplicationJSON, map[string]interface{}{
+				"Key":                  key,
+				"ChainId":              key % 2,
+				"UserName":             "alice",
+				"FullFormattedMessage": name,
+			}))
+
+			b, err := json.Marshal(e)
+			assert.NilError(t, err)
+			_, err = srv.appendRecord(ctx, memlog.Offset(key), &e, b)
+			assert.NilError(t, err)
+			archive = append(archive, b)
+		}
+
+		task, err := taskEvent("/test/source", types.TaskInfo{
+			Key:       "task-1",
+			Task:      types.ManagedObjectReference{Type: "Task", Value: "task-1"},
+			State:     types.TaskInfoStateQueued,
+			QueueTime: begin,
+		})
+		assert.NilError(t, err)
+		assert.NilError(t, srv.activity.appendNext(ctx, &task))
+
+		at := url.QueryEscape(begin.Format(time.RFC3339))
+		future := url.QueryEscape(begin.Add(time.Hour).Format(time.RFC3339))
+
+		tests := []struct {
+			op       string
+			target   string
+			body     []byte
+			etag     string // If-None-Match header
+			notReady bool   // log not initialized and activity disabled
+			noAuth   bool   // admin token not sent
+			want     int
+		}{
+			{op: "GET /events", target: "/events", want: http.StatusOK},
+			{op: "GET /events", target: "/events?since=" + at, want: http.StatusOK},
+			{op: "GET /events", target: "/events", etag: `W/"1-1-3"`, want: http.StatusNotModified},
+			{op: "GET /events", target: "/events?watch=true&bookmarks=true&offset=1", want: http.StatusOK},
+			{op: "GET /events", target: "/events?ids=3,0,10", want: http.StatusOK},
+			{op: "GET /events", target: "/events?ids=1&watch=true", want: http.StatusBadRequest},
+			{op: "GET /events", target: "/events?watch=yes", want: http.StatusBadRequest},
+			{op: "GET /events", target: "/events?watch=true&offset=0", want: http.StatusGone},
+			{op: "GET /events", target: "/events", notReady: true, want: http.StatusServiceUnavailable},
+			{op: "GET /events/{id}", target: "/events/1", want: http.StatusOK},
+			{op: "GET /events/{id}", target: "/events/abc", want: http.StatusBadRequest},
+			{op: "GET /events/{id}", target: "/events/10", want: http.StatusBadRequest},
+			{op: "GET /events/{id}", target: "/events/0", want: http.StatusGone},
+			{op: "GET /range", target: "/range", want: http.StatusOK},
+			{op: "GET /export", target: "/export", want: http.StatusOK},
+			{op: "GET /export", target: "/export?format=batch", want: http.StatusOK},
+			{op: "GET /export", target: "/export?format=ndjson.gz", want: http.StatusOK},
+			{op: "GET /export", target: "/export?format=xml", want: http.StatusBadRequest},
+			{op: "GET /export", target: "/export?from=0", want: http.StatusGone},
+			{op: "GET /offsets", target: "/offsets?time=" + at, want: http.StatusOK},
+			{op: "GET /offsets", target: "/offsets", want: http.StatusBadRequest},
+			{op: "GET /offsets", target: "/offsets?time=" + future, want: http.StatusNotFound},
+			{op: "GET /search", target: "/search?q=alice", want: http.StatusOK},
+			{op: "GET /search", target: "/search", want: http.StatusBadRequest},
+			{op: "GET /chains", target: "/chains", want: http.StatusOK},
+			{op: "GET /chains", target: "/chains?watch=true&offset=1", want: http.StatusOK},
+			{op: "GET /chains", target: "/chains?watch=yes", want: http.StatusBadRequest},
+			{op: "GET /chains/{chainId}", target: "/chains/1", want: http.StatusOK},
+			{op: "GET /chains/{chainId}", target: "/chains/abc", want: http.StatusBadRequest},
+			{op: "GET /chains/{chainId}", target: "/chains/99", want: http.StatusNotFound},
+			{op: "GET /inventory", target: "/inventory", want: http.StatusOK},
+			{op: "GET /types", target: "/types", want: http.StatusOK},
+			{op: "GET /stats", target: "/stats", want: http.StatusOK},
+			{op: "GET /activity/events", target: "/activity/events", want: http.StatusOK},
+			{op: "GET /activity/events", target: "/activity/events?watch=true&bookmarks=true", want: http.StatusOK},
+			{op: "GET /activity/events", target: "/activity/events?ids=0,1", want: http.StatusOK},
+			{op: "GET /activity/events", target: "/activity/events", notReady: true, want: http.StatusNotFound},
+			{op: "GET /activity/events/{id}", target: "/activity/events/0", want: http.StatusOK},
+			{op: "GET /activity/range", target: "/activity/range", want: http.StatusOK},
+			{op: "GET /activity/export", target: "/activity/export", want: http.StatusOK},
+			{op: "GET /activity/offsets", target: "/activity/offsets?time=" + at, want: http.StatusOK},
+			{op: "GET /schemas/{type}", target: "/schemas/com.vmware.vsphere.VmPoweredOnEvent.v0", want: http.StatusOK},
+			{op: "GET /schemas/{type}", target: "/schemas/test.event.v0", want: http.StatusNotFound},
+			{op: "GET /replication", target: "/replication", want: http.StatusNotFound},
+			{op: "GET /internal/replication", target: "/internal/replication?offset=1", want: http.StatusOK},
+			{op: "GET /internal/replication", target: "/internal/replication?offset=0", want: http.StatusGone},
+			{op: "POST /admin/import", target: "/admin/import", body: ndjson(archive), want: http.StatusOK},
+			{op: "POST /admin/import", target: "/admin/import", body: []byte("{"), want: http.StatusBadRequest},
+			{op: "POST /admin/import", target: "/admin/import", body: ndjson(archive), notReady: true, want: http.StatusServiceUnavailable},
+			{op: "POST /admin/import", target: "/admin/import", body: ndjson(archive), noAuth: true, want: http.StatusUnauthorized},
+			{op: "GET /admin/reload", target: "/admin/reload", want: http.StatusServiceUnavailable},
+			{op: "POST /admin/reload", target: "/admin/reload", want: http.StatusServiceUnavailable},
+			{op: "GET /openapi.json", target: "/openapi.json", want: http.StatusOK},
+		}
+
+		routes := srv.routes(ctx)
+		notReady := (&server{ready: make(chan struct{}), adminToken: srv.adminToken}).routes(ctx)
+
+		exercised := make(map[string]bool)
+		for _, tc := range tests {
+			t.Run(tc.op+" "+tc.target, func(t *testing.T) {
+				method, _, _ := strings.Cut(tc.op, " ")
+				watch := strings.Contains(tc.target, "watch=true") || strings.HasPrefix(tc.target, "/internal/")
+
+				rctx := ctx
+				if watch {
+					var cancel context.CancelFunc
+					rctx, cancel = context.WithTimeout(ctx, 100*time.Millisecond)
+					defer cancel()
+				}
+
+				rec := httptest.NewRecorder()
+				req := httptest.NewRequest(method, apiPath+tc.target, bytes.NewReader(tc.body)).WithContext(rctx)
+				if tc.etag != "" {
+					req.Header.Set("If-None-Match", tc.etag)
+				}
+				if !tc.noAuth {
+					req.Header.Set("Authorization", "Bearer "+srv.adminToken)
+				}
+				if tc.notReady {
+					notReady.ServeHTTP(rec, req)
+				} else {
+					routes.ServeHTTP(rec, req)
+				}
+
+				assert.Equal(t, rec.Code, tc.want, rec.Body.String())
+				doc.checkResponse(t, tc.op, watch, rec)
+				exercised[tc.op] = true
+			})
+		}
+
+		var ops []string
+		for op := range exercised {
+			ops = append(ops, op)
+		}
+		sort.Strings(ops)
+		assert.DeepEqual(t, ops, doc.operations())
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/embano1/memlog"
+	"github.com/google/uuid"
+)
+
+const (
+	contentTypeProblem = "application/problem+json"
+	requestIDHeader    = "X-Request-Id"
+)
+
+// stable error codes of problem responses
+const (
+	codeOffsetOutOfRange = "offset_out_of_range"
+	codeOffsetInFuture   = "offset_in_future"
+	codeLogNotReady      = "log_not_ready"
+	codeInvalidParameter = "invalid_parameter"
+	codeInternalError    = "internal_error"
+	codeNotFound         = "not_found"
+	codeConflict         = "conflict"
+	codeUpstreamError    = "upstream_error"
+	codeUnavailable      = "unavailable"
+	codeUnauthorized     = "unauthorized"
+	codeForbidden        = "forbidden"
+)
+
+// problem is an RFC 7807 problem details response. The type is omitted, i.e.
+// about:blank, and the problem is identified by its code instead.
+type problem struct {
+	Title     string         `json:"title"`
+	Status    int            `json:"status"`
+	Detail    string         `json:"detail,omitempty"`
+	Code      string         `json:"code"`
+	RequestID string         `json:"requestId"`
+	Offset    *memlog.Offset `json:"offset,omitempty"` // requested offset
+	Range     *logRange      `json:"range,omitempty"`  // current log range
+}
+
+// withRequestID sets the request ID response header to the request ID of the
+// client or a new ID
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" {
+			id = uuid.New().String()
+		}
+		w.Header().Set(requestIDHeader, id)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// writeProblem writes the problem with the status text as title and the request
+// ID of the response
+func writeProblem(w http.ResponseWriter, p problem) {
+	id := w.Header().Get(requestIDHeader)
+	if id == "" {
+		id = uuid.New().String()
+		w.Header().Set(requestIDHeader, id)
+	}
+
+	p.Title = http.StatusText(p.Status)
+	p.RequestID = id
+
+	w.Header().Set("Content-Type", contentTypeProblem)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	_ = json.NewEncoder(w).Encode(p)
+}
+
+// invalidParameter writes 400 with the detail
+func invalidParameter(w http.ResponseWriter, detail string) {
+	writeProblem(w, problem{Status: http.StatusBadRequest, Code: codeInvalidParameter, Detail: detail})
+}
+
+// internalError writes 500. Details are logged by the caller.
+func internalError(w http.ResponseWriter) {
+	writeProblem(w, problem{Status: http.StatusInternalServerError, Code: codeInternalError})
+}
+
+// notFound writes 404 with the detail
+func notFound(w http.ResponseWriter, detail string) {
+	writeProblem(w, problem{Status: http.StatusNotFound, Code: codeNotFound, Detail: detail})
+}
+
+// conflict writes 409 with the detail
+func conflict(w http.ResponseWriter, detail string) {
+	writeProblem(w, problem{Status: http.StatusConflict, Code: codeConflict, Detail: detail})
+}
+
+// logNotReady writes 503, clients retry later
+func logNotReady(w http.ResponseWriter, detail string) {
+	w.Header().Set("Retry-After", "1")
+	writeProblem(w, problem{Status: http.StatusServiceUnavailable, Code: codeLogNotReady, Detail: detail})
+}
+
+// offsetProblem writes 410 Gone for purged offsets and 400 for future offsets
+// with the current log range. err must be memlog.ErrOutOfRange or
+// memlog.ErrFutureOffset.
+func (s *server) offsetProblem(ctx context.Context, w http.ResponseWriter, offset memlog.Offset, err error) {
+	var lr logRange
+	lr.Earliest, lr.Latest = s.log.Range(ctx)
+
+	p := problem{
+		Status: http.StatusBadRequest,
+		Code:   codeOffsetInFuture,
+		Detail: "invalid offset: " + err.Error(),
+		Offset: &offset,
+		Range:  &lr,
+	}
+	if errors.Is(err, memlog.ErrOutOfRange) {
+		p.Status = http.StatusGone
+		p.Code = codeOffsetOutOfRange
+	}
+	writeProblem(w, p)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/embano1/memlog"
+	"github.com/embano1/vsphere/logger"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/v3/assert"
+)
+
+func Test_problem(t *testing.T) {
+	ctx := logger.Set(context.Background(), zaptest.NewLogger(t))
+
+	ml, err := memlog.New(ctx, memlog.WithStartOffset(10))
+	assert.NilError(t, err)
+	for _, d := range createData(3) {
+		_, err = ml.Write(ctx, d)
+		assert.NilError(t, err)
+	}
+	srv := server{log: wrapLog(t, ml)}
+	routes := srv.routes(ctx)
+
+	get := func(t *testing.T, path, requestID string) (*httptest.ResponseRecorder, problem) {
+		t.Helper()
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if requestID != "" {
+			req.Header.Set(requestIDHeader, requestID)
+		}
+		routes.ServeHTTP(rec, req)
+		assert.Equal(t, rec.Header().Get("Content-Type"), contentTypeProblem)
+
+		var p problem
+		assert.NilError(t, json.NewDecoder(rec.Body).Decode(&p))
+		return rec, p
+	}
+
+	t.Run("offset out of range with log range", func(t *testing.T) {
+		rec, p := get(t, "/api/v1/events/3", "req-1")
+		assert.Equal(t, rec.Code, http.StatusGone)
+
+		offset := memlog.Offset(3)
+		assert.DeepEqual(t, p, problem{
+			Title:     "Gone",
+			Status:    http.StatusGone,
+			Detail:    "invalid offset: offset out of range",
+			Code:      codeOffsetOutOfRange,
+			RequestID: "req-1",
+			Offset:    &offset,
+			Range:     &logRange{Earliest: 10, Latest: 12},
+		})
+	})
+
+	t.Run("offset in future", func(t *testing.T) {
+		rec, p := get(t, "/api/v1/events/13", "")
+		assert.Equal(t, rec.Code, http.StatusBadRequest)
+		assert.Equal(t, p.Code, codeOffsetInFuture)
+		assert.Equal(t, p.RequestID, rec.Header().Get(requestIDHeader))
+		assert.Assert(t, p.RequestID != "")
+	})
+
+	t.Run("invalid parameter", func(t *testing.T) {
+		rec, p := get(t, "/api/v1/events?since=yesterday", "")
+		assert.Equal(t, rec.Code, http.StatusBadRequest)
+		assert.Equal(t, p.Code, codeInvalidParameter)
+		assert.Assert(t, p.Range == nil)
+	})
+
+	t.Run("log not ready", func(t *testing.T) {
+		e := ce.NewEvent()
+		e.SetID("1")
+		e.SetType("test.event.v0")
+		e.SetSource("/test/source")
+		b, err := json.Marshal(e)
+		assert.NilError(t, err)
+
+		notReady := server{adminToken: "t0k3n"}
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/admin/import", bytes.NewReader(b))
+		req.Header.Set("Authorization", "Bearer t0k3n")
+		notReady.routes(ctx).ServeHTTP(rec, req)
+
+		assert.Equal(t, rec.Code, http.StatusServiceUnavailable)
+		assert.Equal(t, rec.Header().Get("Retry-After"), "1")
+		var p problem
+		assert.NilError(t, json.NewDecoder(rec.Body).Decode(&p))
+		assert.Equal(t, p.Code, codeLogNotReady)
+	})
+
+	t.Run("invalid admin token", func(t *testing.T) {
+		admin := server{log: srv.log, adminToken: "t0k3n"}
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/admin/reload", nil)
+		req.Header.Set("Authorization", "Bearer t0k3m")
+		admin.routes(ctx).ServeHTTP(rec, req)
+
+		assert.Equal(t, rec.Code, http.StatusUnauthorized)
+		assert.Equal(t, rec.Header().Get("WWW-Authenticate"), `Bearer realm="admin"`)
+		var p problem
+		assert.NilError(t, json.NewDecoder(rec.Body).Decode(&p))
+		assert.Equal(t, p.Code, codeUnauthorized)
+	})
+
+	t.Run("admin api disabled", func(t *testing.T) {
+		rec, p := get(t, "/api/v1/admin/reload", "")
+		assert.Equal(t, rec.Code, http.StatusForbidden)
+		assert.Equal(t, p.Code, codeForbidden)
+	})
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/embano1/vsphere/logger"
+	"github.com/julienschmidt/httprouter"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const configWatchInterval = 5 * time.Second // check config file for changes
+
+// reloadResult is the outcome of a configuration reload
+type reloadResult struct {
+	Time    time.Time `json:"time"`
+	Trigger string    `json:"trigger"`
+	Success bool      `json:"success"`
+	Changes []string  `json:"changes"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// reloader reloads the dynamic parts of the configuration from the config file
+// and environment variables. A reload is applied completely or not at all.
+type reloader struct {
+	path  string
+	level zap.AtomicLevel
+	sinks *sinkManager
+
+	mu   sync.Mutex // serializes reloads
+	cfg  config
+	last *reloadResult
+	swap chan struct{} // closed and replaced when the collector config changes
+}
+
+func newReloader(path string, cfg config, level zap.AtomicLevel) *reloader {
+	return &reloader{
+		path:  path,
+		level: level,
+		sinks: newSinkManager(cfg.NATS),
+		cfg:   cfg,
+		swap:  make(chan struct{}),
+	}
+}
+
+// config returns the current configuration
+func (r *reloader) config() config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cfg
+}
+
+// collector returns the current configuration and a channel which is closed
+// when the collector configuration changes, i.e. the collector must be swapped
+func (r *reloader) collector() (config, <-chan struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cfg, r.swap
+}
+
+// result returns the result of the last reload or nil
+func (r *reloader) result() *reloadResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.last
+}
+
+func (r *reloader) reload(ctx context.Context, trigger string) reloadResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	res := reloadResult{
+		Time:    time.Now().UTC(),
+		Trigger: trigger,
+		Changes: []string{},
+	}
+
+	changes, err := r.apply(ctx)
+	if err != nil {
+		res.Error = err.Error()
+	} else {
+		res.Success = true
+		res.Changes = changes
+	}
+	r.last = &res
+
+	l := logger.Get(ctx).With(zap.String("trigger", trigger), zap.Strings("changes", res.Changes))
+	if err != nil {
+		l.Error("could not reload configuration", zap.Error(err))
+	} else {
+		l.Info("reloaded configuration")
+	}
+
+	return res
+}
+
+func (r *reloader) apply(ctx context.Context) ([]string, error) {
+	cfg, err := loadConfig(r.path)
+	if err != nil {
+		return nil, err
+	}
+
+	if static := staticChanges(r.cfg, cfg); len(static) > 0 {
+		return nil, fmt.Errorf("settings require a restart: %v", static)
+	}
+
+	var changes []string
+	if cfg.NATS != r.cfg.NATS {
+		if err = r.sinks.update(ctx, cfg.NATS); err != nil {
+			return nil, fmt.Errorf("reconfigure nats sink: %w", err)
+		}
+		changes = append(changes, "nats")
+	}
+
+	// swapped by the collectors after the current batch
+	var swap bool
+	if !reflect.DeepEqual(cfg.Collector, r.cfg.Collector) {
+		swap = true
+		changes = append(changes, "collector")
+	}
+	if cfg.VCenter.Tasks != r.cfg.VCenter.Tasks {
+		swap = true
+		changes = append(changes, "vcenter.tasks")
+	}
+	if cfg.VCenter.Alarms != r.cfg.VCenter.Alarms {
+		swap = true
+		changes = append(changes, "vcenter.alarms")
+	}
+	if swap {
+		close(r.swap)
+		r.swap = make(chan struct{})
+	}
+
+	if cfg.Server.Debug != r.cfg.Server.Debug {
+		r.level.SetLevel(logLevel(cfg.Server.Debug))
+		changes = append(changes, "server.debug")
+	}
+
+	r.cfg = cfg
+	return changes, nil
+}
+
+// staticChanges returns the changed settings which can not be reloaded
+func staticChanges(old, new config) []string {
+	// task and alarm collection can be reloaded
+	oldVC, newVC := old.VCenter, new.VCenter
+	oldVC.Tasks, oldVC.Alarms = newVC.Tasks, newVC.Alarms
+
+	static := []struct {
+		name     string
+		old, new interface{}
+	}{
+		{"server.port", old.Server.Port, new.Server.Port},
+		{"server.watchConfig", old.Server.WatchConfig, new.Server.WatchConfig},
+		{"server.adminToken", old.Server.AdminToken, new.Server.AdminToken},
+		{"vcenter", oldVC, newVC},
+		{"log", old.Log, new.Log},
+		{"import", old.Import, new.Import},
+		{"election", old.Election, new.Election},
+		{"replication", old.Replication, new.Replication},
+		{"tracing", old.Tracing, new.Tracing},
+	}
+
+	var changed []string
+	for _, s := range static {
+		if !reflect.DeepEqual(s.old, s.new) {
+			changed = append(changed, s.name)
+		}
+	}
+	return changed
+}
+
+// watch reloads the configuration when the configuration file changes until
+// the context is cancelled. The file is checked for a changed modification time
+// or size every interval, e.g. when a mounted ConfigMap is updated.
+func (r *reloader) watch(ctx context.Context, interval time.Duration) error {
+	log := logger.Get(ctx).With(zap.String("file", r.path))
+
+	stat := func() (os.FileInfo, bool) {
+		fi, err := os.Stat(r.path)
+		if err != nil {
+			// e.g. replaced
+			log.Debug("could not stat configuration file", zap.Error(err))
+			return nil, false
+		}
+		return fi, true
+	}
+
+	last, _ := stat()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			fi, ok := stat()
+			if !ok {
+				continue
+			}
+			if last != nil && fi.ModTime().Equal(last.ModTime()) && fi.Size() == last.Size() {
+				continue
+			}
+			last = fi
+			r.reload(ctx, "file")
+		}
+	}
+}
+
+func logLevel(debug bool) zapcore.Level {
+	if debug {
+		return zap.DebugLevel
+	}
+	return zap.InfoLevel
+}
+
+// sinkManager runs the configured sink and swaps it on reconfiguration. The
+// new sink resumes after the last record acknowledged by its stream so no
+// records are skipped. The sink only runs on the instance collecting events,
+// e.g. the leader, and resumes the same way when leadership changes.
+type sinkManager struct {
+	mu      sync.Mutex
+	cfg     natsConfig      // applied when the sink is started
+	updates chan sinkUpdate // nil if not running
+	done    chan struct{}   // closed when run returns
+}
+
+type sinkUpdate struct {
+	cfg natsConfig
+	err chan error
+}
+
+// runningSink is a sink publishing in the background
+type runningSink struct {
+	sink   *natsSink
+	cancel context.CancelFunc
+	done   chan error
+}
+
+func (rs *runningSink) stop() {
+	rs.cancel()
+	<-rs.done
+	rs.sink.close()
+}
+
+func newSinkManager(cfg natsConfig) *sinkManager {
+	return &sinkManager{cfg: cfg}
+}
+
+// run starts the sink for the current configuration (if enabled) and applies
+// updates until the context is cancelled or the sink fails
+func (m *sinkManager) run(ctx context.Context, srv *server) error {
+	updates, stopped := make(chan sinkUpdate), make(chan struct{})
+	m.mu.Lock()
+	cfg := m.cfg
+	m.updates, m.done = updates, stopped
+	m.mu.Unlock()
+
+	var current *runningSink
+	defer func() {
+		if current != nil {
+			current.stop()
+		}
+
+		m.mu.Lock()
+		m.updates, m.done = nil, nil
+		m.mu.Unlock()
+		close(stopped)
+	}()
+
+	start := func(cfg natsConfig) (*runningSink, error) {
+		if cfg.URL == "" {
+			return nil, nil
+		}
+
+		sink, err := newNATSSink(ctx, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("create nats sink: %w", err)
+		}
+
+		sctx, cancel := context.WithCancel(ctx)
+		rs := runningSink{sink: sink, cancel: cancel, done: make(chan error, 1)}
+		go func() {
+			log, err := srv.waitLog(sctx)
+			if err == nil {
+				err = sink.run(sctx, log)
+			}
+			rs.done <- err
+		}()
+		return &rs, nil
+	}
+
+	current, err := start(cfg)
+	if err != nil {
+		return err
+	}
+
+	for {
+		var done chan error
+		if current != nil {
+			done = current.done
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case err = <-done:
+			// done is only received from once
+			current.sink.close()
+			current = nil
+			if err == nil || ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("publish to nats: %w", err)
+
+		case u := <-updates:
+			// connect new sink before stopping the current one to keep it on
+			// error
+			next, err := start(u.cfg)
+			if err != nil {
+				u.err <- err
+				continue
+			}
+
+			if current != nil {
+				current.stop()
+			}
+			current = next
+
+			m.mu.Lock()
+			m.cfg = u.cfg
+			m.mu.Unlock()
+			u.err <- nil
+		}
+	}
+}
+
+// update reconfigures the sink, disabling it if the url is empty. If the sink
+// is not running the connection to the new sink is verified and the
+// configuration is applied when the sink is started.
+func (m *sinkManager) update(ctx context.Context, cfg natsConfig) error {
+	u := sinkUpdate{cfg: cfg, err: make(chan error, 1)}
+
+	for {
+		m.mu.Lock()
+		if m.updates == nil {
+			// not started while the lock is held
+			defer m.mu.Unlock()
+			if cfg.URL != "" {
+				sink, err := newNATSSink(ctx, cfg)
+				if err != nil {
+					return fmt.Errorf("create nats sink: %w", err)
+				}
+				sink.close()
+			}
+			m.cfg = cfg
+			return nil
+		}
+		updates, done := m.updates, m.done
+		m.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-done:
+			// stopped in between
+			continue
+		case updates <- u:
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-u.err:
+			return err
+		}
+	}
+}
+
+// reloadConfig triggers a configuration reload (POST) or returns the result of
+// the last reload (GET)
+func (s *server) reloadConfig(ctx context.Context) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		log := logger.Get(ctx)
+
+		if s.reloader == nil {
+			writeProblem(w, problem{Status: http.StatusServiceUnavailable, Code: codeUnavailable, Detail: "reload not available"})
+			return
+		}
+
+		var res *reloadResult
+		switch r.Method {
+		case http.MethodPost:
+			// not bound to the request to not abort a partially applied reload
+			rr := s.reloader.reload(ctx, "api")
+			res = &rr
+		default:
+			if res = s.reloader.result(); res == nil {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodPost && !res.Success {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		}
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			log.Error("marshal reload response", zap.Error(err))
+		}
+	}
+}
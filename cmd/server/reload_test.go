@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/embano1/vsphere/logger"
+	"github.com/julienschmidt/httprouter"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/v3/assert"
+	"gotest.tools/v3/poll"
+)
+
+func Test_reloader(t *testing.T) {
+	ctx, cancel := context.WithCancel(logger.Set(context.Background(), zaptest.NewLogger(t)))
+	defer cancel()
+
+	unsetConfigEnv(t)
+	url := runNATSServer(t)
+
+	configFor := func(port int, debug bool, natsURL, stream string) string {
+		return fmt.Sprintf("version: 1\nserver:\n  port: %d\n  debug: %t\nvcenter:\n  url: https://vcenter.local/sdk\nnats:\n  url: %q\n  stream: %s\n  subjectPrefix: events.%s\n",
+			port, debug, natsURL, stream, stream)
+	}
+
+	path := writeConfig(t, "config.yaml", configFor(8080, false, url, "A"))
+	update := func(t *testing.T, content string) {
+		t.Helper()
+		assert.NilError(t, os.WriteFile(path, []byte(content), 0o600))
+	}
+
+	cfg, err := loadConfig(path)
+	assert.NilError(t, err)
+
+	srv := server{ready: make(chan struct{})}
+	assert.NilError(t, srv.initializeLog(ctx, 0, 100, 1024))
+	writeEvents(t, srv.log, 5)
+
+	level := zap.NewAtomicLevelAt(logLevel(cfg.Server.Debug))
+	rl := newReloader(path, cfg, level)
+	srv.reloader = rl
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- rl.sinks.run(ctx, &srv)
+	}()
+	waitStreamMsgs(t, url, "A", 5)
+
+	reload := func(t *testing.T) (int, reloadResult) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/admin/reload", nil)
+		srv.reloadConfig(ctx)(rec, req, httprouter.Params{})
+
+		var res reloadResult
+		assert.NilError(t, json.NewDecoder(rec.Body).Decode(&res))
+		return rec.Code, res
+	}
+
+	t.Run("no reload yet", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/admin/reload", nil)
+		srv.reloadConfig(ctx)(rec, req, httprouter.Params{})
+		assert.Equal(t, rec.Code, http.StatusNoContent)
+	})
+
+	t.Run("rejects static changes", func(t *testing.T) {
+		update(t, configFor(9090, true, url, "B"))
+
+		code, res := reload(t)
+		assert.Equal(t, code, http.StatusUnprocessableEntity)
+		assert.Assert(t, !res.Success)
+		assert.Equal(t, res.Trigger, "api")
+		assert.ErrorContains(t, fmt.Errorf("%s", res.Error), "settings require a restart: [server.port]")
+		assert.Equal(t, rl.config().Server.Debug, false)
+		assert.Equal(t, level.Level(), zap.InfoLevel)
+	})
+
+	t.Run("rejects invalid configuration", func(t *testing.T) {
+		update(t, "version: 2\n")
+
+		code, res := reload(t)
+		assert.Equal(t, code, http.StatusUnprocessableEntity)
+		assert.ErrorContains(t, fmt.Errorf("%s", res.Error), "version: unsupported version 2")
+	})
+
+	t.Run("keeps current sink if new sink fails", func(t *testing.T) {
+		update(t, configFor(8080, true, "nats://127.0.0.1:1", "B"))
+
+		code, res := reload(t)
+		assert.Equal(t, code, http.StatusUnprocessableEntity)
+		assert.ErrorContains(t, fmt.Errorf("%s", res.Error), "reconfigure nats sink")
+		assert.Equal(t, level.Level(), zap.InfoLevel)
+
+		writeEvents(t, srv.log, 1)
+		waitStreamMsgs(t, url, "A", 6)
+	})
+
+	t.Run("reloads log level and sink", func(t *testing.T) {
+		update(t, configFor(8080, true, url, "B"))
+
+		code, res := reload(t)
+		assert.Equal(t, code, http.StatusOK)
+		assert.Assert(t, res.Success, res.Error)
+		assert.DeepEqual(t, res.Changes, []string{"nats", "server.debug"})
+		assert.Equal(t, level.Level(), zap.DebugLevel)
+
+		// new stream starts with earliest record
+		writeEvents(t, srv.log, 2)
+		waitStreamMsgs(t, url, "B", 8)
+		waitStreamMsgs(t, url, "A", 6)
+	})
+
+	t.Run("disables sink", func(t *testing.T) {
+		update(t, configFor(8080, true, "", "B"))
+
+		code, res := reload(t)
+		assert.Equal(t, code, http.StatusOK)
+		assert.DeepEqual(t, res.Changes, []string{"nats"})
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/admin/reload", nil)
+		srv.reloadConfig(ctx)(rec, req, httprouter.Params{})
+		assert.Equal(t, rec.Code, http.StatusOK)
+
+		var last reloadResult
+		assert.NilError(t, json.NewDecoder(rec.Body).Decode(&last))
+		assert.DeepEqual(t, last.Changes, []string{"nats"})
+	})
+
+	t.Run("swaps collector", func(t *testing.T) {
+		_, swap := rl.collector()
+		update(t, configFor(8080, true, "", "B")+"collector:\n  batchSize: 10\n  extensions:\n    vcenter: vc01\n")
+
+		code, res := reload(t)
+		assert.Equal(t, code, http.StatusOK)
+		assert.DeepEqual(t, res.Changes, []string{"collector"})
+
+		select {
+		case <-swap:
+		default:
+			t.Fatal("collector not swapped")
+		}
+		cfg, _ := rl.collector()
+		assert.Equal(t, cfg.Collector.BatchSize, 10)
+		assert.DeepEqual(t, cfg.Collector.Extensions, map[string]string{"vcenter": "vc01"})
+	})
+
+	t.Run("swaps collector on task and alarm collection changes", func(t *testing.T) {
+		_, swap := rl.collector()
+		config := configFor(8080, true, "", "B") + "collector:\n  batchSize: 10\n  extensions:\n    vcenter: vc01\n"
+		update(t, strings.Replace(config, "vcenter:\n", "vcenter:\n  tasks: true\n  alarms: true\n", 1))
+
+		code, res := reload(t)
+		assert.Equal(t, code, http.StatusOK)
+		assert.DeepEqual(t, res.Changes, []string{"vcenter.tasks", "vcenter.alarms"})
+
+		select {
+		case <-swap:
+		default:
+			t.Fatal("collector not swapped")
+		}
+		cfg, _ := rl.collector()
+		assert.Assert(t, cfg.VCenter.Tasks && cfg.VCenter.Alarms)
+	})
+
+	t.Run("watches config file", func(t *testing.T) {
+		wctx, wcancel := context.WithCancel(ctx)
+		watchErr := make(chan error, 1)
+		go func() {
+			watchErr <- rl.watch(wctx, 10*time.Millisecond)
+		}()
+
+		// changed after the watch started
+		time.Sleep(50 * time.Millisecond)
+		update(t, configFor(8080, false, "", "B"))
+		poll.WaitOn(t, func(poll.LogT) poll.Result {
+			if res := rl.result(); res == nil || res.Trigger != "file" {
+				return poll.Continue("waiting for reload")
+			}
+			return poll.Success()
+		}, poll.WithTimeout(5*time.Second))
+
+		res := rl.result()
+		assert.Assert(t, res.Success, res.Error)
+		assert.DeepEqual(t, res.Changes, []string{"collector", "vcenter.tasks", "vcenter.alarms", "server.debug"})
+
+		wcancel()
+		assert.ErrorIs(t, <-watchErr, context.Canceled)
+	})
+
+	cancel()
+	assert.ErrorIs(t, <-errCh, context.Canceled)
+}
+
+// waitStreamMsgs waits until the JetStream stream contains want messages
+func waitStreamMsgs(t *testing.T, url, stream string, want uint64) {
+	t.Helper()
+
+	nc, err := nats.Connect(url)
+	assert.NilError(t, err)
+	defer nc.Close()
+
+	js, err := jetstream.New(nc)
+	assert.NilError(t, err)
+
+	poll.WaitOn(t, func(poll.LogT) poll.Result {
+		s, err := js.Stream(context.Background(), stream)
+		if err != nil {
+			return poll.Continue("get stream: %v", err)
+		}
+		info, err := s.Info(context.Background())
+		if err != nil {
+			return poll.Continue("get stream info: %v", err)
+		}
+		if info.State.Msgs != want {
+			return poll.Continue("stream %s has %d messages, want %d", stream, info.State.Msgs, want)
+		}
+		return poll.Success()
+	}, poll.WithTimeout(5*time.Second))
+}
+
+func Test_sinkManager(t *testing.T) {
+	ctx, cancel := context.WithCancel(logger.Set(context.Background(), zaptest.NewLogger(t)))
+	defer cancel()
+
+	url := runNATSServer(t)
+
+	srv := server{ready: make(chan struct{})}
+	assert.NilError(t, srv.initializeLog(ctx, 0, 100, 1024))
+	writeEvents(t, srv.log, 3)
+
+	// e.g. a standby
+	m := newSinkManager(natsConfig{})
+
+	t.Run("rejects unreachable sink when not running", func(t *testing.T) {
+		err := m.update(ctx, natsConfig{URL: "nats://127.0.0.1:1", Stream: "A", SubjectPrefix: "events.A"})
+		assert.ErrorContains(t, err, "create nats sink")
+	})
+
+	t.Run("applies update when started", func(t *testing.T) {
+		assert.NilError(t, m.update(ctx, natsConfig{URL: url, Stream: "A", SubjectPrefix: "events.A"}))
+
+		// e.g. acquired leadership
+		rctx, rcancel := context.WithCancel(ctx)
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- m.run(rctx, &srv)
+		}()
+		waitStreamMsgs(t, url, "A", 3)
+
+		rcancel()
+		assert.ErrorIs(t, <-errCh, context.Canceled)
+	})
+}
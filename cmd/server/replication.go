@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/embano1/memlog"
+	"github.com/embano1/vsphere/logger"
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
+	"go.uber.org/zap"
+)
+
+// heartbeat interval on idle replication streams
+var replicationHeartbeat = 5 * time.Second
+
+// replicationFrame is a message on the replication stream. Record frames carry
+// the raw record, heartbeats only the latest offset of the primary log.
+type replicationFrame struct {
+	Latest memlog.Offset   `json:"latest"`
+	Record json.RawMessage `json:"record,omitempty"`
+}
+
+// replicationStatus is reported by read replicas
+type replicationStatus struct {
+	Primary       string        `json:"primary"`
+	Connected     bool          `json:"connected"`
+	Latest        memlog.Offset `json:"latest"`        // latest replicated offset
+	PrimaryLatest memlog.Offset `json:"primaryLatest"` // latest primary offset last seen
+	Lag           int64         `json:"lag"`           // records behind the primary
+	LastContact   *time.Time    `json:"lastContact,omitempty"`
+}
+
+// replicate streams records with the watch semantics of getEvents as
+// replication frames for followers. Heartbeats are sent on idle streams so
+// followers can report their lag.
+func (s *server) replicate(ctx context.Context) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		log := logger.Get(ctx).With(zap.String("replicationID", uuid.New().String()))
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			log.Error("writer does not implement flusher")
+			internalError(w)
+			return
+		}
+
+		start, ok := s.watchStart(ctx, w, r)
+		if !ok {
+			return
+		}
+
+		rctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		// fail before streaming so followers can detect they fell behind
+		if s.startPurged(rctx, w, start) {
+			return
+		}
+
+		w.Header().Set("Connection", "Keep-Alive")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		log.Debug("starting replication stream", zap.Any("start", start))
+
+		// stream blocks until the next record is written
+		records := make(chan memlog.Record)
+		errCh := make(chan error, 1)
+		go func() {
+			stream := s.log.Stream(rctx, start)
+			for {
+				rec, ok := stream.Next()
+				if !ok {
+					errCh <- stream.Err()
+					return
+				}
+				select {
+				case records <- rec:
+				case <-rctx.Done():
+					errCh <- rctx.Err()
+					return
+				}
+			}
+		}()
+
+		heartbeat := time.NewTicker(replicationHeartbeat)
+		defer heartbeat.Stop()
+
+		// records are replicated byte for byte
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		for {
+			var frame replicationFrame
+			select {
+			case <-ctx.Done():
+				return
+			case err := <-errCh:
+				if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+					// follower reconnects and detects if it fell behind
+					log.Warn("replication stream stopped", zap.Error(err))
+				}
+				return
+			case rec := <-records:
+				frame.Record = rec.Data
+			case <-heartbeat.C:
+			}
+
+			_, frame.Latest = s.log.Range(rctx)
+			if err := enc.Encode(frame); err != nil {
+				log.Debug("write replication frame", zap.Error(err))
+				return
+			}
+			flusher.Flush()
+			heartbeat.Reset(replicationHeartbeat)
+		}
+	}
+}
+
+// getReplication returns the replication status of a read replica
+func (s *server) getReplication(ctx context.Context) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		if s.replica == nil {
+			notFound(w, "server is not a read replica")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(s.replica.status()); err != nil {
+			logger.Get(ctx).Error("marshal replication status", zap.Error(err))
+			internalError(w)
+			return
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/embano1/memlog"
+	"github.com/embano1/vsphere/logger"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/v3/assert"
+)
+
+func Test_replicate(t *testing.T) {
+	ctx := logger.Set(context.Background(), zaptest.NewLogger(t))
+
+	heartbeat := replicationHeartbeat
+	replicationHeartbeat = 50 * time.Millisecond
+	t.Cleanup(func() {
+		replicationHeartbeat = heartbeat
+	})
+
+	// log contains offsets 10-29
+	srv := newTimedServer(t, ctx, 10, 30)
+	ts := httptest.NewServer(srv.routes(ctx))
+	defer ts.Close()
+
+	t.Run("streams records and heartbeats", func(t *testing.T) {
+		rctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(rctx, http.MethodGet, ts.URL+"/api/v1/internal/replication?offset=28", nil)
+		assert.NilError(t, err)
+		res, err := http.DefaultClient.Do(req)
+		assert.NilError(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, res.StatusCode, http.StatusOK)
+
+		scanner := bufio.NewScanner(res.Body)
+		var frames []replicationFrame
+		for len(frames) < 3 && scanner.Scan() {
+			var f replicationFrame
+			assert.NilError(t, json.Unmarshal(scanner.Bytes(), &f))
+			frames = append(frames, f)
+		}
+		assert.NilError(t, scanner.Err())
+
+		for i, id := range []string{"28", "29"} {
+			var e ce.Event
+			assert.NilError(t, json.Unmarshal(frames[i].Record, &e))
+			assert.Equal(t, e.ID(), id)
+			assert.Equal(t, frames[i].Latest, memlog.Offset(29))
+		}
+
+		// heartbeat
+		assert.Equal(t, len(frames[2].Record), 0)
+		assert.Equal(t, frames[2].Latest, memlog.Offset(29))
+	})
+
+	t.Run("offset out of range", func(t *testing.T) {
+		res, err := http.Get(ts.URL + "/api/v1/internal/replication?offset=5")
+		assert.NilError(t, err)
+		defer res.Body.Close()
+
+		assert.Equal(t, res.StatusCode, http.StatusGone)
+		b, err := io.ReadAll(res.Body)
+		assert.NilError(t, err)
+		assert.Assert(t, strings.Contains(string(b), memlog.ErrOutOfRange.Error()), string(b))
+	})
+
+	t.Run("replication status on primary", func(t *testing.T) {
+		res, err := http.Get(ts.URL + "/api/v1/replication")
+		assert.NilError(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, res.StatusCode, http.StatusNotFound)
+	})
+}
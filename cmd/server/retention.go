@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/embano1/memlog"
+	"github.com/embano1/vsphere/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	retentionInterval = 10 * time.Second // purge expired records without writes
+)
+
+// purge reasons
+const (
+	purgeAge     = "age"
+	purgeSize    = "size"
+	purgeSegment = "segment" // purged by the log segment size
+)
+
+// retentionPolicy limits the records in the log by event age and total data
+// size in addition to the record count of the log segments. Zero values
+// disable the limit.
+type retentionPolicy struct {
+	maxAge   time.Duration
+	maxBytes int64
+}
+
+// retainedRecord tracks a record for the retention policy
+type retainedRecord struct {
+	offset memlog.Offset
+	time   time.Time // event time
+	size   int64
+}
+
+// eventLogOptions configures an event log
+type eventLogOptions struct {
+	segmentSize int
+	recordSize  int // maximum uncompressed record size
+	retention   retentionPolicy
+	codec       codec       // optional record compression
+	metrics     *logMetrics // optional
+}
+
+// eventLog is a memlog.Log with a retention policy and optional record
+// compression. memlog only purges whole segments by record count, so records
+// exceeding the policy are hidden from readers first and freed by compacting
+// the log once they make up half of the stored data. The latest record is
+// always retained to preserve the log position.
+//
+// Safe for concurrent use.
+type eventLog struct {
+	opts eventLogOptions
+
+	mu      sync.RWMutex
+	log     *memlog.Log
+	floor   memlog.Offset    // earliest retained offset
+	records []retainedRecord // retained records in offset order
+	bytes   int64            // total stored data size of retained records
+	hidden  []retainedRecord // purged records not yet freed in offset order
+	written chan struct{}    // closed and replaced on each write
+}
+
+// newEventLog creates an event log from ml which must be configured with the
+// segment size and, if compressed, the maximum compressed record size. Records
+// already in ml are retained.
+func newEventLog(ctx context.Context, ml *memlog.Log, opts eventLogOptions) (*eventLog, error) {
+	l := eventLog{
+		opts:    opts,
+		log:     ml,
+		floor:   -1,
+		written: make(chan struct{}),
+	}
+
+	earliest, latest := ml.Range(ctx)
+	if latest != -1 {
+		for offset := earliest; offset <= latest; offset++ {
+			rec, err := ml.Read(ctx, offset)
+			if err != nil {
+				return nil, fmt.Errorf("read record %d: %w", offset, err)
+			}
+			stored := len(rec.Data)
+			if err = l.decode(&rec); err != nil {
+				return nil, fmt.Errorf("read record %d: %w", offset, err)
+			}
+			l.track(offset, rec.Data, stored)
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.enforce(ctx, time.Now())
+
+	return &l, nil
+}
+
+// Write compresses and creates a new record and purges records exceeding the
+// retention policy
+func (l *eventLog) Write(ctx context.Context, data []byte) (memlog.Offset, error) {
+	if len(data) > l.opts.recordSize {
+		return -1, memlog.ErrRecordTooLarge
+	}
+
+	stored := data
+	if l.opts.codec != nil {
+		stored = l.opts.codec.encode(data)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	offset, err := l.log.Write(ctx, stored)
+	if err != nil {
+		return offset, err
+	}
+
+	l.track(offset, data, len(stored))
+	l.enforce(ctx, time.Now())
+
+	close(l.written)
+	l.written = make(chan struct{})
+
+	return offset, nil
+}
+
+// Written returns a channel which is closed on the next write, i.e. to wait for
+// a future offset without polling
+func (l *eventLog) Written() <-chan struct{} {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.written
+}
+
+// Read returns the decompressed record at offset. ErrOutOfRange is returned for
+// purged records.
+func (l *eventLog) Read(ctx context.Context, offset memlog.Offset) (memlog.Record, error) {
+	rec, err := l.ReadStored(ctx, offset)
+	if err != nil {
+		return memlog.Record{}, err
+	}
+
+	if err = l.decode(&rec); err != nil {
+		return memlog.Record{}, fmt.Errorf("read record %d: %w", offset, err)
+	}
+	return rec, nil
+}
+
+// ReadStored returns the record at offset as stored, i.e. compressed with the
+// codec of ContentEncoding. ErrOutOfRange is returned for purged records.
+func (l *eventLog) ReadStored(ctx context.Context, offset memlog.Offset) (memlog.Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if offset < l.floor {
+		return memlog.Record{}, memlog.ErrOutOfRange
+	}
+	return l.log.Read(ctx, offset)
+}
+
+// ReadBatch reads decompressed records starting at offset into batch, see
+// memlog.Log.ReadBatch. ErrOutOfRange is returned for purged records.
+func (l *eventLog) ReadBatch(ctx context.Context, offset memlog.Offset, batch []memlog.Record) (int, error) {
+	l.mu.RLock()
+	if offset < l.floor {
+		l.mu.RUnlock()
+		return 0, memlog.ErrOutOfRange
+	}
+	count, err := l.log.ReadBatch(ctx, offset, batch)
+	l.mu.RUnlock()
+
+	for i := 0; i < count; i++ {
+		if derr := l.decode(&batch[i]); derr != nil {
+			return 0, fmt.Errorf("read record %d: %w", batch[i].Metadata.Offset, derr)
+		}
+	}
+	return count, err
+}
+
+// ContentEncoding returns the HTTP content coding of stored records or an
+// empty string if records are not stored in a registered content coding
+func (l *eventLog) ContentEncoding() string {
+	if l.opts.codec == nil {
+		return ""
+	}
+	return l.opts.codec.contentEncoding()
+}
+
+// Range returns the earliest retained and latest offset or -1 for both if the
+// log is empty
+func (l *eventLog) Range(ctx context.Context) (earliest, latest memlog.Offset) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	earliest, latest = l.log.Range(ctx)
+	if latest != -1 && l.floor > earliest {
+		earliest = l.floor
+	}
+	return earliest, latest
+}
+
+// Stream returns a stream iterator starting at the given start offset, see
+// memlog.Log.Stream
+func (l *eventLog) Stream(ctx context.Context, start memlog.Offset) *eventStream {
+	return &eventStream{
+		ctx:      ctx,
+		log:      l,
+		position: start,
+	}
+}
+
+// purge purges records exceeding the maximum age at now, e.g. when no new
+// records are written
+func (l *eventLog) purge(ctx context.Context, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.enforce(ctx, now)
+}
+
+// decode decompresses the record data in place
+func (l *eventLog) decode(rec *memlog.Record) error {
+	if l.opts.codec == nil {
+		return nil
+	}
+
+	data, err := l.opts.codec.decode(rec.Data)
+	if err != nil {
+		return fmt.Errorf("decompress record: %w", err)
+	}
+	rec.Data = data
+	return nil
+}
+
+// track adds a written record with its uncompressed data and stored size to
+// the retained records. Must be protected with a lock by the caller.
+func (l *eventLog) track(offset memlog.Offset, data []byte, stored int) {
+	// records without valid time do not expire
+	t, _ := recordTime(data)
+
+	l.records = append(l.records, retainedRecord{
+		offset: offset,
+		time:   t,
+		size:   int64(stored),
+	})
+	l.bytes += int64(stored)
+}
+
+// enforce purges records exceeding the retention policy and compacts the log.
+// Must be protected with a lock by the caller.
+func (l *eventLog) enforce(ctx context.Context, now time.Time) {
+	earliest, _ := l.log.Range(ctx)
+	for len(l.records) > 0 && l.records[0].offset < earliest {
+		l.pop(purgeSegment)
+	}
+	for len(l.hidden) > 0 && l.hidden[0].offset < earliest {
+		l.hidden = l.hidden[1:]
+	}
+
+	policy := l.opts.retention
+	cutoff := now.Add(-policy.maxAge)
+
+purge:
+	for len(l.records) > 1 {
+		r := l.records[0]
+		switch {
+		case policy.maxAge > 0 && !r.time.IsZero() && r.time.Before(cutoff):
+			l.hidden = append(l.hidden, l.pop(purgeAge))
+		case policy.maxBytes > 0 && l.bytes > policy.maxBytes:
+			l.hidden = append(l.hidden, l.pop(purgeSize))
+		default:
+			break purge
+		}
+	}
+
+	if len(l.records) > 0 {
+		l.floor = l.records[0].offset
+	}
+	l.opts.metrics.retained(len(l.records), l.bytes)
+
+	// compressed record sizes vary, so hidden records are weighed by stored
+	// size instead of count
+	var hidden int64
+	for _, r := range l.hidden {
+		hidden += r.size
+	}
+	if len(l.hidden) > 0 && hidden >= l.bytes {
+		if err := l.compact(); err != nil {
+			// hidden records are freed by the next compaction or segment purge
+			logger.Get(ctx).Warn("could not compact log", zap.Error(err))
+		}
+	}
+}
+
+// pop removes and returns the earliest retained record. Must be protected with
+// a lock by the caller.
+func (l *eventLog) pop(reason string) retainedRecord {
+	r := l.records[0]
+	l.records = l.records[1:]
+	l.bytes -= r.size
+	l.opts.metrics.purged(reason, r.size)
+	return r
+}
+
+// compact replaces the log with a new log containing only the retained
+// records as stored. Must be protected with a lock by the caller.
+func (l *eventLog) compact() error {
+	// must not be interrupted by cancellation
+	ctx := context.Background()
+
+	ml, err := newMemlog(ctx, l.floor, l.opts)
+	if err != nil {
+		return err
+	}
+
+	_, latest := l.log.Range(ctx)
+	for offset := l.floor; offset <= latest; offset++ {
+		rec, err := l.log.Read(ctx, offset)
+		if err != nil {
+			return fmt.Errorf("read record %d: %w", offset, err)
+		}
+		if _, err = ml.Write(ctx, rec.Data); err != nil {
+			return fmt.Errorf("write record %d: %w", offset, err)
+		}
+	}
+
+	l.log = ml
+	l.hidden = nil
+	return nil
+}
+
+// newMemlog creates a memlog.Log starting at start for the event log options
+func newMemlog(ctx context.Context, start memlog.Offset, opts eventLogOptions) (*memlog.Log, error) {
+	maxSize := opts.recordSize
+	if opts.codec != nil {
+		maxSize = opts.codec.maxEncodedLen(maxSize)
+	}
+
+	ml, err := memlog.New(ctx,
+		memlog.WithStartOffset(start),
+		memlog.WithMaxSegmentSize(opts.segmentSize),
+		memlog.WithMaxRecordDataSize(maxSize),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create log: %w", err)
+	}
+	return ml, nil
+}
+
+// eventStream is an iterator to stream records in order from an event log. It
+// reads through the event log so streams continue after compaction and must
+// only be used within the same goroutine.
+type eventStream struct {
+	ctx      context.Context
+	log      *eventLog
+	position memlog.Offset
+	done     bool
+	err      error
+}
+
+// Next blocks until the next record is available, see memlog.Stream.Next
+func (s *eventStream) Next() (memlog.Record, bool) {
+	for {
+		if s.done {
+			return memlog.Record{}, false
+		}
+
+		if s.ctx.Err() != nil {
+			s.err = s.ctx.Err()
+			s.done = true
+			return memlog.Record{}, false
+		}
+
+		// retrieved before reading to not miss a write in between
+		written := s.log.Written()
+		rec, err := s.log.Read(s.ctx, s.position)
+		if err != nil {
+			if errors.Is(err, memlog.ErrFutureOffset) {
+				select {
+				case <-s.ctx.Done():
+				case <-written:
+				}
+				continue
+			}
+
+			s.err = err
+			s.done = true
+			return memlog.Record{}, false
+		}
+
+		s.position = rec.Metadata.Offset + 1
+		return rec, true
+	}
+}
+
+// Err returns the error which stopped the stream
+func (s *eventStream) Err() error {
+	return s.err
+}
+
+// enforceRetention periodically purges records exceeding the maximum age and
+// prunes the indexes until the context is cancelled
+func (s *server) enforceRetention(ctx context.Context) error {
+	if _, err := s.waitLog(ctx); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			s.purge(ctx, time.Now())
+		}
+	}
+}
+
+// purge purges records exceeding the maximum age at now and prunes the indexes
+// which are otherwise only pruned on writes
+func (s *server) purge(ctx context.Context, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.log.purge(ctx, now)
+	earliest, _ := s.log.Range(ctx)
+	for _, idx := range s.indexers {
+		idx.prune(earliest)
+	}
+}
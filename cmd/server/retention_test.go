@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/embano1/memlog"
+	"github.com/embano1/vsphere/logger"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/v3/assert"
+)
+
+func Test_eventLog(t *testing.T) {
+	ctx := logger.Set(context.Background(), zaptest.NewLogger(t))
+	now := time.Now().UTC()
+
+	newLog := func(t *testing.T, policy retentionPolicy) (*eventLog, *logMetrics) {
+		ml, err := memlog.New(ctx, memlog.WithStartOffset(10), memlog.WithMaxSegmentSize(10))
+		assert.NilError(t, err)
+
+		m := newLogMetrics(prometheus.NewRegistry())
+		l, err := newEventLog(ctx, ml, eventLogOptions{segmentSize: 10, recordSize: 1024, retention: policy, metrics: m})
+		assert.NilError(t, err)
+		return l, m
+	}
+
+	t.Run("purges records by age", func(t *testing.T) {
+		l, m := newLog(t, retentionPolicy{maxAge: time.Hour})
+
+		// 10-12 expired
+		for i := 0; i < 8; i++ {
+			at := now
+			if i < 3 {
+				at = now.Add(-3 * time.Hour)
+			}
+			writeEventAt(t, l, at)
+		}
+
+		earliest, latest := l.Range(ctx)
+		assert.Equal(t, earliest, memlog.Offset(13))
+		assert.Equal(t, latest, memlog.Offset(17))
+
+		_, err := l.Read(ctx, 12)
+		assert.ErrorIs(t, err, memlog.ErrOutOfRange)
+		_, err = l.ReadBatch(ctx, 12, make([]memlog.Record, 5))
+		assert.ErrorIs(t, err, memlog.ErrOutOfRange)
+
+		rec, err := l.Read(ctx, 13)
+		assert.NilError(t, err)
+		assert.Equal(t, rec.Metadata.Offset, memlog.Offset(13))
+
+		assert.Equal(t, testutil.ToFloat64(m.purgedRecords.WithLabelValues(purgeAge)), float64(3))
+		assert.Equal(t, testutil.ToFloat64(m.records), float64(5))
+	})
+
+	t.Run("purges expired records without writes but retains latest", func(t *testing.T) {
+		l, m := newLog(t, retentionPolicy{maxAge: time.Hour})
+		for i := 0; i < 3; i++ {
+			writeEventAt(t, l, now.Add(-30*time.Minute))
+		}
+
+		l.mu.Lock()
+		l.enforce(ctx, now.Add(time.Hour))
+		l.mu.Unlock()
+
+		earliest, latest := l.Range(ctx)
+		assert.Equal(t, earliest, memlog.Offset(12))
+		assert.Equal(t, latest, memlog.Offset(12))
+		assert.Equal(t, testutil.ToFloat64(m.purgedRecords.WithLabelValues(purgeAge)), float64(2))
+	})
+
+	t.Run("purges records by size", func(t *testing.T) {
+		empty, _ := newLog(t, retentionPolicy{})
+		size := writeEventAt(t, empty, now)
+
+		l, m := newLog(t, retentionPolicy{maxBytes: 3 * size})
+		for i := 0; i < 5; i++ {
+			writeEventAt(t, l, now)
+		}
+
+		earliest, latest := l.Range(ctx)
+		assert.Equal(t, earliest, memlog.Offset(12))
+		assert.Equal(t, latest, memlog.Offset(14))
+		assert.Equal(t, testutil.ToFloat64(m.purgedRecords.WithLabelValues(purgeSize)), float64(2))
+		assert.Equal(t, testutil.ToFloat64(m.purgedBytes.WithLabelValues(purgeSize)), float64(2*size))
+		assert.Equal(t, testutil.ToFloat64(m.bytes), float64(3*size))
+	})
+
+	t.Run("counts records purged by segment size", func(t *testing.T) {
+		l, m := newLog(t, retentionPolicy{})
+		for i := 0; i < 25; i++ {
+			writeEventAt(t, l, now)
+		}
+
+		earliest, _ := l.Range(ctx)
+		assert.Equal(t, earliest, memlog.Offset(20))
+		assert.Equal(t, testutil.ToFloat64(m.purgedRecords.WithLabelValues(purgeSegment)), float64(10))
+		assert.Equal(t, testutil.ToFloat64(m.records), float64(15))
+	})
+
+	t.Run("compacts log and continues streams", func(t *testing.T) {
+		l, _ := newLog(t, retentionPolicy{maxAge: time.Hour})
+		for i := 0; i < 10; i++ {
+			writeEventAt(t, l, now.Add(-2*time.Hour))
+		}
+
+		sctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		stream := l.Stream(sctx, 19)
+		rec, ok := stream.Next()
+		assert.Assert(t, ok)
+		assert.Equal(t, rec.Metadata.Offset, memlog.Offset(19))
+
+		// all but the latest record are hidden and freed
+		l.mu.RLock()
+		earliest, _ := l.log.Range(ctx)
+		l.mu.RUnlock()
+		assert.Equal(t, earliest, memlog.Offset(19))
+
+		writeEventAt(t, l, now)
+		rec, ok = stream.Next()
+		assert.Assert(t, ok)
+		assert.Equal(t, rec.Metadata.Offset, memlog.Offset(20))
+
+		cancel()
+		_, ok = stream.Next()
+		assert.Assert(t, !ok)
+		assert.ErrorIs(t, stream.Err(), context.Canceled)
+	})
+
+	t.Run("compacts log by stored size", func(t *testing.T) {
+		l, _ := newLog(t, retentionPolicy{maxAge: time.Hour})
+		writeEventAt(t, l, now.Add(-30*time.Minute), 512)
+		for i := 0; i < 3; i++ {
+			writeEventAt(t, l, now)
+		}
+
+		// the large expired record outweighs the retained records
+		l.mu.Lock()
+		l.enforce(ctx, now.Add(45*time.Minute))
+		earliest, _ := l.log.Range(ctx)
+		l.mu.Unlock()
+		assert.Equal(t, earliest, memlog.Offset(11))
+	})
+
+	t.Run("stream waits for future offsets", func(t *testing.T) {
+		l, _ := newLog(t, retentionPolicy{})
+		writeEventAt(t, l, now)
+
+		sctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		stream := l.Stream(sctx, 11)
+
+		rec, err := l.Read(ctx, 10)
+		assert.NilError(t, err)
+		written := make(chan error, 1)
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			_, err := l.Write(ctx, rec.Data)
+			written <- err
+		}()
+		rec, ok := stream.Next()
+		assert.Assert(t, ok)
+		assert.Equal(t, rec.Metadata.Offset, memlog.Offset(11))
+		assert.NilError(t, <-written)
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+		}()
+		_, ok = stream.Next()
+		assert.Assert(t, !ok)
+		assert.ErrorIs(t, stream.Err(), context.Canceled)
+	})
+
+	t.Run("range reflects retention", func(t *testing.T) {
+		l, _ := newLog(t, retentionPolicy{maxAge: time.Hour})
+		for _, age := range []time.Duration{3 * time.Hour, 2 * time.Hour, 90 * time.Minute, 0} {
+			writeEventAt(t, l, now.Add(-age))
+		}
+
+		srv := server{log: l}
+		rec := httptest.NewRecorder()
+		srv.getRange(ctx)(rec, httptest.NewRequest(http.MethodGet, "/api/v1/range", nil), nil)
+		assert.Equal(t, rec.Code, http.StatusOK)
+
+		var got logRange
+		assert.NilError(t, json.NewDecoder(rec.Body).Decode(&got))
+		assert.DeepEqual(t, got, logRange{Earliest: 13, Latest: 13})
+	})
+}
+
+func Test_serverPurge(t *testing.T) {
+	ctx := logger.Set(context.Background(), zaptest.NewLogger(t))
+	now := time.Now().UTC()
+
+	idx := &pruneRecorder{earliest: -1}
+	srv := server{retention: retentionPolicy{maxAge: time.Hour}}
+	srv.indexers = []indexer{idx}
+	assert.NilError(t, srv.initializeLog(ctx, 0, 10, 1024))
+
+	for i := 0; i < 3; i++ {
+		e := ce.NewEvent()
+		e.SetID(uuid.New().String())
+		e.SetType("test.event.v0")
+		e.SetTime(now.Add(-30 * time.Minute))
+		e.SetSource("/test/source")
+
+		b, err := json.Marshal(e)
+		assert.NilError(t, err)
+		_, err = srv.appendRecord(ctx, memlog.Offset(i), &e, b)
+		assert.NilError(t, err)
+	}
+	assert.Equal(t, idx.earliest, memlog.Offset(0))
+
+	srv.purge(ctx, now.Add(time.Hour))
+	assert.Equal(t, idx.earliest, memlog.Offset(2))
+}
+
+// pruneRecorder is an indexer recording the earliest offset it was pruned to
+type pruneRecorder struct {
+	earliest memlog.Offset
+}
+
+func (p *pruneRecorder) index(memlog.Offset, *ce.Event) {}
+
+func (p *pruneRecorder) prune(earliest memlog.Offset) {
+	p.earliest = earliest
+}
+
+// wrapLog returns an event log without retention policy for ml
+func wrapLog(t *testing.T, ml *memlog.Log) *eventLog {
+	t.Helper()
+
+	l, err := newEventLog(context.Background(), ml, eventLogOptions{segmentSize: 1000, recordSize: 524288})
+	assert.NilError(t, err)
+	return l
+}
+
+// writeEventAt writes an event with the given time and optional data size and
+// returns its size
+func writeEventAt(t *testing.T, l *eventLog, at time.Time, dataSize ...int) int64 {
+	t.Helper()
+
+	// fixed size id
+	e := ce.NewEvent()
+	e.SetID(uuid.New().String())
+	e.SetType("test.event.v0")
+	e.SetTime(at)
+	e.SetSource("/test/source")
+	if len(dataSize) > 0 {
+		assert.NilError(t, e.SetData(ce.ApplicationJSON, strings.Repeat("x", dataSize[0])))
+	}
+
+	b, err := json.Marshal(e)
+	assert.NilError(t, err)
+
+	_, err = l.Write(context.Background(), b)
+	assert.NilError(t, err)
+	return int64(len(b))
+}
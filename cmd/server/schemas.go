@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/embano1/vsphere/logger"
+	"github.com/julienschmidt/httprouter"
+	"go.uber.org/zap"
+
+	"github.com/embano1/vsphere-event-streaming/events"
+)
+
+const contentTypeSchema = "application/schema+json"
+
+// getSchema returns the JSON Schema of the event data for the CloudEvent type.
+// The event class is required for the eventex and extendedevent classes.
+func (s *server) getSchema(ctx context.Context) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		schema, err := events.Schema(ps.ByName("type"), r.FormValue(events.ClassExtension))
+		if err != nil {
+			if errors.Is(err, events.ErrUnknownType) {
+				notFound(w, err.Error())
+				return
+			}
+			invalidParameter(w, err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", contentTypeSchema)
+		if _, err = w.Write(schema); err != nil {
+			logger.Get(ctx).Error("write schema", zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/embano1/vsphere/logger"
+	"github.com/julienschmidt/httprouter"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/v3/assert"
+)
+
+func Test_getSchema(t *testing.T) {
+	ctx := logger.Set(context.Background(), zaptest.NewLogger(t))
+
+	tests := []struct {
+		name     string
+		ceType   string
+		query    string
+		wantCode int
+		wantRef  string
+	}{
+		{name: "event", ceType: "com.vmware.vsphere.VmPoweredOnEvent.v0", wantCode: http.StatusOK, wantRef: "#/$defs/VmPoweredOnEvent"},
+		{name: "eventex", ceType: "com.vmware.vsphere.com.vmware.cl.PublishLibraryEvent.v0", query: "?eventclass=eventex", wantCode: http.StatusOK, wantRef: "#/$defs/EventEx"},
+		{name: "eventex without class", ceType: "com.vmware.vsphere.com.vmware.cl.PublishLibraryEvent.v0", wantCode: http.StatusNotFound},
+		{name: "unknown type", ceType: "com.vmware.vsphere.DoesNotExistEvent.v0", wantCode: http.StatusNotFound},
+		{name: "unknown class", ceType: "com.vmware.vsphere.VmPoweredOnEvent.v0", query: "?eventclass=metric", wantCode: http.StatusBadRequest},
+		{name: "task", ceType: "com.vmware.vsphere.task.success.v0", query: "?eventclass=task", wantCode: http.StatusOK, wantRef: "#/$defs/TaskInfo"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var srv server
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/schemas/"+tc.ceType+tc.query, nil)
+			srv.getSchema(ctx)(rec, req, httprouter.Params{{Key: "type", Value: tc.ceType}})
+
+			assert.Equal(t, rec.Code, tc.wantCode)
+			if tc.wantCode != http.StatusOK {
+				return
+			}
+
+			assert.Equal(t, rec.Header().Get("Content-Type"), contentTypeSchema)
+			var schema struct {
+				Title string `json:"title"`
+				Ref   string `json:"$ref"`
+			}
+			assert.NilError(t, json.NewDecoder(rec.Body).Decode(&schema))
+			assert.Equal(t, schema.Title, tc.ceType)
+			assert.Equal(t, schema.Ref, tc.wantRef)
+		})
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/embano1/memlog"
+	"github.com/embano1/vsphere/logger"
+	"github.com/julienschmidt/httprouter"
+	"go.uber.org/zap"
+
+	"github.com/embano1/vsphere-event-streaming/events"
+)
+
+const (
+	queryKey = "q"
+
+	// term prefixes
+	textPrefix  = "text:"
+	typePrefix  = "type:"
+	fieldPrefix = "data."
+
+	messageField = "FullFormattedMessage"
+)
+
+// searchEntry is the forward index of a record to remove its terms when the
+// record is purged
+type searchEntry struct {
+	offset memlog.Offset
+	time   time.Time
+	terms  []string
+}
+
+// searchIndex is an inverted index mapping terms of the retained records to
+// their offsets. Terms are the words in the FullFormattedMessage, the event
+// name and the scalar fields in the event data.
+//
+// Safe for concurrent use.
+type searchIndex struct {
+	mu       sync.RWMutex
+	entries  []searchEntry              // ordered by offset
+	postings map[string][]memlog.Offset // ordered by offset
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		postings: make(map[string][]memlog.Offset),
+	}
+}
+
+func (si *searchIndex) index(offset memlog.Offset, e *ce.Event) {
+	terms := eventTerms(e)
+
+	si.mu.Lock()
+	defer si.mu.Unlock()
+
+	si.entries = append(si.entries, searchEntry{offset: offset, time: e.Time(), terms: terms})
+	for _, term := range terms {
+		si.postings[term] = append(si.postings[term], offset)
+	}
+}
+
+func (si *searchIndex) prune(earliest memlog.Offset) {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+
+	var i int
+	for ; i < len(si.entries) && si.entries[i].offset < earliest; i++ {
+		for _, term := range si.entries[i].terms {
+			// purged in offset order
+			offsets := si.postings[term][1:]
+			if len(offsets) == 0 {
+				delete(si.postings, term)
+				continue
+			}
+			si.postings[term] = offsets
+		}
+	}
+
+	if i > 0 {
+		si.entries = append(si.entries[:0], si.entries[i:]...)
+	}
+}
+
+// search returns the offsets of the records matching all terms with an event
+// time at or after since in offset order
+func (si *searchIndex) search(terms []string, since time.Time) []memlog.Offset {
+	si.mu.RLock()
+	defer si.mu.RUnlock()
+
+	lists := make([][]memlog.Offset, 0, len(terms))
+	for _, term := range terms {
+		offsets, ok := si.postings[term]
+		if !ok {
+			return nil
+		}
+		lists = append(lists, offsets)
+	}
+
+	// intersect starting with the shortest list
+	sort.Slice(lists, func(i, j int) bool {
+		return len(lists[i]) < len(lists[j])
+	})
+	matches := append([]memlog.Offset(nil), lists[0]...)
+	for _, list := range lists[1:] {
+		matches = intersect(matches, list)
+	}
+
+	if since.IsZero() {
+		return matches
+	}
+
+	filtered := matches[:0]
+	for _, offset := range matches {
+		i := sort.Search(len(si.entries), func(i int) bool {
+			return si.entries[i].offset >= offset
+		})
+		if i < len(si.entries) && !si.entries[i].time.Before(since) {
+			filtered = append(filtered, offset)
+		}
+	}
+	return filtered
+}
+
+// intersect returns the offsets in a and b. a is modified.
+func intersect(a, b []memlog.Offset) []memlog.Offset {
+	result := a[:0]
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	return result
+}
+
+// eventTerms returns the unique search terms of the event
+func eventTerms(e *ce.Event) []string {
+	seen := make(map[string]struct{})
+	add := func(term string) {
+		seen[term] = struct{}{}
+	}
+
+	add(typePrefix + strings.ToLower(eventName(e.Type())))
+
+	var data interface{}
+	if err := json.Unmarshal(e.Data(), &data); err == nil {
+		if fields, ok := data.(map[string]interface{}); ok {
+			if msg, ok := fields[messageField].(string); ok {
+				for _, word := range tokenize(msg) {
+					add(textPrefix + word)
+				}
+			}
+		}
+		fieldTerms(strings.TrimSuffix(fieldPrefix, "."), data, add)
+	}
+
+	terms := make([]string, 0, len(seen))
+	for term := range seen {
+		terms = append(terms, term)
+	}
+	return terms
+}
+
+// fieldTerms adds a path=value term for each scalar field in v. Array elements
+// share the path of the array.
+func fieldTerms(path string, v interface{}, add func(string)) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			fieldTerms(path+"."+k, child, add)
+		}
+	case []interface{}:
+		for _, child := range v {
+			fieldTerms(path, child, add)
+		}
+	case string:
+		add(fieldTerm(path, v))
+	case float64:
+		add(fieldTerm(path, strconv.FormatFloat(v, 'f', -1, 64)))
+	case bool:
+		add(fieldTerm(path, strconv.FormatBool(v)))
+	}
+}
+
+func fieldTerm(path, value string) string {
+	return strings.ToLower(path) + "=" + strings.ToLower(value)
+}
+
+// eventName returns the vSphere event name of a cloudevent type or the type if
+// it is not a vSphere event
+func eventName(ceType string) string {
+	if name, err := events.Name(ceType); err == nil {
+		return name
+	}
+	return ceType
+}
+
+// tokenize splits text into lower case words. Dots, dashes and underscores
+// within words are retained, e.g. vm-web-17 or esx-01.lab.
+func tokenize(text string) []string {
+	fields := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '_' && r != '.'
+	})
+
+	words := make([]string, 0, len(fields))
+	for _, f := range fields {
+		if w := strings.Trim(f, "-_."); w != "" {
+			words = append(words, strings.ToLower(w))
+		}
+	}
+	return words
+}
+
+// parseQuery returns the search terms of the query. Terms are separated by
+// whitespace and are either a field predicate (data.<path>=<value>), an event
+// type (type:<name>) or free text.
+func parseQuery(q string) ([]string, error) {
+	var terms []string
+	for _, token := range strings.Fields(q) {
+		switch {
+		case strings.HasPrefix(token, typePrefix):
+			name := strings.TrimPrefix(token, typePrefix)
+			if name == "" {
+				return nil, errors.New("invalid type predicate: missing type")
+			}
+			terms = append(terms, typePrefix+strings.ToLower(eventName(name)))
+		case strings.HasPrefix(token, fieldPrefix):
+			path, value, ok := strings.Cut(token, "=")
+			if !ok || path == fieldPrefix || value == "" {
+				return nil, errors.New("invalid field predicate: must be data.<path>=<value>")
+			}
+			terms = append(terms, fieldTerm(path, value))
+		default:
+			for _, word := range tokenize(token) {
+				terms = append(terms, textPrefix+word)
+			}
+		}
+	}
+
+	if len(terms) == 0 {
+		return nil, errors.New("invalid q parameter: no search terms")
+	}
+	return terms, nil
+}
+
+// parseSearchSince returns the time specified with the since parameter as
+// RFC3339 timestamp or duration before now, e.g. 1h
+func parseSearchSince(r *http.Request, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(r.FormValue(sinceKey)); err == nil {
+		if d < 0 {
+			return time.Time{}, errors.New("invalid since parameter: duration must not be negative")
+		}
+		return now.Add(-d), nil
+	}
+
+	since, _, err := parseSince(r)
+	if err != nil {
+		return time.Time{}, errors.New("invalid since parameter: must be an RFC3339 timestamp or duration")
+	}
+	return since, nil
+}
+
+// searchEvents returns the latest events matching the query in offset order
+func (s *server) searchEvents(ctx context.Context) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		log := logger.Get(ctx)
+
+		q := r.FormValue(queryKey)
+		if q == "" {
+			invalidParameter(w, "missing q parameter")
+			return
+		}
+
+		terms, err := parseQuery(q)
+		if err != nil {
+			invalidParameter(w, err.Error())
+			return
+		}
+
+		since, err := parseSearchSince(r, time.Now())
+		if err != nil {
+			invalidParameter(w, err.Error())
+			return
+		}
+
+		rctx := r.Context()
+		matches := s.search.search(terms, since)
+		if len(matches) > pageSize {
+			matches = matches[len(matches)-pageSize:]
+		}
+
+		results := make([]json.RawMessage, 0, len(matches))
+		for _, offset := range matches {
+			rec, err := s.log.Read(rctx, offset)
+			if err != nil {
+				if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+					return
+				}
+
+				// purged after search
+				if errors.Is(err, memlog.ErrOutOfRange) {
+					continue
+				}
+
+				log.Error("read record", zap.Error(err))
+				internalError(w)
+				return
+			}
+			results = append(results, rec.Data)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(w).Encode(results); err != nil {
+			log.Error("marshal search response", zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/embano1/memlog"
+	"github.com/embano1/vsphere/logger"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/v3/assert"
+)
+
+func Test_tokenize(t *testing.T) {
+	got := tokenize("Virtual machine vm-web-17 on esx-01.lab in DC-1 is powered off. (user: Alice)")
+	assert.DeepEqual(t, got, []string{
+		"virtual", "machine", "vm-web-17", "on", "esx-01.lab", "in", "dc-1", "is", "powered", "off", "user", "alice",
+	})
+}
+
+func Test_parseQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		q       string
+		want    []string
+		wantErr string
+	}{
+		{name: "free text", q: "Powered vm-web-17", want: []string{"text:powered", "text:vm-web-17"}},
+		{name: "type by name", q: "type:VmPoweredOffEvent", want: []string{"type:vmpoweredoffevent"}},
+		{name: "type by cloudevent type", q: "type:com.vmware.vsphere.VmPoweredOffEvent.v0", want: []string{"type:vmpoweredoffevent"}},
+		{name: "field", q: "data.UserName=Alice", want: []string{"data.username=alice"}},
+		{name: "combined", q: "data.Vm.Name=vm-web-17 type:VmPoweredOffEvent off", want: []string{"data.vm.name=vm-web-17", "type:vmpoweredoffevent", "text:off"}},
+		{name: "missing type", q: "type:", wantErr: "invalid type predicate"},
+		{name: "missing value", q: "data.UserName=", wantErr: "invalid field predicate"},
+		{name: "missing path", q: "data.=alice", wantErr: "invalid field predicate"},
+		{name: "no terms", q: "--", wantErr: "no search terms"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseQuery(tc.q)
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			assert.NilError(t, err)
+			assert.DeepEqual(t, got, tc.want)
+		})
+	}
+}
+
+func Test_searchEvents(t *testing.T) {
+	ctx := logger.Set(context.Background(), zaptest.NewLogger(t))
+	now := time.Now().UTC()
+
+	type vm struct {
+		Name string
+	}
+	type data struct {
+		Key                  int
+		UserName             string
+		FullFormattedMessage string
+		Vm                   vm
+	}
+
+	// segment size 5: offsets 0-4 are purged after writing offset 10
+	srv := server{search: newSearchIndex()}
+	srv.indexers = []indexer{srv.search}
+	assert.NilError(t, srv.initializeLog(ctx, 0, 5, 1024))
+
+	for i := 0; i < 12; i++ {
+		name := "vm-web-" + strconv.Itoa(i%3)
+		typ, user, msg := "VmPoweredOnEvent", "alice", name+" on esx-01.lab is powered on"
+		if i%2 == 1 {
+			typ, user, msg = "VmPoweredOffEvent", "bob", name+" on esx-01.lab is powered off"
+		}
+
+		e := ce.NewEvent()
+		e.SetID(strconv.Itoa(i))
+		e.SetType("com.vmware.vsphere." + typ + ".v0")
+		e.SetTime(now.Add(time.Duration(i-11) * 10 * time.Minute))
+		e.SetSource("/test/source")
+		assert.NilError(t, e.SetData(ce.ApplicationJSON, data{Key: i, UserName: user, FullFormattedMessage: msg, Vm: vm{Name: name}}))
+
+		b, err := json.Marshal(e)
+		assert.NilError(t, err)
+		written, err := srv.appendRecord(ctx, memlog.Offset(i), &e, b)
+		assert.NilError(t, err)
+		assert.Assert(t, written)
+	}
+
+	tests := []struct {
+		name     string
+		query    url.Values
+		wantCode int
+		wantIDs  []string
+	}{
+		{name: "free text", query: url.Values{"q": {"vm-web-1"}}, wantCode: http.StatusOK, wantIDs: []string{"7", "10"}},
+		{name: "free text and type", query: url.Values{"q": {"vm-web-1 type:VmPoweredOffEvent"}}, wantCode: http.StatusOK, wantIDs: []string{"7"}},
+		{name: "field", query: url.Values{"q": {"data.UserName=Bob"}}, wantCode: http.StatusOK, wantIDs: []string{"5", "7", "9", "11"}},
+		{name: "numeric field", query: url.Values{"q": {"data.Key=8"}}, wantCode: http.StatusOK, wantIDs: []string{"8"}},
+		{name: "nested field", query: url.Values{"q": {"data.Vm.Name=vm-web-2 powered"}}, wantCode: http.StatusOK, wantIDs: []string{"5", "8", "11"}},
+		{name: "purged", query: url.Values{"q": {"data.Key=4"}}, wantCode: http.StatusOK, wantIDs: []string{}},
+		{name: "no match", query: url.Values{"q": {"vm-db-01"}}, wantCode: http.StatusOK, wantIDs: []string{}},
+		{name: "since duration", query: url.Values{"q": {"esx-01.lab"}, "since": {"25m"}}, wantCode: http.StatusOK, wantIDs: []string{"9", "10", "11"}},
+		{name: "since time", query: url.Values{"q": {"off"}, "since": {now.Add(-25 * time.Minute).Format(time.RFC3339)}}, wantCode: http.StatusOK, wantIDs: []string{"9", "11"}},
+		{name: "missing query", query: url.Values{}, wantCode: http.StatusBadRequest},
+		{name: "invalid query", query: url.Values{"q": {"type:"}}, wantCode: http.StatusBadRequest},
+		{name: "invalid since", query: url.Values{"q": {"off"}, "since": {"yesterday"}}, wantCode: http.StatusBadRequest},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/search?"+tc.query.Encode(), nil)
+			srv.searchEvents(ctx)(rec, req, nil)
+
+			assert.Equal(t, rec.Code, tc.wantCode)
+			if tc.wantCode != http.StatusOK {
+				return
+			}
+
+			var got []ce.Event
+			assert.NilError(t, json.NewDecoder(rec.Body).Decode(&got))
+			ids := []string{}
+			for _, e := range got {
+				ids = append(ids, e.ID())
+			}
+			assert.DeepEqual(t, ids, tc.wantIDs)
+		})
+	}
+
+	t.Run("prunes purged records", func(t *testing.T) {
+		si := newSearchIndex()
+		for i := 0; i < 3; i++ {
+			e := ce.NewEvent()
+			e.SetType("test.event.v0")
+			si.index(memlog.Offset(i), &e)
+		}
+
+		si.prune(2)
+		assert.DeepEqual(t, si.search([]string{"type:test.event.v0"}, time.Time{}), []memlog.Offset{2})
+		assert.Equal(t, len(si.entries), 1)
+
+		si.prune(3)
+		assert.Equal(t, len(si.postings), 0)
+	})
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,6 +10,8 @@ import (
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	ce "github.com/cloudevents/sdk-go/v2"
@@ -17,6 +20,10 @@ import (
 	"github.com/embano1/vsphere/logger"
 	"github.com/google/uuid"
 	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 	"go.uber.org/zap"
 )
 
@@ -29,12 +36,48 @@ const (
 	pageSize        = 50
 	offsetKey       = "offset"
 	watchKey        = "watch"
+	bookmarksKey    = "bookmarks"
 )
 
+// bookmark interval on idle watches with bookmarks
+var bookmarkInterval = 15 * time.Second
+
+// errOffsetGap is returned when a record does not continue the log, i.e. its
+// offset would not match the vCenter event key
+var errOffsetGap = errors.New("offset does not continue log")
+
 type server struct {
-	http *http.Server
-	vc   *client.Client // vsphere
-	log  *memlog.Log
+	http  *http.Server
+	vc    *client.Client // vsphere
+	log   *eventLog
+	ready chan struct{} // closed when log is initialized
+
+	mu       sync.Mutex    // serializes log initialization and writes
+	start    memlog.Offset // log start offset
+	times    *timeIndex
+	types    *typeCatalog
+	search   *searchIndex
+	chains   *chainIndex
+	indexers []indexer // updated on each write
+
+	retention  retentionPolicy // set before the log is initialized
+	codec      codec           // set before the log is initialized
+	registry   *prometheus.Registry
+	logMetrics *logMetrics
+
+	reloader   *reloader    // set before serving http
+	adminToken string       // set before serving http, admin api disabled if empty
+	imports    importConfig // set before serving http, limits of archive uploads
+	replica    *follower    // set before serving http on read replicas
+	activity   *server      // set before serving http unless read replica
+}
+
+// indexer maintains a secondary index over the records in the log
+type indexer interface {
+	// index is called after the event has been written at offset
+	index(offset memlog.Offset, e *ce.Event)
+	// prune removes entries before the earliest offset in the log
+	prune(earliest memlog.Offset)
 }
 
 type logRange struct {
@@ -42,30 +85,35 @@ type logRange struct {
 	Latest   memlog.Offset `json:"latest"`
 }
 
-type envConfig struct {
-	RecordSize  int           `envconfig:"LOG_MAX_RECORD_SIZE_BYTES" required:"true" default:"524288"`
-	SegmentSize int           `envconfig:"LOG_MAX_SEGMENT_SIZE" required:"true" default:"1000"`
-	StreamBegin time.Duration `envconfig:"VCENTER_STREAM_BEGIN" required:"true" default:"10m"`
-	Port        int           `envconfig:"PORT" required:"true" default:"8080"`
-	Debug       bool          `envconfig:"DEBUG" default:"false"`
+// bookmark is sent on watches with bookmarks to report the log range, e.g.
+// {"bookmark":{"earliest":41,"latest":46}}
+type bookmark struct {
+	Bookmark logRange `json:"bookmark"`
 }
 
-func newServer(ctx context.Context, address string) (*server, error) {
-	var srv server
-	vc, err := client.New(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("create vsphere client: %w", err)
+// newServer creates a server listening on address. Read replicas do not
+// connect to vCenter.
+func newServer(ctx context.Context, address string, replica bool) (*server, error) {
+	srv := server{ready: make(chan struct{})}
+	srv.times = newTimeIndex(timeIndexInterval)
+	srv.types = newTypeCatalog()
+	srv.search = newSearchIndex()
+	srv.chains = newChainIndex()
+	srv.indexers = []indexer{srv.times, srv.types, srv.search, srv.chains}
+	srv.registry = newRegistry()
+	srv.logMetrics = newLogMetrics(srv.registry)
+
+	if !replica {
+		vc, err := client.New(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("create vsphere client: %w", err)
+		}
+		srv.vc = vc
 	}
-	srv.vc = vc
-
-	router := httprouter.New()
-	router.GET(apiPath+"/events", srv.getEvents(ctx))
-	router.GET(apiPath+"/events/:id", srv.getEvent(ctx))
-	router.GET(apiPath+"/range", srv.getRange(ctx))
 
 	h := http.Server{
 		Addr:         address,
-		Handler:      router,
+		Handler:      srv.routes(ctx),
 		ReadTimeout:  readTimeout,
 		WriteTimeout: streamTimeout,
 	}
@@ -74,25 +122,213 @@ func newServer(ctx context.Context, address string) (*server, error) {
 	return &srv, nil
 }
 
+// route is an api endpoint relative to apiPath
+type route struct {
+	method string
+	path   string
+	handle httprouter.Handle
+}
+
+// apiRoutes returns the api endpoints documented in openapi.json
+func (s *server) apiRoutes(ctx context.Context) []route {
+	return []route{
+		{http.MethodGet, "/events", s.whenReady(s.getEvents(ctx))},
+		{http.MethodGet, "/events/:id", s.whenReady(s.getEvent(ctx))},
+		{http.MethodGet, "/range", s.whenReady(s.getRange(ctx))},
+		{http.MethodGet, "/export", s.whenReady(s.exportEvents(ctx))},
+		{http.MethodGet, "/offsets", s.whenReady(s.getOffset(ctx))},
+		{http.MethodGet, "/search", s.whenReady(s.searchEvents(ctx))},
+		{http.MethodGet, "/chains", s.whenReady(s.getOperations(ctx))},
+		{http.MethodGet, "/chains/:chainId", s.whenReady(s.getChain(ctx))},
+		{http.MethodGet, "/inventory", s.whenReady(s.getInventory(ctx))},
+		{http.MethodGet, "/types", s.whenReady(s.getTypes(ctx))},
+		{http.MethodGet, "/stats", s.whenReady(s.getStats(ctx))},
+		{http.MethodGet, "/activity/events", s.activityRoute(ctx, (*server).getEvents)},
+		{http.MethodGet, "/activity/events/:id", s.activityRoute(ctx, (*server).getEvent)},
+		{http.MethodGet, "/activity/range", s.activityRoute(ctx, (*server).getRange)},
+		{http.MethodGet, "/activity/export", s.activityRoute(ctx, (*server).exportEvents)},
+		{http.MethodGet, "/activity/offsets", s.activityRoute(ctx, (*server).getOffset)},
+		{http.MethodGet, "/schemas/:type", s.getSchema(ctx)},
+		{http.MethodGet, "/replication", s.getReplication(ctx)},
+		{http.MethodGet, "/internal/replication", s.whenReady(s.replicate(ctx))},
+		{http.MethodPost, "/admin/import", s.admin(s.importEvents(ctx))},
+		{http.MethodGet, "/admin/reload", s.admin(s.reloadConfig(ctx))},
+		{http.MethodPost, "/admin/reload", s.admin(s.reloadConfig(ctx))},
+		{http.MethodGet, "/openapi.json", s.getOpenAPI(ctx)},
+	}
+}
+
+// routes returns the http handler for the api
+func (s *server) routes(ctx context.Context) http.Handler {
+	router := httprouter.New()
+	for _, r := range s.apiRoutes(ctx) {
+		router.Handle(r.method, apiPath+r.path, traced(r.method, apiPath+r.path, r.handle))
+	}
+	if s.registry != nil {
+		router.Handler(http.MethodGet, "/metrics", promhttp.HandlerFor(s.registry, promhttp.HandlerOpts{}))
+	}
+
+	return withRequestID(router)
+}
+
 func (s *server) initializeLog(ctx context.Context, start memlog.Offset, segmentSize, recordSize int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	if s.log != nil {
 		return nil
 	}
 
-	opts := []memlog.Option{
-		memlog.WithStartOffset(start),
-		memlog.WithMaxSegmentSize(segmentSize),
-		memlog.WithMaxRecordDataSize(recordSize),
+	opts := eventLogOptions{
+		segmentSize: segmentSize,
+		recordSize:  recordSize,
+		retention:   s.retention,
+		codec:       s.codec,
+		metrics:     s.logMetrics,
+	}
+	ml, err := newMemlog(ctx, start, opts)
+	if err != nil {
+		return err
 	}
-	ml, err := memlog.New(ctx, opts...)
+	el, err := newEventLog(ctx, ml, opts)
 	if err != nil {
 		return fmt.Errorf("create log: %w", err)
 	}
-	s.log = ml
+	s.log = el
+	s.start = start
+	if s.ready != nil {
+		close(s.ready)
+	}
 
 	return nil
 }
 
+// appendRecord writes the event data to the log unless the offset has already
+// been written, e.g. by an import. Returns whether the record was written and
+// errOffsetGap if the offset does not continue the log, e.g. after importing a
+// stale archive.
+func (s *server) appendRecord(ctx context.Context, offset memlog.Offset, e *ce.Event, data []byte) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := s.nextOffset(ctx)
+	if offset < next {
+		return false, nil
+	}
+	if offset != next {
+		return false, fmt.Errorf("log continues at offset %d, got %d: %w", next, offset, errOffsetGap)
+	}
+
+	if err := s.write(ctx, e, data); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// write writes the event data to the log and updates the indexes. Must be
+// protected with a lock by the caller.
+func (s *server) write(ctx context.Context, e *ce.Event, data []byte) error {
+	offset, err := s.log.Write(ctx, data)
+	if err != nil {
+		return err
+	}
+
+	earliest, _ := s.log.Range(ctx)
+	for _, idx := range s.indexers {
+		idx.index(offset, e)
+		idx.prune(earliest)
+	}
+
+	return nil
+}
+
+// nextOffset returns the offset of the next record written to the log. Must be
+// protected with a lock by the caller.
+func (s *server) nextOffset(ctx context.Context) memlog.Offset {
+	_, latest := s.log.Range(ctx)
+	if latest == -1 {
+		return s.start
+	}
+	return latest + 1
+}
+
+// collectorBegin returns the time of the last record in the log, e.g.
+// replicated from a previous leader, to resume collecting with it. If the log
+// is empty begin is returned.
+func (s *server) collectorBegin(ctx context.Context, begin time.Time) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.log == nil {
+		return begin
+	}
+
+	_, latest := s.log.Range(ctx)
+	if latest == -1 {
+		return begin
+	}
+
+	rec, err := s.log.Read(ctx, latest)
+	if err != nil {
+		return begin
+	}
+
+	t, err := recordTime(rec.Data)
+	if err != nil || t.IsZero() {
+		return begin
+	}
+	return t
+}
+
+// waitLog blocks until the log is initialized or the context is cancelled
+func (s *server) waitLog(ctx context.Context) (*eventLog, error) {
+	if s.ready == nil {
+		return s.log, nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.ready:
+		return s.log, nil
+	}
+}
+
+// whenReady responds with 503 log_not_ready until the log is initialized, e.g.
+// a standby following a leader which did not collect any events yet
+func (s *server) whenReady(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if s.ready != nil {
+			select {
+			case <-s.ready:
+			default:
+				logNotReady(w, "log not initialized")
+				return
+			}
+		}
+		h(w, r, ps)
+	}
+}
+
+// admin requires the admin token as bearer token. The admin api is disabled if
+// no admin token is configured.
+func (s *server) admin(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if s.adminToken == "" {
+			writeProblem(w, problem{Status: http.StatusForbidden, Code: codeForbidden, Detail: "admin api disabled, no admin token configured"})
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeProblem(w, problem{Status: http.StatusUnauthorized, Code: codeUnauthorized, Detail: "missing or invalid admin token"})
+			return
+		}
+		h(w, r, ps)
+	}
+}
+
 func (s *server) stop(ctx context.Context) error {
 	if err := s.http.Shutdown(ctx); err != nil {
 		return err
@@ -101,8 +337,11 @@ func (s *server) stop(ctx context.Context) error {
 }
 
 // returns the last page
+// if "since" is specified returns the page starting at the first event at or after since
 // if "watch=true" starts streaming from next (latest+1)
 // if "watch=true" and a valid "offset" is specified starts streaming from offset
+// if "watch=true" and "since" is specified starts streaming from the first event at or after since
+// if "ids" is specified returns the events with the given ids, e.g. ids=1,5,9
 func (s *server) getEvents(ctx context.Context) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 		var watch bool
@@ -113,11 +352,20 @@ func (s *server) getEvents(ctx context.Context) httprouter.Handle {
 			case "true":
 				watch = true
 			default:
-				http.Error(w, "invalid watch parameter", http.StatusBadRequest)
+				invalidParameter(w, "invalid watch parameter")
 				return
 			}
 		}
 
+		if r.FormValue(idsKey) != "" {
+			if watch {
+				invalidParameter(w, "ids and watch parameters are mutually exclusive")
+				return
+			}
+			s.batchGet(ctx, w, r)
+			return
+		}
+
 		if !watch {
 			s.readEvents(ctx, w, r)
 			return
@@ -137,75 +385,171 @@ func (s *server) streamEvents(ctx context.Context, w http.ResponseWriter, r *htt
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		log.Error("writer does not implement flusher")
-		w.WriteHeader(http.StatusInternalServerError)
+		internalError(w)
+		return
+	}
+
+	var bookmarks bool
+	switch val := r.FormValue(bookmarksKey); val {
+	case "":
+	case "true":
+		bookmarks = true
+	default:
+		invalidParameter(w, "invalid bookmarks parameter")
+		return
+	}
+
+	rctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	start, ok := s.watchStart(ctx, w, r)
+	if !ok {
+		return
+	}
+	if s.startPurged(rctx, w, start) {
 		return
 	}
 
 	w.Header().Set("Connection", "Keep-Alive")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
 
-	rctx := r.Context()
-	start := memlog.Offset(-1)
+	log.Debug("starting stream", zap.Any("start", start))
 
-	if o := r.FormValue(offsetKey); o != "" {
-		o = html.EscapeString(o)
-		offset, err := strconv.Atoi(o)
-		if err != nil {
-			http.Error(w, "invalid offset", http.StatusBadRequest)
-			return
+	// stream blocks until the next record is written
+	records := make(chan memlog.Record)
+	errCh := make(chan error, 1)
+	go func() {
+		stream := s.log.Stream(rctx, start)
+		for {
+			rec, ok := stream.Next()
+			if !ok {
+				errCh <- stream.Err()
+				return
+			}
+			select {
+			case records <- rec:
+			case <-rctx.Done():
+				errCh <- rctx.Err()
+				return
+			}
 		}
-		start = memlog.Offset(offset)
-	}
+	}()
 
-	if start == -1 {
-		log.Debug("no start offset specified")
-		earliest, latest := s.log.Range(rctx)
-		log.Debug("current log range", zap.Any("earliest", earliest), zap.Any("latest", latest))
-		start = latest + 1
+	// bookmarks are sent on idle streams, a nil channel blocks forever
+	ticker := time.NewTicker(bookmarkInterval)
+	defer ticker.Stop()
+	var bookmarkC <-chan time.Time
+	if bookmarks {
+		bookmarkC = ticker.C
 	}
 
-	log.Debug("starting stream", zap.Any("start", start))
-	stream := s.log.Stream(rctx, start)
-
 	for {
+		var (
+			b    []byte
+			span trace.Span = noop.Span{}
+		)
+		select {
 		// give a chance for server shutdown (not guaranteed)
-		if ctx.Err() != nil {
+		case <-ctx.Done():
 			return
-		}
-
-		if rec, ok := stream.Next(); ok {
-			b := rec.Data
-			b = append(b, byte('\n'))
-			data := string(b)
-			_, err := io.WriteString(w, data)
-			if err != nil {
-				log.Error("write event", zap.Error(err))
-				w.WriteHeader(http.StatusInternalServerError)
-				return
+		case err := <-errCh:
+			if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+				// client reconnects and receives 410 if the offset was purged
+				log.Warn("stream stopped", zap.Error(err))
 			}
+			return
+		case rec := <-records:
+			b = rec.Data
+			_, span = startDelivery(rctx, "event.deliver", rec)
+		case <-bookmarkC:
+			var bm bookmark
+			bm.Bookmark.Earliest, bm.Bookmark.Latest = s.log.Range(rctx)
+			b, _ = json.Marshal(bm)
+		}
 
-			log.Debug("sending event", zap.String("event", data))
-			flusher.Flush()
-			continue
+		data := string(append(b, byte('\n')))
+		if _, err := io.WriteString(w, data); err != nil {
+			log.Debug("write event", zap.Error(err))
+			endSpan(span, err)
+			return
 		}
-		break
+
+		log.Debug("sending event", zap.String("event", data))
+		flusher.Flush()
+		span.End()
+		ticker.Reset(bookmarkInterval)
 	}
+}
 
-	if err := stream.Err(); err != nil {
-		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
-			return
+// startPurged writes 410 Gone with the log range if the watch start offset has
+// been purged, so clients can relist and resume from earliest
+func (s *server) startPurged(ctx context.Context, w http.ResponseWriter, start memlog.Offset) bool {
+	earliest, latest := s.log.Range(ctx)
+	if latest == -1 || start >= earliest {
+		return false
+	}
+
+	s.offsetProblem(ctx, w, start, memlog.ErrOutOfRange)
+	return true
+}
+
+// watchStart returns the offset to start streaming from based on the offset or
+// since parameters, defaulting to the next offset. The error response is
+// written if false is returned.
+func (s *server) watchStart(ctx context.Context, w http.ResponseWriter, r *http.Request) (memlog.Offset, bool) {
+	log := logger.Get(ctx)
+
+	rctx := r.Context()
+	start := memlog.Offset(-1)
+
+	since, ok, err := parseSince(r)
+	if err != nil {
+		invalidParameter(w, err.Error())
+		return 0, false
+	}
+
+	if o := r.FormValue(offsetKey); o != "" {
+		if ok {
+			invalidParameter(w, "offset and since parameters are mutually exclusive")
+			return 0, false
 		}
 
-		if errors.Is(err, memlog.ErrOutOfRange) {
-			http.Error(w, "invalid offset: "+err.Error(), http.StatusBadRequest)
-			return
+		o = html.EscapeString(o)
+		offset, err := strconv.Atoi(o)
+		if err != nil {
+			invalidParameter(w, "invalid offset")
+			return 0, false
 		}
+		start = memlog.Offset(offset)
+	}
 
-		log.Error("failed to stream", zap.Error(err))
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+	if ok {
+		offset, err := s.offsetAt(rctx, since)
+		switch {
+		case err == nil:
+			start = offset
+		case errors.Is(err, errNoRecordAfter):
+			// stream from next record
+		case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+			return 0, false
+		default:
+			log.Error("seek offset", zap.Error(err))
+			internalError(w)
+			return 0, false
+		}
+	}
+
+	if start == -1 {
+		log.Debug("no start offset specified")
+		earliest, latest := s.log.Range(rctx)
+		log.Debug("current log range", zap.Any("earliest", earliest), zap.Any("latest", latest))
+		start = latest + 1
 	}
+
+	return start, true
 }
 
 func (s *server) readEvents(ctx context.Context, w http.ResponseWriter, r *http.Request) {
@@ -220,50 +564,97 @@ func (s *server) readEvents(ctx context.Context, w http.ResponseWriter, r *http.
 		return
 	}
 
-	start := getStart(earliest, latest, pageSize)
+	start, end := getStart(earliest, latest, pageSize), latest
 
-	var events []ce.Event
-	for i := start; i <= latest; i++ {
-		record, err := s.log.Read(rctx, i)
+	since, ok, err := parseSince(r)
+	if err != nil {
+		invalidParameter(w, err.Error())
+		return
+	}
+
+	// page starting at since
+	if ok {
+		offset, err := s.offsetAt(rctx, since)
 		if err != nil {
-			// client gone
 			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
 				return
 			}
 
-			// purged record, continue
-			if errors.Is(err, memlog.ErrOutOfRange) {
-				continue
+			if errors.Is(err, errNoRecordAfter) {
+				w.WriteHeader(http.StatusNoContent)
+				return
 			}
 
-			log.Error("read record", zap.Error(err))
-			w.WriteHeader(http.StatusInternalServerError)
+			log.Error("seek offset", zap.Error(err))
+			internalError(w)
 			return
 		}
 
-		var e ce.Event
-		if err = json.Unmarshal(record.Data, &e); err != nil {
-			log.Error("unmarshal event", zap.Error(err))
-			w.WriteHeader(http.StatusInternalServerError)
-			return
+		start = offset
+		if int(end-start+1) > pageSize {
+			end = start + memlog.Offset(pageSize) - 1
 		}
-
-		events = append(events, e)
 	}
 
-	b, err := json.Marshal(events)
-	if err != nil {
-		log.Error("marshal events response", zap.Error(err))
-		w.WriteHeader(http.StatusInternalServerError)
+	// pages of the same offset range contain the same records unless records
+	// have been purged since
+	etag := pageETag(earliest, start, end)
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
-	_, err = w.Write(b)
-	if err != nil {
-		log.Error("write response", zap.Error(err))
+	if err = s.writePage(rctx, &batchWriter{w: w}, start, end); err != nil {
+		// status already sent
+		if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+			log.Error("write page", zap.Error(err))
+		}
+	}
+}
+
+// writePage writes the records between start and end offset (inclusive) as
+// stored in the log. Purged records are skipped.
+func (s *server) writePage(ctx context.Context, rw recordWriter, start, end memlog.Offset) error {
+	if err := rw.begin(); err != nil {
+		return fmt.Errorf("write page header: %w", err)
+	}
+
+	for i := start; i <= end; i++ {
+		rec, err := s.log.Read(ctx, i)
+		if err != nil {
+			if errors.Is(err, memlog.ErrOutOfRange) {
+				continue
+			}
+			return fmt.Errorf("read record: %w", err)
+		}
+
+		if err = rw.write(rec.Data); err != nil {
+			return fmt.Errorf("write record: %w", err)
+		}
+	}
+
+	return rw.end()
+}
+
+// pageETag returns the weak entity tag of a page with the records between
+// start and end offset (inclusive) read when earliest was the earliest
+// retained offset
+func pageETag(earliest, start, end memlog.Offset) string {
+	return fmt.Sprintf(`W/"%d-%d-%d"`, earliest, start, end)
+}
+
+// etagMatches returns whether the If-None-Match header matches the entity tag
+// with weak comparison
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
 	}
+	return false
 }
 
 func (s *server) getEvent(ctx context.Context) httprouter.Handle {
@@ -271,32 +662,46 @@ func (s *server) getEvent(ctx context.Context) httprouter.Handle {
 		id := ps.ByName("id")
 		offset, err := strconv.Atoi(id)
 		if err != nil {
-			http.Error(w, "invalid offset", http.StatusBadRequest)
+			invalidParameter(w, "invalid offset")
 			return
 		}
 
 		rctx := r.Context()
-		rec, err := s.log.Read(rctx, memlog.Offset(offset))
+
+		// serve compressed records as stored if accepted by the client
+		encoding := s.log.ContentEncoding()
+		read := s.log.Read
+		if encoding != "" {
+			w.Header().Set("Vary", "Accept-Encoding")
+			if acceptsEncoding(r, encoding) {
+				read = s.log.ReadStored
+			} else {
+				encoding = ""
+			}
+		}
+
+		rec, err := read(rctx, memlog.Offset(offset))
 		if err != nil {
 			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
 				return
 			}
 
 			if errors.Is(err, memlog.ErrOutOfRange) || errors.Is(err, memlog.ErrFutureOffset) {
-				http.Error(w, "invalid offset: "+err.Error(), http.StatusBadRequest)
+				s.offsetProblem(rctx, w, memlog.Offset(offset), err)
 				return
 			}
 
 			logger.Get(ctx).Error("read record", zap.Error(err))
-			w.WriteHeader(http.StatusInternalServerError)
+			internalError(w)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
-		_, err = io.WriteString(w, string(rec.Data))
+		if encoding != "" {
+			w.Header().Set("Content-Encoding", encoding)
+		}
+		_, err = w.Write(rec.Data)
 		if err != nil {
 			logger.Get(ctx).Error("write event", zap.Error(err))
-			w.WriteHeader(http.StatusInternalServerError)
-			return
 		}
 	}
 }
@@ -312,18 +717,43 @@ func (s *server) getRange(ctx context.Context) httprouter.Handle {
 			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
 		lr := logRange{
 			Earliest: earliest,
 			Latest:   latest,
 		}
 
-		if err := json.NewEncoder(w).Encode(lr); err != nil {
+		b, err := json.Marshal(lr)
+		if err != nil {
 			logger.Get(ctx).Error("marshal range response", zap.Error(err))
-			w.WriteHeader(http.StatusInternalServerError)
+			internalError(w)
 			return
 		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(append(b, '\n'))
+	}
+}
+
+// parseSince returns the time specified with the since parameter and whether it
+// was set
+func parseSince(r *http.Request) (time.Time, bool, error) {
+	return parseTime(r, sinceKey)
+}
+
+// parseTime returns the RFC3339 timestamp specified with the given parameter
+// and whether it was set
+func parseTime(r *http.Request, key string) (time.Time, bool, error) {
+	val := r.FormValue(key)
+	if val == "" {
+		return time.Time{}, false, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, html.EscapeString(val))
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("invalid %s parameter: must be an RFC3339 timestamp", key)
 	}
+
+	return t, true, nil
 }
 
 func getStart(earliest, latest memlog.Offset, pageSize int) memlog.Offset {
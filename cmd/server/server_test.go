@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"io"
@@ -75,7 +76,7 @@ func Test_getRange(t *testing.T) {
 			}
 
 			srv := server{
-				log: log,
+				log: wrapLog(t, log),
 			}
 
 			rec := httptest.NewRecorder()
@@ -109,18 +110,18 @@ func Test_getEvent(t *testing.T) {
 			data:            nil,
 			eventID:         "3",
 			wantCode:        http.StatusBadRequest,
-			wantContentType: "text/plain; charset=utf-8",
-			want:            "future offset",
+			wantContentType: contentTypeProblem,
+			want:            `"code":"offset_in_future"`,
 		},
 		{
-			name:            "400 invalid offset on truncated log",
+			name:            "410 purged offset on truncated log",
 			start:           0,
 			size:            5,
 			data:            createData(20),
 			eventID:         "3",
-			wantCode:        http.StatusBadRequest,
-			wantContentType: "text/plain; charset=utf-8",
-			want:            "invalid offset",
+			wantCode:        http.StatusGone,
+			wantContentType: contentTypeProblem,
+			want:            `"code":"offset_out_of_range"`,
 		},
 		{
 			name:            "400 id is not a number",
@@ -129,8 +130,8 @@ func Test_getEvent(t *testing.T) {
 			data:            createData(10),
 			eventID:         "blabla",
 			wantCode:        http.StatusBadRequest,
-			wantContentType: "text/plain; charset=utf-8",
-			want:            "invalid offset",
+			wantContentType: contentTypeProblem,
+			want:            `"code":"invalid_parameter"`,
 		},
 		{
 			name:            "200 returns event on not truncated log",
@@ -190,7 +191,7 @@ func Test_getEvent(t *testing.T) {
 			}
 
 			srv := server{
-				log: log,
+				log: wrapLog(t, log),
 			}
 
 			rec := httptest.NewRecorder()
@@ -270,7 +271,7 @@ func Test_getEvents(t *testing.T) {
 			}
 
 			srv := server{
-				log: log,
+				log: wrapLog(t, log),
 			}
 
 			rec := httptest.NewRecorder()
@@ -290,6 +291,65 @@ func Test_getEvents(t *testing.T) {
 	}
 }
 
+func Test_readEventsETag(t *testing.T) {
+	ctx := context.Background()
+
+	ml, err := memlog.New(ctx)
+	assert.NilError(t, err)
+	for _, d := range createData(60) {
+		_, err = ml.Write(ctx, d)
+		assert.NilError(t, err)
+	}
+	srv := server{log: wrapLog(t, ml)}
+
+	get := func(t *testing.T, ifNoneMatch string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/events", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		srv.getEvents(ctx)(rec, req, nil)
+		return rec
+	}
+
+	rec := get(t, "")
+	assert.Equal(t, rec.Code, http.StatusOK)
+	assert.Equal(t, rec.Header().Get("ETag"), `W/"0-10-59"`)
+
+	// records are streamed as stored
+	var got []int
+	assert.NilError(t, json.NewDecoder(rec.Body).Decode(&got))
+	assert.Equal(t, len(got), pageSize)
+	assert.Equal(t, got[0], 10)
+	assert.Equal(t, got[pageSize-1], 59)
+
+	for _, tag := range []string{`W/"0-10-59"`, `"0-10-59"`, `W/"0-0-49", W/"0-10-59"`, "*"} {
+		rec = get(t, tag)
+		assert.Equal(t, rec.Code, http.StatusNotModified, tag)
+		assert.Equal(t, rec.Header().Get("ETag"), `W/"0-10-59"`)
+		assert.Equal(t, rec.Body.Len(), 0)
+	}
+
+	// records purged, i.e. 0-9 of 1 byte each
+	srv.log.mu.Lock()
+	srv.log.opts.retention.maxBytes = srv.log.bytes - 10
+	srv.log.enforce(ctx, time.Now())
+	srv.log.opts.retention.maxBytes = 0
+	srv.log.mu.Unlock()
+	rec = get(t, `W/"0-10-59"`)
+	assert.Equal(t, rec.Code, http.StatusOK)
+	assert.Equal(t, rec.Header().Get("ETag"), `W/"10-10-59"`)
+
+	// last page changed
+	_, err = srv.log.Write(ctx, []byte("60"))
+	assert.NilError(t, err)
+	rec = get(t, `W/"10-10-59"`)
+	assert.Equal(t, rec.Code, http.StatusOK)
+	assert.Equal(t, rec.Header().Get("ETag"), `W/"10-11-60"`)
+}
+
 func Test_streamEvents(t *testing.T) {
 	tests := []struct {
 		name            string
@@ -321,8 +381,8 @@ func Test_streamEvents(t *testing.T) {
 			watchParam:      "invalid",
 			offsetParam:     "",
 			wantCode:        400,
-			wantContentType: "text/plain; charset=utf-8",
-			wantResult:      []byte("invalid watch parameter\n"),
+			wantContentType: contentTypeProblem,
+			wantResult:      []byte(`{"title":"Bad Request","status":400,"detail":"invalid watch parameter","code":"invalid_parameter","requestId":"test-request"}` + "\n"),
 		},
 		{
 			name:            "200, write 3 records to log, no offset specified, no data returned",
@@ -347,15 +407,15 @@ func Test_streamEvents(t *testing.T) {
 			wantResult:      []byte("0\n1\n2\n"),
 		},
 		{
-			name:            "400, write 20 records to log with size 5, offset 0, out of range",
+			name:            "410, write 20 records to log with size 5, offset 0, out of range",
 			start:           0,
 			size:            5,
 			data:            createData(20),
 			watchParam:      "true",
 			offsetParam:     "0",
-			wantCode:        400,
-			wantContentType: "text/plain; charset=utf-8",
-			wantResult:      []byte("invalid offset: offset out of range\n"),
+			wantCode:        410,
+			wantContentType: contentTypeProblem,
+			wantResult:      []byte(`{"title":"Gone","status":410,"detail":"invalid offset: offset out of range","code":"offset_out_of_range","requestId":"test-request","offset":0,"range":{"earliest":10,"latest":19}}` + "\n"),
 		},
 		{
 			name:            "400, write 15 records to log with size 5, offset 10, 5 records returned",
@@ -387,7 +447,7 @@ func Test_streamEvents(t *testing.T) {
 			}
 
 			srv := server{
-				log: log,
+				log: wrapLog(t, log),
 			}
 
 			rec := httptest.NewRecorder()
@@ -404,9 +464,12 @@ func Test_streamEvents(t *testing.T) {
 				q.Add(offsetKey, tc.offsetParam)
 			}
 			req.URL.RawQuery = q.Encode()
+			req.Header.Set(requestIDHeader, "test-request")
 
 			h := srv.getEvents(ctx)
-			h(rec, req, nil)
+			withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				h(w, r, nil)
+			})).ServeHTTP(rec, req)
 
 			assert.Equal(t, rec.Result().StatusCode, tc.wantCode)
 			assert.Equal(t, rec.Result().Header.Get("content-type"), tc.wantContentType)
@@ -415,6 +478,58 @@ func Test_streamEvents(t *testing.T) {
 	}
 }
 
+func Test_streamEventsBookmarks(t *testing.T) {
+	ctx := logger.Set(context.Background(), zaptest.NewLogger(t))
+
+	interval := bookmarkInterval
+	bookmarkInterval = 20 * time.Millisecond
+	t.Cleanup(func() {
+		bookmarkInterval = interval
+	})
+
+	ml, err := memlog.New(ctx, memlog.WithStartOffset(5))
+	assert.NilError(t, err)
+	for _, d := range createData(3) {
+		_, err = ml.Write(ctx, d)
+		assert.NilError(t, err)
+	}
+	srv := server{log: wrapLog(t, ml)}
+
+	ts := httptest.NewServer(srv.routes(ctx))
+	defer ts.Close()
+
+	t.Run("invalid bookmarks parameter", func(t *testing.T) {
+		res, err := http.Get(ts.URL + "/api/v1/events?watch=true&bookmarks=yes")
+		assert.NilError(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, res.StatusCode, http.StatusBadRequest)
+	})
+
+	t.Run("sends bookmarks on idle stream", func(t *testing.T) {
+		rctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(rctx, http.MethodGet, ts.URL+"/api/v1/events?watch=true&bookmarks=true&offset=7", nil)
+		assert.NilError(t, err)
+		res, err := http.DefaultClient.Do(req)
+		assert.NilError(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, res.StatusCode, http.StatusOK)
+
+		lines := bufio.NewScanner(res.Body)
+		assert.Assert(t, lines.Scan())
+		assert.Equal(t, lines.Text(), "2")
+
+		assert.Assert(t, lines.Scan())
+		assert.Equal(t, lines.Text(), `{"bookmark":{"earliest":5,"latest":7}}`)
+
+		_, err = srv.log.Write(ctx, []byte("3"))
+		assert.NilError(t, err)
+		assert.Assert(t, lines.Scan())
+		assert.Equal(t, lines.Text(), "3")
+	})
+}
+
 func Test_getStart(t *testing.T) {
 	type args struct {
 		earliest memlog.Offset
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/embano1/memlog"
+	"github.com/embano1/vsphere/logger"
+	"github.com/julienschmidt/httprouter"
+	"go.uber.org/zap"
+)
+
+const (
+	timeKey           = "time"
+	sinceKey          = "since"
+	timeIndexInterval = 100 // index every n-th record
+)
+
+// errNoRecordAfter is returned when no record at or after the requested time
+// exists
+var errNoRecordAfter = errors.New("no record at or after time")
+
+type timeEntry struct {
+	offset memlog.Offset
+	time   time.Time
+}
+
+// timeIndex is a sparse index mapping cloudevent times to log offsets. Every
+// n-th record is indexed. Lookups return the indexed offset to start scanning
+// the log from. Event times are expected to increase with the offset.
+//
+// Safe for concurrent use.
+type timeIndex struct {
+	interval int
+
+	mu      sync.RWMutex
+	entries []timeEntry // ordered by offset
+	last    memlog.Offset
+}
+
+func newTimeIndex(interval int) *timeIndex {
+	return &timeIndex{
+		interval: interval,
+		last:     -1,
+	}
+}
+
+func (ti *timeIndex) index(offset memlog.Offset, e *ce.Event) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+
+	// always index the first record, then every n-th record
+	if len(ti.entries) == 0 || int(offset-ti.last) >= ti.interval {
+		ti.entries = append(ti.entries, timeEntry{offset: offset, time: e.Time()})
+		ti.last = offset
+	}
+}
+
+func (ti *timeIndex) prune(earliest memlog.Offset) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+
+	// keep the last entry before earliest as it covers the beginning of the log
+	i := sort.Search(len(ti.entries), func(i int) bool {
+		return ti.entries[i].offset > earliest
+	})
+	if i > 1 {
+		ti.entries = append(ti.entries[:0], ti.entries[i-1:]...)
+	}
+}
+
+// seek returns the offset of the last indexed record before t, or -1 if there
+// is no such record
+func (ti *timeIndex) seek(t time.Time) memlog.Offset {
+	ti.mu.RLock()
+	defer ti.mu.RUnlock()
+
+	i := sort.Search(len(ti.entries), func(i int) bool {
+		return !ti.entries[i].time.Before(t)
+	})
+	if i == 0 {
+		return -1
+	}
+
+	return ti.entries[i-1].offset
+}
+
+// offsetAt returns the first offset with a cloudevent time at or after t. If
+// all records are older than t, errNoRecordAfter is returned.
+func (s *server) offsetAt(ctx context.Context, t time.Time) (memlog.Offset, error) {
+	earliest, latest := s.log.Range(ctx)
+	if latest == -1 {
+		return -1, errNoRecordAfter
+	}
+
+	start := earliest
+	if s.times != nil {
+		if offset := s.times.seek(t); offset > start {
+			start = offset
+		}
+	}
+
+	batch := make([]memlog.Record, exportBatchSize)
+	for offset := start; offset <= latest; {
+		count, err := s.log.ReadBatch(ctx, offset, batch)
+		if err != nil && !errors.Is(err, memlog.ErrFutureOffset) {
+			// purged while scanning, start over with new earliest
+			if errors.Is(err, memlog.ErrOutOfRange) {
+				offset, _ = s.log.Range(ctx)
+				continue
+			}
+			return -1, err
+		}
+
+		for _, rec := range batch[:count] {
+			rt, err := recordTime(rec.Data)
+			if err != nil {
+				return -1, fmt.Errorf("read cloudevent time at offset %d: %w", rec.Metadata.Offset, err)
+			}
+
+			if !rt.Before(t) {
+				return rec.Metadata.Offset, nil
+			}
+		}
+
+		if count == 0 {
+			break
+		}
+		offset += memlog.Offset(count)
+	}
+
+	return -1, errNoRecordAfter
+}
+
+type offsetResponse struct {
+	Offset memlog.Offset `json:"offset"`
+	Time   time.Time     `json:"time"`
+}
+
+// getOffset returns the first offset at or after the requested time
+func (s *server) getOffset(ctx context.Context) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		log := logger.Get(ctx)
+
+		t, ok, err := parseTime(r, timeKey)
+		if err != nil {
+			invalidParameter(w, err.Error())
+			return
+		}
+		if !ok {
+			invalidParameter(w, "missing time parameter")
+			return
+		}
+
+		rctx := r.Context()
+		offset, err := s.offsetAt(rctx, t)
+		if err != nil {
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				return
+			}
+
+			if errors.Is(err, errNoRecordAfter) {
+				notFound(w, err.Error())
+				return
+			}
+
+			log.Error("seek offset", zap.Error(err))
+			internalError(w)
+			return
+		}
+
+		rec, err := s.log.Read(rctx, offset)
+		if err != nil {
+			if errors.Is(err, memlog.ErrOutOfRange) {
+				s.offsetProblem(rctx, w, offset, err)
+				return
+			}
+
+			log.Error("read record", zap.Error(err))
+			internalError(w)
+			return
+		}
+
+		rt, err := recordTime(rec.Data)
+		if err != nil {
+			log.Error("read cloudevent time", zap.Error(err))
+			internalError(w)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(w).Encode(offsetResponse{Offset: offset, Time: rt}); err != nil {
+			log.Error("marshal offset response", zap.Error(err))
+		}
+	}
+}
+
+// recordTime returns the cloudevent time of the record data
+func recordTime(data []byte) (time.Time, error) {
+	var e struct {
+		Time time.Time `json:"time"`
+	}
+	if err := json.Unmarshal(data, &e); err != nil {
+		return time.Time{}, err
+	}
+
+	return e.Time, nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/embano1/memlog"
+	"github.com/embano1/vsphere/logger"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/v3/assert"
+)
+
+var indexBegin = time.Date(2022, 1, 14, 14, 0, 0, 0, time.UTC)
+
+func Test_timeIndex(t *testing.T) {
+	ti := newTimeIndex(10)
+
+	for i := 0; i < 35; i++ {
+		e := ce.NewEvent()
+		e.SetTime(indexBegin.Add(time.Duration(i) * time.Minute))
+		ti.index(memlog.Offset(100+i), &e)
+	}
+
+	assert.Equal(t, len(ti.entries), 4) // 100, 110, 120, 130
+
+	tests := []struct {
+		name string
+		time time.Time
+		want memlog.Offset
+	}{
+		{name: "before first record", time: indexBegin.Add(-time.Hour), want: -1},
+		{name: "equals first record", time: indexBegin, want: -1},
+		{name: "within first interval", time: indexBegin.Add(5 * time.Minute), want: 100},
+		{name: "equals indexed record", time: indexBegin.Add(20 * time.Minute), want: 110},
+		{name: "after last record", time: indexBegin.Add(time.Hour), want: 130},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, ti.seek(tc.time), tc.want)
+		})
+	}
+
+	t.Run("prune keeps entry covering earliest", func(t *testing.T) {
+		ti.prune(115)
+		assert.Equal(t, len(ti.entries), 3)
+		assert.Equal(t, ti.entries[0].offset, memlog.Offset(110))
+
+		ti.prune(130)
+		assert.Equal(t, len(ti.entries), 1)
+		assert.Equal(t, ti.entries[0].offset, memlog.Offset(130))
+	})
+}
+
+func Test_getOffset(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		events   int
+		time     string
+		wantCode int
+		want     string
+	}{
+		{
+			name:     "400 missing time",
+			size:     100,
+			events:   10,
+			time:     "",
+			wantCode: http.StatusBadRequest,
+			want:     `{"title":"Bad Request","status":400,"detail":"missing time parameter","code":"invalid_parameter","requestId":"test-request"}`,
+		},
+		{
+			name:     "400 invalid time",
+			size:     100,
+			events:   10,
+			time:     "14:02",
+			wantCode: http.StatusBadRequest,
+			want:     `{"title":"Bad Request","status":400,"detail":"invalid time parameter: must be an RFC3339 timestamp","code":"invalid_parameter","requestId":"test-request"}`,
+		},
+		{
+			name:     "404 on empty log",
+			size:     100,
+			events:   0,
+			time:     indexBegin.Format(time.RFC3339),
+			wantCode: http.StatusNotFound,
+			want:     `{"title":"Not Found","status":404,"detail":"no record at or after time","code":"not_found","requestId":"test-request"}`,
+		},
+		{
+			name:     "404 after latest record",
+			size:     100,
+			events:   10,
+			time:     indexBegin.Add(time.Hour).Format(time.RFC3339),
+			wantCode: http.StatusNotFound,
+			want:     `{"title":"Not Found","status":404,"detail":"no record at or after time","code":"not_found","requestId":"test-request"}`,
+		},
+		{
+			name:     "200 returns earliest before first record",
+			size:     100,
+			events:   10,
+			time:     indexBegin.Add(-time.Hour).Format(time.RFC3339),
+			wantCode: http.StatusOK,
+			want:     `{"offset":0,"time":"2022-01-14T14:00:00Z"}`,
+		},
+		{
+			name:     "200 returns exact match",
+			size:     500,
+			events:   250,
+			time:     indexBegin.Add(142 * time.Minute).Format(time.RFC3339),
+			wantCode: http.StatusOK,
+			want:     `{"offset":142,"time":"2022-01-14T16:22:00Z"}`,
+		},
+		{
+			name:     "200 returns next record between records",
+			size:     500,
+			events:   250,
+			time:     indexBegin.Add(142*time.Minute + time.Second).Format(time.RFC3339),
+			wantCode: http.StatusOK,
+			want:     `{"offset":143,"time":"2022-01-14T16:23:00Z"}`,
+		},
+		{
+			name:     "200 returns earliest on truncated log",
+			size:     10,
+			events:   50,
+			time:     indexBegin.Format(time.RFC3339),
+			wantCode: http.StatusOK,
+			want:     `{"offset":30,"time":"2022-01-14T14:30:00Z"}`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := logger.Set(context.Background(), zaptest.NewLogger(t))
+			srv := newTimedServer(t, ctx, tc.size, tc.events)
+
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/offsets", nil)
+			q := req.URL.Query()
+			if tc.time != "" {
+				q.Add(timeKey, tc.time)
+			}
+			req.URL.RawQuery = q.Encode()
+			req.Header.Set(requestIDHeader, "test-request")
+
+			h := srv.getOffset(ctx)
+			withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				h(w, r, nil)
+			})).ServeHTTP(rec, req)
+
+			assert.Equal(t, rec.Result().StatusCode, tc.wantCode)
+			assert.Equal(t, strings.TrimRight(rec.Body.String(), "\n"), tc.want)
+		})
+	}
+}
+
+func Test_getEventsSince(t *testing.T) {
+	tests := []struct {
+		name     string
+		watch    bool
+		params   map[string]string
+		wantCode int
+		wantIDs  []string
+	}{
+		{
+			name:     "200 returns page starting at since",
+			params:   map[string]string{sinceKey: indexBegin.Add(10 * time.Minute).Format(time.RFC3339)},
+			wantCode: http.StatusOK,
+			wantIDs:  idRange(10, 59),
+		},
+		{
+			name:     "200 returns last partial page",
+			params:   map[string]string{sinceKey: indexBegin.Add(97 * time.Minute).Format(time.RFC3339)},
+			wantCode: http.StatusOK,
+			wantIDs:  idRange(97, 99),
+		},
+		{
+			name:     "204 since after latest",
+			params:   map[string]string{sinceKey: indexBegin.Add(time.Hour * 2).Format(time.RFC3339)},
+			wantCode: http.StatusNoContent,
+		},
+		{
+			name:     "400 invalid since",
+			params:   map[string]string{sinceKey: "yesterday"},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "200 watch starting at since",
+			watch:    true,
+			params:   map[string]string{sinceKey: indexBegin.Add(95 * time.Minute).Format(time.RFC3339)},
+			wantCode: http.StatusOK,
+			wantIDs:  idRange(95, 99),
+		},
+		{
+			name:     "400 watch with offset and since",
+			watch:    true,
+			params:   map[string]string{sinceKey: indexBegin.Format(time.RFC3339), offsetKey: "3"},
+			wantCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := logger.Set(context.Background(), zaptest.NewLogger(t))
+			srv := newTimedServer(t, ctx, 100, 100)
+
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/events", nil)
+
+			rctx, cancel := context.WithTimeout(ctx, time.Millisecond*100)
+			defer cancel()
+			req = req.WithContext(rctx)
+
+			q := req.URL.Query()
+			if tc.watch {
+				q.Add(watchKey, "true")
+			}
+			for k, v := range tc.params {
+				q.Add(k, v)
+			}
+			req.URL.RawQuery = q.Encode()
+
+			h := srv.getEvents(ctx)
+			h(rec, req, nil)
+
+			assert.Equal(t, rec.Result().StatusCode, tc.wantCode)
+			if tc.wantCode != http.StatusOK {
+				return
+			}
+
+			var got []string
+			dec := json.NewDecoder(rec.Body)
+			if tc.watch {
+				for dec.More() {
+					var e ce.Event
+					assert.NilError(t, dec.Decode(&e))
+					got = append(got, e.ID())
+				}
+			} else {
+				var events []ce.Event
+				assert.NilError(t, dec.Decode(&events))
+				for _, e := range events {
+					got = append(got, e.ID())
+				}
+			}
+			assert.DeepEqual(t, got, tc.wantIDs)
+		})
+	}
+}
+
+// newTimedServer returns a server with a log of the given segment size and
+// events one minute apart starting at indexBegin
+func newTimedServer(t *testing.T, ctx context.Context, size, events int) *server {
+	t.Helper()
+
+	srv := server{times: newTimeIndex(10)}
+	srv.indexers = []indexer{srv.times}
+	assert.NilError(t, srv.initializeLog(ctx, 0, size, 1024))
+
+	for i := 0; i < events; i++ {
+		e := ce.NewEvent()
+		e.SetID(strconv.Itoa(i))
+		e.SetType("test.event.v0")
+		e.SetTime(indexBegin.Add(time.Duration(i) * time.Minute))
+		e.SetSource("/test/source")
+
+		b, err := json.Marshal(e)
+		assert.NilError(t, err)
+
+		written, err := srv.appendRecord(ctx, memlog.Offset(i), &e, b)
+		assert.NilError(t, err)
+		assert.Assert(t, written)
+	}
+
+	return &srv
+}
+
+// idRange returns the string IDs from start to end (inclusive)
+func idRange(start, end int) []string {
+	var ids []string
+	for i := start; i <= end; i++ {
+		ids = append(ids, strconv.Itoa(i))
+	}
+	return ids
+}
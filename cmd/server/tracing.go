@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/extensions"
+	"github.com/embano1/memlog"
+	"github.com/julienschmidt/httprouter"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.39.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const (
+	tracerName  = "github.com/embano1/vsphere-event-streaming"
+	serviceName = "vsphere-event-streaming"
+
+	tracingExporterNone   = "none"
+	tracingExporterStdout = "stdout"
+	tracingExporterOTLP   = "otlp"
+)
+
+// traceContext propagates W3C trace context in HTTP headers and the
+// distributed tracing extension of cloudevents
+var traceContext = propagation.TraceContext{}
+
+// tracingEnabled is set when a tracer provider is configured to not read the
+// trace context of records otherwise
+var tracingEnabled atomic.Bool
+
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// newTracerProvider returns the tracer provider with the configured exporter or
+// nil if tracing is disabled. The stdout exporter writes to w. The otlp
+// exporter also reads the standard OTEL_EXPORTER_OTLP_* environment variables.
+func newTracerProvider(ctx context.Context, cfg tracingConfig, w io.Writer) (*sdktrace.TracerProvider, error) {
+	var (
+		exp sdktrace.SpanExporter
+		err error
+	)
+	switch cfg.Exporter {
+	case tracingExporterNone:
+		return nil, nil
+	case tracingExporterStdout:
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(w))
+	case tracingExporterOTLP:
+		var opts []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+		}
+		exp, err = otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unsupported tracing exporter %q", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create %s trace exporter: %w", cfg.Exporter, err)
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(serviceName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("create trace resource: %w", err)
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	), nil
+}
+
+// setTracerProvider sets the global tracer provider used by all spans
+func setTracerProvider(tp trace.TracerProvider) {
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(traceContext)
+	tracingEnabled.Store(true)
+}
+
+// injectTraceContext adds the trace context of the span in ctx to the
+// cloudevent with the distributed tracing extension
+func injectTraceContext(ctx context.Context, e *ce.Event) {
+	carrier := propagation.MapCarrier{}
+	traceContext.Inject(ctx, carrier)
+
+	ext := extensions.DistributedTracingExtension{
+		TraceParent: carrier.Get(extensions.TraceParentExtension),
+		TraceState:  carrier.Get(extensions.TraceStateExtension),
+	}
+	ext.AddTracingAttributes(e)
+}
+
+// startDelivery starts a span for delivering the record as child of the trace
+// of its ingestion, if recorded with the distributed tracing extension, and
+// linked to the span in ctx, e.g. of the watch request
+func startDelivery(ctx context.Context, name string, rec memlog.Record, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if !tracingEnabled.Load() {
+		return ctx, noop.Span{}
+	}
+
+	var e struct {
+		Type string `json:"type"`
+		extensions.DistributedTracingExtension
+	}
+	_ = json.Unmarshal(rec.Data, &e)
+
+	attrs = append(attrs,
+		semconv.CloudEventsEventID(strconv.Itoa(int(rec.Metadata.Offset))),
+		semconv.CloudEventsEventType(e.Type),
+	)
+	opts := []trace.SpanStartOption{trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(attrs...)}
+
+	parent := ctx
+	if e.TraceParent != "" {
+		carrier := propagation.MapCarrier{
+			extensions.TraceParentExtension: e.TraceParent,
+			extensions.TraceStateExtension:  e.TraceState,
+		}
+		if sc := trace.SpanContextFromContext(traceContext.Extract(context.Background(), carrier)); sc.IsValid() {
+			parent = trace.ContextWithRemoteSpanContext(ctx, sc)
+			if link := trace.SpanContextFromContext(ctx); link.IsValid() {
+				opts = append(opts, trace.WithLinks(trace.Link{SpanContext: link}))
+			}
+		}
+	}
+
+	return tracer().Start(parent, name, opts...)
+}
+
+// endSpan records the error, if any, and ends the span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traced starts a server span for each request of the route continuing the W3C
+// trace context of the request
+func traced(method, route string, h httprouter.Handle) httprouter.Handle {
+	name := method + " " + route
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		ctx := traceContext.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer().Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(r.URL.Path),
+				attribute.String("http.request.id", w.Header().Get(requestIDHeader)),
+			),
+		)
+		defer span.End()
+
+		sw := statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h(&sw, r.WithContext(ctx), ps)
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(sw.status))
+		if sw.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(sw.status))
+		}
+	}
+}
+
+// statusWriter records the response status code
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (s *statusWriter) WriteHeader(code int) {
+	if !s.wroteHeader {
+		s.status = code
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusWriter) Write(b []byte) (int, error) {
+	s.wroteHeader = true
+	return s.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher for streaming responses
+func (s *statusWriter) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/extensions"
+	"github.com/embano1/memlog"
+	"github.com/embano1/vsphere/logger"
+	"github.com/vmware/govmomi/vim25/types"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"go.uber.org/zap/zaptest"
+	"gotest.tools/v3/assert"
+)
+
+const (
+	testTraceID    = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testSpanID     = "00f067aa0ba902b7"
+	testRecordSpan = "b7ad6b7169203331"
+)
+
+// recordSpans sets a tracer provider recording all spans for the duration of
+// the test
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	setTracerProvider(tp)
+	t.Cleanup(func() {
+		tracingEnabled.Store(false)
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		assert.NilError(t, tp.Shutdown(context.Background()))
+	})
+	return sr
+}
+
+// endedSpan returns the ended span with the given name
+func endedSpan(t *testing.T, sr *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	t.Helper()
+
+	for _, s := range sr.Ended() {
+		if s.Name() == name {
+			return s
+		}
+	}
+	t.Fatalf("span %q not found", name)
+	return nil
+}
+
+func spanAttributes(s sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range s.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func Test_newTracerProvider(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("disabled", func(t *testing.T) {
+		tp, err := newTracerProvider(ctx, tracingConfig{Exporter: tracingExporterNone}, nil)
+		assert.NilError(t, err)
+		assert.Assert(t, tp == nil)
+	})
+
+	t.Run("stdout exporter", func(t *testing.T) {
+		var buf bytes.Buffer
+		tp, err := newTracerProvider(ctx, tracingConfig{Exporter: tracingExporterStdout, SampleRatio: 1}, &buf)
+		assert.NilError(t, err)
+
+		_, span := tp.Tracer(tracerName).Start(ctx, "test.span")
+		span.End()
+		assert.NilError(t, tp.Shutdown(ctx))
+
+		got := buf.String()
+		assert.Assert(t, strings.Contains(got, `"Name":"test.span"`), got)
+		assert.Assert(t, strings.Contains(got, serviceName), got)
+	})
+
+	t.Run("otlp exporter", func(t *testing.T) {
+		tp, err := newTracerProvider(ctx, tracingConfig{Exporter: tracingExporterOTLP, Endpoint: "http://127.0.0.1:4318", SampleRatio: 1}, nil)
+		assert.NilError(t, err)
+		assert.Assert(t, tp != nil)
+
+		shutdownCtx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		assert.NilError(t, tp.Shutdown(shutdownCtx))
+	})
+
+	t.Run("unsupported exporter", func(t *testing.T) {
+		_, err := newTracerProvider(ctx, tracingConfig{Exporter: "jaeger"}, nil)
+		assert.ErrorContains(t, err, `unsupported tracing exporter "jaeger"`)
+	})
+}
+
+func Test_traced(t *testing.T) {
+	ctx := logger.Set(context.Background(), zaptest.NewLogger(t))
+	sr := recordSpans(t)
+
+	ml, err := memlog.New(ctx)
+	assert.NilError(t, err)
+	for _, d := range createData(3) {
+		_, err = ml.Write(ctx, d)
+		assert.NilError(t, err)
+	}
+	srv := server{log: wrapLog(t, ml)}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/events/1", nil)
+	req.Header.Set("traceparent", "00-"+testTraceID+"-"+testSpanID+"-01")
+	req.Header.Set(requestIDHeader, "test-request")
+	srv.routes(ctx).ServeHTTP(rec, req)
+	assert.Equal(t, rec.Code, http.StatusOK)
+
+	span := endedSpan(t, sr, "GET /api/v1/events/:id")
+	assert.Equal(t, span.SpanKind(), trace.SpanKindServer)
+	assert.Equal(t, span.SpanContext().TraceID().String(), testTraceID)
+	assert.Equal(t, span.Parent().SpanID().String(), testSpanID)
+	assert.Assert(t, span.Parent().IsRemote())
+
+	attrs := spanAttributes(span)
+	assert.Equal(t, attrs["http.request.method"].AsString(), http.MethodGet)
+	assert.Equal(t, attrs["http.route"].AsString(), "/api/v1/events/:id")
+	assert.Equal(t, attrs["url.path"].AsString(), "/api/v1/events/1")
+	assert.Equal(t, attrs["http.request.id"].AsString(), "test-request")
+	assert.Equal(t, attrs["http.response.status_code"].AsInt64(), int64(http.StatusOK))
+}
+
+func Test_ingest(t *testing.T) {
+	ctx := logger.Set(context.Background(), zaptest.NewLogger(t))
+	sr := recordSpans(t)
+
+	ml, err := memlog.New(ctx, memlog.WithStartOffset(10))
+	assert.NilError(t, err)
+	srv := server{log: wrapLog(t, ml), start: 10}
+
+	e := &types.VmPoweredOnEvent{VmEvent: types.VmEvent{Event: types.Event{Key: 10, CreatedTime: time.Now().UTC()}}}
+	assert.NilError(t, ingest(ctx, &srv, "https://vcenter.local/sdk", e, map[string]string{"vcenter": "vc01"}))
+
+	span := endedSpan(t, sr, "event.ingest")
+	attrs := spanAttributes(span)
+	assert.Equal(t, attrs["cloudevents.event_id"].AsString(), "10")
+	assert.Equal(t, attrs["cloudevents.event_type"].AsString(), "com.vmware.vsphere.VmPoweredOnEvent.v0")
+
+	rec, err := srv.log.Read(ctx, 10)
+	assert.NilError(t, err)
+
+	var got ce.Event
+	assert.NilError(t, json.Unmarshal(rec.Data, &got))
+	ext, ok := extensions.GetDistributedTracingExtension(got)
+	assert.Assert(t, ok)
+	assert.Equal(t, ext.TraceParent, "00-"+span.SpanContext().TraceID().String()+"-"+span.SpanContext().SpanID().String()+"-01")
+	assert.DeepEqual(t, got.Extensions()["vcenter"], "vc01")
+
+	t.Run("duplicate event", func(t *testing.T) {
+		sr.Reset()
+		assert.NilError(t, ingest(ctx, &srv, "https://vcenter.local/sdk", e, nil))
+		assert.Equal(t, spanAttributes(endedSpan(t, sr, "event.ingest"))["event.duplicate"].AsBool(), true)
+	})
+}
+
+// tracedRecord returns a cloudevent with the test trace context
+func tracedRecord(t *testing.T) []byte {
+	t.Helper()
+
+	e := ce.NewEvent()
+	e.SetID("0")
+	e.SetType("com.vmware.vsphere.VmPoweredOnEvent.v0")
+	e.SetSource("/test/source")
+	e.SetTime(time.Now().UTC())
+	extensions.DistributedTracingExtension{TraceParent: "00-" + testTraceID + "-" + testRecordSpan + "-01"}.AddTracingAttributes(&e)
+
+	b, err := json.Marshal(e)
+	assert.NilError(t, err)
+	return b
+}
+
+func Test_startDelivery(t *testing.T) {
+	ctx := logger.Set(context.Background(), zaptest.NewLogger(t))
+
+	t.Run("watch continues the trace of the record", func(t *testing.T) {
+		sr := recordSpans(t)
+
+		ml, err := memlog.New(ctx)
+		assert.NilError(t, err)
+		_, err = ml.Write(ctx, tracedRecord(t))
+		assert.NilError(t, err)
+		srv := server{log: wrapLog(t, ml)}
+
+		rctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/events?watch=true&offset=0", nil).WithContext(rctx)
+		srv.routes(ctx).ServeHTTP(rec, req)
+		assert.Equal(t, rec.Code, http.StatusOK)
+
+		request := endedSpan(t, sr, "GET /api/v1/events")
+		span := endedSpan(t, sr, "event.deliver")
+		assert.Equal(t, span.SpanKind(), trace.SpanKindProducer)
+		assert.Equal(t, span.SpanContext().TraceID().String(), testTraceID)
+		assert.Equal(t, span.Parent().SpanID().String(), testRecordSpan)
+		assert.Equal(t, len(span.Links()), 1)
+		assert.Equal(t, span.Links()[0].SpanContext.SpanID(), request.SpanContext().SpanID())
+		assert.Equal(t, spanAttributes(span)["cloudevents.event_id"].AsString(), "0")
+	})
+
+	t.Run("record without trace context", func(t *testing.T) {
+		sr := recordSpans(t)
+
+		parent, request := otel.Tracer(tracerName).Start(ctx, "request")
+		_, span := startDelivery(parent, "event.deliver", memlog.Record{Data: []byte(`{"type":"test"}`)})
+		span.End()
+		request.End()
+
+		got := endedSpan(t, sr, "event.deliver")
+		assert.Equal(t, got.Parent().SpanID(), request.SpanContext().SpanID())
+		assert.Equal(t, len(got.Links()), 0)
+	})
+
+	t.Run("nats message carries the trace context", func(t *testing.T) {
+		sr := recordSpans(t)
+		url := runNATSServer(t)
+
+		sink, err := newNATSSink(ctx, natsConfig{URL: url, Stream: "TEST", SubjectPrefix: "vsphere.events"})
+		assert.NilError(t, err)
+		defer sink.close()
+
+		assert.NilError(t, sink.publish(ctx, memlog.Record{Metadata: memlog.Header{Offset: 10}, Data: tracedRecord(t)}))
+
+		span := endedSpan(t, sr, "event.publish")
+		assert.Equal(t, span.Parent().SpanID().String(), testRecordSpan)
+		assert.Equal(t, spanAttributes(span)["messaging.destination.name"].AsString(), "vsphere.events.VmPoweredOnEvent")
+
+		msg, err := sink.stream.GetMsg(ctx, 1)
+		assert.NilError(t, err)
+		assert.Equal(t, msg.Header.Get("Traceparent"), "00-"+testTraceID+"-"+span.SpanContext().SpanID().String()+"-01")
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		_, span := startDelivery(ctx, "event.deliver", memlog.Record{Data: tracedRecord(t)})
+		assert.Assert(t, !span.SpanContext().IsValid())
+	})
+}
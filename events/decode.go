@@ -0,0 +1,106 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+var (
+	null        = []byte("null")
+	unmarshaler = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+)
+
+// decode unmarshals the JSON data into v like json.Unmarshal but skips fields
+// of non-empty interface types which json.Unmarshal can not decode
+func decode(data []byte, v reflect.Value) error {
+	if bytes.Equal(bytes.TrimSpace(data), null) {
+		return nil
+	}
+
+	if reflect.PointerTo(v.Type()).Implements(unmarshaler) {
+		return json.Unmarshal(data, v.Addr().Interface())
+	}
+
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.NumMethod() > 0 {
+			return nil
+		}
+	case reflect.Pointer:
+		elem := reflect.New(v.Type().Elem())
+		if err := decode(data, elem.Elem()); err != nil {
+			return err
+		}
+		v.Set(elem)
+		return nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			break // base64
+		}
+		var items []json.RawMessage
+		if err := json.Unmarshal(data, &items); err != nil {
+			return err
+		}
+		s := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := decode(item, s.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+		return nil
+	case reflect.Struct:
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return err
+		}
+		return decodeFields(fields, v)
+	}
+
+	return json.Unmarshal(data, v.Addr().Interface())
+}
+
+// decodeFields decodes the JSON object fields into the struct v including
+// its embedded structs
+func decodeFields(fields map[string]json.RawMessage, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			if err := decodeFields(fields, v.Field(i)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		name, ok := fieldName(f)
+		if !ok {
+			continue
+		}
+		if data, ok := fields[name]; ok {
+			if err := decode(data, v.Field(i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fieldName returns the JSON object key of a struct field and false if the
+// field is omitted
+func fieldName(f reflect.StructField) (string, bool) {
+	tag := f.Tag.Get("json")
+	if tag == "-" {
+		return "", false
+	}
+	if name, _, _ := strings.Cut(tag, ","); name != "" {
+		return name, true
+	}
+	return f.Name, true
+}
@@ -0,0 +1,156 @@
+// Package events maps the CloudEvent types emitted by the vSphere Event
+// Streaming server to the govmomi vSphere event types and decodes the event
+// data into the concrete Go type, e.g. *types.VmPoweredOnEvent.
+package events
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const (
+	typePrefix = "com.vmware.vsphere."
+	typeSuffix = ".v0"
+)
+
+// ClassExtension is the CloudEvent extension containing the vSphere event class
+const ClassExtension = "eventclass"
+
+// vSphere event classes
+const (
+	// ClassEvent is a vSphere event with its own type, e.g. VmPoweredOnEvent
+	ClassEvent = "event"
+	// ClassEventEx is a types.EventEx identified by its EventTypeId
+	ClassEventEx = "eventex"
+	// ClassExtendedEvent is a types.ExtendedEvent identified by its EventTypeId
+	ClassExtendedEvent = "extendedevent"
+	// ClassTask is a types.TaskInfo state change, e.g. task.success
+	ClassTask = "task"
+	// ClassAlarm is a types.AlarmState change, e.g. alarm.triggered
+	ClassAlarm = "alarm"
+)
+
+// ErrUnknownType is returned when a CloudEvent type does not map to a vSphere
+// event type
+var ErrUnknownType = errors.New("unknown event type")
+
+var baseEvent = reflect.TypeOf((*types.BaseEvent)(nil)).Elem()
+
+// Type returns the CloudEvent type for a vSphere event name, e.g.
+// com.vmware.vsphere.VmPoweredOnEvent.v0 for VmPoweredOnEvent
+func Type(name string) string {
+	return typePrefix + name + typeSuffix
+}
+
+// Name returns the vSphere event name of a CloudEvent type, e.g.
+// VmPoweredOnEvent for com.vmware.vsphere.VmPoweredOnEvent.v0. For the eventex
+// and extendedevent classes the name is the EventTypeId.
+func Name(ceType string) (string, error) {
+	if !strings.HasPrefix(ceType, typePrefix) || !strings.HasSuffix(ceType, typeSuffix) ||
+		len(ceType) <= len(typePrefix)+len(typeSuffix) {
+		return "", fmt.Errorf("%w: %q", ErrUnknownType, ceType)
+	}
+	return ceType[len(typePrefix) : len(ceType)-len(typeSuffix)], nil
+}
+
+// TypeOf returns the govmomi struct type of the event data for a CloudEvent
+// type and event class. If class is empty the type must be a vSphere event of
+// the event class. Tasks and alarms are not vSphere events, see DecodeTask and
+// DecodeAlarm.
+func TypeOf(ceType, class string) (reflect.Type, error) {
+	name, err := Name(ceType)
+	if err != nil {
+		return nil, err
+	}
+
+	switch class {
+	case ClassEventEx:
+		return reflect.TypeOf(types.EventEx{}), nil
+	case ClassExtendedEvent:
+		return reflect.TypeOf(types.ExtendedEvent{}), nil
+	case ClassTask:
+		return reflect.TypeOf(types.TaskInfo{}), nil
+	case ClassAlarm:
+		return reflect.TypeOf(types.AlarmState{}), nil
+	case "", ClassEvent:
+		t, ok := types.TypeFunc()(name)
+		if !ok || t.Kind() != reflect.Struct || !reflect.PointerTo(t).Implements(baseEvent) {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownType, ceType)
+		}
+		return t, nil
+	default:
+		return nil, fmt.Errorf("unknown event class %q", class)
+	}
+}
+
+// Decode returns the vSphere event in the data of the CloudEvent as its
+// concrete govmomi type, e.g. *types.VmPoweredOnEvent. The event class is read
+// from the eventclass extension.
+//
+// Fields of govmomi interface types, e.g. the fault of a
+// types.LocalizedMethodFault, are left nil because the JSON encoding does not
+// retain their concrete type.
+func Decode(e ce.Event) (types.BaseEvent, error) {
+	t, err := TypeOf(e.Type(), eventClass(e))
+	if err != nil {
+		return nil, err
+	}
+
+	v := reflect.New(t)
+	if err = decode(e.Data(), v.Elem()); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", t.Name(), err)
+	}
+	be, ok := v.Interface().(types.BaseEvent)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q is not a vSphere event", ErrUnknownType, e.Type())
+	}
+	return be, nil
+}
+
+// DecodeTask returns the task info in the data of a CloudEvent of the task
+// class
+func DecodeTask(e ce.Event) (*types.TaskInfo, error) {
+	var info types.TaskInfo
+	if err := decodeClass(e, ClassTask, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// DecodeAlarm returns the alarm state in the data of a CloudEvent of the alarm
+// class
+func DecodeAlarm(e ce.Event) (*types.AlarmState, error) {
+	var state types.AlarmState
+	if err := decodeClass(e, ClassAlarm, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func eventClass(e ce.Event) string {
+	if v, ok := e.Extensions()[ClassExtension]; ok {
+		return fmt.Sprint(v)
+	}
+	return ""
+}
+
+// decodeClass decodes the data of a CloudEvent of the class into v
+func decodeClass(e ce.Event, class string, v interface{}) error {
+	if c := eventClass(e); c != class {
+		return fmt.Errorf("%w: %q is of class %q", ErrUnknownType, e.Type(), c)
+	}
+	if _, err := Name(e.Type()); err != nil {
+		return err
+	}
+
+	rv := reflect.ValueOf(v).Elem()
+	if err := decode(e.Data(), rv); err != nil {
+		return fmt.Errorf("decode %s: %w", rv.Type().Name(), err)
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package events
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/embano1/vsphere/event"
+	"github.com/vmware/govmomi/vim25/types"
+	"gotest.tools/v3/assert"
+)
+
+func TestName(t *testing.T) {
+	tests := []struct {
+		ceType  string
+		want    string
+		wantErr bool
+	}{
+		{ceType: "com.vmware.vsphere.VmPoweredOnEvent.v0", want: "VmPoweredOnEvent"},
+		{ceType: "com.vmware.vsphere.com.vmware.applmgmt.backup.job.failed.event.v0", want: "com.vmware.applmgmt.backup.job.failed.event"},
+		{ceType: "VmPoweredOnEvent", wantErr: true},
+		{ceType: "com.vmware.vsphere..v0", wantErr: true},
+		{ceType: "com.vmware.vsphere.VmPoweredOnEvent.v1", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.ceType, func(t *testing.T) {
+			got, err := Name(tc.ceType)
+			if tc.wantErr {
+				assert.ErrorIs(t, err, ErrUnknownType)
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, got, tc.want)
+			assert.Equal(t, Type(got), tc.ceType)
+		})
+	}
+}
+
+func TestTypeOf(t *testing.T) {
+	tests := []struct {
+		name    string
+		ceType  string
+		class   string
+		want    reflect.Type
+		wantErr string
+	}{
+		{name: "event", ceType: "com.vmware.vsphere.VmPoweredOnEvent.v0", class: ClassEvent, want: reflect.TypeOf(types.VmPoweredOnEvent{})},
+		{name: "event without class", ceType: "com.vmware.vsphere.HostConnectionLostEvent.v0", want: reflect.TypeOf(types.HostConnectionLostEvent{})},
+		{name: "eventex", ceType: "com.vmware.vsphere.com.vmware.cl.PublishLibraryEvent.v0", class: ClassEventEx, want: reflect.TypeOf(types.EventEx{})},
+		{name: "extendedevent", ceType: "com.vmware.vsphere.com.vmware.applmgmt.backup.job.failed.event.v0", class: ClassExtendedEvent, want: reflect.TypeOf(types.ExtendedEvent{})},
+		{name: "not an event", ceType: "com.vmware.vsphere.VirtualMachineConfigSpec.v0", wantErr: "unknown event type"},
+		{name: "unknown event", ceType: "com.vmware.vsphere.DoesNotExistEvent.v0", wantErr: "unknown event type"},
+		{name: "eventex without class", ceType: "com.vmware.vsphere.com.vmware.cl.PublishLibraryEvent.v0", wantErr: "unknown event type"},
+		{name: "task", ceType: "com.vmware.vsphere.task.success.v0", class: ClassTask, want: reflect.TypeOf(types.TaskInfo{})},
+		{name: "alarm", ceType: "com.vmware.vsphere.alarm.triggered.v0", class: ClassAlarm, want: reflect.TypeOf(types.AlarmState{})},
+		{name: "unknown class", ceType: "com.vmware.vsphere.VmPoweredOnEvent.v0", class: "metric", wantErr: `unknown event class "metric"`},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := TypeOf(tc.ceType, tc.class)
+			if tc.wantErr != "" {
+				assert.ErrorContains(t, err, tc.wantErr)
+				return
+			}
+			assert.NilError(t, err)
+			assert.Equal(t, got, tc.want)
+		})
+	}
+}
+
+func TestDecode(t *testing.T) {
+	now := time.Now().UTC()
+	base := types.Event{
+		Key:                  42,
+		ChainId:              41,
+		CreatedTime:          now,
+		UserName:             "test-user",
+		FullFormattedMessage: "test message",
+		Host: &types.HostEventArgument{
+			EntityEventArgument: types.EntityEventArgument{Name: "esx-01"},
+			Host:                types.ManagedObjectReference{Type: "HostSystem", Value: "host-1"},
+		},
+		Vm: &types.VmEventArgument{
+			EntityEventArgument: types.EntityEventArgument{Name: "vm-01"},
+			Vm:                  types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-1"},
+		},
+	}
+
+	t.Run("event", func(t *testing.T) {
+		want := &types.VmPoweredOnEvent{VmEvent: types.VmEvent{Event: base, Template: true}}
+		got, err := Decode(toCloudEvent(t, want))
+		assert.NilError(t, err)
+		assert.DeepEqual(t, got, types.BaseEvent(want))
+	})
+
+	t.Run("event with fault", func(t *testing.T) {
+		e := &types.VmFailedToPowerOnEvent{
+			VmEvent: types.VmEvent{Event: base},
+			Reason: types.LocalizedMethodFault{
+				Fault:            &types.InsufficientResourcesFault{},
+				LocalizedMessage: "insufficient resources",
+			},
+		}
+		got, err := Decode(toCloudEvent(t, e))
+		assert.NilError(t, err)
+
+		failed, ok := got.(*types.VmFailedToPowerOnEvent)
+		assert.Assert(t, ok, "got %T", got)
+		assert.Equal(t, failed.Vm.Name, "vm-01")
+		assert.Equal(t, failed.Reason.LocalizedMessage, "insufficient resources")
+		assert.Assert(t, failed.Reason.Fault == nil)
+	})
+
+	t.Run("eventex", func(t *testing.T) {
+		want := &types.EventEx{
+			Event:       base,
+			EventTypeId: "com.vmware.cl.PublishLibraryEvent",
+			Severity:    "info",
+			Arguments:   []types.KeyAnyValue{{Key: "library", Value: "content"}},
+		}
+		got, err := Decode(toCloudEvent(t, want))
+		assert.NilError(t, err)
+		assert.DeepEqual(t, got, types.BaseEvent(want))
+	})
+
+	t.Run("unknown type", func(t *testing.T) {
+		e := ce.NewEvent()
+		e.SetType("test.event.v0")
+		_, err := Decode(e)
+		assert.Assert(t, errors.Is(err, ErrUnknownType))
+	})
+
+	t.Run("invalid data", func(t *testing.T) {
+		e := toCloudEvent(t, &types.VmPoweredOnEvent{VmEvent: types.VmEvent{Event: base}})
+		e.DataEncoded = []byte(`{"Key":"42"}`)
+		_, err := Decode(e)
+		assert.ErrorContains(t, err, "decode VmPoweredOnEvent")
+	})
+}
+
+func TestDecodeTask(t *testing.T) {
+	now := time.Now().UTC()
+	want := &types.TaskInfo{
+		Key:        "task-42",
+		Task:       types.ManagedObjectReference{Type: "Task", Value: "task-42"},
+		Name:       "PowerOnVM_Task",
+		EntityName: "vm-01",
+		Entity:     &types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-1"},
+		State:      types.TaskInfoStateSuccess,
+		QueueTime:  now,
+		StartTime:  &now,
+	}
+
+	e := ce.NewEvent()
+	e.SetType(Type("task.success"))
+	e.SetExtension(ClassExtension, ClassTask)
+	assert.NilError(t, e.SetData(ce.ApplicationJSON, want))
+
+	got, err := DecodeTask(e)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, got, want)
+
+	_, err = DecodeAlarm(e)
+	assert.Assert(t, errors.Is(err, ErrUnknownType))
+
+	_, err = Decode(e)
+	assert.Assert(t, errors.Is(err, ErrUnknownType))
+}
+
+func TestDecodeAlarm(t *testing.T) {
+	acknowledged := true
+	want := &types.AlarmState{
+		Key:           "alarm-7.vm-1",
+		Entity:        types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-1"},
+		Alarm:         types.ManagedObjectReference{Type: "Alarm", Value: "alarm-7"},
+		OverallStatus: types.ManagedEntityStatusRed,
+		Time:          time.Now().UTC(),
+		Acknowledged:  &acknowledged,
+	}
+
+	e := ce.NewEvent()
+	e.SetType(Type("alarm.triggered"))
+	e.SetExtension(ClassExtension, ClassAlarm)
+	assert.NilError(t, e.SetData(ce.ApplicationJSON, want))
+
+	got, err := DecodeAlarm(e)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, got, want)
+
+	e.SetExtension(ClassExtension, ClassTask)
+	_, err = DecodeAlarm(e)
+	assert.Assert(t, errors.Is(err, ErrUnknownType))
+}
+
+func toCloudEvent(t *testing.T, be types.BaseEvent) ce.Event {
+	t.Helper()
+
+	details := event.GetDetails(be)
+	e, err := event.ToCloudEvent("/test/source", be, map[string]string{ClassExtension: details.Class})
+	assert.NilError(t, err)
+	return e
+}
@@ -0,0 +1,126 @@
+package events
+
+import (
+	"encoding/json"
+	"reflect"
+	"time"
+)
+
+const schemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Schema returns the JSON Schema of the CloudEvent data for a CloudEvent type
+// and event class, see TypeOf. Structs are defined in $defs by their govmomi
+// type name and fields of govmomi interface types accept any value.
+func Schema(ceType, class string) ([]byte, error) {
+	t, err := TypeOf(ceType, class)
+	if err != nil {
+		return nil, err
+	}
+
+	g := schemaGenerator{defs: make(map[string]interface{})}
+	root := g.schema(t)
+	root["$schema"] = schemaDialect
+	root["title"] = ceType
+	root["$defs"] = g.defs
+
+	return json.Marshal(root)
+}
+
+type schemaGenerator struct {
+	defs map[string]interface{} // struct schemas by type name
+}
+
+// schema returns the schema of the JSON encoding of t
+func (g *schemaGenerator) schema(t reflect.Type) map[string]interface{} {
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Pointer:
+		return nullable(g.schema(t.Elem()))
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": []string{"string", "null"}, "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": []string{"array", "null"}, "items": g.schema(t.Elem())}
+	case reflect.Array:
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": []string{"object", "null"}, "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		if _, ok := g.defs[t.Name()]; !ok {
+			g.defs[t.Name()] = nil // recursive types
+			g.defs[t.Name()] = g.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/$defs/" + t.Name()}
+	default:
+		// interfaces accept any value
+		return map[string]interface{}{}
+	}
+}
+
+// object returns the object schema of a struct with the fields of embedded
+// structs flattened
+func (g *schemaGenerator) object(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	required := []string{}
+	g.properties(t, properties, &required)
+
+	return map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}
+}
+
+func (g *schemaGenerator) properties(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			g.properties(f.Type, properties, required)
+			continue
+		}
+
+		name, ok := fieldName(f)
+		if !ok {
+			continue
+		}
+		properties[name] = g.schema(f.Type)
+		*required = append(*required, name)
+	}
+}
+
+// nullable returns the schema accepting null in addition to s
+func nullable(s map[string]interface{}) map[string]interface{} {
+	switch typ := s["type"].(type) {
+	case string:
+		s["type"] = []string{typ, "null"}
+		return s
+	case []string:
+		return s
+	}
+
+	if len(s) == 0 {
+		return s
+	}
+	return map[string]interface{}{"anyOf": []interface{}{s, map[string]interface{}{"type": "null"}}}
+}
@@ -0,0 +1,76 @@
+package events
+
+import (
+	"encoding/json"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestSchema(t *testing.T) {
+	b, err := Schema("com.vmware.vsphere.VmFailedToPowerOnEvent.v0", "")
+	assert.NilError(t, err)
+
+	var schema struct {
+		Schema string                     `json:"$schema"`
+		Title  string                     `json:"title"`
+		Ref    string                     `json:"$ref"`
+		Defs   map[string]json.RawMessage `json:"$defs"`
+	}
+	assert.NilError(t, json.Unmarshal(b, &schema))
+	assert.Equal(t, schema.Schema, schemaDialect)
+	assert.Equal(t, schema.Title, "com.vmware.vsphere.VmFailedToPowerOnEvent.v0")
+	assert.Equal(t, schema.Ref, "#/$defs/VmFailedToPowerOnEvent")
+
+	type object struct {
+		Properties map[string]map[string]interface{} `json:"properties"`
+		Required   []string                          `json:"required"`
+	}
+	def := func(t *testing.T, name string) object {
+		t.Helper()
+		raw, ok := schema.Defs[name]
+		assert.Assert(t, ok, "missing definition %s", name)
+		var o object
+		assert.NilError(t, json.Unmarshal(raw, &o))
+		return o
+	}
+
+	event := def(t, "VmFailedToPowerOnEvent")
+	// embedded structs are flattened
+	assert.DeepEqual(t, event.Properties["Key"], map[string]interface{}{"type": "integer"})
+	assert.DeepEqual(t, event.Properties["CreatedTime"], map[string]interface{}{"type": "string", "format": "date-time"})
+	assert.DeepEqual(t, event.Properties["FullFormattedMessage"], map[string]interface{}{"type": "string"})
+	assert.DeepEqual(t, event.Properties["Template"], map[string]interface{}{"type": "boolean"})
+	assert.DeepEqual(t, event.Properties["Reason"], map[string]interface{}{"$ref": "#/$defs/LocalizedMethodFault"})
+	assert.DeepEqual(t, event.Properties["Vm"], map[string]interface{}{
+		"anyOf": []interface{}{
+			map[string]interface{}{"$ref": "#/$defs/VmEventArgument"},
+			map[string]interface{}{"type": "null"},
+		},
+	})
+	assert.Assert(t, len(event.Required) == len(event.Properties))
+
+	vm := def(t, "VmEventArgument")
+	assert.DeepEqual(t, vm.Properties["Name"], map[string]interface{}{"type": "string"})
+	assert.DeepEqual(t, vm.Properties["Vm"], map[string]interface{}{"$ref": "#/$defs/ManagedObjectReference"})
+
+	// interfaces accept any value
+	fault := def(t, "LocalizedMethodFault")
+	assert.DeepEqual(t, fault.Properties["Fault"], map[string]interface{}{})
+
+	t.Run("eventex", func(t *testing.T) {
+		b, err := Schema("com.vmware.vsphere.com.vmware.cl.PublishLibraryEvent.v0", ClassEventEx)
+		assert.NilError(t, err)
+		assert.NilError(t, json.Unmarshal(b, &schema))
+		assert.Equal(t, schema.Ref, "#/$defs/EventEx")
+		assert.DeepEqual(t, def(t, "EventEx").Properties["Arguments"], map[string]interface{}{
+			"type":  []interface{}{"array", "null"},
+			"items": map[string]interface{}{"$ref": "#/$defs/KeyAnyValue"},
+		})
+	})
+
+	t.Run("unknown type", func(t *testing.T) {
+		_, err := Schema("com.vmware.vsphere.DoesNotExistEvent.v0", "")
+		assert.ErrorIs(t, err, ErrUnknownType)
+	})
+}